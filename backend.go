@@ -1,9 +1,12 @@
 package dukedb
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -18,11 +21,13 @@ type DefaultM2MCollection struct {
 	backend  Backend
 	relation *Relation
 
-	model           interface{}
-	localFieldValue interface{}
+	model            interface{}
+	localFieldValues []interface{}
 
-	localFieldName   string
-	foreignFieldName string
+	// localFieldNames and foreignFieldNames hold the pivot columns, which
+	// are multiple for models with composite primary keys.
+	localFieldNames   []string
+	foreignFieldNames []string
 }
 
 // Ensure M2MCollection implements M2MCollection
@@ -34,65 +39,119 @@ func NewM2MCollection(backend Backend, relation *Relation, model interface{}) (M
 		return nil, apperror.Wrap(err, "invalid_model")
 	}
 
-	id := r.Field(relation.LocalField())
-	if id.IsZero() {
-		msg := fmt.Sprintf("Can't retrieve a m2m collection when the m2m foreign key field %v.%v is emtpy",
-			relation.Model().Collection(), relation.LocalField())
-		return nil, apperror.New("invalid_m2m_key", msg)
+	values := make([]interface{}, 0)
+	for _, field := range relation.LocalFields() {
+		id := r.Field(field)
+		if id.IsZero() {
+			msg := fmt.Sprintf("Can't retrieve a m2m collection when the m2m foreign key field %v.%v is emtpy",
+				relation.Model().Collection(), field)
+			return nil, apperror.New("invalid_m2m_key", msg)
+		}
+		values = append(values, id.Interface())
 	}
 
 	m := &DefaultM2MCollection{
-		backend:         backend,
-		relation:        relation,
-		model:           model,
-		localFieldValue: id.Interface(),
+		backend:          backend,
+		relation:         relation,
+		model:            model,
+		localFieldValues: values,
 
-		localFieldName:   relation.Model().BackendName() + "." + relation.Model().Attribute(relation.LocalField()).BackendName(),
-		foreignFieldName: relation.RelatedModel().BackendName() + "." + relation.RelatedModel().Attribute(relation.ForeignField()).BackendName(),
+		localFieldNames:   relation.PivotLocalFields(),
+		foreignFieldNames: relation.PivotForeignFields(),
 	}
 
 	return m, nil
 }
 
+// pivotQ returns a query for the pivot rows of the model.
+func (c *DefaultM2MCollection) pivotQ() *Query {
+	q := c.backend.Q(c.relation.BackendName())
+	for i, name := range c.localFieldNames {
+		q.Filter(name, c.localFieldValues[i])
+	}
+	return q
+}
+
+// foreignValues returns the values of the foreign fields of a related model.
+func (c *DefaultM2MCollection) foreignValues(model interface{}) ([]interface{}, apperror.Error) {
+	r, err := reflector.Reflect(model).Struct()
+	if err != nil {
+		return nil, apperror.Wrap(err, "invalid_model")
+	}
+
+	values := make([]interface{}, 0)
+	for _, field := range c.relation.ForeignFields() {
+		values = append(values, r.UFieldValue(field))
+	}
+	return values, nil
+}
+
+// foreignFilter builds a filter for the pivot rows of a related model.
+func (c *DefaultM2MCollection) foreignFilter(values []interface{}) Expression {
+	filters := make([]Expression, 0)
+	for i, name := range c.foreignFieldNames {
+		filters = append(filters, NewFieldValFilter("", name, OPERATOR_EQ, values[i]))
+	}
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return NewAndExpr(filters...)
+}
+
 func (c *DefaultM2MCollection) Add(models ...interface{}) apperror.Error {
 	for _, model := range models {
-		r, err := reflector.Reflect(model).Struct()
+		values, err := c.foreignValues(model)
 		if err != nil {
-			return apperror.Wrap(err, "invalid_model")
+			return err
 		}
 
-		_, err2 := c.backend.CreateByMap(c.relation.BackendName(), map[string]interface{}{
-			c.localFieldName:   c.localFieldValue,
-			c.foreignFieldName: r.UFieldValue(c.relation.ForeignField()),
-		})
-		if err2 != nil {
-			return err2
+		data := make(map[string]interface{})
+		for i, name := range c.localFieldNames {
+			data[name] = c.localFieldValues[i]
+		}
+		for i, name := range c.foreignFieldNames {
+			data[name] = values[i]
+		}
+
+		if _, err := c.backend.CreateByMap(c.relation.BackendName(), data); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 func (c *DefaultM2MCollection) Remove(models ...interface{}) apperror.Error {
-	q := c.backend.Q(c.relation.BackendName())
-	q.Filter(c.localFieldName, c.localFieldValue)
+	q := c.pivotQ()
 
-	ids := make([]interface{}, 0)
-	for _, model := range models {
-		r, err := reflector.Reflect(model).Struct()
-		if err != nil {
-			return apperror.Wrap(err, "invalid_model")
+	if len(c.foreignFieldNames) == 1 {
+		ids := make([]interface{}, 0)
+		for _, model := range models {
+			values, err := c.foreignValues(model)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, values[0])
 		}
 
-		ids = append(ids, r.UFieldValue(c.relation.ForeignField()))
-	}
+		q.FilterCond(c.foreignFieldNames[0], OPERATOR_IN, ids)
+	} else {
+		filters := make([]Expression, 0)
+		for _, model := range models {
+			values, err := c.foreignValues(model)
+			if err != nil {
+				return err
+			}
+			filters = append(filters, c.foreignFilter(values))
+		}
 
-	q.FilterCond(c.foreignFieldName, OPERATOR_IN, ids)
+		q.FilterExpr(NewOrExpr(filters...))
+	}
 
 	return q.Delete()
 }
 
 func (c *DefaultM2MCollection) Clear() apperror.Error {
-	return c.backend.Q(c.relation.BackendName()).Filter(c.localFieldName, c.localFieldValue).Delete()
+	return c.pivotQ().Delete()
 }
 
 func (c *DefaultM2MCollection) Replace(models ...interface{}) apperror.Error {
@@ -103,23 +162,34 @@ func (c *DefaultM2MCollection) Replace(models ...interface{}) apperror.Error {
 }
 
 func (c *DefaultM2MCollection) Count() (int, apperror.Error) {
-	return c.backend.Q(c.relation.BackendName()).Filter(c.localFieldName, c.localFieldValue).Count()
+	return c.pivotQ().Count()
 }
 
 func (c *DefaultM2MCollection) Contains(model interface{}) (bool, apperror.Error) {
-	r, err := reflector.Reflect(model).Struct()
+	values, err := c.foreignValues(model)
 	if err != nil {
-		return false, apperror.Wrap(err, "invalid_model")
+		return false, err
 	}
 
-	id := r.UFieldValue(c.relation.ForeignField())
-	return c.ContainsId(id)
+	if len(values) == 1 {
+		return c.ContainsId(values[0])
+	}
+	return c.ContainsId(values)
 }
 
+// ContainsId checks if the related model with the given id is part of the
+// collection. For related models with a composite primary key, id must be
+// a slice or a map like for FindOne().
 func (c *DefaultM2MCollection) ContainsId(id interface{}) (bool, apperror.Error) {
-	q := c.backend.Q(c.relation.BackendName()).Filter(c.localFieldName, c.localFieldValue)
-	q.Filter(c.foreignFieldName, id)
-	count, err := q.Count()
+	values := []interface{}{id}
+	if len(c.foreignFieldNames) > 1 {
+		var err apperror.Error
+		if values, err = c.relation.RelatedModel().compositeId(id); err != nil {
+			return false, err
+		}
+	}
+
+	count, err := c.pivotQ().FilterExpr(c.foreignFilter(values)).Count()
 	if err != nil {
 		return false, err
 	}
@@ -127,13 +197,25 @@ func (c *DefaultM2MCollection) ContainsId(id interface{}) (bool, apperror.Error)
 }
 
 func (c *DefaultM2MCollection) Q() *Query {
-	q := c.backend.Q(c.relation.RelatedModel().Collection())
-	//q.Join(c.relation.BackendName(), JOIN_INNER)
-	//jq := RelQ(q, c.relation.BackendName(), "", JOIN_INNER)
-	//jq.FilterExpr()
-	localField := c.relation.RelatedModel().Attribute(c.relation.ForeignField()).BackendName()
-	jq := RelQCustom(q, c.relation.BackendName(), localField, c.foreignFieldName, JOIN_INNER)
-	q.JoinQ(jq)
+	relatedInfo := c.relation.RelatedModel()
+	q := c.backend.Q(relatedInfo.Collection())
+
+	conditions := make([]Expression, 0)
+	for i, field := range c.relation.ForeignFields() {
+		conditions = append(conditions, NewFilter(
+			NewColFieldIdExpr(q.GetCollection(), relatedInfo.Attribute(field).BackendName()),
+			OPERATOR_EQ,
+			NewColFieldIdExpr(c.relation.BackendName(), c.foreignFieldNames[i])))
+	}
+	var condition Expression = NewAndExpr(conditions...)
+	if len(conditions) == 1 {
+		condition = conditions[0]
+	}
+	q.JoinQ(RelQExpr(q, c.relation.BackendName(), JOIN_INNER, condition))
+
+	for i, name := range c.localFieldNames {
+		q.FilterExpr(NewFieldValFilter(c.relation.BackendName(), name, OPERATOR_EQ, c.localFieldValues[i]))
+	}
 	return q
 }
 
@@ -141,6 +223,15 @@ func (c *DefaultM2MCollection) All() ([]interface{}, apperror.Error) {
 	return c.Q().Find()
 }
 
+func (c *DefaultM2MCollection) PivotRows() ([]map[string]interface{}, apperror.Error) {
+	q := c.pivotQ()
+	// Pluck() does not normalize the query.
+	if err := q.Normalize(); err != nil {
+		return nil, err
+	}
+	return q.Pluck()
+}
+
 type BaseBackend struct {
 	name             string
 	debug            bool
@@ -152,12 +243,30 @@ type BaseBackend struct {
 	backend Backend
 
 	hooks map[string][]HookHandler
+
+	// typeMappings maps Go types to database column types.
+	typeMappings map[reflect.Type]string
+
+	// built is true once Build() analyzed the relations.
+	built bool
+
+	// ctx is the context of the backend, set with WithContext().
+	ctx context.Context
+
+	idGenerator IDGenerator
+
+	statementInterceptor StatementInterceptor
+
+	// skipRelationPersistence disables persisting relations on create,
+	// update and delete. See SetAutoPersistRelations().
+	skipRelationPersistence bool
 }
 
 func NewBaseBackend(backend Backend) BaseBackend {
 	return BaseBackend{
-		backend:   backend,
-		modelInfo: make(ModelInfos),
+		backend:      backend,
+		modelInfo:    make(ModelInfos),
+		typeMappings: make(map[reflect.Type]string),
 	}
 }
 
@@ -233,7 +342,105 @@ func (b *BaseBackend) Clone() *BaseBackend {
 		modelInfo: b.modelInfo,
 		backend:   b.backend,
 		hooks:     b.hooks,
+
+		typeMappings: b.typeMappings,
+		built:        b.built,
+		ctx:          b.ctx,
+
+		idGenerator:          b.idGenerator,
+		statementInterceptor: b.statementInterceptor,
+
+		skipRelationPersistence: b.skipRelationPersistence,
+	}
+}
+
+// SetBackend sets the parent backend.
+// Backends must call it on the copy returned by Clone().
+func (b *BaseBackend) SetBackend(backend Backend) {
+	b.backend = backend
+}
+
+/**
+ * Context.
+ */
+
+// Context returns the context of the backend, which defaults to
+// context.Background().
+func (b *BaseBackend) Context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+func (b *BaseBackend) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
+
+func (b *BaseBackend) IDGenerator() IDGenerator {
+	if b.idGenerator == nil {
+		return UUIDGenerator{}
+	}
+	return b.idGenerator
+}
+
+func (b *BaseBackend) SetIDGenerator(generator IDGenerator) {
+	b.idGenerator = generator
+}
+
+// WithContext returns a copy of the backend which uses the given context.
+func (b *BaseBackend) WithContext(ctx context.Context) Backend {
+	backend := b.backend.Clone()
+	backend.SetContext(ctx)
+	return backend
+}
+
+// CreateCtx creates the models with the given context.
+func (b *BaseBackend) CreateCtx(ctx context.Context, models ...interface{}) apperror.Error {
+	return b.WithContext(ctx).Create(models...)
+}
+
+// QueryCtx executes the query with the given context.
+// The query runs on a clone, since Query() binds it to the backend.
+func (b *BaseBackend) QueryCtx(ctx context.Context, q *Query, targetSlice ...interface{}) ([]interface{}, apperror.Error) {
+	return b.WithContext(ctx).Query(q.Clone(), targetSlice...)
+}
+
+// ExecCtx executes the statement with the given context.
+func (b *BaseBackend) ExecCtx(ctx context.Context, statement Expression) apperror.Error {
+	return b.WithContext(ctx).Exec(statement)
+}
+
+/**
+ * Type mappings.
+ */
+
+// RegisterTypeMapping registers the database column type used for
+// attributes of the given Go type.
+// Mappings take precedence over the type detection of the backend, but not
+// over an explicit type specified in the struct tag.
+// Mappings must be registered before calling Build().
+func (b *BaseBackend) RegisterTypeMapping(goType reflect.Type, dbType string) {
+	if b.typeMappings == nil {
+		b.typeMappings = make(map[reflect.Type]string)
+	}
+	b.typeMappings[goType] = dbType
+}
+
+// TypeMapping returns the registered column type for a Go type.
+// Pointer types fall back to the mapping of their element type.
+func (b *BaseBackend) TypeMapping(goType reflect.Type) (string, bool) {
+	if goType == nil {
+		return "", false
+	}
+	if typ, ok := b.typeMappings[goType]; ok {
+		return typ, true
 	}
+	if goType.Kind() == reflect.Ptr {
+		typ, ok := b.typeMappings[goType.Elem()]
+		return typ, ok
+	}
+	return "", false
 }
 
 /**
@@ -244,6 +451,10 @@ func (b *BaseBackend) RegisterHook(hook string, handler HookHandler) {
 	switch hook {
 	case "before_create", "after_create", "before_update", "after_update", "before_delete", "after_delete":
 		// No op.
+	case HOOK_BEFORE_BULK_CREATE, HOOK_AFTER_BULK_CREATE, HOOK_BEFORE_BULK_UPDATE, HOOK_AFTER_BULK_UPDATE, HOOK_BEFORE_BULK_DELETE, HOOK_AFTER_BULK_DELETE:
+		// No op.
+	case HOOK_BEFORE_QUERY:
+		// No op.
 	default:
 		panic("Unknown hook type: " + hook)
 	}
@@ -267,6 +478,98 @@ func (b *BaseBackend) GetHooks(hook string) []HookHandler {
 	return b.hooks[hook]
 }
 
+/**
+ * Statement interceptor.
+ */
+
+func (b *BaseBackend) StatementInterceptor() StatementInterceptor {
+	return b.statementInterceptor
+}
+
+func (b *BaseBackend) SetStatementInterceptor(interceptor StatementInterceptor) {
+	b.statementInterceptor = interceptor
+}
+
+/**
+ * Relation persistence.
+ */
+
+// AutoPersistRelations returns true if relations are persisted on create,
+// update and delete, which is the default.
+func (b *BaseBackend) AutoPersistRelations() bool {
+	return !b.skipRelationPersistence
+}
+
+func (b *BaseBackend) SetAutoPersistRelations(persist bool) {
+	b.skipRelationPersistence = !persist
+}
+
+// WithoutRelationPersistence returns a copy of the backend that does not
+// persist relations, which allows to opt a single operation out:
+//
+//	backend.WithoutRelationPersistence().Create(&task)
+func (b *BaseBackend) WithoutRelationPersistence() Backend {
+	backend := b.backend.Clone()
+	backend.SetAutoPersistRelations(false)
+	return backend
+}
+
+// persistRelations calls PersistRelations() unless relation persistence
+// is disabled.
+func (b *BaseBackend) persistRelations(action string, beforePersist bool, info *ModelInfo, model interface{}) apperror.Error {
+	if b.skipRelationPersistence {
+		return nil
+	}
+	return b.PersistRelations(action, beforePersist, info, model)
+}
+
+// InterceptStatement passes the statement to the statement interceptor and
+// returns the statement that should be executed.
+// Backends must call it in Exec() and ExecQuery() before translating.
+func (b *BaseBackend) InterceptStatement(stmt Expression) (Expression, apperror.Error) {
+	if b.statementInterceptor == nil {
+		return stmt, nil
+	}
+
+	newStmt, err := b.statementInterceptor(stmt)
+	if err != nil {
+		return nil, err
+	}
+	if newStmt == nil {
+		return stmt, nil
+	}
+	return newStmt, nil
+}
+
+// InterceptQueryStatement is like InterceptStatement, but verifies that the
+// statement returned by the interceptor is still a FieldedExpression.
+func (b *BaseBackend) InterceptQueryStatement(stmt FieldedExpression) (FieldedExpression, apperror.Error) {
+	newStmt, err := b.InterceptStatement(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	fielded, ok := newStmt.(FieldedExpression)
+	if !ok {
+		return nil, &apperror.Err{
+			Code:    "invalid_intercepted_statement",
+			Message: fmt.Sprintf("The statement interceptor returned a %T, which is not a FieldedExpression", newStmt),
+		}
+	}
+	return fielded, nil
+}
+
+// callBulkHooks calls all handlers of a bulk hook.
+// An error returned by a handler aborts the operation.
+func (b *BaseBackend) callBulkHooks(hook string, op *BulkOperation) apperror.Error {
+	for _, handler := range b.backend.GetHooks(hook) {
+		if err := handler(b.backend, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /**
  * Model info.
  */
@@ -293,24 +596,72 @@ func (b *BaseBackend) InfoForModel(model interface{}) (*ModelInfo, apperror.Erro
 	return info, nil
 }
 
+func (b *BaseBackend) Collections(includePivots bool) []string {
+	return b.modelInfo.Collections(includePivots)
+}
+
 func (b *BaseBackend) HasCollection(collection string) bool {
 	return b.modelInfo.Has(collection)
 }
 
-func (b *BaseBackend) RegisterModel(model interface{}) *ModelInfo {
+// RegisterModel registers a model, replacing an existing registration of
+// the same collection.
+// If the backend was already built, the relations of the model are analyzed
+// right away, and relations of other models are updated to the new model.
+func (b *BaseBackend) RegisterModel(model interface{}) (*ModelInfo, apperror.Error) {
 	info, err := BuildModelInfo(model)
 	if err != nil {
-		panic(fmt.Sprintf("Could not register model '%v': %v\n", reflect.TypeOf(model).Name(), err))
+		return nil, apperror.Wrap(err, "invalid_model",
+			fmt.Sprintf("Could not register model '%v'", reflect.TypeOf(model).Name()))
+	}
+
+	if b.built && b.modelInfo.Has(info.Collection()) {
+		if err := b.modelInfo.Replace(info); err != nil {
+			return nil, apperror.Wrap(err, "model_replace_failed",
+				fmt.Sprintf("Could not replace model '%v'", reflect.TypeOf(model).Name()))
+		}
+		return info, nil
 	}
 
 	b.modelInfo.Add(info)
-	return info
+	return info, nil
+}
+
+// DeregisterModel removes a collection and its m2m pivot collections.
+// Returns a model_still_referenced error if a relation of another
+// collection references the collection.
+func (b *BaseBackend) DeregisterModel(collection string) apperror.Error {
+	return b.modelInfo.Remove(collection)
+}
+
+// IsBuilt returns true once Build() was called successfully.
+func (b *BaseBackend) IsBuilt() bool {
+	return b.built
 }
 
-func (b *BaseBackend) Build() {
+func (b *BaseBackend) RegisterModels(models ...interface{}) apperror.Error {
+	for _, model := range models {
+		if _, err := b.backend.RegisterModel(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterAndBuild registers the models and builds the backend.
+func (b *BaseBackend) RegisterAndBuild(models ...interface{}) apperror.Error {
+	if err := b.RegisterModels(models...); err != nil {
+		return err
+	}
+	return b.backend.Build()
+}
+
+func (b *BaseBackend) Build() apperror.Error {
 	if err := b.modelInfo.AnalyzeRelations(); err != nil {
-		panic(fmt.Sprintf("Analyzing relationships failed: %v", err))
+		return apperror.Wrap(err, "analyze_relations_failed", "Analyzing relationships failed")
 	}
+	b.built = true
+	return nil
 }
 
 /**
@@ -358,11 +709,32 @@ func (b *BaseBackend) CreateCollection(collections ...string) apperror.Error {
 			return b.unknownColErr(collection)
 		}
 
+		// MySQL has no partial indexes, so unique-where can not be enforced.
+		if b.backend.Dialect() == "mysql" {
+			for _, attr := range info.Attributes() {
+				if attr.UniqueWhereFilter() != nil && (attr.IsUnique() || attr.IsUniqueCi() || len(attr.IsUniqueWith()) > 0) {
+					return &apperror.Err{
+						Public: true,
+						Code:   "unsupported_partial_unique",
+						Message: fmt.Sprintf("The %v dialect does not support partial unique indexes, which %v.%v requires for unique-where",
+							b.backend.Dialect(), info.Collection(), attr.Name()),
+					}
+				}
+			}
+		}
+
 		stmt := info.BuildCreateStmt(false)
 		if err := b.backend.Exec(stmt); err != nil {
 			return err
 		}
 
+		// Case insensitive and unique-where attributes need separate indexes.
+		for _, stmt := range info.BuildIndexStmts() {
+			if err := b.backend.Exec(stmt); err != nil {
+				return err
+			}
+		}
+
 		// Create m2m collections.
 		for _, relation := range info.Relations() {
 			if relation.RelationType() == RELATION_TYPE_M2M {
@@ -405,12 +777,49 @@ func (b *BaseBackend) DropCollection(collection string, ifExists, cascade bool)
 }
 
 func (b *BaseBackend) DropAllCollections() apperror.Error {
-	for col, _ := range b.backend.ModelInfos() {
-		if err := b.backend.DropCollection(col, true, true); err != nil {
-			return err
+	_, err := b.DropAllCollectionsWithProgress(nil, false)
+	return err
+}
+
+func (b *BaseBackend) DropAllCollectionsWithProgress(progress DropProgressFunc, continueOnError bool) (*DropResult, apperror.Error) {
+	infos := b.backend.ModelInfos()
+
+	// Models first, pivots last.
+	collections := infos.Collections(false)
+	for _, name := range infos.Collections(true) {
+		if infos[name].IsPivot() {
+			collections = append(collections, name)
 		}
 	}
-	return nil
+
+	result := &DropResult{
+		Dropped: make([]string, 0),
+		Failed:  make(map[string]apperror.Error),
+	}
+
+	for index, col := range collections {
+		err := b.backend.DropCollection(col, true, true)
+		if err != nil {
+			result.Failed[col] = err
+		} else {
+			result.Dropped = append(result.Dropped, col)
+		}
+
+		if progress != nil {
+			progress(col, index, len(collections), err)
+		}
+
+		if err != nil && !continueOnError {
+			return result, err
+		}
+	}
+
+	if len(result.Failed) > 0 {
+		return result, apperror.New("drop_collections_failed",
+			fmt.Sprintf("Could not drop %v of %v collections", len(result.Failed), len(collections)))
+	}
+
+	return result, nil
 }
 
 func (b *BaseBackend) CreateField(collection, fieldName string) apperror.Error {
@@ -594,6 +1003,12 @@ func (b *BaseBackend) Query(q *Query, targetSlice ...interface{}) ([]interface{}
 		stats.Normalizing = time.Now().Sub(stats.Started)
 	}
 
+	for _, handler := range b.backend.GetHooks(HOOK_BEFORE_QUERY) {
+		if err := handler(b.backend, q); err != nil {
+			return nil, err
+		}
+	}
+
 	stmt := q.GetStatement()
 	result, err := b.backend.ExecQuery(stmt)
 	if err != nil {
@@ -607,18 +1022,24 @@ func (b *BaseBackend) Query(q *Query, targetSlice ...interface{}) ([]interface{}
 	}
 
 	models := result
+	q.rowErrors = nil
 
 	if len(result) > 0 {
 		_, isMapData := result[0].(map[string]interface{})
 		if isMapData && info.HasStruct() {
 			// Received map data, so convert to models first.
-			models = make([]interface{}, len(result), len(result))
-			for i, data := range result {
+			models = make([]interface{}, 0, len(result))
+			for _, data := range result {
 				model, err := info.ModelFromMap(data.(map[string]interface{}))
 				if err != nil {
-					return nil, err
+					if !q.skipErrors {
+						return nil, err
+					}
+					// Lenient mode, so remember the error and skip the row.
+					q.rowErrors = append(q.rowErrors, err)
+					continue
 				}
-				models[i] = model
+				models = append(models, model)
 			}
 		}
 	}
@@ -669,6 +1090,50 @@ func (b *BaseBackend) QueryCursor(q *Query) (Cursor, apperror.Error) {
 	panic("QueryCursor() not implemented!")
 }
 
+// QueryRaw executes a native query with ExecRaw() of the backend, and
+// converts the resulting rows to models of the collection.
+func (b *BaseBackend) QueryRaw(collection string, raw string, args ...interface{}) ([]interface{}, apperror.Error) {
+	info := b.ModelInfo(collection)
+	if info == nil {
+		return nil, b.unknownColErr(collection)
+	}
+
+	rawBackend, ok := b.backend.(RawQueryBackend)
+	if !ok {
+		return nil, &apperror.Err{
+			Code:    "unsupported",
+			Message: fmt.Sprintf("The %v backend does not support raw queries", b.name),
+		}
+	}
+
+	rows, err := rawBackend.ExecRaw(raw, args)
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]interface{}, 0, len(rows))
+	for _, data := range rows {
+		if !info.HasStruct() {
+			models = append(models, data)
+			continue
+		}
+
+		model, err := info.ModelFromMap(data)
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, model)
+	}
+
+	for _, model := range models {
+		if err := CallModelHook(b.backend, model, "AfterQuery"); err != nil {
+			return nil, err
+		}
+	}
+
+	return models, nil
+}
+
 func (b *BaseBackend) QueryOne(q *Query, targetModels ...interface{}) (interface{}, apperror.Error) {
 	res, err := b.backend.Query(q.Limit(1))
 	if err != nil {
@@ -723,6 +1188,18 @@ func (b *BaseBackend) FindOne(collection string, id interface{}, targetModel ...
 		return nil, b.unknownColErr(collection)
 	}
 
+	if info.HasCompositePk() {
+		ids, err := info.compositeId(id)
+		if err != nil {
+			return nil, err
+		}
+		q := b.backend.Q(collection)
+		for i, attr := range info.PkAttributes() {
+			q.Filter(attr.BackendName(), ids[i])
+		}
+		return q.First(targetModel...)
+	}
+
 	// Try to convert the id to the correct type.
 	convertedId, err := reflector.Reflect(id).ConvertTo(info.PkAttribute().Type())
 	if err != nil {
@@ -736,9 +1213,30 @@ func (b *BaseBackend) FindOneBy(collection, field string, value interface{}, tar
 	return b.backend.Q(collection).Filter(field, value).First(targetModel...)
 }
 
+// Count returns the number of rows matched by the query, or the number of
+// groups if the query is grouped.
+// The query is cloned, so it can still be used after counting.
 func (b *BaseBackend) Count(q *Query) (int, apperror.Error) {
+	q = q.Clone()
+	if q.IsGrouped() {
+		return b.countGroups(q)
+	}
+	if q.IsDistinct() || len(q.GetStatement().DistinctOn()) > 0 {
+		return b.countDistinct(q)
+	}
+
 	count := NewFieldSelectorExpr("count", NewFuncExpr("COUNT", NewTextExpr("*")), reflect.TypeOf(1))
 	q.SetFieldExpressions([]Expression{count})
+	// Sorts are irrelevant for counting, and invalid next to an aggregate
+	// on some databases.
+	q.SetSorts(nil)
+
+	// Normalize, since filters like HavingCount() must be resolved
+	// before building the statement.
+	q.SetBackend(b.backend)
+	if err := q.Normalize(); err != nil {
+		return 0, err
+	}
 
 	result, err := b.backend.Pluck(q)
 	if err != nil {
@@ -768,10 +1266,61 @@ func (b *BaseBackend) Count(q *Query) (int, apperror.Error) {
 	return x.(int), nil
 }
 
-func (b *BaseBackend) Pluck(q *Query) ([]map[string]interface{}, apperror.Error) {
-	res, err := b.backend.ExecQuery(q.GetStatement())
-	if err != nil {
-		return nil, err
+// countGroups counts the number of groups of a grouped query by selecting
+// only the group by fields and counting the resulting rows.
+// All groups are counted, independent of the limit and offset.
+// The query must already be a clone.
+func (b *BaseBackend) countGroups(q *Query) (int, apperror.Error) {
+	q.SetBackend(b.backend)
+	if err := q.Normalize(); err != nil {
+		return 0, err
+	}
+
+	stmt := q.GetStatement()
+	stmt.SetFields(stmt.GroupBy())
+	stmt.SetSorts(nil)
+	stmt.SetLimit(0)
+	stmt.SetOffset(0)
+
+	return b.countRows(stmt)
+}
+
+// countDistinct counts the rows of a DISTINCT or DISTINCT ON query, which
+// can not be combined with COUNT(*) in the same select.
+// The query must already be a clone.
+func (b *BaseBackend) countDistinct(q *Query) (int, apperror.Error) {
+	q.SetBackend(b.backend)
+	if err := q.Normalize(); err != nil {
+		return 0, err
+	}
+
+	stmt := q.GetStatement()
+	stmt.SetSorts(nil)
+	stmt.SetLimit(0)
+	stmt.SetOffset(0)
+
+	return b.countRows(stmt)
+}
+
+// countRows returns the number of rows returned by the statement.
+// If the backend implements RowCountBackend, it counts the rows itself.
+// Otherwise, the rows are loaded and counted.
+func (b *BaseBackend) countRows(stmt FieldedExpression) (int, apperror.Error) {
+	if counter, ok := b.backend.(RowCountBackend); ok {
+		return counter.ExecQueryCount(stmt)
+	}
+
+	res, err := b.backend.ExecQuery(stmt)
+	if err != nil {
+		return 0, err
+	}
+	return len(res), nil
+}
+
+func (b *BaseBackend) Pluck(q *Query) ([]map[string]interface{}, apperror.Error) {
+	res, err := b.backend.ExecQuery(q.GetStatement())
+	if err != nil {
+		return nil, err
 	}
 
 	info := b.ModelInfos().Find(q.GetCollection())
@@ -788,6 +1337,7 @@ func (b *BaseBackend) Pluck(q *Query) ([]map[string]interface{}, apperror.Error)
 			if err != nil {
 				return nil, err
 			}
+			b.applyFieldAliases(q, m)
 			maps[i] = m
 		}
 	}
@@ -795,10 +1345,162 @@ func (b *BaseBackend) Pluck(q *Query) ([]map[string]interface{}, apperror.Error)
 	return maps, nil
 }
 
+// EachRow executes the query and calls fn with the data map of each row.
+// If the backend implements RowStreamBackend, the rows are read one at a
+// time from a cursor. Otherwise, the complete result is loaded first.
+func (b *BaseBackend) EachRow(q *Query, fn func(row map[string]interface{}) apperror.Error) apperror.Error {
+	q.SetBackend(b.backend)
+	if err := q.Normalize(); err != nil {
+		return err
+	}
+
+	info := b.ModelInfos().Find(q.GetCollection())
+	return b.execQueryEach(q.GetStatement(), func(row interface{}) apperror.Error {
+		m, ok := row.(map[string]interface{})
+		if !ok {
+			if info == nil {
+				panic("No map data and no collection info")
+			}
+			var err apperror.Error
+			if m, err = info.ModelToMap(row, false, false, true); err != nil {
+				return err
+			}
+			b.applyFieldAliases(q, m)
+		}
+		return fn(m)
+	})
+}
+
+// Each executes the query and calls fn with each model.
+// Like EachRow(), the rows are streamed from a cursor if the backend
+// implements RowStreamBackend.
+// Joined relations are loaded separately for each model.
+func (b *BaseBackend) Each(q *Query, fn func(model interface{}) apperror.Error) apperror.Error {
+	info := b.ModelInfo(q.GetCollection())
+	if info == nil {
+		return b.unknownColErr(q.GetCollection())
+	}
+
+	q.SetBackend(b.backend)
+	if err := q.Normalize(); err != nil {
+		return err
+	}
+	if err := b.BuildJoins(info, q); err != nil {
+		return err
+	}
+
+	for _, handler := range b.backend.GetHooks(HOOK_BEFORE_QUERY) {
+		if err := handler(b.backend, q); err != nil {
+			return err
+		}
+	}
+
+	q.rowErrors = nil
+	return b.execQueryEach(q.GetStatement(), func(row interface{}) apperror.Error {
+		model := row
+		if data, ok := row.(map[string]interface{}); ok && info.HasStruct() {
+			m, err := info.ModelFromMap(data)
+			if err != nil {
+				if !q.skipErrors {
+					return err
+				}
+				// Lenient mode, so remember the error and skip the row.
+				q.rowErrors = append(q.rowErrors, err)
+				return nil
+			}
+			model = m
+		}
+
+		if len(q.GetJoins()) > 0 {
+			if err := b.DoJoins(info, q, []interface{}{model}); err != nil {
+				return err
+			}
+		}
+		if err := CallModelHook(b.backend, model, "AfterQuery"); err != nil {
+			return err
+		}
+		return fn(model)
+	})
+}
+
+// execQueryEach calls fn with each row of the query statement, streamed
+// from a cursor if the backend implements RowStreamBackend.
+func (b *BaseBackend) execQueryEach(stmt FieldedExpression, fn func(row interface{}) apperror.Error) apperror.Error {
+	if streamer, ok := b.backend.(RowStreamBackend); ok {
+		return streamer.ExecQueryEach(stmt, fn)
+	}
+
+	rows, err := b.backend.ExecQuery(stmt)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFieldAliases adds the values of fields selected with FieldAs() under
+// their alias to a map built from a model.
+func (b *BaseBackend) applyFieldAliases(q *Query, data map[string]interface{}) {
+	for _, field := range q.GetStatement().Fields() {
+		sel, ok := field.(*FieldSelectorExpr)
+		if !ok {
+			continue
+		}
+		id, ok := sel.Expression().(*ColFieldIdentifierExpr)
+		if !ok || id.Field() == sel.Name() {
+			continue
+		}
+		if val, ok := data[id.Field()]; ok {
+			data[sel.Name()] = val
+		}
+	}
+}
+
 /**
  * Relationship related methods.
  */
 
+// polymorphicOwnerInfo returns the info of the owning collection of a
+// polymorphic relation, which is stored in the type field of the models.
+// All models must reference the same collection.
+func (b *BaseBackend) polymorphicOwnerInfo(relation *Relation, models []interface{}) (*ModelInfo, apperror.Error) {
+	collection := ""
+	for _, m := range models {
+		r, err := reflector.Reflect(m).Struct()
+		if err != nil {
+			return nil, apperror.Wrap(err, "invalid_base_model")
+		}
+		// The type field may have a named string type.
+		typ := reflect.ValueOf(r.UFieldValue(relation.PolymorphicTypeField())).String()
+		if typ == "" {
+			continue
+		} else if collection != "" && typ != collection {
+			return nil, &apperror.Err{
+				Code: "mixed_polymorphic_types",
+				Message: fmt.Sprintf("The polymorphic relation %v.%v can only be queried for models of the same type, got %v and %v",
+					relation.Model().Collection(), relation.Name(), collection, typ),
+			}
+		}
+		collection = typ
+	}
+
+	if collection == "" {
+		return nil, apperror.New("relation_query_on_empty_result", "None of the base models has a value for the relation")
+	}
+	info := b.backend.ModelInfos().Find(collection)
+	if info == nil {
+		return nil, &apperror.Err{
+			Code:    "unknown_polymorphic_type",
+			Message: fmt.Sprintf("The polymorphic relation %v.%v references the unknown collection %v", relation.Model().Collection(), relation.Name(), collection),
+		}
+	}
+	return info, nil
+}
+
 func (b *BaseBackend) BuildRelationQuery(q *RelationQuery) (*Query, apperror.Error) {
 	baseQ := q.GetBaseQuery()
 	baseInfo := b.backend.ModelInfo(baseQ.GetCollection())
@@ -806,10 +1508,22 @@ func (b *BaseBackend) BuildRelationQuery(q *RelationQuery) (*Query, apperror.Err
 		return nil, b.unknownColErr(baseQ.GetCollection())
 	}
 
+	relationName := q.GetRelationName()
+	if relationName == "" {
+		return nil, apperror.New("invalid_join_query_no_relation_name", "Invalid join query: no RelationName set")
+	}
+	relation := baseInfo.Relation(relationName)
+	if relation == nil {
+		return nil, apperror.New(
+			"invalid_join_query_unknown_relation",
+			fmt.Sprintf("Join query tried to join on inexistant relation %v.%v", baseInfo.Collection(), relationName))
+	}
+
 	baseModels := baseQ.GetModels()
 
 	// If baseModels is empty, check if we need to load them first.
-	if len(baseModels) < 1 && !b.backend.HasNativeJoins() {
+	// The collection of polymorphic owners is only known from the models.
+	if len(baseModels) < 1 && (!b.backend.HasNativeJoins() || relation.IsPolymorphicOwner()) {
 		// No baseModels, and backend does not have native joins, so execute
 		// base query first.
 		var err apperror.Error
@@ -822,20 +1536,30 @@ func (b *BaseBackend) BuildRelationQuery(q *RelationQuery) (*Query, apperror.Err
 		}
 	}
 
-	relationName := q.GetRelationName()
-	if relationName == "" {
-		return nil, apperror.New("invalid_join_query_no_relation_name", "Invalid join query: no RelationName set")
-	}
-	relation := baseInfo.Relation(relationName)
-	if relation == nil {
-		return nil, apperror.New(
-			"invalid_join_query_unknown_relation",
-			fmt.Sprintf("Join query tried to join on inexistant relation %v.%v", baseInfo.Collection(), relationName))
-	}
 	relatedInfo := relation.RelatedModel()
+	foreignFieldName := relation.ForeignField()
+	if relation.IsPolymorphicOwner() {
+		var err apperror.Error
+		if relatedInfo, err = b.polymorphicOwnerInfo(relation, baseModels); err != nil {
+			return nil, err
+		}
+		foreignFieldName = relatedInfo.PkAttribute().Name()
+	}
 
 	// Build filter arguments.
+	// Duplicate keys are skipped, since many base models can refer to the
+	// same related model.
 	filterArgs := make([]interface{}, 0)
+	seenArgs := make(map[interface{}]bool)
+	addArg := func(val interface{}) {
+		if val != nil && reflect.TypeOf(val).Comparable() {
+			if seenArgs[val] {
+				return
+			}
+			seenArgs[val] = true
+		}
+		filterArgs = append(filterArgs, val)
+	}
 	for _, m := range baseModels {
 		r, err := reflector.Reflect(m).Struct()
 		if err != nil {
@@ -843,23 +1567,48 @@ func (b *BaseBackend) BuildRelationQuery(q *RelationQuery) (*Query, apperror.Err
 		}
 		val, _ := r.FieldValue(relation.LocalField())
 
+		reflVal := reflect.ValueOf(val)
+		if reflVal.Kind() == reflect.Ptr {
+			if reflVal.IsNil() {
+				// Models with an empty nullable key have no related model.
+				continue
+			}
+			reflVal = reflVal.Elem()
+			val = reflVal.Interface()
+		} else if !reflVal.IsValid() {
+			continue
+		}
+
 		// TODO: Figure out why this code was added.
 		// When might the field value be a slice of arguments??
 		// Probably something to do with m2m.
-		reflVal := reflect.ValueOf(val)
 		if reflVal.Type().Kind() == reflect.Slice {
 			for i := 0; i < reflVal.Len(); i++ {
-				filterArgs = append(filterArgs, reflVal.Index(i).Interface())
+				addArg(reflVal.Index(i).Interface())
 			}
 		} else {
-			filterArgs = append(filterArgs, val)
+			addArg(val)
 		}
 	}
 
+	if len(baseModels) > 0 && len(filterArgs) == 0 {
+		return nil, apperror.New("relation_query_on_empty_result", "None of the base models has a value for the relation")
+	}
+
 	resultQuery := &q.Query
-	resultQuery.SetCollection(relation.RelatedModel().Collection())
+	resultQuery.SetCollection(relatedInfo.Collection())
+
+	if relation.RelationType() == RELATION_TYPE_POLYMORPHIC && !relation.IsPolymorphicOwner() {
+		// Only include related models that reference the base collection.
+		typeField := relatedInfo.Attribute(relation.PolymorphicTypeField()).BackendName()
+		resultQuery.FilterExpr(NewFieldValFilter(relatedInfo.BackendName(), typeField, OPERATOR_EQ, baseInfo.Collection()))
+	}
 
 	if relation.RelationType() != RELATION_TYPE_M2M {
+		// Store the fields for assigning the results to the base models.
+		q.localField = foreignFieldName
+		q.foreignField = relation.LocalField()
+
 		if len(baseModels) > 0 {
 			// Basemodels present, so just use the data from them.
 			operator := OPERATOR_EQ
@@ -871,7 +1620,7 @@ func (b *BaseBackend) BuildRelationQuery(q *RelationQuery) (*Query, apperror.Err
 				filterVal = filterArgs[0]
 			}
 
-			foreignField := relatedInfo.Attribute(relation.ForeignField()).BackendName()
+			foreignField := relatedInfo.Attribute(foreignFieldName).BackendName()
 			filter := NewFieldValFilter(relatedInfo.BackendName(), foreignField, operator, filterVal)
 			resultQuery.FilterExpr(filter)
 		} else {
@@ -891,20 +1640,22 @@ func (b *BaseBackend) BuildRelationQuery(q *RelationQuery) (*Query, apperror.Err
 	} else {
 		// M2M query!
 
+		if relation.IsCompositeM2M() {
+			return nil, compositeM2MErr(relation)
+		}
+
 		//localField := baseInfo.Attribute(relation.LocalField()).BackendName()
 		foreignField := relatedInfo.Attribute(relation.ForeignField()).BackendName()
 
 		// Relation.BackendName holds the name of the m2m collection.
-		localFieldName := relatedInfo.BackendName() + "." + foreignField
-
-		relQ := RelQCustom(resultQuery, relation.BackendName(), foreignField, localFieldName, JOIN_INNER)
+		relQ := RelQCustom(resultQuery, relation.BackendName(), foreignField, relation.PivotForeignField(), JOIN_INNER)
 
 		q.localField = relation.ForeignField()
-		q.foreignField = baseInfo.BackendName() + "." + baseInfo.Attribute(relation.localField).BackendName()
+		q.foreignField = relation.PivotLocalField()
 		q.SetJoinResultAssigner(assignM2MJoinModels)
 
 		// Add required field to join statement.
-		fieldSel := NewFieldSelector(q.foreignField, relation.BackendName(), baseInfo.BackendName()+"."+baseInfo.Attribute(relation.localField).BackendName(), nil)
+		fieldSel := NewFieldSelector(q.foreignField, relation.BackendName(), relation.PivotLocalField(), nil)
 		relQ.GetStatement().AddField(fieldSel)
 
 		resultQuery.JoinQ(relQ)
@@ -920,9 +1671,7 @@ func (b *BaseBackend) BuildRelationQuery(q *RelationQuery) (*Query, apperror.Err
 				filterVal = filterArgs[0]
 			}
 
-			localField := baseInfo.Attribute(relation.LocalField()).BackendName()
-			localFieldName := baseInfo.BackendName() + "." + localField
-			filter := NewFieldValFilter(relation.BackendName(), localFieldName, operator, filterVal)
+			filter := NewFieldValFilter(relation.BackendName(), relation.PivotLocalField(), operator, filterVal)
 			resultQuery.FilterExpr(filter)
 		}
 	}
@@ -979,6 +1728,32 @@ func (b *BaseBackend) persistBelongsToRelation(
 	return nil
 }
 
+// relationItems returns the related models in the field of a has-many or
+// m2m relation, which may be a slice or a map.
+// Struct values of maps are copied, so changes to them are not written back.
+func relationItems(field *reflector.Reflector) ([]*reflector.Reflector, error) {
+	if !field.IsMap() {
+		slice, err := field.Slice()
+		if err != nil {
+			return nil, err
+		}
+		return slice.Items(), nil
+	}
+
+	m := field.Value()
+	items := make([]*reflector.Reflector, 0, m.Len())
+	for _, key := range m.MapKeys() {
+		val := m.MapIndex(key)
+		if val.Kind() == reflect.Struct {
+			ptr := reflect.New(val.Type())
+			ptr.Elem().Set(val)
+			val = ptr
+		}
+		items = append(items, reflector.Reflect(val.Interface()))
+	}
+	return items, nil
+}
+
 //
 // action may be either "create", "update" or "delete"
 func (b *BaseBackend) PersistRelations(action string, beforePersist bool, info *ModelInfo, model interface{}) apperror.Error {
@@ -988,6 +1763,11 @@ func (b *BaseBackend) PersistRelations(action string, beforePersist bool, info *
 	}
 
 	for _, relation := range info.Relations() {
+		// Polymorphic relations are managed with their type and id field.
+		if relation.RelationType() == RELATION_TYPE_POLYMORPHIC {
+			continue
+		}
+
 		relatedInfo := relation.RelatedModel()
 
 		if !relatedInfo.HasStruct() {
@@ -1069,18 +1849,18 @@ func (b *BaseBackend) PersistRelations(action string, beforePersist bool, info *
 		}
 
 		if relation.RelationType() == RELATION_TYPE_HAS_MANY {
-			slice, err := r.Field(relation.Name()).Slice()
+			items, err := relationItems(r.Field(relation.Name()))
 			if err != nil {
 				// This should never happen, just be save.
 				panic(err)
 			}
 
-			if slice.Len() < 1 {
+			if len(items) < 1 {
 				// Ignore empty slice.
 				continue
 			}
 
-			for _, item := range slice.Items() {
+			for _, item := range items {
 				if item.IsPtr() && item.IsZero() {
 					// Ignore zero pointers to be quicker.
 					continue
@@ -1100,20 +1880,20 @@ func (b *BaseBackend) PersistRelations(action string, beforePersist bool, info *
 
 		if relation.RelationType() == RELATION_TYPE_M2M {
 			if (action == "create" || action == "update") && !beforePersist {
-				slice, err := r.Field(relation.Name()).Slice()
+				items, err := relationItems(r.Field(relation.Name()))
 				if err != nil {
 					// This should never happen, just be save.
 					return apperror.Wrap(err, "invalid_slice_field")
 				}
 
-				if slice.Len() < 1 {
+				if len(items) < 1 {
 					// Ignore when empty.
 					continue
 				}
 
 				newModels := make([]interface{}, 0)
 
-				for _, item := range slice.Items() {
+				for _, item := range items {
 					if item.IsPtr() && item.IsZero() {
 						continue
 					}
@@ -1232,15 +2012,24 @@ func (b *BaseBackend) BuildJoins(info *ModelInfo, q *Query) apperror.Error {
 			return err
 		}
 
-		if b.backend.HasNativeJoins() && !relation.IsMany() {
+		if b.backend.HasNativeJoins() && !relation.IsMany() && !join.GetPreload() && !relation.IsSelfReferential() {
 			// to-one join, and backend supports native joins, so
 			// we can just add it to the main query.
+			// Self-referential joins are loaded separately, since the
+			// joined collection would be ambiguous.
 			joinStmt, err := b.buildJoin(relation, join)
 			if err != nil {
 				return err
 			}
 
 			stmt.AddJoin(joinStmt)
+		} else if join.GetJoinType() == JOIN_INNER {
+			// The join will be executed separately, so an inner join has to
+			// exclude models without related models with a relation count
+			// filter on the main query.
+			filter := NewFilter(NewFuncExpr("COUNT", NewIdExpr(relation.Name())), OPERATOR_GT, NewValueExpr(0))
+			q.normalizeRelationCount(info, filter)
+			stmt.FilterAnd(filter)
 		} else {
 			// Nothing to do here.
 			// Join will be executed separately.
@@ -1267,6 +2056,54 @@ func (b *BaseBackend) Related(model interface{}, name string) (*RelationQuery, a
 	return b.backend.Q(model).Related(name), nil
 }
 
+func (b *BaseBackend) RelatedCount(model interface{}, name string) (int, apperror.Error) {
+	q, err := b.backend.Related(model, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if q.relation().RelationType() == RELATION_TYPE_M2M {
+		// Count the entries of the m2m collection, so the related models
+		// do not have to be joined.
+		m2m, err := b.backend.M2M(model, name)
+		if err != nil {
+			return 0, err
+		}
+		return m2m.Count()
+	}
+
+	return q.CountRelated()
+}
+
+func (b *BaseBackend) Load(model interface{}, name string) apperror.Error {
+	info, err := b.backend.InfoForModel(model)
+	if err != nil {
+		return err
+	}
+
+	relation := info.FindRelation(name)
+	if relation == nil {
+		return &apperror.Err{
+			Code:    "invalid_relation",
+			Message: fmt.Sprintf("The collection %v does not have a relation '%v'", info.Collection(), name),
+		}
+	}
+
+	q, err := b.backend.NewModelQuery(model)
+	if err != nil {
+		return err
+	}
+
+	// Clear the relation first, so it does not keep a stale value
+	// when no related models exist anymore.
+	if err := resetRelationField(relation, model); err != nil {
+		return err
+	}
+
+	joinQ := RelQ(q, relation.Name(), "", JOIN_INNER)
+	return b.loadRelation(relation, q.GetModels(), joinQ)
+}
+
 func (b *BaseBackend) M2M(model interface{}, name string) (M2MCollection, apperror.Error) {
 	info, err := b.InfoForModel(model)
 	if err != nil {
@@ -1292,88 +2129,782 @@ func (b *BaseBackend) M2M(model interface{}, name string) (M2MCollection, apperr
 	return NewM2MCollection(b.backend, info.Relation(name), model)
 }
 
-/**
- * Create, update, delete.
- */
-
-func (b *BaseBackend) doCreate(info *ModelInfo, model interface{}) apperror.Error {
-	// Call BeforeCreate hook on model.
-	if err := CallModelHook(b.backend, model, "BeforeCreate"); err != nil {
-		return err
+// compositeM2MErr returns the error for m2m relations with composite keys,
+// which can be managed with M2M() and persisted, but not joined.
+func compositeM2MErr(relation *Relation) apperror.Error {
+	return &apperror.Err{
+		Code: "unsupported_composite_m2m",
+		Message: fmt.Sprintf("The m2m relation %v.%v uses composite keys, which is not supported for joins and AttachMany()/Detach()",
+			relation.Model().Collection(), relation.Name()),
 	}
+}
 
-	// Call backend-wide before_create hooks.
-	for _, handler := range b.backend.GetHooks("before_create") {
-		handler(b.backend, model)
+// relationLocalValue returns the value of the local field of a relation for
+// a persisted model.
+func relationLocalValue(relation *Relation, model interface{}) (interface{}, apperror.Error) {
+	r, err := reflector.Reflect(model).Struct()
+	if err != nil {
+		return nil, apperror.Wrap(err, "invalid_model")
 	}
 
-	// Persist relationships before create.
-	if err := b.PersistRelations("create", true, info, model); err != nil {
-		return err
+	val := r.Field(relation.LocalField())
+	if val.IsZero() {
+		return nil, &apperror.Err{
+			Code:    "unpersisted_model",
+			Message: fmt.Sprintf("The field %v.%v is empty", relation.Model().Collection(), relation.LocalField()),
+		}
 	}
+	return val.Interface(), nil
+}
 
-	if err := info.ValidateModel(model); err != nil {
-		return err
+func (b *BaseBackend) AttachMany(model interface{}, name string, ids ...interface{}) apperror.Error {
+	if len(ids) < 1 {
+		return nil
 	}
 
-	values, err := info.ModelToFieldExpressions(model)
+	info, err := b.backend.InfoForModel(model)
 	if err != nil {
 		return err
 	}
 
-	// Build a CreateStatement.
-	stmt := NewCreateStmt(info.BackendName(), values)
-	stmt.SetRawValue(model)
+	relation := info.FindRelation(name)
+	if relation == nil {
+		return &apperror.Err{
+			Code:    "invalid_relation",
+			Message: fmt.Sprintf("The collection %v does not have a relation '%v'", info.Collection(), name),
+		}
+	}
 
-	res, err := b.backend.ExecQuery(stmt)
+	localVal, err := relationLocalValue(relation, model)
 	if err != nil {
 		return err
 	}
 
-	if len(res) == 1 {
-		if err := info.UpdateModelFromData(model, res[0].(map[string]interface{})); err != nil {
+	relatedInfo := relation.RelatedModel()
+
+	switch relation.RelationType() {
+	case RELATION_TYPE_HAS_MANY:
+		// Set the foreign key of all children with a single update.
+		fk := relatedInfo.Attribute(relation.ForeignField())
+		q := b.backend.Q(relatedInfo.Collection()).FilterCond(relatedInfo.PkAttribute().BackendName(), OPERATOR_IN, ids)
+		return b.backend.UpdateByMap(q, map[string]interface{}{
+			fk.BackendName(): localVal,
+		})
+
+	case RELATION_TYPE_M2M:
+		if relation.IsCompositeM2M() {
+			return compositeM2MErr(relation)
+		}
+
+		// Insert the pivot rows in a transaction, so a failing insert does
+		// not leave the children attached partially.
+		tx, err := b.beginImplicitTransaction()
+		if err != nil {
 			return err
+		} else if tx != nil {
+			return finishTransaction(tx, tx.AttachMany(model, name, ids...))
+		}
+
+		// Insert a pivot row for each child.
+		for _, id := range ids {
+			_, err := b.backend.CreateByMap(relation.BackendName(), map[string]interface{}{
+				relation.PivotLocalField():   localVal,
+				relation.PivotForeignField(): id,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return &apperror.Err{
+			Code:    "unsupported_relation_type",
+			Message: fmt.Sprintf("AttachMany only supports has-many and m2m relations, but %v is %v", relation.Name(), relation.RelationType()),
 		}
 	}
+}
 
-	// Persist relationships again since m2m can only be handled  when an Id is set.
-	if err := b.PersistRelations("create", false, info, model); err != nil {
+func (b *BaseBackend) Detach(model interface{}, name string, ids ...interface{}) apperror.Error {
+	info, err := b.backend.InfoForModel(model)
+	if err != nil {
 		return err
 	}
 
-	CallModelHook(b.backend, model, "AfterCreate")
+	relation := info.FindRelation(name)
+	if relation == nil {
+		return &apperror.Err{
+			Code:    "invalid_relation",
+			Message: fmt.Sprintf("The collection %v does not have a relation '%v'", info.Collection(), name),
+		}
+	}
+
+	localVal, err := relationLocalValue(relation, model)
+	if err != nil {
+		return err
+	}
+
+	relatedInfo := relation.RelatedModel()
+
+	switch relation.RelationType() {
+	case RELATION_TYPE_HAS_MANY:
+		fk := relatedInfo.Attribute(relation.ForeignField())
+
+		q := b.backend.Q(relatedInfo.Collection()).Filter(fk.BackendName(), localVal)
+		if len(ids) > 0 {
+			q.FilterCond(relatedInfo.PkAttribute().BackendName(), OPERATOR_IN, ids)
+		}
+
+		// Nullable foreign keys are set to NULL, all others to their zero value.
+		var emptyVal interface{}
+		if fk.Type().Kind() != reflect.Ptr {
+			emptyVal = reflect.Zero(fk.Type()).Interface()
+		}
+
+		return b.backend.UpdateByMap(q, map[string]interface{}{
+			fk.BackendName(): emptyVal,
+		})
+
+	case RELATION_TYPE_M2M:
+		if relation.IsCompositeM2M() {
+			return compositeM2MErr(relation)
+		}
+
+		q := b.backend.Q(relation.BackendName()).Filter(relation.PivotLocalField(), localVal)
+		if len(ids) > 0 {
+			q.FilterCond(relation.PivotForeignField(), OPERATOR_IN, ids)
+		}
+		return q.Delete()
+
+	default:
+		return &apperror.Err{
+			Code:    "unsupported_relation_type",
+			Message: fmt.Sprintf("Detach only supports has-many and m2m relations, but %v is %v", relation.Name(), relation.RelationType()),
+		}
+	}
+}
+
+/**
+ * Create, update, delete.
+ */
+
+func (b *BaseBackend) doCreate(info *ModelInfo, model interface{}) apperror.Error {
+	// Call BeforeCreate hook on model.
+	if err := CallModelHook(b.backend, model, "BeforeCreate"); err != nil {
+		return err
+	}
+
+	// Call backend-wide before_create hooks.
+	for _, handler := range b.backend.GetHooks("before_create") {
+		handler(b.backend, model)
+	}
+
+	if err := b.generateIds(info, model); err != nil {
+		return err
+	}
+
+	// Persist relationships before create.
+	if err := b.persistRelations("create", true, info, model); err != nil {
+		return err
+	}
+
+	if err := info.ValidateModel(model); err != nil {
+		return err
+	}
+
+	if err := b.checkUniqueCi(info, model); err != nil {
+		return err
+	}
+	if err := b.checkUniqueWhere(info, model); err != nil {
+		return err
+	}
+
+	values, err := info.ModelToFieldExpressions(model)
+	if err != nil {
+		return err
+	}
+
+	// Build a CreateStatement.
+	stmt := NewCreateStmt(info.BackendName(), values)
+	stmt.SetRawValue(model)
+
+	res, err := b.backend.ExecQuery(stmt)
+	if err != nil {
+		return err
+	}
+
+	if len(res) == 1 {
+		if err := info.UpdateModelFromData(model, res[0].(map[string]interface{})); err != nil {
+			return err
+		}
+	}
+
+	// Persist relationships again since m2m can only be handled  when an Id is set.
+	if err := b.persistRelations("create", false, info, model); err != nil {
+		return err
+	}
+
+	CallModelHook(b.backend, model, "AfterCreate")
+
+	// Call backend-wide after_create hooks.
+	for _, handler := range b.backend.GetHooks("after_create") {
+		handler(b.backend, model)
+	}
+
+	return nil
+}
+
+// checkUniqueCi verifies that no other model exists with a value that only
+// differs in case for attributes with the unique-ci tag.
+func (b *BaseBackend) checkUniqueCi(info *ModelInfo, model interface{}) apperror.Error {
+	for _, attr := range info.Attributes() {
+		if !attr.IsUniqueCi() {
+			continue
+		}
+
+		r, err := reflector.Reflect(model).Struct()
+		if err != nil {
+			return apperror.Wrap(err, "invalid_model")
+		}
+		val, ok := r.UFieldValue(attr.Name()).(string)
+		if !ok || val == "" {
+			continue
+		}
+
+		if !uniqueWhereApplies(info, attr, r) {
+			continue
+		}
+
+		field := NewFuncExpr("LOWER", NewIdExpr(attr.BackendName()))
+		q := b.backend.Q(info.Collection()).FilterExpr(NewFilter(field, OPERATOR_EQ, NewValueExpr(strings.ToLower(val))))
+		if field, operator := attr.UniqueWhere(); field != "" {
+			q.WithDeleted().FilterCond(field, operator, nil)
+		}
+		// Exclude the model itself on updates.
+		if filter := info.ModelFilter(model); filter != nil {
+			q.FilterExpr(NewNotExpr(filter))
+		}
+		count, err2 := q.Count()
+		if err2 != nil {
+			return err2
+		}
+		if count > 0 {
+			return &apperror.Err{
+				Public:  true,
+				Code:    "unique_constraint_violation",
+				Message: fmt.Sprintf("A %v with the %v %v already exists", info.Collection(), attr.Name(), val),
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkUniqueWhere verifies that no other model exists with the same values
+// for unique attributes restricted with unique-where.
+// Only existing models matching the predicate are considered, and the check
+// is skipped if the model itself does not match it.
+func (b *BaseBackend) checkUniqueWhere(info *ModelInfo, model interface{}) apperror.Error {
+	for _, attr := range info.Attributes() {
+		field, operator := attr.UniqueWhere()
+		if field == "" || !(attr.IsUnique() || len(attr.IsUniqueWith()) > 0) {
+			continue
+		}
+
+		r, err := reflector.Reflect(model).Struct()
+		if err != nil {
+			return apperror.Wrap(err, "invalid_model")
+		}
+		if !uniqueWhereApplies(info, attr, r) {
+			continue
+		}
+
+		q := b.backend.Q(info.Collection()).WithDeleted().FilterCond(field, operator, nil)
+		q.Filter(attr.BackendName(), r.UFieldValue(attr.Name()))
+		for _, name := range attr.IsUniqueWith() {
+			withAttr := info.FindAttribute(name)
+			q.Filter(name, r.UFieldValue(withAttr.Name()))
+		}
+		// Exclude the model itself on updates.
+		if filter := info.ModelFilter(model); filter != nil {
+			q.FilterExpr(NewNotExpr(filter))
+		}
+
+		count, err2 := q.Count()
+		if err2 != nil {
+			return err2
+		}
+		if count > 0 {
+			return &apperror.Err{
+				Public:  true,
+				Code:    "unique_constraint_violation",
+				Message: fmt.Sprintf("A %v with the %v %v already exists", info.Collection(), attr.Name(), r.UFieldValue(attr.Name())),
+			}
+		}
+	}
+
+	return nil
+}
+
+// uniqueWhereApplies returns true if the model matches the unique-where
+// predicate of the attribute, or if the attribute has no predicate.
+func uniqueWhereApplies(info *ModelInfo, attr *Attribute, r *reflector.StructReflector) bool {
+	field, operator := attr.UniqueWhere()
+	if field == "" {
+		return true
+	}
+
+	whereAttr := info.FindAttribute(field)
+	if whereAttr == nil {
+		return true
+	}
+	isNull := r.Field(whereAttr.Name()).IsZero()
+	return isNull == (operator == OPERATOR_IS_NULL)
+}
+
+func (b *BaseBackend) Create(models ...interface{}) apperror.Error {
+	if len(models) < 1 {
+		return apperror.New("no_models")
+	}
+
+	info, err := b.backend.InfoForModel(models[0])
+	if err != nil {
+		return err
+	}
+
+	var op *BulkOperation
+	if len(models) > 1 {
+		op = &BulkOperation{Collection: info.Collection(), Models: models}
+		if err := b.callBulkHooks(HOOK_BEFORE_BULK_CREATE, op); err != nil {
+			return err
+		}
+	}
+
+	for _, model := range models {
+		if err := b.doCreate(info, model); err != nil {
+			return err
+		}
+	}
+
+	if op != nil {
+		return b.callBulkHooks(HOOK_AFTER_BULK_CREATE, op)
+	}
+	return nil
+}
+
+// CreateMany creates many models with as few statements as possible.
+// The models are grouped by collection, and if the backend implements
+// BatchCreateBackend, models with the same fields are inserted with a
+// single statement. Otherwise, one statement per model is executed.
+//
+// Unlike Create(), CreateMany does not persist relations, and only calls
+// the bulk create hooks once per collection instead of the per-model create
+// hooks.
+func (b *BaseBackend) CreateMany(models ...interface{}) apperror.Error {
+	if len(models) < 1 {
+		return apperror.New("no_models")
+	}
+
+	// Run in a transaction, so a failing statement does not leave the rows
+	// of earlier statements created.
+	tx, err := b.beginImplicitTransaction()
+	if err != nil {
+		return err
+	} else if tx != nil {
+		return finishTransaction(tx, tx.CreateMany(models...))
+	}
+
+	batch := false
+	if batchBackend, ok := b.backend.(BatchCreateBackend); ok {
+		batch = batchBackend.HasBatchCreate()
+	}
+
+	// Group the models by collection, keeping their order.
+	infos := make(map[string]*ModelInfo)
+	groups := make(map[string][]interface{})
+	collections := make([]string, 0)
+	for _, model := range models {
+		info, err := b.backend.InfoForModel(model)
+		if err != nil {
+			return err
+		}
+
+		collection := info.Collection()
+		if _, ok := groups[collection]; !ok {
+			infos[collection] = info
+			collections = append(collections, collection)
+		}
+		groups[collection] = append(groups[collection], model)
+	}
+
+	for _, collection := range collections {
+		if err := b.createBatch(infos[collection], groups[collection], batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// beginImplicitTransaction starts a transaction for an operation that must
+// be atomic. Returns nil if the backend does not support transactions or
+// already is a transaction.
+func (b *BaseBackend) beginImplicitTransaction() (Transaction, apperror.Error) {
+	txBackend, ok := b.backend.(TransactionBackend)
+	if !ok || txBackend.IsTransaction() {
+		return nil, nil
+	}
+	return txBackend.Begin()
+}
+
+// finishTransaction commits the transaction if err is nil, and rolls it
+// back otherwise. Returns err or the error of the commit.
+func finishTransaction(tx Transaction, err apperror.Error) apperror.Error {
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// generateIds sets the empty pk-uuid attributes of a model to a value
+// of the IDGenerator.
+// The model may also be the data map of CreateByMap(), keyed by backend
+// names.
+func (b *BaseBackend) generateIds(info *ModelInfo, model interface{}) apperror.Error {
+	if data, ok := model.(map[string]interface{}); ok {
+		for _, attr := range info.Attributes() {
+			if !attr.GenerateUUID() {
+				continue
+			}
+			if val := data[attr.BackendName()]; val != nil && !reflector.R(val).IsZero() {
+				continue
+			}
+
+			id, err := b.backend.IDGenerator().GenerateID()
+			if err != nil {
+				return err
+			}
+			data[attr.BackendName()] = id
+		}
+		return nil
+	}
+
+	r := reflector.Reflect(model)
+	if !r.IsStructPtr() {
+		return nil
+	}
+
+	for _, attr := range info.Attributes() {
+		if !attr.GenerateUUID() {
+			continue
+		}
+
+		field := r.MustStruct().Field(attr.Name())
+		if !field.IsZero() {
+			continue
+		}
+
+		id, err := b.backend.IDGenerator().GenerateID()
+		if err != nil {
+			return err
+		}
+		if err := field.SetValue(id, true); err != nil {
+			return apperror.Wrap(err, "set_generated_id_error")
+		}
+	}
+	return nil
+}
+
+// createBatch creates models of a single collection for CreateMany().
+func (b *BaseBackend) createBatch(info *ModelInfo, models []interface{}, batch bool) apperror.Error {
+	op := &BulkOperation{Collection: info.Collection(), Models: models}
+	if err := b.callBulkHooks(HOOK_BEFORE_BULK_CREATE, op); err != nil {
+		return err
+	}
+
+	// Only rows with the same fields can be inserted with one statement, so
+	// the rows are grouped by their field names.
+	stmts := make(map[string]*CreateStmt)
+	stmtModels := make(map[string][]interface{})
+	keys := make([]string, 0)
+
+	for _, model := range models {
+		if err := b.generateIds(info, model); err != nil {
+			return err
+		}
+		if err := info.ValidateModel(model); err != nil {
+			return err
+		}
+		if err := b.checkUniqueCi(info, model); err != nil {
+			return err
+		}
+		if err := b.checkUniqueWhere(info, model); err != nil {
+			return err
+		}
+
+		data, err := info.ModelToMap(model, true, false, false)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(data))
+		for name := range data {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]*FieldValueExpr, 0, len(names))
+		for _, name := range names {
+			values = append(values, NewFieldVal(name, data[name]))
+		}
+
+		if !batch {
+			stmt := NewCreateStmt(info.BackendName(), values)
+			stmt.SetRawValue(model)
+			if err := b.execCreateBatch(info, stmt, []interface{}{model}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := strings.Join(names, ",")
+		if stmt, ok := stmts[key]; ok {
+			stmt.AddRow(values)
+		} else {
+			stmts[key] = NewCreateStmt(info.BackendName(), values)
+			keys = append(keys, key)
+		}
+		stmtModels[key] = append(stmtModels[key], model)
+	}
+
+	for _, key := range keys {
+		if err := b.execCreateBatch(info, stmts[key], stmtModels[key]); err != nil {
+			return err
+		}
+	}
+
+	return b.callBulkHooks(HOOK_AFTER_BULK_CREATE, op)
+}
+
+// BulkLoad creates a row for each entry of rows, which hold the values in
+// the order of columns. Returns the number of created rows, which is 0 if
+// an error occurs.
+// The rows are converted to models and created with CreateMany(), in a
+// transaction if the backend supports them.
+func (b *BaseBackend) BulkLoad(collection string, columns []string, rows [][]interface{}) (int, apperror.Error) {
+	info := b.backend.ModelInfo(collection)
+	if info == nil {
+		return 0, b.unknownColErr(collection)
+	}
+	for _, column := range columns {
+		if info.FindAttribute(column) == nil {
+			return 0, &apperror.Err{
+				Public:  true,
+				Code:    "unknown_field",
+				Message: fmt.Sprintf("Collection %v does not have a field %v", info.Collection(), column),
+			}
+		}
+	}
+	for index, row := range rows {
+		if len(row) != len(columns) {
+			return 0, apperror.New("invalid_row", fmt.Sprintf("Row %v has %v values, but %v columns were given", index, len(row), len(columns)))
+		}
+	}
+
+	tx, err := b.beginImplicitTransaction()
+	if err != nil {
+		return 0, err
+	} else if tx != nil {
+		n, err := tx.BulkLoad(collection, columns, rows)
+		if err := finishTransaction(tx, err); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	models := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		data := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			data[column] = row[i]
+		}
+
+		if !info.HasStruct() {
+			if _, err := b.backend.CreateByMap(info.Collection(), data); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		model := info.New()
+		if err := info.UpdateModelFromData(model, data); err != nil {
+			return 0, err
+		}
+		models = append(models, model)
+	}
+
+	if len(models) > 0 {
+		if err := b.backend.CreateMany(models...); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// execCreateBatch executes a create statement and writes the returned data,
+// like generated ids, back to the models.
+func (b *BaseBackend) execCreateBatch(info *ModelInfo, stmt *CreateStmt, models []interface{}) apperror.Error {
+	res, err := b.backend.ExecQuery(stmt)
+	if err != nil {
+		return err
+	}
+
+	if len(res) == 0 && len(models) == 1 {
+		// Backends that do not return the created row, like Create().
+		return nil
+	}
+	if len(res) != len(models) {
+		return apperror.New("batch_id_mismatch",
+			fmt.Sprintf("Created %v models of collection %v, but the backend returned %v rows", len(models), info.Collection(), len(res)))
+	}
+	for i, model := range models {
+		if data, ok := res[i].(map[string]interface{}); ok {
+			if err := info.UpdateModelFromData(model, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// doUpsert validates the model and executes an upsert statement built by
+// buildStmt for it.
+func (b *BaseBackend) doUpsert(model interface{}, buildStmt func(info *ModelInfo, values []*FieldValueExpr) *UpsertStmt) apperror.Error {
+	info, err := b.backend.InfoForModel(model)
+	if err != nil {
+		return err
+	}
+
+	if err := info.ValidateModel(model); err != nil {
+		return err
+	}
+
+	values, err := info.ModelToFieldExpressions(model)
+	if err != nil {
+		return err
+	}
 
-	// Call backend-wide after_create hooks.
-	for _, handler := range b.GetHooks("after_create") {
-		handler(b.backend, model)
+	stmt := buildStmt(info, values)
+	stmt.SetRawValue(model)
+
+	res, err := b.backend.ExecQuery(stmt)
+	if err != nil {
+		return err
+	}
+
+	if len(res) == 1 {
+		if data, ok := res[0].(map[string]interface{}); ok {
+			if err := info.UpdateModelFromData(model, data); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-func (b *BaseBackend) Create(models ...interface{}) apperror.Error {
-	if len(models) < 1 {
-		return apperror.New("no_models")
+// CreateUnlessExists creates the model unless the query built by filter on
+// the collection of the model matches a row.
+// If the backend supports transactions, the check and the create run in a
+// transaction. Concurrent callers may still both create the model unless a
+// unique constraint prevents it.
+func (b *BaseBackend) CreateUnlessExists(model interface{}, filter func(q *Query)) (bool, apperror.Error) {
+	info, err := b.backend.InfoForModel(model)
+	if err != nil {
+		return false, err
 	}
 
-	info, err := b.backend.InfoForModel(models[0])
+	backend := b.backend
+	var tx Transaction
+	if txBackend, ok := b.backend.(TransactionBackend); ok && !txBackend.IsTransaction() {
+		tx, err = txBackend.Begin()
+		if err != nil {
+			return false, err
+		}
+		backend = tx
+	}
+
+	q := backend.Q(info.Collection())
+	if filter != nil {
+		filter(q)
+	}
+	exists, err := q.Exists()
+	if err == nil && !exists {
+		err = backend.Create(model)
+	}
+
+	if tx != nil {
+		if err != nil || exists {
+			if err2 := tx.Rollback(); err == nil {
+				err = err2
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	for _, model := range models {
-		if err := b.doCreate(info, model); err != nil {
-			return err
+	return !exists, nil
+}
+
+// Upsert creates the model, or updates the existing row with the same values
+// for the conflict fields, which must be covered by a unique constraint in
+// SQL databases.
+func (b *BaseBackend) Upsert(model interface{}, conflictFields ...string) apperror.Error {
+	if len(conflictFields) < 1 {
+		return apperror.New("no_conflict_fields", "Upsert requires at least one conflict field", true)
+	}
+
+	info, err := b.backend.InfoForModel(model)
+	if err != nil {
+		return err
+	}
+	fields := make([]Expression, 0, len(conflictFields))
+	for _, name := range conflictFields {
+		attr := info.FindAttribute(name)
+		if attr == nil {
+			return &apperror.Err{
+				Public:  true,
+				Code:    "unknown_field",
+				Message: fmt.Sprintf("Collection %v does not have a field %v", info.Collection(), name),
+			}
 		}
+		fields = append(fields, NewIdExpr(attr.BackendName()))
 	}
 
-	return nil
+	return b.doUpsert(model, func(info *ModelInfo, values []*FieldValueExpr) *UpsertStmt {
+		return NewUpsertStmt(info.BackendName(), values, fields)
+	})
+}
+
+func (b *BaseBackend) UpsertOnConstraint(model interface{}, constraintName string) apperror.Error {
+	if constraintName == "" {
+		return apperror.New("empty_constraint_name", "UpsertOnConstraint requires a constraint name", true)
+	}
+
+	return b.doUpsert(model, func(info *ModelInfo, values []*FieldValueExpr) *UpsertStmt {
+		return NewConstraintUpsertStmt(info.BackendName(), values, constraintName)
+	})
 }
 
 func (b *BaseBackend) CreateByMap(collection string, data map[string]interface{}) (interface{}, apperror.Error) {
 	info := b.backend.ModelInfo(collection)
 	if info != nil && info.Reflector() != nil {
 		// Known collection which has a struct.
+		if err := b.validateMapKeys(info, data); err != nil {
+			return nil, err
+		}
 
 		// Create new model instance and fill it with data.
 		model := info.New()
@@ -1388,20 +2919,95 @@ func (b *BaseBackend) CreateByMap(collection string, data map[string]interface{}
 
 	// Either unknown collection, or collection does not have a struct, so
 	// manually create a statement.
+	if info != nil {
+		// Known collection, so validate and convert the data.
+		converted, err := b.convertMapData(info, data)
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+		collection = info.BackendName()
+
+		if err := b.generateIds(info, data); err != nil {
+			return nil, err
+		}
+	}
+
 	values := make([]*FieldValueExpr, 0)
 	for name, val := range data {
 		values = append(values, NewFieldVal(name, val))
 	}
-	stmt := NewCreateStmt(info.BackendName(), values)
+	stmt := NewCreateStmt(collection, values)
 	stmt.SetRawValue(data)
 	res, err := b.backend.ExecQuery(stmt)
 	if err != nil {
 		return nil, err
 	}
-	if len(res) == 0 {
-		return nil, nil
+
+	// Return a copy of the data, with values returned by the backend like
+	// a generated id merged in.
+	result := make(map[string]interface{}, len(data))
+	for key, val := range data {
+		result[key] = val
+	}
+	if len(res) > 0 {
+		if row, ok := res[0].(map[string]interface{}); ok {
+			for key, val := range row {
+				result[key] = val
+			}
+		}
+	}
+	return result, nil
+}
+
+// validateMapKeys returns an unknown_field error if a key of the data does
+// not belong to an attribute or a relation of the collection.
+func (b *BaseBackend) validateMapKeys(info *ModelInfo, data map[string]interface{}) apperror.Error {
+	for key := range data {
+		if info.FindAttribute(key) != nil {
+			continue
+		}
+		left, _ := utils.StrSplitLeft(key, ".")
+		if info.FindRelation(left) != nil {
+			continue
+		}
+		return &apperror.Err{
+			Public:  true,
+			Code:    "unknown_field",
+			Message: fmt.Sprintf("Collection %v does not have a field %v", info.Collection(), key),
+		}
+	}
+	return nil
+}
+
+// convertMapData validates that all keys of the data belong to an attribute
+// of the collection, and converts the values to the attribute types.
+// The returned map uses the backend names as keys.
+func (b *BaseBackend) convertMapData(info *ModelInfo, data map[string]interface{}) (map[string]interface{}, apperror.Error) {
+	converted := make(map[string]interface{}, len(data))
+	for key, val := range data {
+		attr := info.FindAttribute(key)
+		if attr == nil {
+			return nil, &apperror.Err{
+				Public:  true,
+				Code:    "unknown_field",
+				Message: fmt.Sprintf("Collection %v does not have a field %v", info.Collection(), key),
+			}
+		}
+
+		typ := attr.Type()
+		if val != nil && typ != nil && typ.Kind() != reflect.Ptr && !attr.BackendMarshal() {
+			convertedVal, err := reflector.R(val).ConvertTo(reflect.Zero(typ).Interface())
+			if err != nil {
+				msg := fmt.Sprintf("Data for field %v (%v) could not be converted to %v", key, val, typ)
+				return nil, apperror.Wrap(err, "unconvertable_field_value", msg, true)
+			}
+			val = convertedVal
+		}
+
+		converted[attr.BackendName()] = val
 	}
-	return res[0], nil
+	return converted, nil
 }
 
 func (b *BaseBackend) Update(model interface{}) apperror.Error {
@@ -1426,13 +3032,19 @@ func (b *BaseBackend) Update(model interface{}) apperror.Error {
 	if err := info.ValidateModel(model); err != nil {
 		return err
 	}
+	if err := b.checkUniqueCi(info, model); err != nil {
+		return err
+	}
+	if err := b.checkUniqueWhere(info, model); err != nil {
+		return err
+	}
 
 	// Call backend-wide before_update hooks.
 	for _, handler := range b.backend.GetHooks("before_update") {
 		handler(b.backend, model)
 	}
 
-	if err := b.PersistRelations("update", true, info, model); err != nil {
+	if err := b.persistRelations("update", true, info, model); err != nil {
 		return err
 	}
 
@@ -1450,7 +3062,7 @@ func (b *BaseBackend) Update(model interface{}) apperror.Error {
 	}
 
 	// Persist relationships again since m2m can only be handled  when an Id is set.
-	if err := b.PersistRelations("update", false, info, model); err != nil {
+	if err := b.persistRelations("update", false, info, model); err != nil {
 		return err
 	}
 
@@ -1475,18 +3087,54 @@ func (b *BaseBackend) Save(model interface{}) apperror.Error {
 		return err
 	}
 
+	// The save hooks wrap the create and update hooks.
+	if err := CallModelHook(b.backend, model, "BeforeSave"); err != nil {
+		return err
+	}
+
 	if !hasId {
-		return b.backend.Create(model)
+		err = b.backend.Create(model)
 	} else {
-		return b.backend.Update(model)
+		err = b.backend.Update(model)
+	}
+	if err != nil {
+		return err
 	}
+
+	CallModelHook(b.backend, model, "AfterSave")
+	return nil
 }
 
 func (b *BaseBackend) UpdateByMap(query *Query, data map[string]interface{}) apperror.Error {
+	_, err := b.updateByMap(query, data, false)
+	return err
+}
+
+func (b *BaseBackend) UpdateByMapCount(query *Query, data map[string]interface{}) (int64, apperror.Error) {
+	return b.updateByMap(query, data, true)
+}
+
+// updateByMap updates the models matched by the query.
+// The number of updated models is only determined if count is true.
+func (b *BaseBackend) updateByMap(query *Query, data map[string]interface{}, count bool) (int64, apperror.Error) {
+	if err := b.checkBulkFilter(query, "update"); err != nil {
+		return 0, err
+	}
+
+	op := &BulkOperation{Collection: query.GetCollection(), Query: query, Data: data}
+	if err := b.callBulkHooks(HOOK_BEFORE_BULK_UPDATE, op); err != nil {
+		return 0, err
+	}
+
 	collection := query.GetCollection()
 	info := b.ModelInfo(collection)
 	if info != nil {
 		collection = info.BackendName()
+
+		// Normalize, so sorts can be resolved to backend names.
+		if err := query.Normalize(); err != nil {
+			return 0, err
+		}
 	}
 
 	values := make([]*FieldValueExpr, 0)
@@ -1496,6 +3144,57 @@ func (b *BaseBackend) UpdateByMap(query *Query, data map[string]interface{}) app
 	stmt := NewUpdateStmt(collection, values, query.GetStatement())
 	stmt.SetRawValue(data)
 
+	var updated int64
+	var err apperror.Error
+	if count {
+		updated, err = b.backend.ExecCount(stmt)
+	} else {
+		err = b.backend.Exec(stmt)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := b.callBulkHooks(HOOK_AFTER_BULK_UPDATE, op); err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
+
+func (b *BaseBackend) UpdateJSONPath(query *Query, field, path string, value interface{}) apperror.Error {
+	if err := b.checkBulkFilter(query, "update"); err != nil {
+		return err
+	}
+
+	info := b.ModelInfo(query.GetCollection())
+	if info == nil {
+		return b.unknownColErr(query.GetCollection())
+	}
+
+	attr := info.FindAttribute(field)
+	if attr == nil {
+		return &apperror.Err{
+			Public:  true,
+			Code:    "unknown_field",
+			Message: fmt.Sprintf("The collection %v does not have a field %v", info.Collection(), field),
+		}
+	} else if !attr.BackendMarshal() {
+		return &apperror.Err{
+			Public:  true,
+			Code:    "not_json_field",
+			Message: fmt.Sprintf("The field %v.%v is not marshalled", info.Collection(), field),
+		}
+	}
+
+	if err := query.Normalize(); err != nil {
+		return err
+	}
+
+	id := NewIdExpr(attr.BackendName())
+	values := []*FieldValueExpr{
+		NewFieldValExpr(id, NewJSONSetExpr(id, strings.Split(path, "."), value)),
+	}
+	stmt := NewUpdateStmt(info.BackendName(), values, query.GetStatement())
+
 	return b.backend.Exec(stmt)
 }
 
@@ -1522,17 +3221,37 @@ func (b *BaseBackend) Delete(model interface{}) apperror.Error {
 		handler(b.backend, model)
 	}
 
-	if err := b.PersistRelations("delete", true, info, model); err != nil {
-		return err
+	// Relations are kept for soft deleted models, so they are still
+	// there once the model is restored.
+	softDelete := info.SoftDeleteAttribute()
+	if softDelete == nil {
+		if err := b.persistRelations("delete", true, info, model); err != nil {
+			return err
+		}
 	}
 
-	stmt := info.ModelDeleteStmt(model)
+	var stmt Expression
+	if softDelete != nil {
+		// Soft delete: only set the deletion time.
+		deletedAt := softDeleteValue(softDelete)
+		if err := reflector.Reflect(model).MustStruct().Field(softDelete.Name()).SetValue(deletedAt, true); err != nil {
+			return apperror.Wrap(err, "set_soft_delete_error")
+		}
+		values := []*FieldValueExpr{NewFieldVal(softDelete.BackendName(), deletedAt)}
+		update := NewUpdateStmt(info.BackendName(), values, info.ModelSelect(model))
+		update.SetRawValue(model)
+		stmt = update
+	} else {
+		stmt = info.ModelDeleteStmt(model)
+	}
 	if err := b.backend.Exec(stmt); err != nil {
 		return err
 	}
 
-	if err := b.PersistRelations("delete", false, info, model); err != nil {
-		return err
+	if softDelete == nil {
+		if err := b.persistRelations("delete", false, info, model); err != nil {
+			return err
+		}
 	}
 
 	CallModelHook(b.backend, model, "AfterDelete")
@@ -1546,20 +3265,97 @@ func (b *BaseBackend) Delete(model interface{}) apperror.Error {
 }
 
 func (b *BaseBackend) DeleteMany(query *Query) apperror.Error {
+	_, err := b.deleteMany(query, false)
+	return err
+}
+
+func (b *BaseBackend) DeleteManyCount(query *Query) (int64, apperror.Error) {
+	return b.deleteMany(query, true)
+}
+
+// deleteMany deletes the models matched by the query.
+// The number of deleted models is only determined if count is true.
+func (b *BaseBackend) deleteMany(query *Query, count bool) (int64, apperror.Error) {
+	if err := b.checkBulkFilter(query, "delete"); err != nil {
+		return 0, err
+	}
+
 	collection := query.GetCollection()
 	info := b.ModelInfo(collection)
 	if info != nil {
 		collection = info.BackendName()
 	}
 
-	stmt := NewDeleteStmt(collection, query.GetStatement())
-	return b.backend.Exec(stmt)
+	op := &BulkOperation{Collection: query.GetCollection(), Query: query}
+	if err := b.callBulkHooks(HOOK_BEFORE_BULK_DELETE, op); err != nil {
+		return 0, err
+	}
+
+	var attr *Attribute
+	if info != nil {
+		// Normalize, so sorts can be resolved to backend names.
+		if err := query.Normalize(); err != nil {
+			return 0, err
+		}
+		attr = info.SoftDeleteAttribute()
+	}
+
+	var stmt Expression
+	if attr != nil {
+		// Soft delete: only set the deletion time.
+		deletedAt := softDeleteValue(attr)
+		values := []*FieldValueExpr{NewFieldVal(attr.BackendName(), deletedAt)}
+		update := NewUpdateStmt(collection, values, query.GetStatement())
+		update.SetRawValue(map[string]interface{}{attr.BackendName(): deletedAt})
+		stmt = update
+	} else {
+		stmt = NewDeleteStmt(collection, query.GetStatement())
+	}
+
+	var deleted int64
+	var err apperror.Error
+	if count {
+		deleted, err = b.backend.ExecCount(stmt)
+	} else {
+		err = b.backend.Exec(stmt)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := b.callBulkHooks(HOOK_AFTER_BULK_DELETE, op); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// softDeleteValue returns the current time as a value for the soft-delete
+// attribute, which may be a time.Time or a *time.Time.
+func softDeleteValue(attr *Attribute) interface{} {
+	now := time.Now()
+	if attr.Type().Kind() == reflect.Ptr {
+		return &now
+	}
+	return now
+}
+
+// checkBulkFilter returns a missing_filter error if a bulk update or delete
+// query has no filter and AllowAll() was not called.
+func (b *BaseBackend) checkBulkFilter(query *Query, action string) apperror.Error {
+	if query.GetStatement().Filter() != nil || query.GetAllowAll() {
+		return nil
+	}
+	msg := fmt.Sprintf("Refusing to %v all rows of %v without a filter. Use query.AllowAll() to do so explicitly.", action, query.GetCollection())
+	return apperror.New("missing_filter", msg)
 }
 
 /**
  * Join logic.
  */
 
+// DoJoins loads the relations joined on q for the resulting models.
+// Each relation is loaded with a single query for all models. Nested joins
+// are part of that relation query, so they are loaded for all related models
+// at once as well, which results in one query per relation level.
 func (b *BaseBackend) DoJoins(baseInfo *ModelInfo, q *Query, models []interface{}) apperror.Error {
 	if len(models) < 1 {
 		return nil
@@ -1589,11 +3385,17 @@ func (b *BaseBackend) DoJoin(baseInfo *ModelInfo, objs []interface{}, joinQ *Rel
 		return apperror.New("invalid_relationship", msg)
 	}
 
-	if b.backend.HasNativeJoins() && !relation.IsMany() {
+	if b.backend.HasNativeJoins() && !relation.IsMany() && !joinQ.GetPreload() && !relation.IsSelfReferential() {
 		// Ignore to-one joins, which can be handled natively.
 		return nil
 	}
 
+	return b.loadRelation(relation, objs, joinQ)
+}
+
+// loadRelation queries the related models for all objs with a single query
+// and assigns them to the relation field of each model.
+func (b *BaseBackend) loadRelation(relation *Relation, objs []interface{}, joinQ *RelationQuery) apperror.Error {
 	resultQuery, err := b.BuildRelationQuery(joinQ)
 	if err != nil {
 		if apperror.IsCode(err, "relation_query_on_empty_result") {
@@ -1611,104 +3413,219 @@ func (b *BaseBackend) DoJoin(baseInfo *ModelInfo, objs []interface{}, joinQ *Rel
 
 	if len(res) > 0 && relation.relatedModel.HasStruct() {
 		if assigner := resultQuery.GetJoinResultAssigner(); assigner != nil {
-			assigner(relation, joinQ, resultQuery, objs, res)
+			if err := assigner(relation, joinQ, resultQuery, objs, res); err != nil {
+				return err
+			}
 		} else {
-			assignJoinModels(relation, joinQ, objs, res)
+			if err := assignJoinModels(relation, joinQ, objs, res); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
-func assignM2MJoinModels(relation *Relation, joinQ *RelationQuery, resultQuery *Query, objs, joinedModels []interface{}) {
+func assignM2MJoinModels(relation *Relation, joinQ *RelationQuery, resultQuery *Query, objs, joinedModels []interface{}) apperror.Error {
 	localFieldInfo := relation.Model().Attribute(relation.LocalField())
 	foreignFieldInfo := relation.RelatedModel().Attribute(relation.ForeignField())
 
 	joinedModelMap := make(map[interface{}]interface{})
 	for _, model := range joinedModels {
-		val, err := reflector.Reflect(model).MustStruct().FieldValue(joinQ.localField)
+		r, err := reflector.Reflect(model).Struct()
 		if err != nil {
-			panic(err)
+			return apperror.Wrap(err, "invalid_joined_model")
+		}
+		val, err := r.FieldValue(joinQ.localField)
+		if err != nil {
+			return apperror.Wrap(err, "join_assignment_error")
 		}
 		joinedModelMap[val] = model
 	}
 
 	resultMap := make(map[interface{}][]interface{})
 	for _, rawRow := range resultQuery.rawResult {
-		row := rawRow.(map[string]interface{})
+		row, ok := rawRow.(map[string]interface{})
+		if !ok {
+			return apperror.New("join_assignment_error", fmt.Sprintf("Expected a map as m2m join row, got %T", rawRow))
+		}
 
 		id, err := reflector.Reflect(row[joinQ.foreignField]).ConvertToType(localFieldInfo.Type())
 		if err != nil {
-			panic(err)
+			return apperror.Wrap(err, "join_assignment_error")
 		}
 		foreignId, err := reflector.Reflect(row[joinQ.localField]).ConvertToType(foreignFieldInfo.Type())
 		if err != nil {
-			panic(err)
+			return apperror.Wrap(err, "join_assignment_error")
 		}
 		resultMap[id] = append(resultMap[id], joinedModelMap[foreignId])
 	}
 
 	for _, model := range objs {
-		r := reflector.Reflect(model).MustStruct()
+		r, err := reflector.Reflect(model).Struct()
+		if err != nil {
+			return apperror.Wrap(err, "invalid_base_model")
+		}
 
 		val, err := r.FieldValue(relation.LocalField())
 		if err != nil {
-			panic("Join result assignment error: " + err.Error())
+			return apperror.Wrap(err, "join_assignment_error")
 		}
 
 		if joins, ok := resultMap[val]; ok && len(joins) > 0 {
-			if relation.IsMany() {
-				if err := r.Field(relation.Name()).SetValue(joins, true); err != nil {
-					panic(err)
-				}
-			} else {
-				if err := r.Field(relation.Name()).SetValue(joins[0], true); err != nil {
-					panic(err)
-				}
+			value, err := relationFieldValue(relation, joins)
+			if err != nil {
+				return err
+			}
+			if err := r.Field(relation.Name()).SetValue(value, true); err != nil {
+				return apperror.Wrap(err, "join_assignment_error")
 			}
 		}
 	}
-}
 
-func assignJoinModels(relation *Relation, joinQ *RelationQuery, objs, joinedModels []interface{}) {
-	targetField := relation.Name()
+	return nil
+}
 
-	joinField := joinQ.localField
+// assignJoinModels assigns the models of a join query to the relation field
+// of the base models. The joined models are matched by the fields stored on
+// the join query, which default to the foreign and local field of the
+// relation.
+func assignJoinModels(relation *Relation, joinQ *RelationQuery, objs, joinedModels []interface{}) apperror.Error {
+	joinField := joinQ.GetLocalField()
 	if joinField == "" {
 		joinField = relation.ForeignField()
 	}
-	joinedField := joinQ.foreignField
+	joinedField := joinQ.GetForeignField()
 	if joinedField == "" {
 		joinedField = relation.LocalField()
 	}
 
-	mapper := make(map[interface{}][]interface{})
+	mapper := make(map[string][]interface{})
 	for _, model := range joinedModels {
-		val, err := reflector.Reflect(model).MustStruct().FieldValue(joinField)
+		r, err := reflector.Reflect(model).Struct()
 		if err != nil {
-			panic(err)
+			return apperror.Wrap(err, "invalid_joined_model")
+		}
+		val, err := r.FieldValue(joinField)
+		if err != nil {
+			return apperror.Wrap(err, "join_assignment_error")
+		}
+		if key, ok := joinKey(val); ok {
+			mapper[key] = append(mapper[key], model)
 		}
-		mapper[val] = append(mapper[val], model)
 	}
 
 	for _, model := range objs {
-		r := reflector.Reflect(model).MustStruct()
+		r, err := reflector.Reflect(model).Struct()
+		if err != nil {
+			return apperror.Wrap(err, "invalid_base_model")
+		}
 
 		val, err := r.FieldValue(joinedField)
 		if err != nil {
-			panic("Join result assignment error: " + err.Error())
+			return apperror.Wrap(err, "join_assignment_error")
+		}
+		key, ok := joinKey(val)
+		if !ok {
+			continue
 		}
 
-		if joins, ok := mapper[val]; ok && len(joins) > 0 {
-			if relation.IsMany() {
-				if err := r.Field(targetField).SetValue(joins, true); err != nil {
-					panic(err)
-				}
-			} else {
-				if err := r.Field(targetField).SetValue(joins[0], true); err != nil {
-					panic(err)
-				}
+		if joins := mapper[key]; len(joins) > 0 {
+			value, err := relationFieldValue(relation, joins)
+			if err != nil {
+				return err
+			}
+			if err := r.Field(relation.Name()).SetValue(value, true); err != nil {
+				return apperror.Wrap(err, "join_assignment_error")
+			}
+		}
+	}
+
+	return nil
+}
+
+// joinKey returns the key for matching the value of a join field, so values
+// of different types like uint64 and *int64 match.
+// Returns false for nil values.
+func joinKey(val interface{}) (string, bool) {
+	v := reflect.ValueOf(val)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return "", false
+	}
+	return fmt.Sprint(v.Interface()), true
+}
+
+// relationFieldValue returns the value to assign to the relation field for
+// the given related models.
+// For relations stored in a map, the models are keyed by the map-key field.
+// resetRelationField sets the relation field of the model to an empty
+// slice or map for has-many relations, and to the zero value otherwise.
+func resetRelationField(relation *Relation, model interface{}) apperror.Error {
+	typ := relation.Type()
+	var value reflect.Value
+	switch typ.Kind() {
+	case reflect.Slice:
+		value = reflect.MakeSlice(typ, 0, 0)
+	case reflect.Map:
+		value = reflect.MakeMap(typ)
+	default:
+		value = reflect.Zero(typ)
+	}
+
+	field := reflect.ValueOf(model).Elem().FieldByName(relation.Name())
+	if field.CanSet() {
+		field.Set(value)
+		return nil
+	}
+	// Unexported fields can only be set with the reflector.
+	if err := reflector.Reflect(model).MustStruct().Field(relation.Name()).SetValue(value.Interface(), true); err != nil {
+		return apperror.Wrap(err, "join_assignment_error")
+	}
+	return nil
+}
+
+func relationFieldValue(relation *Relation, joins []interface{}) (interface{}, apperror.Error) {
+	if !relation.IsMany() {
+		return joins[0], nil
+	}
+	typ := relation.Type()
+	if typ.Kind() != reflect.Map {
+		return joins, nil
+	}
+
+	m := reflect.MakeMap(typ)
+	for _, model := range joins {
+		rawKey, err := reflector.Reflect(model).MustStruct().FieldValue(relation.MapKey())
+		if err != nil {
+			msg := fmt.Sprintf("Could not read map key %v of relation %v", relation.MapKey(), relation.Name())
+			return nil, apperror.Wrap(err, "invalid_relation_map_key", msg)
+		}
+		key, err := reflector.Reflect(rawKey).ConvertToType(typ.Key())
+		if err != nil {
+			msg := fmt.Sprintf("Could not convert map key %v of relation %v", relation.MapKey(), relation.Name())
+			return nil, apperror.Wrap(err, "invalid_relation_map_key", msg)
+		}
+
+		keyVal := reflect.ValueOf(key)
+		if m.MapIndex(keyVal).IsValid() {
+			return nil, &apperror.Err{
+				Code:    "duplicate_relation_map_key",
+				Message: fmt.Sprintf("Multiple models of relation %v have the %v %v", relation.Name(), relation.MapKey(), key),
 			}
 		}
+
+		val := reflect.ValueOf(model)
+		if typ.Elem().Kind() != reflect.Ptr {
+			val = val.Elem()
+		}
+		m.SetMapIndex(keyVal, val)
 	}
+
+	return m.Interface(), nil
 }
@@ -0,0 +1,116 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/theduke/go-apperror"
+	"github.com/theduke/go-reflector"
+
+	. "github.com/theduke/go-dukedb/expressions"
+)
+
+/**
+ * Document collections.
+ *
+ * Document collections store schemaless map documents without a registered
+ * model, which makes the memory backend usable as a simple document store.
+ */
+
+// RegisterDocumentCollection registers a schemaless collection that stores
+// map documents. The id of each document is stored in the idField key.
+func (b *Backend) RegisterDocumentCollection(name, idField string) apperror.Error {
+	if name == "" || idField == "" {
+		return apperror.New("invalid_document_collection", "Document collections need a name and an id field")
+	}
+	if _, ok := b.data[name]; ok {
+		return apperror.New("collection_exists", fmt.Sprintf("The collection %v already exists", name))
+	}
+
+	b.data[name] = make(map[string]interface{})
+	b.documentIdFields[name] = idField
+	return nil
+}
+
+func (b *Backend) documentCollection(name string) (string, apperror.Error) {
+	idField, ok := b.documentIdFields[name]
+	if !ok {
+		return "", apperror.New("unknown_collection", fmt.Sprintf("The document collection %v was not registered", name))
+	}
+	return idField, nil
+}
+
+// copyDocument returns a shallow copy of a document so callers can not
+// modify the stored data.
+func copyDocument(doc map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(doc))
+	for key, val := range doc {
+		copied[key] = val
+	}
+	return copied
+}
+
+// Put stores a document with the given id, replacing an existing one.
+// If id is empty, a new id is generated.
+// Returns the id of the document.
+func (b *Backend) Put(collection, id string, doc map[string]interface{}) (string, apperror.Error) {
+	idField, err := b.documentCollection(collection)
+	if err != nil {
+		return "", err
+	}
+
+	if id == "" {
+		id = b.nextId(collection)
+	}
+
+	doc = copyDocument(doc)
+	doc[idField] = id
+	b.data[collection][id] = doc
+
+	return id, nil
+}
+
+// Get returns the document with the given id, or nil if it does not exist.
+func (b *Backend) Get(collection, id string) (map[string]interface{}, apperror.Error) {
+	if _, err := b.documentCollection(collection); err != nil {
+		return nil, err
+	}
+
+	doc, ok := b.data[collection][id]
+	if !ok {
+		return nil, nil
+	}
+	return copyDocument(doc.(map[string]interface{})), nil
+}
+
+// FindDocuments returns all documents where field equals value, sorted by id.
+func (b *Backend) FindDocuments(collection, field string, value interface{}) ([]map[string]interface{}, apperror.Error) {
+	if _, err := b.documentCollection(collection); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for id := range b.data[collection] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	docs := make([]map[string]interface{}, 0)
+	for _, id := range ids {
+		doc := b.data[collection][id].(map[string]interface{})
+		val, ok := doc[field]
+		if !ok {
+			continue
+		}
+
+		flag, err := reflector.R(val).CompareTo(value, OPERATOR_EQ)
+		if err != nil {
+			return nil, apperror.Wrap(err, "compare_error")
+		}
+		if flag {
+			docs = append(docs, copyDocument(doc))
+		}
+	}
+
+	return docs, nil
+}
@@ -1,9 +1,14 @@
 package memory
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/theduke/go-apperror"
 	"github.com/theduke/go-reflector"
@@ -12,11 +17,35 @@ import (
 	. "github.com/theduke/go-dukedb/expressions"
 )
 
+const (
+	// COLLATION_BINARY compares strings byte-wise, like the "C" collation of
+	// Postgres. This is the default.
+	COLLATION_BINARY = "binary"
+
+	// COLLATION_CASE_INSENSITIVE compares lower cased strings, like the
+	// default "_ci" collations of MySQL.
+	COLLATION_CASE_INSENSITIVE = "case_insensitive"
+)
+
 type Backend struct {
 	db.BaseBackend
 
+	// collation is used for ordering strings in filters and sorts.
+	collation string
+
 	data map[string]map[string]interface{}
 
+	// lastIds holds the last generated id of each collection, so the ids of
+	// deleted items are never reused. It is shared with transactions.
+	lastIds map[string]int
+
+	// documentIdFields maps the names of document collections to their
+	// id field. See RegisterDocumentCollection().
+	documentIdFields map[string]string
+
+	// tx is set for transactions started with Begin().
+	tx *transaction
+
 	MigrationHandler *db.MigrationHandler
 	MigrationVersion int
 }
@@ -24,13 +53,18 @@ type Backend struct {
 // Ensure that Backend implements the db.Backend interface at compile time.
 var _ db.Backend = (*Backend)(nil)
 var _ db.MigrationBackend = (*Backend)(nil)
+var _ db.TransactionBackend = (*Backend)(nil)
+var _ db.RowStreamBackend = (*Backend)(nil)
 
 func New() *Backend {
 	b := &Backend{}
 	b.BaseBackend = db.NewBaseBackend(b)
 	b.SetName("memory")
 
+	b.collation = COLLATION_BINARY
 	b.data = make(map[string]map[string]interface{})
+	b.lastIds = make(map[string]int)
+	b.documentIdFields = make(map[string]string)
 
 	b.MigrationHandler = db.NewMigrationHandler(b)
 	b.MigrationVersion = 0
@@ -41,6 +75,10 @@ func New() *Backend {
 	return b
 }
 
+func (b *Backend) Dialect() string {
+	return "memory"
+}
+
 func (b *Backend) HasStringIds() bool {
 	return false
 }
@@ -49,71 +87,514 @@ func (b *Backend) HasNativeJoins() bool {
 	return false
 }
 
+// Collation returns the collation used for ordering strings.
+func (b *Backend) Collation() string {
+	return b.collation
+}
+
+// SetCollation sets the collation used for the <, <=, > and >= filters and
+// for sorting by string fields.
+// Equality filters always compare strings exactly.
+// Use the collation that matches the database used in production to get
+// the same ordering in tests.
+func (b *Backend) SetCollation(collation string) apperror.Error {
+	switch collation {
+	case COLLATION_BINARY, COLLATION_CASE_INSENSITIVE:
+		b.collation = collation
+		return nil
+	default:
+		return apperror.New("unsupported_collation", fmt.Sprintf("The memory backend does not support the collation %v", collation))
+	}
+}
+
+// collate returns the value used for ordering comparisons of strings
+// according to the collation. Other values are returned unchanged.
+func (b *Backend) collate(val interface{}) interface{} {
+	if str, ok := val.(string); ok && b.collation == COLLATION_CASE_INSENSITIVE {
+		return strings.ToLower(str)
+	}
+	return val
+}
+
 func (b *Backend) Clone() db.Backend {
 	copied := &Backend{
 		BaseBackend:      b.BaseBackend,
+		collation:        b.collation,
 		data:             b.data,
+		lastIds:          b.lastIds,
+		documentIdFields: b.documentIdFields,
+		tx:               b.tx,
 		MigrationHandler: b.MigrationHandler,
 		MigrationVersion: b.MigrationVersion,
 	}
 
+	copied.SetBackend(copied)
+
 	return copied
 }
 
-func (b *Backend) RegisterModel(m interface{}) *db.ModelInfo {
-	info := b.BaseBackend.RegisterModel(m)
-	b.data[info.Collection()] = make(map[string]interface{})
-	return info
+func (b *Backend) RegisterModel(m interface{}) (*db.ModelInfo, apperror.Error) {
+	info, err := b.BaseBackend.RegisterModel(m)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the data when an existing model is replaced.
+	if _, ok := b.data[info.Collection()]; !ok {
+		b.data[info.Collection()] = make(map[string]interface{})
+	}
+	if b.IsBuilt() {
+		// Replaced model, which was analyzed right away.
+		b.buildPivots(info)
+	}
+	return info, nil
+}
+
+// DeregisterModel removes the collection and its data.
+func (b *Backend) DeregisterModel(collection string) apperror.Error {
+	info := b.ModelInfos().Find(collection)
+	if info == nil {
+		return b.BaseBackend.DeregisterModel(collection)
+	}
+
+	if err := b.BaseBackend.DeregisterModel(collection); err != nil {
+		return err
+	}
+
+	delete(b.data, info.Collection())
+	for _, relation := range info.Relations() {
+		if relation.RelationType() == db.RELATION_TYPE_M2M {
+			delete(b.data, relation.BackendName())
+		}
+	}
+	return nil
 }
 
-func (b *Backend) Build() {
-	b.BaseBackend.Build()
+func (b *Backend) Build() apperror.Error {
+	if err := b.BaseBackend.Build(); err != nil {
+		return err
+	}
 
-	// Add an id field to m2m collections.
 	for _, info := range b.ModelInfos() {
-		for _, relation := range info.Relations() {
-			if relation.RelationType() != db.RELATION_TYPE_M2M {
-				continue
-			}
+		b.buildPivots(info)
+	}
 
-			m2mCol := b.ModelInfo(relation.BackendName())
-			attr := &db.Attribute{}
-			attr.SetName("id")
-			attr.SetBackendName("id")
-			attr.SetMarshalName("id")
-			attr.SetIsPrimaryKey(true)
-			attr.SetIsUnique(true)
-			attr.SetType(reflect.TypeOf(""))
-			m2mCol.AddAttribute(attr)
+	return nil
+}
+
+// buildPivots adds an id field to the m2m collections of a model.
+func (b *Backend) buildPivots(info *db.ModelInfo) {
+	for _, relation := range info.Relations() {
+		if relation.RelationType() != db.RELATION_TYPE_M2M {
+			continue
+		}
 
+		m2mCol := relation.PivotInfo()
+		attr := &db.Attribute{}
+		attr.SetName("id")
+		attr.SetBackendName("id")
+		attr.SetMarshalName("id")
+		attr.SetIsPrimaryKey(true)
+		attr.SetIsUnique(true)
+		attr.SetType(reflect.TypeOf(""))
+		m2mCol.AddAttribute(attr)
+
+		if _, ok := b.data[relation.BackendName()]; !ok {
 			b.data[relation.BackendName()] = make(map[string]interface{})
 		}
 	}
 }
 
-func (b *Backend) sort(info *db.ModelInfo, items *reflector.SliceReflector, field Expression, asc bool) apperror.Error {
+func (b *Backend) sort(info *db.ModelInfo, items *reflector.SliceReflector, sort *SortExpr) (*reflector.SliceReflector, apperror.Error) {
+	field := sort.Expression()
+	if order, ok := field.(*CaseExpr); ok {
+		return b.sortByKey(info, items, sort.Ascending(), func(item *reflector.Reflector) (interface{}, apperror.Error) {
+			return b.caseValue(info, item, order)
+		})
+	} else if stmt, ok := field.(*SelectStmt); ok {
+		// Relation count built by Query.SortByRelationCount().
+		return b.sortByKey(info, items, sort.Ascending(), func(item *reflector.Reflector) (interface{}, apperror.Error) {
+			return b.relationCount(info, item, stmt)
+		})
+	}
+
 	fieldName := ""
 	if id, ok := field.(*IdentifierExpr); ok {
 		fieldName = id.Identifier()
 	} else if id, ok := field.(*ColFieldIdentifierExpr); ok {
 		if id.Collection() != info.Collection() {
-			return apperror.New("unsupported_sort", fmt.Sprint("The memory backend does not support sorting with joined collections"))
+			return nil, apperror.New("unsupported_sort", fmt.Sprint("The memory backend does not support sorting with joined collections"))
 		}
 		fieldName = id.Field()
 	} else {
-		return apperror.New("unsupported_sort", fmt.Sprintf("The memory backend does not support sorting with custom field expressions"))
+		return nil, apperror.New("unsupported_sort", fmt.Sprintf("The memory backend does not support sorting with custom field expressions"))
 	}
 
 	attr := info.FindAttribute(fieldName)
 	if attr == nil {
-		return apperror.New("invalid_sort", fmt.Sprintf("Invalid sort for inexistant field %v", fieldName))
+		return nil, apperror.New("invalid_sort", fmt.Sprintf("Invalid sort for inexistant field %v", fieldName))
 	}
 
-	if err := items.SortByField(attr.Name(), asc); err != nil {
-		return apperror.Wrap(err, "sort_error")
+	// Strings, including nullable ones, are ordered by the collation.
+	typ := attr.Type()
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
 	}
+	collated := b.collation != COLLATION_BINARY && typ != nil && typ.Kind() == reflect.String
 
-	return nil
+	sortValues := func(items *reflector.SliceReflector) (*reflector.SliceReflector, apperror.Error) {
+		if collated {
+			return b.sortByKey(info, items, sort.Ascending(), func(item *reflector.Reflector) (interface{}, apperror.Error) {
+				val, err := b.itemValue(info, item, attr)
+				if err != nil {
+					return nil, err
+				}
+				if v := reflect.ValueOf(val); v.Kind() == reflect.Ptr && !v.IsNil() {
+					val = v.Elem().Interface()
+				}
+				return b.collate(val), nil
+			})
+		}
+
+		if err := items.SortByField(attr.Name(), sort.Ascending()); err != nil {
+			return nil, apperror.Wrap(err, "sort_error")
+		}
+		return items, nil
+	}
+
+	nulls := sort.Nulls()
+	if nulls == NULLS_DEFAULT {
+		if !collated {
+			return sortValues(items)
+		}
+		// Collated values can not be compared to nil, so nil values are
+		// placed like Postgres does: last in ascending order.
+		nulls = NULLS_LAST
+		if !sort.Ascending() {
+			nulls = NULLS_FIRST
+		}
+	}
+
+	// Separate nil values, sort the rest and place the nils according to
+	// the nulls placement.
+	nils := reflector.R(info.Item()).NewSlice()
+	values := reflector.R(info.Item()).NewSlice()
+	for _, item := range items.Items() {
+		val, err := b.itemValue(info, item, attr)
+		if err != nil {
+			return nil, err
+		}
+
+		target := values
+		if isNil(val) {
+			target = nils
+		}
+		if err := target.AppendValue(item.Interface()); err != nil {
+			return nil, apperror.Wrap(err, "slice_append_error")
+		}
+	}
+
+	values, err := sortValues(values)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := values, nils
+	if nulls == NULLS_FIRST {
+		first, last = nils, values
+	}
+	for _, item := range last.Items() {
+		if err := first.AppendValue(item.Interface()); err != nil {
+			return nil, apperror.Wrap(err, "slice_append_error")
+		}
+	}
+
+	return first, nil
+}
+
+// keySorter sorts items by keys that are computed once per item, like the
+// value of a CASE expression, a relation count or a collated string.
+type keySorter struct {
+	items     []*reflector.Reflector
+	keys      []interface{}
+	ascending bool
+	err       error
+}
+
+func (s *keySorter) Len() int {
+	return len(s.items)
+}
+
+func (s *keySorter) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+func (s *keySorter) Less(i, j int) bool {
+	x, y := s.keys[i], s.keys[j]
+	if !s.ascending {
+		x, y = y, x
+	}
+	flag, err := reflector.R(x).CompareTo(y, OPERATOR_LT)
+	if err != nil {
+		s.err = err
+	}
+	return flag
+}
+
+// sortByKey sorts items by a computed key, like the value of a CASE
+// expression created by Query.OrderByIds(), the relation count of
+// Query.SortByRelationCount() or a collated string.
+func (b *Backend) sortByKey(info *db.ModelInfo, items *reflector.SliceReflector, ascending bool, keyFunc func(*reflector.Reflector) (interface{}, apperror.Error)) (*reflector.SliceReflector, apperror.Error) {
+	sorter := &keySorter{ascending: ascending}
+	for _, item := range items.Items() {
+		key, err := keyFunc(item)
+		if err != nil {
+			return nil, err
+		}
+		sorter.items = append(sorter.items, item)
+		sorter.keys = append(sorter.keys, key)
+	}
+
+	sort.Stable(sorter)
+	if sorter.err != nil {
+		return nil, apperror.Wrap(sorter.err, "sort_error")
+	}
+
+	sorted := reflector.R(info.Item()).NewSlice()
+	for _, item := range sorter.items {
+		if err := sorted.AppendValue(item.Interface()); err != nil {
+			return nil, apperror.Wrap(err, "slice_append_error")
+		}
+	}
+	return sorted, nil
+}
+
+// caseValue evaluates a CASE expression for an item.
+// Only value results are supported.
+func (b *Backend) caseValue(info *db.ModelInfo, item *reflector.Reflector, order *CaseExpr) (interface{}, apperror.Error) {
+	result := order.Else()
+	for i, when := range order.Whens() {
+		flag, err := b.filterItem(info, item, when)
+		if err != nil {
+			return nil, err
+		}
+		if flag {
+			result = order.Thens()[i]
+			break
+		}
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+	val, ok := result.(*ValueExpr)
+	if !ok {
+		return nil, apperror.New("unsupported_case", "The memory backend only supports CASE expressions with value results")
+	}
+	return val.Value(), nil
+}
+
+// setJSONPath sets the value at the path in a marshalled field value by
+// encoding it to JSON, setting the key, and decoding it into a new value of
+// the field type.
+func setJSONPath(current interface{}, typ reflect.Type, path []string, value interface{}) (interface{}, apperror.Error) {
+	var doc map[string]interface{}
+	if !isNil(current) {
+		encoded, err := json.Marshal(current)
+		if err != nil {
+			return nil, apperror.Wrap(err, "json_marshal_error")
+		}
+		if err := json.Unmarshal(encoded, &doc); err != nil {
+			return nil, apperror.Wrap(err, "json_unmarshal_error")
+		}
+	}
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+
+	// Walk the path, creating missing objects.
+	parent := doc
+	for _, key := range path[:len(path)-1] {
+		child, ok := parent[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			parent[key] = child
+		}
+		parent = child
+	}
+	parent[path[len(path)-1]] = value
+
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, apperror.Wrap(err, "json_marshal_error")
+	}
+	newVal := reflect.New(typ)
+	if err := json.Unmarshal(encoded, newVal.Interface()); err != nil {
+		return nil, apperror.Wrap(err, "json_unmarshal_error")
+	}
+	return newVal.Elem().Interface(), nil
+}
+
+// arrayFilter checks if the slice val contains the clause value, or the
+// values of a clause slice.
+// For OPERATOR_CONTAINS all values must be contained, for OPERATOR_OVERLAPS
+// any of them.
+func arrayFilter(val, clauseValue interface{}, operator string) (bool, apperror.Error) {
+	items := reflect.ValueOf(val)
+	if items.Kind() != reflect.Slice {
+		return false, apperror.New("invalid_array_filter", fmt.Sprintf("Operator %v requires an array field", operator))
+	}
+
+	values := []interface{}{clauseValue}
+	if v := reflect.ValueOf(clauseValue); v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		values = values[:0]
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, v.Index(i).Interface())
+		}
+	}
+
+	for _, value := range values {
+		found := false
+		for i := 0; i < items.Len(); i++ {
+			flag, err := reflector.R(items.Index(i).Interface()).CompareTo(value, OPERATOR_EQ)
+			if err != nil {
+				return false, apperror.Wrap(err, "compare_error")
+			}
+			if flag {
+				found = true
+				break
+			}
+		}
+
+		if found && operator == OPERATOR_OVERLAPS {
+			return true, nil
+		} else if !found && operator == OPERATOR_CONTAINS {
+			return false, nil
+		}
+	}
+	return operator == OPERATOR_CONTAINS, nil
+}
+
+// isOrderingOperator returns true for the operators that compare the order
+// of values, which depends on the collation for strings.
+func isOrderingOperator(operator string) bool {
+	switch operator {
+	case OPERATOR_LT, OPERATOR_LTE, OPERATOR_GT, OPERATOR_GTE:
+		return true
+	}
+	return false
+}
+
+// truncDate truncates a time value to the start of its day, week, month or
+// year. Weeks start on Monday, like in PostgreSQL.
+func truncDate(val interface{}, unit string) (interface{}, apperror.Error) {
+	if isNil(val) {
+		return nil, nil
+	}
+	t, ok := reflect.Indirect(reflect.ValueOf(val)).Interface().(time.Time)
+	if !ok {
+		return nil, apperror.New("date_trunc_error", fmt.Sprintf("Can not truncate %T to a %v", val, unit))
+	}
+
+	switch unit {
+	case DATE_TRUNC_DAY:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()), nil
+	case DATE_TRUNC_WEEK:
+		// time.Weekday starts with Sunday as 0.
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location()), nil
+	case DATE_TRUNC_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()), nil
+	case DATE_TRUNC_YEAR:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location()), nil
+	}
+	return nil, apperror.New("invalid_date_trunc_unit", fmt.Sprintf("Unknown date_trunc unit %v", unit))
+}
+
+// castValue converts a value to the Go type that corresponds to a database
+// type, like CAST(value AS type) does in SQL databases.
+// Nil values stay nil.
+func castValue(val interface{}, targetType string) (interface{}, apperror.Error) {
+	if isNil(val) {
+		return nil, nil
+	}
+	val = reflect.Indirect(reflect.ValueOf(val)).Interface()
+
+	typ := strings.ToLower(strings.TrimSpace(targetType))
+	if index := strings.Index(typ, "("); index != -1 {
+		// Strip a length or precision, like varchar(255).
+		typ = strings.TrimSpace(typ[:index])
+	}
+
+	str, isStr := val.(string)
+	str = strings.TrimSpace(str)
+
+	var result interface{}
+	var err error
+
+	switch typ {
+	case "int", "integer", "bigint", "smallint":
+		if isStr {
+			result, err = strconv.ParseInt(str, 10, 64)
+		} else {
+			result, err = reflector.R(val).ConvertTo(int64(0))
+		}
+
+	case "float", "real", "double precision", "numeric", "decimal":
+		if isStr {
+			result, err = strconv.ParseFloat(str, 64)
+		} else {
+			result, err = reflector.R(val).ConvertTo(float64(0))
+		}
+
+	case "bool", "boolean":
+		if isStr {
+			result, err = strconv.ParseBool(str)
+		} else {
+			result, err = reflector.R(val).ConvertTo(false)
+		}
+
+	case "text", "varchar", "char", "string":
+		if t, ok := val.(time.Time); ok {
+			return t.Format(time.RFC3339), nil
+		}
+		return fmt.Sprint(val), nil
+
+	case "date", "timestamp", "timestamptz":
+		t, ok := val.(time.Time)
+		if !ok && isStr {
+			if t, err = time.Parse(time.RFC3339, str); err != nil {
+				t, err = time.Parse("2006-01-02", str)
+			}
+		} else if !ok {
+			err = fmt.Errorf("can not cast %T to %v", val, typ)
+		}
+		if typ == "date" && err == nil {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		}
+		result = t
+
+	default:
+		return nil, apperror.New("unsupported_cast", fmt.Sprintf("The memory backend does not support casts to %v", targetType))
+	}
+
+	if err != nil {
+		return nil, apperror.Wrap(err, "cast_error", fmt.Sprintf("Could not cast %v to %v", val, targetType))
+	}
+	return result, nil
+}
+
+// isNil returns true if the value is nil or a nil pointer, map or slice.
+func isNil(val interface{}) bool {
+	v := reflect.ValueOf(val)
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
 }
 
 func (b *Backend) filter(info *db.ModelInfo, items *reflector.SliceReflector, filter Expression) (*reflector.SliceReflector, apperror.Error) {
@@ -166,68 +647,933 @@ func (b *Backend) filterItem(info *db.ModelInfo, item *reflector.Reflector, filt
 			return !flag, nil
 		}
 
-	case FilterExpression:
-		field := f.Field()
+	case *CursorExpr:
+		if err := f.Validate(); err != nil {
+			return false, err
+		}
+		return b.filterItem(info, item, f.Expand())
+
+	case *SearchExpr:
+		// Case insensitive substring matching in any of the fields.
+		term := strings.ToLower(f.Term())
+		for _, field := range f.Expressions() {
+			attr, err := b.fieldAttribute(info, field)
+			if err != nil {
+				return false, err
+			}
+			val, err := b.itemValue(info, item, attr)
+			if err != nil {
+				return false, err
+			}
+			if !isNil(val) && strings.Contains(strings.ToLower(fmt.Sprint(val)), term) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case FilterExpression:
+		// Like in SQL databases, an empty IN list never matches.
+		if IsEmptyInFilter(f) {
+			return false, nil
+		}
+
+		field := f.Field()
+
+		// Support relation counts built by Query.HavingCount().
+		if stmt, ok := field.(*SelectStmt); ok {
+			count, err := b.relationCount(info, item, stmt)
+			if err != nil {
+				return false, err
+			}
+			valExpr, ok := f.Clause().(*ValueExpr)
+			if !ok {
+				return false, apperror.New("unsupported_filter_clause", fmt.Sprintf("The memory backend does not support filtering with custom clause expressions"))
+			}
+			flag, err2 := reflector.R(count).CompareTo(valExpr.Value(), f.Operator())
+			if err2 != nil {
+				return false, apperror.Wrap(err2, "compare_error")
+			}
+			return flag, nil
+		}
+
+		// Support comparisons of computed fields, like CAST(field AS int).
+		switch field.(type) {
+		case *CastExpr, *DateTruncExpr:
+			return b.filterComputed(info, item, field, f)
+		}
+
+		// Support case insensitive comparisons with LOWER(field).
+		lower := false
+		if fn, ok := field.(*FunctionExpr); ok && strings.ToUpper(fn.Function()) == "LOWER" {
+			lower = true
+			field = fn.Expression()
+		}
+
+		fieldName := ""
+
+		if id, ok := field.(*IdentifierExpr); ok {
+			fieldName = id.Identifier()
+		} else if id, ok := field.(*ColFieldIdentifierExpr); ok {
+			if id.Collection() != info.Collection() {
+				return false, apperror.New("unsupported_filter", fmt.Sprint("The memory backend does not support filtering with joined collections"))
+			}
+			fieldName = id.Field()
+		} else {
+			return false, apperror.New("unsupported_filter", fmt.Sprintf("The memory backend does not support filtering with custom field expressions"))
+		}
+
+		attr := info.FindAttribute(fieldName)
+		if attr == nil {
+			return false, apperror.New("invalid_filter", fmt.Sprintf("Invalid filter for inexistant field %v", fieldName))
+		}
+
+		operator := f.Operator()
+
+		if IsNullOperator(operator) {
+			// Nil pointers and zero values are treated as NULL.
+			val, err := b.itemValue(info, item, attr)
+			if err != nil {
+				return false, err
+			}
+			null := isNil(val) || reflector.R(val).IsZero()
+			return null == (operator == OPERATOR_IS_NULL), nil
+		}
+
+		clauseValue, err := filterClauseValue(f.Clause())
+		if err != nil {
+			return false, err
+		}
+
+		if IsArrayOperator(operator) {
+			val, err := b.itemValue(info, item, attr)
+			if err != nil {
+				return false, err
+			}
+			return arrayFilter(val, clauseValue, operator)
+		}
+
+		if b.collation != COLLATION_BINARY && isOrderingOperator(operator) {
+			if str, ok := clauseValue.(string); ok {
+				val, err := b.itemValue(info, item, attr)
+				if err != nil {
+					return false, err
+				}
+				if _, ok := val.(string); ok {
+					flag, err2 := reflector.R(b.collate(val)).CompareTo(b.collate(str), operator)
+					if err2 != nil {
+						return false, apperror.Wrap(err2, "compare_error")
+					}
+					return flag, nil
+				}
+			}
+		}
+
+		if lower {
+			val, err := b.itemValue(info, item, attr)
+			if err != nil {
+				return false, err
+			}
+			flag, err2 := reflector.R(strings.ToLower(fmt.Sprint(val))).CompareTo(clauseValue, operator)
+			if err2 != nil {
+				return false, apperror.Wrap(err2, "compare_error")
+			}
+			return flag, nil
+		}
+
+		if info.StructName() != "" {
+			b.Logger().Infof("filtering item with %v %v %v", fieldName, operator, clauseValue)
+			s, err := item.Struct()
+			if err != nil {
+				return false, apperror.Wrap(err, "invalid_model_error")
+			}
+			flag, err := s.Field(attr.Name()).CompareTo(clauseValue, operator)
+			if err != nil {
+				return false, apperror.Wrap(err, "compare_error")
+			}
+			return flag, nil
+		} else {
+			// Assume a map.
+			if !item.IsMap() {
+				return false, apperror.New("filter_invalid_model", "Could not filter because model value is neither struct nor map.")
+			}
+			flag, err := reflector.R(item.Value().MapIndex(reflect.ValueOf(attr.BackendName()))).CompareTo(clauseValue, operator)
+			if err != nil {
+				return false, apperror.Wrap(err, "compare_error")
+			}
+			return flag, nil
+		}
+
+	default:
+		b.Logger().Panicf("Unhandled filter expression: %v", reflect.TypeOf(filter))
+	}
+
+	return false, nil
+}
+
+// filterComputed evaluates a filter on a cast or date_trunc field.
+// Like in SQL, comparisons with a NULL value are false.
+func (b *Backend) filterComputed(info *db.ModelInfo, item *reflector.Reflector, field Expression, f FilterExpression) (bool, apperror.Error) {
+	val, err := b.computedItemValue(info, item, field)
+	if err != nil {
+		return false, err
+	}
+
+	if IsNullOperator(f.Operator()) {
+		return isNil(val) == (f.Operator() == OPERATOR_IS_NULL), nil
+	}
+
+	clauseValue, err := filterClauseValue(f.Clause())
+	if err != nil {
+		return false, err
+	}
+	if isNil(val) || isNil(clauseValue) {
+		return false, nil
+	}
+
+	flag, err2 := reflector.R(val).CompareTo(clauseValue, f.Operator())
+	if err2 != nil {
+		return false, apperror.Wrap(err2, "compare_error")
+	}
+	return flag, nil
+}
+
+// computedItemValue returns the value of a field for an item.
+// Casts and date truncations of fields are computed from the field value.
+func (b *Backend) computedItemValue(info *db.ModelInfo, item *reflector.Reflector, expr Expression) (interface{}, apperror.Error) {
+	switch e := expr.(type) {
+	case *CastExpr:
+		val, err := b.computedItemValue(info, item, e.Expression())
+		if err != nil {
+			return nil, err
+		}
+		return castValue(val, e.TargetType())
+
+	case *DateTruncExpr:
+		if err := e.Validate(); err != nil {
+			return nil, err
+		}
+		val, err := b.computedItemValue(info, item, e.Expression())
+		if err != nil {
+			return nil, err
+		}
+		return truncDate(val, e.Unit())
+	}
+
+	attr, err := b.fieldAttribute(info, expr)
+	if err != nil {
+		return nil, err
+	}
+	return b.itemValue(info, item, attr)
+}
+
+// filterClauseValue returns the value of a filter clause, which must either
+// be a value or a cast of a value.
+func filterClauseValue(clause Expression) (interface{}, apperror.Error) {
+	switch c := clause.(type) {
+	case *ValueExpr:
+		return c.Value(), nil
+	case *CastExpr:
+		val, err := filterClauseValue(c.Expression())
+		if err != nil {
+			return nil, err
+		}
+		return castValue(val, c.TargetType())
+	}
+	return nil, apperror.New("unsupported_filter_clause", "The memory backend does not support filtering with custom clause expressions")
+}
+
+// relationCount evaluates a correlated COUNT subquery for an item.
+// Only subqueries filtering a field of the counted collection by a field of
+// the item are supported, as built by Query.HavingCount().
+func (b *Backend) relationCount(info *db.ModelInfo, item *reflector.Reflector, stmt *SelectStmt) (int, apperror.Error) {
+	countInfo := b.ModelInfos().Find(stmt.Collection())
+	if countInfo == nil {
+		return 0, apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with backend", stmt.Collection()))
+	}
+
+	filter, ok := stmt.Filter().(*Filter)
+	if !ok {
+		return 0, apperror.New("unsupported_filter", "The memory backend only supports simple relation count subqueries")
+	}
+	countField, ok1 := filter.Field().(*ColFieldIdentifierExpr)
+	itemField, ok2 := filter.Clause().(*ColFieldIdentifierExpr)
+	if !ok1 || !ok2 {
+		return 0, apperror.New("unsupported_filter", "The memory backend only supports simple relation count subqueries")
+	}
+
+	countAttr, err := b.fieldAttribute(countInfo, countField)
+	if err != nil {
+		return 0, err
+	}
+	itemAttr, err := b.fieldAttribute(info, itemField)
+	if err != nil {
+		return 0, err
+	}
+
+	val, err := b.itemValue(info, item, itemAttr)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, related := range b.data[countInfo.Collection()] {
+		relatedVal, err := b.itemValue(countInfo, reflector.R(related), countAttr)
+		if err != nil {
+			return 0, err
+		}
+		if relatedVal == nil {
+			continue
+		}
+		flag, err2 := reflector.R(relatedVal).CompareTo(val, OPERATOR_EQ)
+		if err2 != nil {
+			return 0, apperror.Wrap(err2, "compare_error")
+		}
+		if flag {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// fieldAttribute returns the attribute referenced by a field identifier
+// expression.
+func (b *Backend) fieldAttribute(info *db.ModelInfo, expr Expression) (*db.Attribute, apperror.Error) {
+	fieldName := ""
+	if id, ok := expr.(*IdentifierExpr); ok {
+		fieldName = id.Identifier()
+	} else if id, ok := expr.(*ColFieldIdentifierExpr); ok {
+		if id.Collection() != "" && id.Collection() != info.Collection() && id.Collection() != info.BackendName() {
+			return nil, apperror.New("unsupported_field", "The memory backend does not support fields of joined collections")
+		}
+		fieldName = id.Field()
+	} else {
+		return nil, apperror.New("unsupported_field", "The memory backend does not support custom field expressions")
+	}
+
+	attr := info.FindAttribute(fieldName)
+	if attr == nil {
+		return nil, apperror.New("unknown_field", fmt.Sprintf("The collection %v does not have a field %v", info.Collection(), fieldName))
+	}
+	return attr, nil
+}
+
+// itemValue returns the value of an attribute for a struct or map item.
+func (b *Backend) itemValue(info *db.ModelInfo, item *reflector.Reflector, attr *db.Attribute) (interface{}, apperror.Error) {
+	if info.HasStruct() {
+		s, err := item.Struct()
+		if err != nil {
+			return nil, apperror.Wrap(err, "invalid_model_error")
+		}
+		return s.Field(attr.Name()).Interface(), nil
+	}
+
+	if v := item.Value().MapIndex(reflect.ValueOf(attr.BackendName())); v.IsValid() {
+		return v.Interface(), nil
+	}
+	return nil, nil
+}
+
+// applyDefaults sets attributes without a value to their default value,
+// like the column defaults of SQL databases do.
+func (b *Backend) applyDefaults(info *db.ModelInfo, obj interface{}) apperror.Error {
+	for _, attr := range info.Attributes() {
+		defaultVal := attr.DefaultValue()
+		if defaultVal == nil {
+			continue
+		}
+
+		if info.HasStruct() {
+			s, err := reflector.R(obj).Struct()
+			if err != nil {
+				return apperror.Wrap(err, "invalid_model_error")
+			}
+			field := s.Field(attr.Name())
+			if !field.IsZero() {
+				continue
+			}
+			if err := field.SetValue(defaultVal, true); err != nil {
+				msg := fmt.Sprintf("Invalid default value (%v) for %v.%v", defaultVal, info.Collection(), attr.Name())
+				return apperror.Wrap(err, "invalid_default_value", msg)
+			}
+			continue
+		}
+
+		mapObj := obj.(map[string]interface{})
+		if val, ok := mapObj[attr.BackendName()]; ok && val != nil && !reflector.R(val).IsZero() {
+			continue
+		}
+		if attr.Type() != nil {
+			converted, err := reflector.R(defaultVal).ConvertTo(reflect.Zero(attr.Type()).Interface())
+			if err != nil {
+				msg := fmt.Sprintf("Invalid default value (%v) for %v.%v", defaultVal, info.Collection(), attr.Name())
+				return apperror.Wrap(err, "invalid_default_value", msg)
+			}
+			defaultVal = converted
+		}
+		mapObj[attr.BackendName()] = defaultVal
+	}
+
+	return nil
+}
+
+// itemId returns the key of an item in the data, which is the canonical
+// string form of its primary key. See strId().
+func (b *Backend) itemId(info *db.ModelInfo, item interface{}) (string, apperror.Error) {
+	if m, ok := item.(map[string]interface{}); ok {
+		return b.strId(info, m[info.PkAttribute().BackendName()])
+	}
+	return info.DetermineModelStrId(item)
+}
+
+// strId converts a primary key value to the key used in the data.
+// The value is converted to the type of the primary key first, so that
+// "1", 1 and uint64(1) all result in the key of the stored item, just
+// like for DetermineModelStrId().
+// Returns an empty string for zero values.
+func (b *Backend) strId(info *db.ModelInfo, id interface{}) (string, apperror.Error) {
+	if isNil(id) || reflector.R(id).IsZero() {
+		return "", nil
+	}
+	converted, err := reflector.R(id).ConvertTo(info.PkAttribute().Type())
+	if err != nil {
+		return "", apperror.Wrap(err, "id_conversion_error")
+	}
+	return fmt.Sprint(converted), nil
+}
+
+// nextId generates a new id for a collection that is not used yet.
+// Like database sequences, the ids of deleted items are never reused.
+func (b *Backend) nextId(collection string) string {
+	next := b.lastIds[collection] + 1
+	for {
+		id := strconv.Itoa(next)
+		if _, ok := b.data[collection][id]; !ok {
+			b.lastIds[collection] = next
+			return id
+		}
+		next++
+	}
+}
+
+// itemKey builds a key from the values of the given attributes that is
+// equal for items with equal values.
+func (b *Backend) itemKey(info *db.ModelInfo, item *reflector.Reflector, attrs []*db.Attribute) (string, apperror.Error) {
+	key := ""
+	for _, attr := range attrs {
+		val, err := b.itemValue(info, item, attr)
+		if err != nil {
+			return "", err
+		}
+		key += fmt.Sprintf("%#v|", val)
+	}
+	return key, nil
+}
+
+// checkUniqueWith returns a unique_constraint_violation error if an item
+// already exists with the same values for the fields of a unique-with constraint.
+// The item with the id excludeId, which is being updated, is skipped.
+func (b *Backend) checkUniqueWith(info *db.ModelInfo, obj interface{}, excludeId string) apperror.Error {
+	for _, attr := range info.Attributes() {
+		if len(attr.IsUniqueWith()) < 1 {
+			continue
+		}
+
+		attrs := []*db.Attribute{attr}
+		for _, name := range attr.IsUniqueWith() {
+			attrs = append(attrs, info.FindAttribute(name))
+		}
+
+		key, err := b.itemKey(info, reflector.R(obj), attrs)
+		if err != nil {
+			return err
+		}
+
+		for id, item := range b.data[info.Collection()] {
+			if id == excludeId {
+				continue
+			}
+			itemKey, err := b.itemKey(info, reflector.R(item), attrs)
+			if err != nil {
+				return err
+			}
+			if itemKey == key {
+				msg := fmt.Sprintf("A %v with the same values for %v already exists", info.Collection(), attr.Name())
+				return apperror.New("unique_constraint_violation", msg)
+			}
+		}
+	}
+
+	return nil
+}
+
+// windowValues computes the window function, cast and date_trunc fields of
+// a select.
+// The result maps the field names to the values of the items, keyed by the
+// primary key of the item.
+func (b *Backend) windowValues(info *db.ModelInfo, items *reflector.SliceReflector, fields []Expression) (map[string]map[string]interface{}, apperror.Error) {
+	values := make(map[string]map[string]interface{})
+	for _, field := range fields {
+		sel, ok := field.(*FieldSelectorExpr)
+		if !ok {
+			continue
+		}
+
+		switch sel.Expression().(type) {
+		case *CastExpr, *DateTruncExpr:
+			vals := make(map[string]interface{})
+			for _, item := range items.Items() {
+				val, err := b.computedItemValue(info, item, sel.Expression())
+				if err != nil {
+					return nil, err
+				}
+				id, err := b.itemKey(info, item, info.PkAttributes())
+				if err != nil {
+					return nil, err
+				}
+				vals[id] = val
+			}
+			values[sel.Name()] = vals
+			continue
+		}
+
+		window, ok := sel.Expression().(*WindowExpr)
+		if !ok {
+			continue
+		}
+
+		vals, err := b.window(info, items, window)
+		if err != nil {
+			return nil, err
+		}
+		values[sel.Name()] = vals
+	}
+	return values, nil
+}
+
+// window computes a ROW_NUMBER or RANK window function for each item,
+// keyed by the primary key of the item.
+func (b *Backend) window(info *db.ModelInfo, items *reflector.SliceReflector, window *WindowExpr) (map[string]interface{}, apperror.Error) {
+	function := strings.ToUpper(window.Function())
+	if function != WINDOW_ROW_NUMBER && function != WINDOW_RANK {
+		return nil, apperror.New("unsupported_window_function", fmt.Sprintf("The memory backend does not support the window function %v", window.Function()))
+	}
+	if len(window.Sorts()) > 1 {
+		return nil, apperror.New("unsupported_window_sort", "The memory backend only supports windows with a single sort")
+	}
+
+	partitionAttrs := make([]*db.Attribute, 0)
+	for _, expr := range window.PartitionBy() {
+		attr, err := b.fieldAttribute(info, expr)
+		if err != nil {
+			return nil, err
+		}
+		partitionAttrs = append(partitionAttrs, attr)
+	}
+
+	partitions := make(map[string]*reflector.SliceReflector)
+	for _, item := range items.Items() {
+		key, err := b.itemKey(info, item, partitionAttrs)
+		if err != nil {
+			return nil, err
+		}
+		partition, ok := partitions[key]
+		if !ok {
+			partition = reflector.R(info.Item()).NewSlice()
+			partitions[key] = partition
+		}
+		if err := partition.AppendValue(item.Interface()); err != nil {
+			return nil, apperror.Wrap(err, "slice_append_error")
+		}
+	}
+
+	pk := info.PkAttributes()
+	values := make(map[string]interface{})
+	for _, partition := range partitions {
+		var sortAttr *db.Attribute
+		if len(window.Sorts()) == 1 {
+			sorted, err := b.sort(info, partition, window.Sorts()[0])
+			if err != nil {
+				return nil, err
+			}
+			partition = sorted
+
+			if sortAttr, err = b.fieldAttribute(info, window.Sorts()[0].Expression()); err != nil {
+				return nil, err
+			}
+		}
+
+		// Rows with equal sort values share the same rank.
+		rank := 1
+		var previous interface{}
+		for index, item := range partition.Items() {
+			var val interface{}
+			if sortAttr != nil {
+				var err apperror.Error
+				if val, err = b.itemValue(info, item, sortAttr); err != nil {
+					return nil, err
+				}
+			}
+			if index > 0 && !reflect.DeepEqual(val, previous) {
+				rank = index + 1
+			}
+			previous = val
+
+			id, err := b.itemKey(info, item, pk)
+			if err != nil {
+				return nil, err
+			}
+			if function == WINDOW_ROW_NUMBER {
+				values[id] = index + 1
+			} else {
+				values[id] = rank
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// windowRow converts an item to a map that holds the computed window
+// function fields.
+func (b *Backend) windowRow(info *db.ModelInfo, item *reflector.Reflector, windows map[string]map[string]interface{}) (map[string]interface{}, apperror.Error) {
+	row := make(map[string]interface{})
+	if info.HasStruct() {
+		data, err := info.ModelToMap(item.Interface(), false, false, true)
+		if err != nil {
+			return nil, err
+		}
+		row = data
+	} else {
+		for key, val := range item.Interface().(map[string]interface{}) {
+			row[key] = val
+		}
+	}
+
+	id, err := b.itemKey(info, item, info.PkAttributes())
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range windows {
+		row[name] = values[id]
+	}
+	return row, nil
+}
+
+// group collapses the items so that only the first item for each distinct
+// combination of the group by field values is kept.
+// The returned counts hold the size of each group, keyed by the primary key
+// of the kept item.
+func (b *Backend) group(info *db.ModelInfo, items *reflector.SliceReflector, groups []Expression) (*reflector.SliceReflector, map[string]interface{}, apperror.Error) {
+	grouped := reflector.R(info.Item()).NewSlice()
+	// firstIds maps the group keys to the primary key of the kept item.
+	firstIds := make(map[string]string)
+	counts := make(map[string]interface{})
+	for _, item := range items.Items() {
+		key := ""
+		for _, group := range groups {
+			val, err := b.computedItemValue(info, item, group)
+			if err != nil {
+				return nil, nil, err
+			}
+			key += fmt.Sprintf("%#v|", val)
+		}
+
+		if id, ok := firstIds[key]; ok {
+			counts[id] = counts[id].(int) + 1
+			continue
+		}
+
+		id, err := b.itemKey(info, item, info.PkAttributes())
+		if err != nil {
+			return nil, nil, err
+		}
+		firstIds[key] = id
+		counts[id] = 1
+
+		if err := grouped.AppendValue(item.Interface()); err != nil {
+			return nil, nil, apperror.Wrap(err, "slice_append_error")
+		}
+	}
+
+	return grouped, counts, nil
+}
+
+// havingItem applies a having filter to the first item of a group.
+// COUNT(*) filters are compared with the size of the group, all other
+// filters are handled by filterItem().
+func (b *Backend) havingItem(info *db.ModelInfo, item *reflector.Reflector, counts map[string]interface{}, having Expression) (bool, apperror.Error) {
+	switch f := having.(type) {
+	case *AndExpr:
+		for _, e := range f.Expressions() {
+			if flag, err := b.havingItem(info, item, counts, e); err != nil || !flag {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case *OrExpr:
+		for _, e := range f.Expressions() {
+			if flag, err := b.havingItem(info, item, counts, e); err != nil || flag {
+				return flag, err
+			}
+		}
+		return false, nil
+
+	case *NotExpr:
+		flag, err := b.havingItem(info, item, counts, f.Not())
+		if err != nil {
+			return false, err
+		}
+		return !flag, nil
+
+	case *Filter:
+		fn, ok := f.Field().(*FunctionExpr)
+		if !ok || strings.ToUpper(fn.Function()) != "COUNT" {
+			break
+		}
+		valExpr, ok := f.Clause().(*ValueExpr)
+		if !ok {
+			return false, apperror.New("unsupported_filter_clause", "The memory backend does not support having filters with custom clause expressions")
+		}
+
+		id, err := b.itemKey(info, item, info.PkAttributes())
+		if err != nil {
+			return false, err
+		}
+		flag, err2 := reflector.R(counts[id]).CompareTo(valExpr.Value(), f.Operator())
+		if err2 != nil {
+			return false, apperror.Wrap(err2, "compare_error")
+		}
+		return flag, nil
+	}
+
+	return b.filterItem(info, item, having)
+}
+
+// aggregate computes the SUM, AVG, MIN, MAX and COUNT fields of a select over
+// all items. Returns nil if the select has no aggregate fields.
+func (b *Backend) aggregate(info *db.ModelInfo, items *reflector.SliceReflector, fields []Expression) (map[string]interface{}, apperror.Error) {
+	var row map[string]interface{}
+	for _, field := range fields {
+		sel, ok := field.(*FieldSelectorExpr)
+		if !ok {
+			continue
+		}
+		fn, ok := sel.Expression().(*FunctionExpr)
+		if !ok {
+			continue
+		}
+		function := strings.ToUpper(fn.Function())
+		switch function {
+		case "SUM", "AVG", "MIN", "MAX", "COUNT":
+		default:
+			continue
+		}
+
+		if row == nil {
+			row = make(map[string]interface{})
+		}
+		if function == "COUNT" {
+			row[sel.Name()] = items.Len()
+			continue
+		}
+
+		attr, err := b.fieldAttribute(info, fn.Expression())
+		if err != nil {
+			return nil, err
+		}
+
+		var result interface{}
+		sum := float64(0)
+		count := 0
+		for _, item := range items.Items() {
+			val, err := b.itemValue(info, item, attr)
+			if err != nil {
+				return nil, err
+			}
+			if isNil(val) {
+				continue
+			}
+			val = reflect.Indirect(reflect.ValueOf(val)).Interface()
+
+			// MIN and MAX of dates keep the time value.
+			if t, ok := val.(time.Time); ok && (function == "MIN" || function == "MAX") {
+				if count == 0 || (function == "MIN" && t.Before(result.(time.Time))) || (function == "MAX" && t.After(result.(time.Time))) {
+					result = t
+				}
+				count++
+				continue
+			}
+
+			num, err2 := reflector.R(val).ConvertTo(float64(0))
+			if err2 != nil {
+				return nil, apperror.Wrap(err2, "aggregate_conversion_error")
+			}
+			x := num.(float64)
+
+			if count == 0 || (function == "MIN" && x < result.(float64)) || (function == "MAX" && x > result.(float64)) {
+				result = x
+			}
+			sum += x
+			count++
+		}
+
+		if count > 0 {
+			if function == "SUM" {
+				result = sum
+			} else if function == "AVG" {
+				result = sum / float64(count)
+			}
+		}
+		row[sel.Name()] = result
+	}
+
+	return row, nil
+}
+
+// groupCountField returns the field selector of COUNT(*) fields, which are
+// computed per group for grouped selects.
+func groupCountField(field Expression) (*FieldSelectorExpr, bool) {
+	sel, ok := field.(*FieldSelectorExpr)
+	if !ok {
+		return nil, false
+	}
+	fn, ok := sel.Expression().(*FunctionExpr)
+	if !ok || strings.ToUpper(fn.Function()) != "COUNT" {
+		return nil, false
+	}
+	return sel, true
+}
+
+// distinct keeps only the first item for each distinct combination of the
+// selected field values.
+// Returns the remaining items and the attributes of the selected fields.
+func (b *Backend) distinct(info *db.ModelInfo, items *reflector.SliceReflector, fields []Expression) (*reflector.SliceReflector, []*db.Attribute, apperror.Error) {
+	attrs := make([]*db.Attribute, 0)
+	for _, field := range fields {
+		if sel, ok := field.(*FieldSelectorExpr); ok {
+			field = sel.Expression()
+		}
+		attr, err := b.fieldAttribute(info, field)
+		if err != nil {
+			return nil, nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+
+	distinctItems := reflector.R(info.Item()).NewSlice()
+	seen := make(map[string]bool)
+	for _, item := range items.Items() {
+		key, err := b.itemKey(info, item, attrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if err := distinctItems.AppendValue(item.Interface()); err != nil {
+			return nil, nil, apperror.Wrap(err, "slice_append_error")
+		}
+	}
 
-		fieldName := ""
+	return distinctItems, attrs, nil
+}
 
-		if id, ok := field.(*IdentifierExpr); ok {
-			fieldName = id.Identifier()
-		} else if id, ok := field.(*ColFieldIdentifierExpr); ok {
-			if id.Collection() != info.Collection() {
-				return false, apperror.New("unsupported_filter", fmt.Sprint("The memory backend does not support filtering with joined collections"))
-			}
-			fieldName = id.Field()
-		} else {
-			return false, apperror.New("unsupported_filter", fmt.Sprintf("The memory backend does not support filtering with custom field expressions"))
+// distinctOn keeps only the first item for each distinct combination of the
+// distinct field values, according to the sorts that do not refer to
+// the distinct fields.
+func (b *Backend) distinctOn(info *db.ModelInfo, items *reflector.SliceReflector, distinct []Expression, sorts []*SortExpr) (*reflector.SliceReflector, apperror.Error) {
+	distinctAttrs := make([]*db.Attribute, 0)
+	distinctNames := make(map[string]bool)
+	for _, expr := range distinct {
+		attr, err := b.fieldAttribute(info, expr)
+		if err != nil {
+			return nil, err
 		}
+		distinctAttrs = append(distinctAttrs, attr)
+		distinctNames[attr.Name()] = true
+	}
 
-		attr := info.FindAttribute(fieldName)
-		if attr == nil {
-			return false, apperror.New("invalid_filter", fmt.Sprintf("Invalid filter for inexistant field %v", fieldName))
+	orderAttrs := make([]*db.Attribute, 0)
+	orderAsc := make([]bool, 0)
+	for _, sort := range sorts {
+		attr, err := b.fieldAttribute(info, sort.Expression())
+		if err != nil {
+			return nil, err
 		}
+		if !distinctNames[attr.Name()] {
+			orderAttrs = append(orderAttrs, attr)
+			orderAsc = append(orderAsc, sort.Ascending())
+		}
+	}
 
-		operator := f.Operator()
-
-		var clauseValue interface{}
+	keys := make([]string, 0)
+	selected := make(map[string]*reflector.Reflector)
+	for _, item := range items.Items() {
+		key, err := b.itemKey(info, item, distinctAttrs)
+		if err != nil {
+			return nil, err
+		}
 
-		if valExpr, ok := f.Clause().(*ValueExpr); ok {
-			clauseValue = valExpr.Value()
-		} else {
-			return false, apperror.New("unsupported_filter_clause", fmt.Sprintf("The memory backend does not support filtering with custom clause expressions"))
+		current, ok := selected[key]
+		if !ok {
+			keys = append(keys, key)
+			selected[key] = item
+			continue
 		}
 
-		if info.StructName() != "" {
-			b.Logger().Infof("filtering item with %v %v %v", fieldName, operator, clauseValue)
-			s, err := item.Struct()
+		// Check if the item comes before the currently selected one.
+		for index, attr := range orderAttrs {
+			val, err := b.itemValue(info, item, attr)
 			if err != nil {
-				return false, apperror.Wrap(err, "invalid_model_error")
+				return nil, err
 			}
-			flag, err := s.Field(attr.Name()).CompareTo(clauseValue, operator)
+			currentVal, err := b.itemValue(info, current, attr)
 			if err != nil {
-				return false, apperror.Wrap(err, "compare_error")
+				return nil, err
 			}
-			return flag, nil
-		} else {
-			// Assume a map.
-			if !item.IsMap() {
-				return false, apperror.New("filter_invalid_model", "Could not filter because model value is neither struct nor map.")
+
+			equal, err2 := reflector.R(val).CompareTo(currentVal, OPERATOR_EQ)
+			if err2 != nil {
+				return nil, apperror.Wrap(err2, "compare_error")
 			}
-			flag, err := reflector.R(item.Value().MapIndex(reflect.ValueOf(attr.BackendName()))).CompareTo(clauseValue, operator)
-			if err != nil {
-				return false, apperror.Wrap(err, "compare_error")
+			if equal {
+				continue
 			}
-			return flag, nil
+
+			greater, err2 := reflector.R(val).CompareTo(currentVal, OPERATOR_GT)
+			if err2 != nil {
+				return nil, apperror.Wrap(err2, "compare_error")
+			}
+			if greater != orderAsc[index] {
+				selected[key] = item
+			}
+			break
 		}
+	}
 
-	default:
-		b.Logger().Panicf("Unhandled filter expression: %v", reflect.TypeOf(filter))
+	result := reflector.R(info.Item()).NewSlice()
+	for _, key := range keys {
+		if err := result.AppendValue(selected[key].Interface()); err != nil {
+			return nil, apperror.Wrap(err, "slice_append_error")
+		}
 	}
 
-	return false, nil
+	return result, nil
 }
 
 func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
+	if err := b.Context().Err(); err != nil {
+		code := "context_canceled"
+		if err == context.DeadlineExceeded {
+			code = "context_deadline_exceeded"
+		}
+		return nil, apperror.Wrap(err, code, "Context of the backend is done")
+	}
+
 	switch s := statement.(type) {
 	case *CreateCollectionStmt:
 		col := s.Collection()
@@ -239,12 +1585,15 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 	case *RenameCollectionStmt:
 		b.data[s.NewName()] = b.data[s.Collection()]
 		delete(b.data, s.Collection())
+		b.lastIds[s.NewName()] = b.lastIds[s.Collection()]
+		delete(b.lastIds, s.Collection())
 
 	case *DropFieldStmt:
 		// No-op.
 
 	case *DropCollectionStmt:
 		delete(b.data, s.Collection())
+		delete(b.lastIds, s.Collection())
 
 	case *CreateFieldStmt:
 		// No-op.
@@ -264,6 +1613,10 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 			return nil, apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with backend", s.Collection()))
 		}
 
+		if s.IndexHint() != "" {
+			b.Logger().Debugf("Ignoring index hint %v: not supported by the memory backend", s.IndexHint())
+		}
+
 		collection := info.Collection()
 		b.Logger().Infof("all data: %+v", b.data)
 		allData := b.data[collection]
@@ -285,13 +1638,82 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 			}
 		}
 
-		if sorts := s.Sorts(); len(sorts) > 1 {
+		sorts := s.Sorts()
+		if distinct := s.DistinctOn(); len(distinct) > 0 {
+			if distinctItems, err := b.distinctOn(info, items, distinct, sorts); err != nil {
+				return nil, err
+			} else {
+				items = distinctItems
+			}
+
+			// The result only needs to be sorted by the leading sort now.
+			if len(sorts) > 1 {
+				sorts = sorts[:1]
+			}
+		}
+
+		// Aggregates without grouping return a single row, computed on the
+		// rows picked by DISTINCT ON.
+		if len(s.GroupBy()) == 0 {
+			row, err := b.aggregate(info, items, s.Fields())
+			if err != nil {
+				return nil, err
+			} else if row != nil {
+				return []interface{}{row}, nil
+			}
+		}
+
+		// Window functions are computed on the filtered items.
+		windows, err := b.windowValues(info, items, s.Fields())
+		if err != nil {
+			return nil, err
+		}
+
+		// distinctAttrs holds the selected fields of a SELECT DISTINCT.
+		var distinctAttrs []*db.Attribute
+		if s.IsDistinct() && len(s.Fields()) > 0 {
+			distinctItems, attrs, err := b.distinct(info, items, s.Fields())
+			if err != nil {
+				return nil, err
+			}
+			items = distinctItems
+			distinctAttrs = attrs
+		}
+
+		if len(sorts) > 1 {
 			panic("Memory backend does not support sorting by more than one field")
 		} else if len(sorts) == 1 {
 			b.Logger().Infof("Sorting with %+v", sorts[0])
-			if err := b.sort(info, items, sorts[0].Expression(), sorts[0].Ascending()); err != nil {
+			sortedItems, err := b.sort(info, items, sorts[0])
+			if err != nil {
+				return nil, err
+			}
+			items = sortedItems
+		}
+
+		if groups := s.GroupBy(); len(groups) > 0 {
+			groupedItems, counts, err := b.group(info, items, groups)
+			if err != nil {
 				return nil, err
 			}
+			items = groupedItems
+
+			if having := s.Having(); having != nil {
+				filtered, err := items.FilterBy(func(item *reflector.Reflector) (bool, error) {
+					return b.havingItem(info, item, counts, having)
+				})
+				if err != nil {
+					return nil, apperror.Wrap(err, "filter_error")
+				}
+				items = filtered
+			}
+
+			// Per group counts are returned like window function values.
+			for _, field := range s.Fields() {
+				if sel, ok := groupCountField(field); ok {
+					windows[sel.Name()] = counts
+				}
+			}
 		}
 
 		if offset := s.Offset(); offset > 0 {
@@ -326,6 +1748,27 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 
 		ifSlice := make([]interface{}, items.Len(), items.Len())
 		for i, item := range items.Items() {
+			if distinctAttrs != nil {
+				// Distinct rows only contain the selected fields.
+				row := make(map[string]interface{})
+				for _, attr := range distinctAttrs {
+					val, err := b.itemValue(info, item, attr)
+					if err != nil {
+						return nil, err
+					}
+					row[attr.BackendName()] = val
+				}
+				ifSlice[i] = row
+				continue
+			}
+			if len(windows) > 0 {
+				row, err := b.windowRow(info, item, windows)
+				if err != nil {
+					return nil, err
+				}
+				ifSlice[i] = row
+				continue
+			}
 			ifSlice[i] = item.Interface()
 		}
 		b.Logger().Infof("if slice %+v", ifSlice)
@@ -355,10 +1798,12 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 			if err != nil {
 				return nil, err
 			}
-			if id == "" {
+			if id == "" && info.HasCompositePk() {
+				return nil, apperror.New("missing_composite_id",
+					fmt.Sprintf("All primary key fields of %v must be set on create", collection), true)
+			} else if id == "" {
 				// Empty id, so create a new one and update the model.
-				intId := len(b.data[collection]) + 1
-				id = strconv.Itoa(intId)
+				id = b.nextId(collection)
 				if err := info.SetModelId(obj, id); err != nil {
 					return nil, err
 				}
@@ -367,29 +1812,90 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 		} else {
 			// Map instead of struct.
 			mapObj := obj.(map[string]interface{})
-			rawId := mapObj[info.PkAttribute().BackendName()]
-			idRefl := reflector.R(rawId)
-
-			id := ""
-			if idRefl.IsZero() {
-				intId := len(b.data[collection]) + 1
-				id = strconv.Itoa(intId)
-				mapObj[info.PkAttribute().BackendName()] = id
-			} else {
-				strId, err := idRefl.ConvertTo("")
-				if err != nil {
-					return nil, apperror.Wrap(err, "id_conversion_error")
-				}
-				mapObj[info.PkAttribute().BackendName()] = strId.(string)
+			pk := info.PkAttribute()
+
+			id, err := b.strId(info, mapObj[pk.BackendName()])
+			if err != nil {
+				return nil, err
+			}
+			if id == "" {
+				id = b.nextId(collection)
 			}
 
+			// Store the id with the type of the primary key.
+			typedId, err2 := reflector.R(id).ConvertTo(pk.Type())
+			if err2 != nil {
+				return nil, apperror.Wrap(err2, "id_conversion_error")
+			}
+			mapObj[pk.BackendName()] = typedId
+
 			obj = mapObj
 			newId = id
 		}
 
+		if err := b.applyDefaults(info, obj); err != nil {
+			return nil, err
+		}
+
+		if err := b.checkUniqueWith(info, obj, ""); err != nil {
+			return nil, err
+		}
+
 		b.data[collection][newId] = obj
 		b.Logger().Infof("created model %+v", obj)
 
+	case *UpsertStmt:
+		if s.ConflictConstraint() != "" {
+			return nil, apperror.New("unsupported_upsert_constraint",
+				"The memory backend does not support named constraints as upsert conflict target")
+		}
+
+		info := b.ModelInfos().Find(s.Collection())
+		if info == nil {
+			return nil, apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with backend", s.Collection()))
+		}
+
+		attrs := make([]*db.Attribute, 0)
+		for _, field := range s.ConflictFields() {
+			attr, err := b.fieldAttribute(info, field)
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, attr)
+		}
+
+		obj := s.RawValue()
+		key, err := b.itemKey(info, reflector.R(obj), attrs)
+		if err != nil {
+			return nil, err
+		}
+
+		for id, item := range b.data[info.Collection()] {
+			itemKey, err := b.itemKey(info, reflector.R(item), attrs)
+			if err != nil {
+				return nil, err
+			}
+			if itemKey != key {
+				continue
+			}
+
+			// Conflict, so replace the existing row while keeping its id.
+			if info.HasStruct() {
+				if err := info.SetModelId(obj, id); err != nil {
+					return nil, err
+				}
+			} else {
+				obj.(map[string]interface{})[info.PkAttribute().BackendName()] = id
+			}
+			b.data[info.Collection()][id] = obj
+			return nil, nil
+		}
+
+		// No conflict, so create a new row.
+		create := NewCreateStmt(s.Collection(), s.Values())
+		create.SetRawValue(obj)
+		return b.exec(create)
+
 	case *UpdateStmt:
 
 		obj := s.RawValue()
@@ -397,10 +1903,13 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 		if err == nil {
 			// Direct update for one model.
 			// So just update the model in the data.
-			id, err := info.DetermineModelStrId(obj)
+			id, err := b.itemId(info, obj)
 			if err != nil {
 				return nil, err
 			}
+			if err := b.checkUniqueWith(info, obj, id); err != nil {
+				return nil, err
+			}
 			b.data[info.Collection()][id] = obj
 
 			// All done.
@@ -408,106 +1917,240 @@ func (b *Backend) exec(statement Expression) ([]interface{}, apperror.Error) {
 		}
 
 		// Must be a custom update with a select.
-
-		info = b.ModelInfos().Find(s.Collection())
-		if info == nil {
-			return nil, apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with backend", s.Collection()))
+		if _, err := b.updateItems(s); err != nil {
+			return nil, err
 		}
 
-		// Execute select query to find items.
-		items, err := b.exec(s.Select())
-		if err != nil {
+	case *DeleteStmt:
+		if _, err := b.deleteItems(s); err != nil {
 			return nil, err
 		}
 
-		slice := reflector.R(items).MustSlice()
+	default:
+		panic(fmt.Sprintf("Unhandled statement type: %v", reflect.TypeOf(statement)))
+	}
+
+	return nil, nil
+}
 
-		// Determine update data.
-		var data map[string]interface{}
-		if d, ok := s.RawValue().(map[string]interface{}); ok {
-			// Data supplied as raw value.
-			data = d
-		} else {
-			// Build a map with the fields values to update.
-			data = make(map[string]interface{})
-			for _, field := range s.Values() {
-				expr, ok := field.Field().(*IdentifierExpr)
-				if !ok {
-					return nil, apperror.New("unsupported_field_expression",
-						"The memory backend does not support custom field expressions")
-				}
-				valExpr, ok := field.Value().(*ValueExpr)
-				if !ok {
-					return nil, apperror.New("unsupported_field_value_expression",
-						"The memory backend does not support custom field value expressions")
-				}
+// updateItems applies an update statement with a select to the matched
+// items and returns the number of updated items.
+func (b *Backend) updateItems(s *UpdateStmt) (int64, apperror.Error) {
+	info := b.ModelInfos().Find(s.Collection())
+	if info == nil {
+		return 0, apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with backend", s.Collection()))
+	}
 
-				attr := info.FindAttribute(expr.Identifier())
-				if attr == nil {
-					return nil, apperror.New("unknown_field",
-						fmt.Sprintf("The collection %v does not have a field %v", info.Collection(), expr.Identifier()))
+	// Execute select query to find items.
+	items, err := b.exec(s.Select())
+	if err != nil {
+		return 0, err
+	}
+
+	slice := reflector.R(items).MustSlice()
+
+	// Determine update data.
+	var data map[string]interface{}
+	jsonSets := make(map[string]*JSONSetExpr)
+	if d, ok := s.RawValue().(map[string]interface{}); ok {
+		// Data supplied as raw value.
+		// Keys may be struct field names or backend names.
+		data = make(map[string]interface{})
+		for key, val := range d {
+			if attr := info.FindAttribute(key); attr != nil {
+				if info.HasStruct() {
+					key = attr.Name()
+				} else {
+					key = attr.BackendName()
 				}
+			}
+			data[key] = val
+		}
+	} else {
+		// Build a map with the fields values to update.
+		data = make(map[string]interface{})
+		for _, field := range s.Values() {
+			expr, ok := field.Field().(*IdentifierExpr)
+			if !ok {
+				return 0, apperror.New("unsupported_field_expression",
+					"The memory backend does not support custom field expressions")
+			}
 
+			attr := info.FindAttribute(expr.Identifier())
+			if attr == nil {
+				return 0, apperror.New("unknown_field",
+					fmt.Sprintf("The collection %v does not have a field %v", info.Collection(), expr.Identifier()))
+			}
+
+			switch valExpr := field.Value().(type) {
+			case *ValueExpr:
 				data[attr.Name()] = valExpr.Value()
+			case *JSONSetExpr:
+				// Applied to each item below.
+				jsonSets[attr.Name()] = valExpr
+			default:
+				return 0, apperror.New("unsupported_field_value_expression",
+					"The memory backend does not support custom field value expressions")
 			}
 		}
+	}
 
-		// Update each item with the new data.
-		for _, item := range slice.Items() {
-			if item.IsStruct() || item.IsStructPtr() {
-				s := item.MustStruct()
+	// Update each item with the new data.
+	count := int64(0)
+	for _, item := range slice.Items() {
+		count++
+		if item.IsStruct() || item.IsStructPtr() {
+			s := item.MustStruct()
 
-				for key, val := range data {
-					if err := s.Field(key).SetValue(val); err != nil {
-						return nil, apperror.Wrap(err, "struct_field_update_error")
-					}
+			for key, val := range data {
+				if err := s.Field(key).SetValue(val); err != nil {
+					return 0, apperror.Wrap(err, "struct_field_update_error")
 				}
-			} else if item.IsMap() {
-				for key, val := range data {
-					if err := item.SetStrMapKeyValue(key, val, true); err != nil {
-						return nil, apperror.Wrap(err, "struct_field_update_error")
-					}
+			}
+
+			for key, expr := range jsonSets {
+				field := s.Field(key)
+				val, err := setJSONPath(field.Interface(), info.Attribute(key).Type(), expr.Path(), expr.Value())
+				if err != nil {
+					return 0, err
+				}
+				if err := field.SetValue(val); err != nil {
+					return 0, apperror.Wrap(err, "struct_field_update_error")
+				}
+			}
+		} else if item.IsMap() {
+			for key, val := range data {
+				if err := item.SetStrMapKeyValue(key, val, true); err != nil {
+					return 0, apperror.Wrap(err, "struct_field_update_error")
+				}
+			}
+
+			for key, expr := range jsonSets {
+				attr := info.Attribute(key)
+				current, err := b.itemValue(info, item, attr)
+				if err != nil {
+					return 0, err
+				}
+				val, err := setJSONPath(current, attr.Type(), expr.Path(), expr.Value())
+				if err != nil {
+					return 0, err
+				}
+				if err := item.SetStrMapKeyValue(attr.BackendName(), val, true); err != nil {
+					return 0, apperror.Wrap(err, "struct_field_update_error")
 				}
 			}
 		}
+	}
 
-	case *DeleteStmt:
-		info := b.ModelInfos().Find(s.Collection())
+	return count, nil
+}
+
+// deleteItems deletes the items matched by a delete statement and returns
+// the number of deleted items.
+func (b *Backend) deleteItems(s *DeleteStmt) (int64, apperror.Error) {
+	info := b.ModelInfos().Find(s.Collection())
+
+	// Execute select query to find items.
+	items, err := b.exec(s.SelectStmt())
+	if err != nil {
+		return 0, err
+	}
 
-		// Execute select query to find items.
-		items, err := b.exec(s.SelectStmt())
+	count := int64(0)
+	slice := reflector.R(items).MustSlice()
+	for _, item := range slice.Items() {
+		id, err := b.itemId(info, item.Interface())
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 
-		slice := reflector.R(items).MustSlice()
-		for _, item := range slice.Items() {
-			id, err := info.DetermineModelStrId(item.Interface())
-			if err != nil {
-				return nil, err
-			}
-
+		if _, ok := b.data[info.Collection()][id]; ok {
 			delete(b.data[info.Collection()], id)
+			count++
 		}
-
-	default:
-		panic(fmt.Sprintf("Unhandled statement type: %v", reflect.TypeOf(statement)))
 	}
 
-	return nil, nil
+	return count, nil
 }
 
 func (b *Backend) Exec(statement Expression) apperror.Error {
-	_, err := b.exec(statement)
+	statement, err := b.InterceptStatement(statement)
+	if err != nil {
+		return err
+	}
+	_, err = b.exec(statement)
 	return err
 }
 
+// ExecCount executes the statement and returns the number of deleted or
+// updated items for delete and update statements, and 0 otherwise.
+func (b *Backend) ExecCount(statement Expression) (int64, apperror.Error) {
+	statement, err := b.InterceptStatement(statement)
+	if err != nil {
+		return 0, err
+	}
+
+	switch s := statement.(type) {
+	case *DeleteStmt:
+		return b.deleteItems(s)
+
+	case *UpdateStmt:
+		if info, err := b.InfoForModel(s.RawValue()); err == nil {
+			// Direct update of one model, which only affects an existing
+			// item.
+			id, err := b.itemId(info, s.RawValue())
+			if err != nil {
+				return 0, err
+			}
+			if _, ok := b.data[info.Collection()][id]; !ok {
+				return 0, nil
+			}
+			if _, err := b.exec(s); err != nil {
+				return 0, err
+			}
+			return 1, nil
+		}
+
+		return b.updateItems(s)
+	}
+
+	if _, err := b.exec(statement); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
 func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperror.Error) {
+	statement, err := b.InterceptQueryStatement(statement)
+	if err != nil {
+		return nil, err
+	}
 	return b.exec(statement)
 }
 
+// ExecQueryEach implements db.RowStreamBackend.
+// The rows are read from a snapshot of the result that is taken when the
+// query is executed, so fn may safely modify the collection.
+func (b *Backend) ExecQueryEach(statement FieldedExpression, fn func(row interface{}) apperror.Error) apperror.Error {
+	rows, err := b.ExecQuery(statement)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (b *Backend) Count(q *db.Query) (int, apperror.Error) {
-	items, err := b.Query(q)
+	if q.IsGrouped() {
+		// Count the groups without limit and offset.
+		return b.BaseBackend.Count(q)
+	}
+
+	items, err := b.Query(q.Clone())
 	if err != nil {
 		return 0, err
 	}
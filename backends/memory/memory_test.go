@@ -1,18 +1,563 @@
 package memory_test
 
 import (
+	"context"
+	"reflect"
+	"time"
+
 	. "github.com/onsi/ginkgo"
-	//. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega"
 
 	"github.com/theduke/go-apperror"
 	db "github.com/theduke/go-dukedb"
 	. "github.com/theduke/go-dukedb/backends/memory"
 	"github.com/theduke/go-dukedb/backends/tests"
+	"github.com/theduke/go-dukedb/expressions"
 )
 
+type DefaultsModel struct {
+	Id       uint64
+	Status   string `db:"default:open"`
+	Priority int    `db:"default:3"`
+}
+
+type ArrayModel struct {
+	Id   uint64
+	Tags []string `db:"array"`
+}
+
+type DatedModel struct {
+	Id        uint64
+	Name      string
+	CreatedAt time.Time
+}
+
+type IntPkModel struct {
+	Id   uint64
+	Name string
+}
+
+type StrPkModel struct {
+	Id   string
+	Name string
+}
+
+// OwnerType is a named string type for a polymorphic type field.
+type OwnerType string
+
+type TypedComment struct {
+	Id        uint64
+	OwnerType OwnerType
+	OwnerId   uint64
+	Owner     interface{} `db:"polymorphic:OwnerType:OwnerId"`
+}
+
+type NickModel struct {
+	Id   uint64
+	Nick *string
+}
+
+type JoinChild struct {
+	Id   uint64
+	Name string
+}
+
+type JoinParent struct {
+	Id      uint64
+	Child   *JoinChild
+	ChildId *uint64
+}
+
+// rowsBackend returns fixed rows from ExecQuery, as SQL backends return
+// map rows that still need to be converted to models.
+type rowsBackend struct {
+	*Backend
+	rows []interface{}
+}
+
+func (b *rowsBackend) ExecQuery(statement expressions.FieldedExpression) ([]interface{}, apperror.Error) {
+	return b.rows, nil
+}
+
 var _ = Describe("Memory", func() {
 	var skip = false
 	tests.TestBackend(&skip, func() (db.Backend, apperror.Error) {
 		return New(), nil
 	})
+
+	It("Should return an error when the context is canceled", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.Tag{})).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Expect(b.CreateCtx(ctx, &tests.Tag{Tag: "a"})).ToNot(HaveOccurred())
+
+		q := b.Q("tags")
+		res, err := b.QueryCtx(ctx, q)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		// The query stays bound to the backend.
+		Expect(q.GetBackend()).To(BeIdenticalTo(b))
+
+		cancel()
+		err = b.CreateCtx(ctx, &tests.Tag{Tag: "b"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("context_canceled"))
+
+		_, err = b.QueryCtx(ctx, b.Q("tags"))
+		Expect(err.GetCode()).To(Equal("context_canceled"))
+
+		// The backend itself is not affected.
+		Expect(b.Q("tags").Count()).To(Equal(1))
+	})
+
+	It("Should skip rows that can not be converted with .SkipErrors()", func() {
+		b := &rowsBackend{Backend: New()}
+		b.SetBackend(b)
+		Expect(b.RegisterAndBuild(&tests.MarshalledModel{})).ToNot(HaveOccurred())
+		b.rows = []interface{}{
+			map[string]interface{}{"id": uint64(1), "map_val": `{"a":"b"}`},
+			map[string]interface{}{"id": uint64(2), "map_val": "{invalid"},
+			map[string]interface{}{"id": uint64(3), "map_val": `{"c":"d"}`},
+		}
+
+		_, err := b.Q("marshalled_models").Find()
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("json_unmarshal_error"))
+
+		q := b.Q("marshalled_models").SkipErrors()
+		res, err := q.Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(2))
+		Expect(res[0].(*tests.MarshalledModel).Id).To(Equal(uint64(1)))
+		Expect(res[1].(*tests.MarshalledModel).MapVal).To(Equal(map[string]interface{}{"c": "d"}))
+		Expect(q.GetRowErrors()).To(HaveLen(1))
+		Expect(q.GetRowErrors()[0].GetCode()).To(Equal("json_unmarshal_error"))
+	})
+
+	It("Should return a stable dialect independent of the name", func() {
+		b := New()
+		b.SetName("custom")
+		Expect(b.Name()).To(Equal("custom"))
+		Expect(b.Dialect()).To(Equal("memory"))
+		Expect(b.Clone().Dialect()).To(Equal("memory"))
+	})
+
+	It("Should register type mappings", func() {
+		b := New()
+		codeType := reflect.TypeOf("")
+		_, ok := b.TypeMapping(codeType)
+		Expect(ok).To(BeFalse())
+
+		b.RegisterTypeMapping(codeType, "varchar(10)")
+		typ, ok := b.TypeMapping(codeType)
+		Expect(ok).To(BeTrue())
+		Expect(typ).To(Equal("varchar(10)"))
+
+		// Pointers fall back to the mapping of the element type.
+		typ, ok = b.TypeMapping(reflect.PtrTo(codeType))
+		Expect(ok).To(BeTrue())
+		Expect(typ).To(Equal("varchar(10)"))
+
+		_, ok = b.TypeMapping(nil)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Should count direct model updates only for existing models", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&IntPkModel{})).ToNot(HaveOccurred())
+		info, err := b.InfoForModel(&IntPkModel{})
+		Expect(err).ToNot(HaveOccurred())
+
+		update := func(m *IntPkModel) *expressions.UpdateStmt {
+			stmt := expressions.NewUpdateStmt(info.BackendName(), nil, info.ModelSelect(m))
+			stmt.SetRawValue(m)
+			return stmt
+		}
+
+		m := &IntPkModel{Name: "a"}
+		Expect(b.Create(m)).ToNot(HaveOccurred())
+		m.Name = "b"
+		count, err := b.ExecCount(update(m))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(int64(1)))
+
+		missing := &IntPkModel{Id: m.Id + 100, Name: "missing"}
+		count, err = b.ExecCount(update(missing))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+		Expect(b.Q(info.Collection()).Count()).To(Equal(1))
+	})
+
+	It("Should apply default values on create", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&DefaultsModel{})).ToNot(HaveOccurred())
+		info, err := b.InfoForModel(&DefaultsModel{})
+		Expect(err).ToNot(HaveOccurred())
+
+		m := &DefaultsModel{Priority: 1}
+		stmt := expressions.NewCreateStmt(info.BackendName(), nil)
+		stmt.SetRawValue(m)
+		Expect(b.Exec(stmt)).ToNot(HaveOccurred())
+		Expect(m.Id).ToNot(BeZero())
+		Expect(m.Status).To(Equal("open"))
+		Expect(m.Priority).To(Equal(1))
+
+		res, err := b.FindOne(info.Collection(), m.Id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.(*DefaultsModel).Status).To(Equal("open"))
+
+		m = &DefaultsModel{}
+		stmt = expressions.NewCreateStmt(info.BackendName(), nil)
+		stmt.SetRawValue(m)
+		Expect(b.Exec(stmt)).ToNot(HaveOccurred())
+		Expect(m.Priority).To(Equal(3))
+	})
+
+	It("Should upsert by conflict fields", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.Tag{})).ToNot(HaveOccurred())
+
+		tag := &tests.Tag{Tag: "go"}
+		Expect(b.Upsert(tag, "Tag")).ToNot(HaveOccurred())
+		Expect(tag.Id).ToNot(BeZero())
+
+		again := &tests.Tag{Tag: "go"}
+		Expect(b.Upsert(again, "Tag")).ToNot(HaveOccurred())
+		Expect(again.Id).To(Equal(tag.Id))
+
+		Expect(b.Upsert(&tests.Tag{Tag: "rust"}, "Tag")).ToNot(HaveOccurred())
+
+		count, err := b.Q("tags").Count()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(2))
+
+		err = b.Upsert(&tests.Tag{Tag: "go"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("no_conflict_fields"))
+	})
+
+	It("Should store and filter array fields", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&ArrayModel{})).ToNot(HaveOccurred())
+		Expect(b.ModelInfo("array_models").Attribute("Tags").BackendArray()).To(BeTrue())
+
+		m := &ArrayModel{Tags: []string{"go", "sql"}}
+		Expect(b.Create(m, &ArrayModel{Tags: []string{"rust"}})).ToNot(HaveOccurred())
+
+		res, err := b.FindOne("array_models", m.Id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.(*ArrayModel).Tags).To(Equal([]string{"go", "sql"}))
+
+		Expect(b.Q("array_models").FilterCond("tags", "contains", "go").Count()).To(Equal(1))
+		Expect(b.Q("array_models").FilterCond("tags", "contains", []string{"go", "sql"}).Count()).To(Equal(1))
+		Expect(b.Q("array_models").FilterCond("tags", "contains", []string{"go", "rust"}).Count()).To(Equal(0))
+		Expect(b.Q("array_models").FilterCond("tags", "overlaps", []string{"go", "rust"}).Count()).To(Equal(2))
+	})
+
+	It("Should assign joined models with nullable keys", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&JoinChild{}, &JoinParent{})).ToNot(HaveOccurred())
+
+		child := &JoinChild{Name: "child"}
+		Expect(b.Create(child)).ToNot(HaveOccurred())
+		withChild := &JoinParent{ChildId: &child.Id}
+		Expect(b.Create(withChild, &JoinParent{})).ToNot(HaveOccurred())
+
+		res, err := b.Q("join_parents").Join("Child").Sort("id", true).Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(2))
+		Expect(res[0].(*JoinParent).Child).ToNot(BeNil())
+		Expect(res[0].(*JoinParent).Child.Name).To(Equal("child"))
+		Expect(res[1].(*JoinParent).Child).To(BeNil())
+
+		// No base model has a key, so the join is skipped.
+		res, err = b.Q("join_parents").Filter("id", res[1].(*JoinParent).Id).Join("Child").Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		Expect(res[0].(*JoinParent).Child).To(BeNil())
+	})
+
+	It("Should query polymorphic owners with a named string type field", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.Tag{}, &TypedComment{})).ToNot(HaveOccurred())
+
+		tag := &tests.Tag{Tag: "a"}
+		Expect(b.Create(tag)).ToNot(HaveOccurred())
+		comment := &TypedComment{OwnerType: "tags", OwnerId: tag.Id}
+		Expect(b.Create(comment)).ToNot(HaveOccurred())
+
+		q, err := b.Related(comment, "Owner")
+		Expect(err).ToNot(HaveOccurred())
+		owner, err := q.First()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(owner.(*tests.Tag).Id).To(Equal(tag.Id))
+	})
+
+	It("Should not support raw queries", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.Tag{})).ToNot(HaveOccurred())
+
+		_, err := b.QueryRaw("tags", "SELECT * FROM tags")
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unsupported"))
+	})
+
+	It("Should return typed values for .MinValue() and .MaxValue() of dates", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&DatedModel{})).ToNot(HaveOccurred())
+
+		first := time.Date(2020, 1, 5, 10, 0, 0, 0, time.UTC)
+		last := time.Date(2021, 6, 1, 8, 30, 0, 0, time.UTC)
+		for _, date := range []time.Time{last, first, time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)} {
+			Expect(b.Create(&DatedModel{Name: "a", CreatedAt: date})).ToNot(HaveOccurred())
+		}
+
+		min, err := b.Q("dated_models").MinValue("created_at")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(min).To(Equal(first))
+
+		max, err := b.Q("dated_models").MaxValue("CreatedAt")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(max).To(Equal(last))
+
+		max, err = b.Q("dated_models").Filter("name", "none").MaxValue("created_at")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(max).To(BeNil())
+	})
+
+	It("Should aggregate the rows picked by .LatestPer()", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.TestModel{})).ToNot(HaveOccurred())
+		for _, val := range []int64{1, 1, 2} {
+			Expect(b.Create(&tests.TestModel{IntVal: val})).ToNot(HaveOccurred())
+		}
+
+		Expect(b.Q("test_models").Sum("int_val")).To(Equal(float64(4)))
+		Expect(b.Q("test_models").LatestPer("int_val", "id").Sum("int_val")).To(Equal(float64(3)))
+	})
+
+	Describe("Ids", func() {
+		var b *Backend
+
+		BeforeEach(func() {
+			b = New()
+			Expect(b.RegisterAndBuild(&IntPkModel{}, &StrPkModel{})).ToNot(HaveOccurred())
+		})
+
+		It("Should find models with int ids of any type", func() {
+			m1 := &IntPkModel{Name: "a"}
+			m2 := &IntPkModel{Name: "b"}
+			Expect(b.Create(m1, m2)).ToNot(HaveOccurred())
+
+			for _, id := range []interface{}{m2.Id, int(m2.Id), int64(m2.Id), "2"} {
+				m, err := b.FindOne("int_pk_models", id)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m).To(Equal(m2))
+			}
+		})
+
+		It("Should not reuse ids of deleted models", func() {
+			m1 := &IntPkModel{Name: "a"}
+			m2 := &IntPkModel{Name: "b"}
+			Expect(b.Create(m1, m2)).ToNot(HaveOccurred())
+			Expect(b.Delete(m1)).ToNot(HaveOccurred())
+
+			m3 := &IntPkModel{Name: "c"}
+			Expect(b.Create(m3)).ToNot(HaveOccurred())
+			Expect(m3.Id).ToNot(Equal(m2.Id))
+			Expect(b.Q("int_pk_models").Count()).To(Equal(2))
+
+			m, err := b.FindOne("int_pk_models", m2.Id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.(*IntPkModel).Name).To(Equal("b"))
+
+			// Deleting the model with the highest id must not free it.
+			Expect(b.Delete(m3)).ToNot(HaveOccurred())
+			m4 := &IntPkModel{Name: "d"}
+			Expect(b.Create(m4)).ToNot(HaveOccurred())
+			Expect(m4.Id).To(BeNumerically(">", m3.Id))
+		})
+
+		It("Should find models with string ids", func() {
+			m1 := &StrPkModel{Id: "abc", Name: "a"}
+			m2 := &StrPkModel{Name: "b"}
+			Expect(b.Create(m1, m2)).ToNot(HaveOccurred())
+			Expect(m2.Id).ToNot(BeEmpty())
+
+			m, err := b.FindOne("str_pk_models", "abc")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).To(Equal(m1))
+
+			m, err = b.FindOne("str_pk_models", m2.Id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).To(Equal(m2))
+		})
+	})
+
+	It("Should restore snapshots", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.Tag{})).ToNot(HaveOccurred())
+
+		tag := &tests.Tag{Tag: "seeded"}
+		Expect(b.Create(tag)).ToNot(HaveOccurred())
+		snapshot := b.Snapshot()
+
+		tag.Tag = "changed"
+		Expect(b.Update(tag)).ToNot(HaveOccurred())
+		Expect(b.Create(&tests.Tag{Tag: "b"})).ToNot(HaveOccurred())
+		Expect(b.Q("tags").Count()).To(Equal(2))
+
+		b.Restore(snapshot)
+		res, err := b.Q("tags").Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		Expect(res[0].(*tests.Tag).Tag).To(Equal("seeded"))
+
+		// Changes after restoring do not affect the snapshot.
+		Expect(b.Create(&tests.Tag{Tag: "c"})).ToNot(HaveOccurred())
+		b.Restore(snapshot)
+		Expect(b.Q("tags").Count()).To(Equal(1))
+	})
+
+	It("Should restore snapshots for all clones", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.Tag{})).ToNot(HaveOccurred())
+
+		tag := &tests.Tag{Tag: "seeded"}
+		Expect(b.Create(tag)).ToNot(HaveOccurred())
+		snapshot := b.Snapshot()
+
+		restorer := b.Clone().(*Backend)
+		reader := b.Clone().(*Backend)
+		Expect(reader.Create(&tests.Tag{Tag: "b"})).ToNot(HaveOccurred())
+
+		restorer.Restore(snapshot)
+		Expect(reader.Q("tags").Count()).To(Equal(1))
+		Expect(b.Q("tags").Count()).To(Equal(1))
+
+		// The id counter is restored as well.
+		next := &tests.Tag{Tag: "c"}
+		Expect(reader.Create(next)).ToNot(HaveOccurred())
+		Expect(next.Id).To(Equal(tag.Id + 1))
+	})
+
+	It("Should deeply copy snapshots", func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&ArrayModel{})).ToNot(HaveOccurred())
+
+		m := &ArrayModel{Tags: []string{"a", "b"}}
+		Expect(b.Create(m)).ToNot(HaveOccurred())
+		snapshot := b.Snapshot()
+
+		m.Tags[0] = "changed"
+		b.Restore(snapshot)
+
+		res, err := b.FindOne("array_models", m.Id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.(*ArrayModel).Tags).To(Equal([]string{"a", "b"}))
+	})
+
+	Describe("Collation", func() {
+		strVals := func(q *db.Query) []string {
+			res, err := q.Find()
+			Expect(err).ToNot(HaveOccurred())
+			vals := make([]string, 0)
+			for _, m := range res {
+				vals = append(vals, m.(*tests.TestModel).StrVal)
+			}
+			return vals
+		}
+
+		build := func() *Backend {
+			b := New()
+			Expect(b.RegisterAndBuild(&tests.TestModel{})).ToNot(HaveOccurred())
+			for _, val := range []string{"b", "C", "a"} {
+				Expect(b.Create(&tests.TestModel{StrVal: val})).ToNot(HaveOccurred())
+			}
+			return b
+		}
+
+		It("Should compare strings byte-wise by default", func() {
+			b := build()
+			Expect(b.Collation()).To(Equal(COLLATION_BINARY))
+			Expect(strVals(b.Q("test_models").Sort("str_val", true))).To(Equal([]string{"C", "a", "b"}))
+			Expect(strVals(b.Q("test_models").FilterCond("str_val", ">", "a"))).To(Equal([]string{"b"}))
+		})
+
+		It("Should compare strings case insensitively", func() {
+			b := build()
+			Expect(b.SetCollation(COLLATION_CASE_INSENSITIVE)).ToNot(HaveOccurred())
+			Expect(strVals(b.Q("test_models").Sort("str_val", true))).To(Equal([]string{"a", "b", "C"}))
+			Expect(strVals(b.Q("test_models").FilterCond("str_val", ">", "a"))).To(ConsistOf("b", "C"))
+
+			Expect(b.SetCollation("de_DE")).To(HaveOccurred())
+		})
+
+		It("Should place nulls when sorting collated strings", func() {
+			b := New()
+			Expect(b.RegisterAndBuild(&NickModel{})).ToNot(HaveOccurred())
+			Expect(b.SetCollation(COLLATION_CASE_INSENSITIVE)).ToNot(HaveOccurred())
+			for _, val := range []string{"b", "", "C", "a"} {
+				m := &NickModel{}
+				if val != "" {
+					nick := val
+					m.Nick = &nick
+				}
+				Expect(b.Create(m)).ToNot(HaveOccurred())
+			}
+
+			nicks := func(q *db.Query) []string {
+				res, err := q.Find()
+				Expect(err).ToNot(HaveOccurred())
+				vals := make([]string, 0)
+				for _, m := range res {
+					if nick := m.(*NickModel).Nick; nick != nil {
+						vals = append(vals, *nick)
+					} else {
+						vals = append(vals, "<nil>")
+					}
+				}
+				return vals
+			}
+
+			Expect(nicks(b.Q("nick_models").SortNulls("nick", true, true))).To(Equal([]string{"<nil>", "a", "b", "C"}))
+			Expect(nicks(b.Q("nick_models").SortNulls("nick", false, false))).To(Equal([]string{"C", "b", "a", "<nil>"}))
+			Expect(nicks(b.Q("nick_models").Sort("nick", true))).To(Equal([]string{"a", "b", "C", "<nil>"}))
+		})
+	})
+
+	Describe("Document collections", func() {
+		It("Should put, get and find documents", func() {
+			b := New()
+			Expect(b.RegisterDocumentCollection("docs", "key")).ToNot(HaveOccurred())
+			Expect(b.RegisterDocumentCollection("docs", "key")).To(HaveOccurred())
+
+			id, err := b.Put("docs", "", map[string]interface{}{"name": "a", "n": 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal("1"))
+			_, err = b.Put("docs", "x", map[string]interface{}{"name": "b", "n": 1})
+			Expect(err).ToNot(HaveOccurred())
+
+			doc, err := b.Get("docs", "1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(doc).To(Equal(map[string]interface{}{"key": "1", "name": "a", "n": 1}))
+
+			doc, err = b.Get("docs", "missing")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(doc).To(BeNil())
+
+			docs, err := b.FindDocuments("docs", "n", 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(docs).To(HaveLen(2))
+			Expect(docs[1]["name"]).To(Equal("b"))
+
+			docs, err = b.FindDocuments("docs", "name", "b")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(docs).To(HaveLen(1))
+
+			_, err = b.Get("unknown", "1")
+			Expect(err.GetCode()).To(Equal("unknown_collection"))
+		})
+	})
 })
@@ -0,0 +1,74 @@
+//go:build go1.18
+// +build go1.18
+
+package memory_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	db "github.com/theduke/go-dukedb"
+	. "github.com/theduke/go-dukedb/backends/memory"
+	"github.com/theduke/go-dukedb/backends/tests"
+)
+
+var _ = Describe("Repo", func() {
+	var repo *db.Repo[tests.Tag]
+
+	BeforeEach(func() {
+		b := New()
+		Expect(b.RegisterAndBuild(&tests.Tag{})).ToNot(HaveOccurred())
+		repo = db.MustNewRepo[tests.Tag](b)
+	})
+
+	It("Should use the collection of the model", func() {
+		Expect(repo.Collection()).To(Equal("tags"))
+	})
+
+	It("Should fail for unregistered models", func() {
+		_, err := db.NewRepo[tests.TestModel](New())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should create and find typed models", func() {
+		a := &tests.Tag{Tag: "a"}
+		b := &tests.Tag{Tag: "b"}
+		Expect(repo.Create(a, b)).ToNot(HaveOccurred())
+
+		tags, err := repo.Query(repo.Q().Sort("tag", true))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tags).To(HaveLen(2))
+		Expect(tags[0].Tag).To(Equal("a"))
+		Expect(tags[1].Tag).To(Equal("b"))
+
+		tag, err := repo.FindOne(b.Id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tag.Tag).To(Equal("b"))
+
+		tag, err = repo.FindOneBy("tag", "a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tag.Id).To(Equal(a.Id))
+
+		Expect(repo.Count()).To(Equal(2))
+	})
+
+	It("Should return nil if no model was found", func() {
+		tag, err := repo.FindOneBy("tag", "missing")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tag).To(BeNil())
+	})
+
+	It("Should update and delete typed models", func() {
+		tag := &tests.Tag{Tag: "a"}
+		Expect(repo.Create(tag)).ToNot(HaveOccurred())
+
+		tag.Tag = "b"
+		Expect(repo.Update(tag)).ToNot(HaveOccurred())
+		tags, err := repo.FindBy("tag", "b")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tags).To(HaveLen(1))
+
+		Expect(repo.Delete(tag)).ToNot(HaveOccurred())
+		Expect(repo.Find()).To(BeEmpty())
+	})
+})
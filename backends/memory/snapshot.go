@@ -0,0 +1,154 @@
+package memory
+
+import (
+	"reflect"
+)
+
+/**
+ * Snapshots.
+ *
+ * Snapshots capture the stored data of the backend, which allows tests to
+ * seed data once and reset the backend between test cases without
+ * re-registering models or re-creating collections.
+ */
+
+// Snapshot holds a copy of the data of a memory backend.
+// Create one with Backend.Snapshot().
+type Snapshot struct {
+	data    map[string]map[string]interface{}
+	lastIds map[string]int
+}
+
+// Snapshot returns a copy of the data currently stored in the backend.
+// Model registrations are not part of the snapshot.
+func (b *Backend) Snapshot() Snapshot {
+	lastIds := make(map[string]int, len(b.lastIds))
+	for collection, id := range b.lastIds {
+		lastIds[collection] = id
+	}
+
+	return Snapshot{
+		data:    copyData(b.data),
+		lastIds: lastIds,
+	}
+}
+
+// Restore resets the stored data and the generated ids to the state of the
+// snapshot.
+// Collections that were created after the snapshot was taken are kept, but
+// emptied.
+// The snapshot is copied, so it can be restored multiple times.
+// The data is updated in place, so clones of the backend see the restored
+// data as well.
+func (b *Backend) Restore(snapshot Snapshot) {
+	data := copyData(snapshot.data)
+	for collection, items := range b.data {
+		for id := range items {
+			delete(items, id)
+		}
+		for id, item := range data[collection] {
+			items[id] = item
+		}
+		delete(data, collection)
+	}
+	for collection, items := range data {
+		b.data[collection] = items
+	}
+
+	for collection := range b.lastIds {
+		delete(b.lastIds, collection)
+	}
+	for collection, id := range snapshot.lastIds {
+		b.lastIds[collection] = id
+	}
+}
+
+// copyData copies all collections and items of the data.
+func copyData(data map[string]map[string]interface{}) map[string]map[string]interface{} {
+	copied := make(map[string]map[string]interface{}, len(data))
+	for collection, items := range data {
+		copiedItems := make(map[string]interface{}, len(items))
+		for id, item := range items {
+			copiedItems[id] = copyItem(item)
+		}
+		copied[collection] = copiedItems
+	}
+	return copied
+}
+
+// copyItem returns a deep copy of a stored item, so that modifying the
+// models returned by queries, including slices, maps and pointers in their
+// fields, does not change the copy.
+func copyItem(item interface{}) interface{} {
+	if item == nil {
+		return nil
+	}
+	return deepCopy(reflect.ValueOf(item), make(map[uintptr]reflect.Value)).Interface()
+}
+
+// deepCopy recursively copies val.
+// Pointers that were already copied are looked up in copied, so that shared
+// and cyclic pointers keep their structure.
+// Unexported struct fields can not be set and are copied shallowly.
+func deepCopy(val reflect.Value, copied map[uintptr]reflect.Value) reflect.Value {
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			return val
+		}
+		if ptr, ok := copied[val.Pointer()]; ok {
+			return ptr
+		}
+		ptr := reflect.New(val.Elem().Type())
+		copied[val.Pointer()] = ptr
+		ptr.Elem().Set(deepCopy(val.Elem(), copied))
+		return ptr
+
+	case reflect.Interface:
+		if val.IsNil() {
+			return val
+		}
+		iface := reflect.New(val.Type()).Elem()
+		iface.Set(deepCopy(val.Elem(), copied))
+		return iface
+
+	case reflect.Struct:
+		s := reflect.New(val.Type()).Elem()
+		s.Set(val)
+		for i := 0; i < s.NumField(); i++ {
+			if field := s.Field(i); field.CanSet() {
+				field.Set(deepCopy(val.Field(i), copied))
+			}
+		}
+		return s
+
+	case reflect.Slice:
+		if val.IsNil() {
+			return val
+		}
+		slice := reflect.MakeSlice(val.Type(), val.Len(), val.Len())
+		for i := 0; i < val.Len(); i++ {
+			slice.Index(i).Set(deepCopy(val.Index(i), copied))
+		}
+		return slice
+
+	case reflect.Array:
+		arr := reflect.New(val.Type()).Elem()
+		for i := 0; i < val.Len(); i++ {
+			arr.Index(i).Set(deepCopy(val.Index(i), copied))
+		}
+		return arr
+
+	case reflect.Map:
+		if val.IsNil() {
+			return val
+		}
+		m := reflect.MakeMap(val.Type())
+		for _, key := range val.MapKeys() {
+			m.SetMapIndex(key, deepCopy(val.MapIndex(key), copied))
+		}
+		return m
+	}
+
+	return val
+}
@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"github.com/theduke/go-apperror"
+
+	db "github.com/theduke/go-dukedb"
+)
+
+/**
+ * Transactions.
+ *
+ * A transaction works on a copy of the data of the backend. Commit() writes
+ * the copy back, Rollback() discards it.
+ * Transactions are not isolated from each other: the last transaction to
+ * commit overwrites the changes of transactions that committed earlier.
+ */
+
+type transaction struct {
+	// data is the data of the backend the transaction was started on.
+	data map[string]map[string]interface{}
+	done bool
+}
+
+func (b *Backend) Begin() (db.Transaction, apperror.Error) {
+	if b.tx != nil {
+		panic("Can't call .Begin() on a transaction.")
+	}
+
+	copied := b.Clone().(*Backend)
+	copied.data = copyData(b.data)
+	copied.tx = &transaction{
+		data: b.data,
+	}
+
+	return copied, nil
+}
+
+// BeginTx starts a transaction.
+// The options are validated, but otherwise ignored: the memory backend has
+// no concurrent connections, and read only transactions are not enforced.
+func (b *Backend) BeginTx(opts *db.TxOptions) (db.Transaction, apperror.Error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return b.Begin()
+}
+
+func (b *Backend) MustBegin() db.Transaction {
+	tx, err := b.Begin()
+	if err != nil {
+		panic(err)
+	}
+	return tx
+}
+
+func (b *Backend) IsTransaction() bool {
+	return b.tx != nil
+}
+
+// Rollback discards the data of the transaction.
+func (b *Backend) Rollback() apperror.Error {
+	return b.finishTransaction()
+}
+
+// Commit replaces the data of the backend the transaction was started on
+// with the data of the transaction.
+func (b *Backend) Commit() apperror.Error {
+	if err := b.finishTransaction(); err != nil {
+		return err
+	}
+
+	// The data map is updated in place, since clones of the backend share it.
+	for collection := range b.tx.data {
+		if _, ok := b.data[collection]; !ok {
+			delete(b.tx.data, collection)
+		}
+	}
+	for collection, items := range b.data {
+		b.tx.data[collection] = items
+	}
+	return nil
+}
+
+// finishTransaction marks the transaction as done, and returns an error if
+// it is not running.
+func (b *Backend) finishTransaction() apperror.Error {
+	if b.tx == nil {
+		return apperror.New("no_transaction", "The backend is not a transaction")
+	} else if b.tx.done {
+		return apperror.New("transaction_done", "The transaction was already committed or rolled back")
+	}
+	b.tx.done = true
+	return nil
+}
@@ -24,6 +24,7 @@ type Backend struct {
 
 // Ensure Backend implements dukedb.Backend.
 var _ db.Backend = (*Backend)(nil)
+var _ db.RawQueryBackend = (*Backend)(nil)
 
 //var _ db.TransactionBackend = (*Backend)(nil)
 //var _ db.MigrationBackend = (*Backend)(nil)
@@ -54,6 +55,10 @@ func New(host, database, user, password string) (*Backend, apperror.Error) {
 	return b, nil
 }
 
+func (b *Backend) Dialect() string {
+	return "orientdb"
+}
+
 func (b *Backend) HasStringIds() bool {
 	return true
 }
@@ -64,12 +69,14 @@ func (b *Backend) HasNativeJoins() bool {
 
 func (b *Backend) Clone() db.Backend {
 	base := b.BaseBackend.Clone()
-	return &Backend{
+	copied := &Backend{
 		BaseBackend:      *base,
 		Db:               b.Db,
 		translator:       b.translator,
 		migrationHandler: b.migrationHandler,
 	}
+	copied.SetBackend(copied)
+	return copied
 }
 
 func (b *Backend) analyzeAllRelations() apperror.Error {
@@ -109,20 +116,29 @@ func (b *Backend) analyzeRelations(info *db.ModelInfo) apperror.Error {
 	return nil
 }
 
-func (b *Backend) Build() {
+func (b *Backend) Build() apperror.Error {
 	if err := b.analyzeAllRelations(); err != nil {
-		panic(err)
+		return err
 	}
 
 	for _, info := range b.ModelInfos() {
 		for _, attr := range info.Attributes() {
+			if attr.BackendType() == "" && !attr.BackendMarshal() {
+				if typ, ok := b.TypeMapping(attr.Type()); ok {
+					attr.SetBackendType(typ)
+					continue
+				}
+			}
+
 			typ, err := b.translator.DetermineColumnType(attr)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			attr.SetBackendType(typ)
 		}
 	}
+
+	return nil
 }
 
 // SqlExec executes a any SQL statement and returns the result.
@@ -146,12 +162,45 @@ func (b *Backend) SqlExec(query string, args ...interface{}) orient.Results {
 }
 
 func (b *Backend) Exec(statement Expression) apperror.Error {
+	res, err := b.exec(statement)
+	if err != nil {
+		return err
+	}
+	if err := res.Close(); err != nil {
+		return apperror.Wrap(err, "orient_close_result_error")
+	}
+
+	return nil
+}
+
+// ExecCount executes the statement and returns the number of affected
+// records, which OrientDB returns as the result of UPDATE and DELETE
+// commands.
+func (b *Backend) ExecCount(statement Expression) (int64, apperror.Error) {
+	res, err := b.exec(statement)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := res.All(&count); err != nil {
+		return 0, apperror.Wrap(err, "orient_result_error")
+	}
+	return count, nil
+}
+
+func (b *Backend) exec(statement Expression) (orient.Results, apperror.Error) {
+	statement, err := b.InterceptStatement(statement)
+	if err != nil {
+		return nil, err
+	}
+
 	translator := b.translator.New()
 	if err := translator.PrepareExpression(statement); err != nil {
-		return err
+		return nil, err
 	}
 	if err := translator.Translate(statement); err != nil {
-		return err
+		return nil, err
 	}
 
 	sql := translator.String()
@@ -159,16 +208,22 @@ func (b *Backend) Exec(statement Expression) apperror.Error {
 
 	res := b.SqlExec(sql, args...)
 	if res.Err() != nil {
-		return apperror.Wrap(res.Err(), "orient_error")
-	}
-	if err := res.Close(); err != nil {
-		return apperror.Wrap(err, "orient_close_result_error")
+		return nil, apperror.Wrap(res.Err(), "orient_error")
 	}
 
-	return nil
+	return res, nil
 }
 
 func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperror.Error) {
+	statement, err := b.InterceptQueryStatement(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	if sel, ok := statement.(*SelectStmt); ok && sel.IndexHint() != "" {
+		b.Logger().Debugf("Ignoring index hint %v: not supported by the orientdb backend", sel.IndexHint())
+	}
+
 	translator := b.translator.New()
 	if err := translator.PrepareExpression(statement); err != nil {
 		return nil, err
@@ -180,6 +235,49 @@ func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperro
 	sql := translator.String()
 	args := translator.RawArguments()
 
+	var info *db.ModelInfo
+	if sel, ok := statement.(*SelectStmt); ok {
+		info = b.ModelInfos().Find(sel.Collection())
+	}
+
+	rows, err := b.queryDocuments(info, sql, args)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]interface{}, len(rows), len(rows))
+	for i, row := range rows {
+		if row != nil {
+			items[i] = row
+		}
+	}
+
+	return items, nil
+}
+
+// ExecRaw executes a raw OrientDB SQL query and returns the resulting
+// documents.
+// Since the collection is unknown, the record id is not included, and must
+// be selected explicitly, like "SELECT @rid AS id, * FROM tasks".
+func (b *Backend) ExecRaw(raw string, args []interface{}) ([]map[string]interface{}, apperror.Error) {
+	rows, err := b.queryDocuments(nil, raw, args)
+	if err != nil {
+		return nil, err
+	}
+
+	maps := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		if row != nil {
+			maps = append(maps, row)
+		}
+	}
+	return maps, nil
+}
+
+// queryDocuments executes a query and converts the resulting documents to
+// maps. Records that are not documents result in a nil map.
+// If info is given, the record id is stored in the primary key field.
+func (b *Backend) queryDocuments(info *db.ModelInfo, sql string, args []interface{}) ([]map[string]interface{}, apperror.Error) {
 	res := b.SqlExec(sql, args...)
 	if res.Err() != nil {
 		return nil, apperror.Wrap(res.Err(), "orient_error")
@@ -196,13 +294,7 @@ func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperro
 		return nil, apperror.New("invalid_non_record_orient_result")
 	}
 
-	items := make([]interface{}, len(rows), len(rows))
-
-	var info *db.ModelInfo
-	if sel, ok := statement.(*SelectStmt); ok {
-		info = b.ModelInfos().Find(sel.Collection())
-	}
-
+	maps := make([]map[string]interface{}, len(rows), len(rows))
 	for i, rawItem := range rows {
 		document, ok := rawItem.(*orient.Document)
 		if !ok {
@@ -218,10 +310,10 @@ func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperro
 			data[docEntry.Name] = docEntry.Value
 		}
 
-		items[i] = data
+		maps[i] = data
 	}
 
-	return items, nil
+	return maps, nil
 }
 
 func (b *Backend) CreateField(collection, fieldName string) apperror.Error {
@@ -135,9 +135,21 @@ func (t *OrientTranslator) Translate(expression Expression) apperror.Error {
 		return nil
 
 	case FilterExpression:
+		if IsEmptyInFilter(e) {
+			// An empty IN list never matches.
+			t.W("1=0")
+			return nil
+		}
+
 		if err := t.Translate(e.Field()); err != nil {
 			return err
 		}
+
+		if IsNullOperator(e.Operator()) {
+			t.W(" ", e.Operator())
+			return nil
+		}
+
 		t.W(" ", e.Operator(), " ")
 
 		if e.Operator() != OPERATOR_IN {
@@ -155,10 +167,6 @@ func (t *OrientTranslator) Translate(expression Expression) apperror.Error {
 				return apperror.New("invalid_in_filter_value")
 			}
 
-			if r.Len() < 1 {
-				return apperror.New("invalid_in_filter_no_values")
-			}
-
 			t.W("[")
 
 			lastIndex := r.Len() - 1
@@ -255,9 +263,19 @@ func (t *OrientTranslator) Translate(expression Expression) apperror.Error {
 		t.WQ(e.IndexName())
 		return nil
 
+	case *SortExpr:
+		if e.Nulls() != NULLS_DEFAULT {
+			return apperror.New("unsupported_nulls_placement", "The orientdb backend does not support NULLS FIRST/LAST")
+		}
+		return t.SqlTranslator.Translate(e)
+
 	case *SelectStmt:
 		// If counter is bigger than 0, this is a subquery and needs to be
 		// wrapped in parantheses.
+		if len(e.DistinctOn()) > 0 {
+			return apperror.New("unsupported_distinct_on", "The orientdb backend does not support DISTINCT ON")
+		}
+
 		isSubQuery := t.TranslationCounter > 0
 		if isSubQuery {
 			t.W("(")
@@ -304,6 +322,19 @@ func (t *OrientTranslator) Translate(expression Expression) apperror.Error {
 			}
 		}
 
+		if len(e.GroupBy()) > 0 {
+			t.W(" GROUP BY ")
+			lastIndex := len(e.GroupBy()) - 1
+			for i, group := range e.GroupBy() {
+				if err := t.Translate(group); err != nil {
+					return err
+				}
+				if i < lastIndex {
+					t.W(", ")
+				}
+			}
+		}
+
 		if len(e.Sorts()) > 0 {
 			t.W(" ORDER BY ")
 			lastIndex := len(e.Sorts()) - 1
@@ -392,6 +423,9 @@ func (t *OrientTranslator) Translate(expression Expression) apperror.Error {
 		}
 		return nil
 
+	case *UpsertStmt:
+		return apperror.New("unsupported_upsert", "The orientdb backend does not support upserts")
+
 	case *DeleteStmt:
 		t.W("DELETE FROM ")
 		t.WQ(e.Collection())
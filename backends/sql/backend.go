@@ -2,7 +2,9 @@ package sql
 
 import (
 	"database/sql"
+	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -21,12 +23,23 @@ type Backend struct {
 	Tx *sql.Tx
 
 	migrationHandler *db.MigrationHandler
+
+	// namedSQL holds the queries registered with RegisterNamedSQL.
+	namedSQL *namedQueries
+
+	// stmtCache holds the prepared statements of the named queries.
+	stmtCache *stmtCache
 }
 
 // Ensure Backend implements dukedb.Backend.
 var _ db.Backend = (*Backend)(nil)
 var _ db.TransactionBackend = (*Backend)(nil)
 var _ db.MigrationBackend = (*Backend)(nil)
+var _ db.SchemaDiffBackend = (*Backend)(nil)
+var _ db.BatchCreateBackend = (*Backend)(nil)
+var _ db.RowStreamBackend = (*Backend)(nil)
+var _ db.RowCountBackend = (*Backend)(nil)
+var _ db.RawQueryBackend = (*Backend)(nil)
 
 func New(driver, driverOptions string) (*Backend, apperror.Error) {
 	b := &Backend{}
@@ -37,28 +50,41 @@ func New(driver, driverOptions string) (*Backend, apperror.Error) {
 	case "postgres":
 		b.dialect = NewPostgresDialect(b)
 	case "mysql":
-		b.dialect = &MysqlDialect{}
+		b.dialect = NewMysqlDialect(b)
 	case "sqlite3":
-		b.dialect = &SqliteDialect{}
+		b.dialect = NewSqliteDialect(b)
 	default:
 		panic("Unsupported sql driver: " + driver)
 	}
 
+	for goType, dbType := range defaultTypeMappings(b.dialect.Name()) {
+		b.RegisterTypeMapping(goType, dbType)
+	}
+
 	DB, err := sql.Open(driver, driverOptions)
 	if err != nil {
 		return nil, apperror.Wrap(err, "sql_connection_error")
 	}
 
 	b.Db = DB
+	b.namedSQL = newNamedQueries()
+	b.stmtCache = newStmtCache(DB)
 
 	b.migrationHandler = db.NewMigrationHandler(b)
-	b.RegisterModel(&MigrationAttempt{})
+	if _, err := b.RegisterModel(&MigrationAttempt{}); err != nil {
+		return nil, err
+	}
 
 	b.BuildLogger()
 
 	return b, nil
 }
 
+// Dialect returns the name of the sql dialect in use.
+func (b *Backend) Dialect() string {
+	return b.dialect.Name()
+}
+
 func (b *Backend) HasStringIds() bool {
 	return false
 }
@@ -67,6 +93,12 @@ func (b *Backend) HasNativeJoins() bool {
 	return true
 }
 
+// HasBatchCreate returns true for postgres, which returns the generated
+// ids of all rows inserted by a single statement.
+func (b *Backend) HasBatchCreate() bool {
+	return b.dialect.Name() == "postgres"
+}
+
 func (b *Backend) IsSqlProfilingEnabled() bool {
 	return b.sqlProfilingEnabled
 }
@@ -81,14 +113,18 @@ func (b *Backend) DisableSqlProfiling() {
 
 func (b *Backend) Clone() db.Backend {
 	base := b.BaseBackend.Clone()
-	return &Backend{
+	copied := &Backend{
 		BaseBackend:         *base,
 		dialect:             b.dialect,
 		Db:                  b.Db,
 		Tx:                  b.Tx,
 		migrationHandler:    b.migrationHandler,
 		sqlProfilingEnabled: b.sqlProfilingEnabled,
+		namedSQL:            b.namedSQL,
+		stmtCache:           b.stmtCache,
 	}
+	copied.SetBackend(copied)
+	return copied
 }
 
 /**
@@ -112,6 +148,41 @@ func (b *Backend) Begin() (db.Transaction, apperror.Error) {
 	return copied, nil
 }
 
+// BeginTx starts a transaction with the isolation level and access mode of
+// the options, which the database driver maps to the statements of the
+// dialect. Nil options use the defaults of the database.
+func (b *Backend) BeginTx(opts *db.TxOptions) (db.Transaction, apperror.Error) {
+	if b.Tx != nil {
+		panic("Can't call .BeginTx() on a transaction.")
+	}
+	if opts == nil {
+		opts = &db.TxOptions{}
+	} else if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	isolation := sql.LevelDefault
+	switch opts.Isolation {
+	case db.ISOLATION_READ_COMMITTED:
+		isolation = sql.LevelReadCommitted
+	case db.ISOLATION_REPEATABLE_READ:
+		isolation = sql.LevelRepeatableRead
+	case db.ISOLATION_SERIALIZABLE:
+		isolation = sql.LevelSerializable
+	}
+
+	copied := b.Clone().(*Backend)
+	tx, err := b.Db.BeginTx(b.Context(), &sql.TxOptions{Isolation: isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return nil, apperror.Wrap(err, "begin_transaction_failed")
+	}
+
+	copied.Tx = tx
+	copied.Db = nil
+
+	return copied, nil
+}
+
 func (b *Backend) MustBegin() db.Transaction {
 	tx, err := b.Begin()
 	if err != nil {
@@ -120,6 +191,10 @@ func (b *Backend) MustBegin() db.Transaction {
 	return tx
 }
 
+func (b *Backend) IsTransaction() bool {
+	return b.Tx != nil
+}
+
 func (b *Backend) Rollback() apperror.Error {
 	if err := b.Tx.Rollback(); err != nil {
 		return apperror.Wrap(err, "transaction_rollback_failed")
@@ -134,18 +209,29 @@ func (b *Backend) Commit() apperror.Error {
 	return nil
 }
 
-func (b *Backend) Build() {
-	b.BaseBackend.Build()
+func (b *Backend) Build() apperror.Error {
+	if err := b.BaseBackend.Build(); err != nil {
+		return err
+	}
 
 	for _, info := range b.ModelInfos() {
 		for _, attr := range info.Attributes() {
+			if attr.BackendType() == "" && !attr.BackendMarshal() {
+				if typ, ok := b.TypeMapping(attr.Type()); ok {
+					attr.SetBackendType(typ)
+					continue
+				}
+			}
+
 			typ, err := b.dialect.DetermineColumnType(attr)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			attr.SetBackendType(typ)
 		}
 	}
+
+	return nil
 }
 
 func (b *Backend) SqlExec(query string, args ...interface{}) (sql.Result, error) {
@@ -158,9 +244,9 @@ func (b *Backend) SqlExec(query string, args ...interface{}) (sql.Result, error)
 	}
 
 	if b.Tx != nil {
-		res, err = b.Tx.Exec(query, args...)
+		res, err = b.Tx.ExecContext(b.Context(), query, args...)
 	} else {
-		res, err = b.Db.Exec(query, args...)
+		res, err = b.Db.ExecContext(b.Context(), query, args...)
 	}
 
 	if err != nil {
@@ -189,9 +275,9 @@ func (b *Backend) SqlQuery(query string, args ...interface{}) (*sql.Rows, error)
 	}
 
 	if b.Tx != nil {
-		rows, err = b.Tx.Query(query, args...)
+		rows, err = b.Tx.QueryContext(b.Context(), query, args...)
 	} else {
-		rows, err = b.Db.Query(query, args...)
+		rows, err = b.Db.QueryContext(b.Context(), query, args...)
 	}
 
 	if err != nil {
@@ -211,46 +297,153 @@ func (b *Backend) SqlQuery(query string, args ...interface{}) (*sql.Rows, error)
 }
 
 func (b *Backend) Exec(statement Expression) apperror.Error {
+	_, err := b.exec(statement)
+	return err
+}
+
+func (b *Backend) ExecCount(statement Expression) (int64, apperror.Error) {
+	res, err := b.exec(statement)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err2 := res.RowsAffected()
+	if err2 != nil {
+		return 0, apperror.Wrap(err2, "rows_affected_error")
+	}
+	return count, nil
+}
+
+func (b *Backend) exec(statement Expression) (sql.Result, apperror.Error) {
+	statement, err := b.InterceptStatement(statement)
+	if err != nil {
+		return nil, err
+	}
+
 	dialect := b.dialect.New()
 	if err := dialect.PrepareExpression(statement); err != nil {
-		return err
+		return nil, err
 	}
 	if err := dialect.Translate(statement); err != nil {
-		return err
+		return nil, err
 	}
 
 	sql := dialect.String()
 	args := dialect.RawArguments()
 
-	_, err := b.SqlExec(sql, args...)
-	if err != nil {
-		return apperror.Wrap(err, "sql_error")
+	res, err2 := b.SqlExec(sql, args...)
+	if err2 != nil {
+		return nil, b.dialect.TranslateError(err2)
 	}
 
-	return nil
+	return res, nil
 }
 
 func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperror.Error) {
+	rows, statement, err := b.queryRows(statement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return b.scanRows(rows, statement.Fields())
+}
+
+// ExecQueryEach implements db.RowStreamBackend by reading the rows one at a
+// time from the *sql.Rows cursor, which is closed before returning.
+func (b *Backend) ExecQueryEach(statement FieldedExpression, fn func(row interface{}) apperror.Error) apperror.Error {
+	rows, statement, err := b.queryRows(statement)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return b.eachRow(rows, statement.Fields(), fn)
+}
+
+// queryRows translates a query statement and executes it.
+// It returns the statement returned by the interceptors along with the rows,
+// which the caller must close.
+func (b *Backend) queryRows(statement FieldedExpression) (*sql.Rows, FieldedExpression, apperror.Error) {
+	return b.queryRowsWrapped(statement, nil)
+}
+
+// queryRowsWrapped is like queryRows, but passes the translated SQL of the
+// statement to wrap before executing it, which allows selecting from the
+// statement as a subquery.
+func (b *Backend) queryRowsWrapped(statement FieldedExpression, wrap func(sql string) string) (*sql.Rows, FieldedExpression, apperror.Error) {
+	statement, err := b.InterceptQueryStatement(statement)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sel, ok := statement.(*SelectStmt); ok && sel.IndexHint() != "" {
+		if _, ok := b.dialect.(IndexHintTranslator); !ok {
+			b.Logger().Debugf("Ignoring index hint %v: not supported by the sql dialect", sel.IndexHint())
+		}
+	}
+
 	dialect := b.dialect.New()
 	if err := dialect.PrepareExpression(statement); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := dialect.Translate(statement); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	sql := dialect.String()
 	args := dialect.RawArguments()
+	if wrap != nil {
+		sql = wrap(sql)
+	}
 
 	rows, err2 := b.SqlQuery(sql, args...)
 	if err2 != nil {
-		return nil, apperror.Wrap(err2, "sql_error")
+		return nil, nil, b.dialect.TranslateError(err2)
+	}
+	return rows, statement, nil
+}
+
+// ExecRaw executes a raw SQL query and returns the resulting rows.
+func (b *Backend) ExecRaw(raw string, args []interface{}) ([]map[string]interface{}, apperror.Error) {
+	rows, err := b.SqlQuery(raw, args...)
+	if err != nil {
+		return nil, b.dialect.TranslateError(err)
 	}
 	defer rows.Close()
 
+	result, err2 := b.scanRows(rows, nil)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	maps := make([]map[string]interface{}, len(result))
+	for i, row := range result {
+		maps[i] = row.(map[string]interface{})
+	}
+	return maps, nil
+}
+
+// scanRows reads all rows into maps keyed by the column names.
+func (b *Backend) scanRows(rows *sql.Rows, fields []Expression) ([]interface{}, apperror.Error) {
+	result := make([]interface{}, 0)
+	err := b.eachRow(rows, fields, func(row interface{}) apperror.Error {
+		result = append(result, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// eachRow reads the rows one at a time into maps keyed by the column names
+// and calls fn with each map, until all rows were read or fn returns an
+// error.
+func (b *Backend) eachRow(rows *sql.Rows, fields []Expression, fn func(row interface{}) apperror.Error) apperror.Error {
 	cols, err := rows.Columns()
 	if err != nil {
-		return nil, apperror.Wrap(err, "sql_rows_error")
+		return apperror.Wrap(err, "sql_rows_error")
 	}
 
 	colMap := make(map[string]int)
@@ -259,7 +452,7 @@ func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperro
 	}
 
 	fieldMap := make(map[string]reflect.Type)
-	for _, field := range statement.Fields() {
+	for _, field := range fields {
 		continue
 		if e, ok := field.(NamedTypedExpression); ok && e.Type() != nil && e.Name() != "" {
 			if _, ok := colMap[e.Name()]; ok {
@@ -268,7 +461,6 @@ func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperro
 		}
 	}
 
-	result := make([]interface{}, 0)
 	for rows.Next() {
 		//values := make([]reflect.Value, len(cols), len(cols))
 		values := make([]interface{}, len(cols), len(cols))
@@ -287,7 +479,7 @@ func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperro
 		}
 
 		if err := rows.Scan(pointers...); err != nil {
-			return nil, apperror.Wrap(err, "sql_scan_error")
+			return apperror.Wrap(err, "sql_scan_error")
 		}
 
 		m := make(map[string]interface{})
@@ -296,13 +488,105 @@ func (b *Backend) ExecQuery(statement FieldedExpression) ([]interface{}, apperro
 			m[col] = values[i]
 		}
 
-		result = append(result, m)
+		if err := fn(m); err != nil {
+			return err
+		}
 	}
 	if err := rows.Err(); err != nil {
-		return nil, apperror.Wrap(err, "sql_rows_error")
+		return apperror.Wrap(err, "sql_rows_error")
 	}
 
-	return result, nil
+	return nil
+}
+
+// ExecQueryCount implements db.RowCountBackend by selecting the count of
+// the statement rows from the statement as a subquery.
+func (b *Backend) ExecQueryCount(statement FieldedExpression) (int, apperror.Error) {
+	rows, _, err := b.queryRowsWrapped(statement, func(sql string) string {
+		return "SELECT COUNT(*) FROM (" + sql + ") AS counted"
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return 0, apperror.Wrap(err, "sql_scan_error")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, apperror.Wrap(err, "sql_rows_error")
+	}
+
+	return count, nil
+}
+
+// BulkLoad uses COPY on postgres to load the rows without building models.
+// Other dialects fall back to BaseBackend.BulkLoad().
+func (b *Backend) BulkLoad(collection string, columns []string, rows [][]interface{}) (int, apperror.Error) {
+	if b.dialect.Name() != "postgres" {
+		return b.BaseBackend.BulkLoad(collection, columns, rows)
+	}
+
+	info := b.ModelInfo(collection)
+	if info == nil {
+		return 0, apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with backend", collection))
+	}
+
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		attr := info.FindAttribute(column)
+		if attr == nil {
+			return 0, &apperror.Err{
+				Public:  true,
+				Code:    "unknown_field",
+				Message: fmt.Sprintf("Collection %v does not have a field %v", info.Collection(), column),
+			}
+		}
+		names = append(names, b.dialect.QuoteIdentifier(attr.BackendName()))
+	}
+	for index, row := range rows {
+		if len(row) != len(columns) {
+			return 0, apperror.New("invalid_row", fmt.Sprintf("Row %v has %v values, but %v columns were given", index, len(row), len(columns)))
+		}
+	}
+
+	// COPY has to be run inside a transaction.
+	tx := b.Tx
+	if tx == nil {
+		var err error
+		tx, err = b.Db.Begin()
+		if err != nil {
+			return 0, apperror.Wrap(err, "begin_transaction_failed")
+		}
+		defer tx.Rollback()
+	}
+
+	query := fmt.Sprintf("COPY %v (%v) FROM STDIN", b.dialect.QuoteIdentifier(info.BackendName()), strings.Join(names, ", "))
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return 0, apperror.Wrap(err, "sql_prepare_error")
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			return 0, b.dialect.TranslateError(err)
+		}
+	}
+	// An Exec() without arguments flushes the buffered rows.
+	if _, err := stmt.Exec(); err != nil {
+		return 0, b.dialect.TranslateError(err)
+	}
+
+	if b.Tx == nil {
+		if err := tx.Commit(); err != nil {
+			return 0, apperror.Wrap(err, "transaction_commit_failed")
+		}
+	}
+	return len(rows), nil
 }
 
 func (b *Backend) CreateCollection(collections ...string) apperror.Error {
@@ -3,7 +3,9 @@ package sql
 import (
 	"fmt"
 	"reflect"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/theduke/go-apperror"
 
@@ -14,9 +16,18 @@ import (
 type Dialect interface {
 	ExpressionTranslator
 	New() Dialect
+
+	// Name returns the name of the dialect, like "postgres".
+	Name() string
+
 	DetermineColumnType(attr *db.Attribute) (string, apperror.Error)
 
 	AfterCollectionCreate(info *db.ModelInfo) apperror.Error
+
+	// TranslateError converts an error returned by the database driver.
+	// Unique constraint violations are returned as a not_unique error with
+	// the name of the violated constraint as data.
+	TranslateError(err error) apperror.Error
 }
 
 type baseDialect struct {
@@ -25,10 +36,51 @@ type baseDialect struct {
 	modelInfo db.ModelInfos
 }
 
+// defaultTypeMappings returns the Go type to column type mappings that are
+// registered for a dialect by default.
+func defaultTypeMappings(dialect string) map[reflect.Type]string {
+	timeType := reflect.TypeOf(time.Time{})
+	bytesType := reflect.TypeOf([]byte{})
+
+	switch dialect {
+	case "postgres":
+		return map[reflect.Type]string{
+			timeType:  "timestamp with time zone",
+			bytesType: "bytea",
+		}
+	case "mysql":
+		return map[reflect.Type]string{
+			timeType:  "datetime",
+			bytesType: "blob",
+		}
+	case "sqlite":
+		return map[reflect.Type]string{
+			timeType:  "datetime",
+			bytesType: "blob",
+		}
+	}
+	return nil
+}
+
 func (baseDialect) AfterCollectionCreate(info *db.ModelInfo) apperror.Error {
 	return nil
 }
 
+func (baseDialect) TranslateError(err error) apperror.Error {
+	return apperror.Wrap(err, "sql_error")
+}
+
+// notUniqueErr builds the error for a violation of the given unique constraint.
+func notUniqueErr(err error, constraint string) apperror.Error {
+	return &apperror.Err{
+		Public:  true,
+		Code:    "not_unique",
+		Message: fmt.Sprintf("Unique constraint %v was violated", constraint),
+		Data:    constraint,
+		Errors:  []error{err},
+	}
+}
+
 func (baseDialect) DetermineColumnType(attr *db.Attribute) (string, apperror.Error) {
 	if attr.BackendType() != "" {
 		return attr.BackendType(), nil
@@ -88,22 +140,316 @@ func (baseDialect) DetermineColumnType(attr *db.Attribute) (string, apperror.Err
 }
 
 func (d *baseDialect) PrepareExpression(e Expression) apperror.Error {
+	if sel, ok := e.(*SelectStmt); ok && len(sel.DistinctOn()) > 0 {
+		if err := d.emulateDistinctOn(sel); err != nil {
+			return err
+		}
+	}
+
 	d.SqlTranslator.PrepareExpression(e)
 	return nil
 }
 
+// emulateDistinctOn rewrites a DISTINCT ON select for databases that do not
+// support it.
+// Each row is only selected if its primary key is the one picked by a
+// correlated subquery, which selects the first row of the same group
+// according to the remaining sorts:
+//
+//	WHERE col.id = (SELECT latest.id FROM col AS latest
+//		WHERE latest.group = col.group AND <filter> ORDER BY <sorts> LIMIT 1)
+func (d *baseDialect) emulateDistinctOn(sel *SelectStmt) apperror.Error {
+	col := sel.Collection()
+	info := d.modelInfo.Find(col)
+	if info == nil || info.HasCompositePk() {
+		return apperror.New("unsupported_distinct_on", "DISTINCT ON emulation needs a collection with a single primary key")
+	}
+	pk := info.PkAttribute().BackendName()
+
+	distinctFields := make(map[string]bool)
+	for _, expr := range sel.DistinctOn() {
+		name := identifierFieldName(expr)
+		if name == "" {
+			return apperror.New("unsupported_distinct_on", "DISTINCT ON emulation only supports plain field identifiers")
+		}
+		distinctFields[name] = true
+	}
+
+	alias := "latest"
+	sub := NewSelectStmt(col)
+	sub.SetAlias(alias)
+	sub.SetFields([]Expression{NewColFieldIdExpr(alias, pk)})
+	sub.SetLimit(1)
+
+	// Restrict the subquery to the group of the outer row. NULL values
+	// form a group of their own, like with DISTINCT ON.
+	and := NewAndExpr()
+	for _, expr := range sel.DistinctOn() {
+		name := identifierFieldName(expr)
+		inner := NewColFieldIdExpr(alias, name)
+		outer := NewColFieldIdExpr(col, name)
+		and.Add(NewOrExpr(
+			NewFilter(inner, OPERATOR_EQ, outer),
+			NewAndExpr(NewFilter(inner, OPERATOR_IS_NULL, nil), NewFilter(outer, OPERATOR_IS_NULL, nil)),
+		))
+	}
+	if sel.Filter() != nil {
+		filter := CloneExpression(sel.Filter())
+		renameCollection(filter, col, alias)
+		and.Add(filter)
+	}
+	sub.SetFilter(and)
+
+	for _, sortExpr := range sel.Sorts() {
+		if distinctFields[identifierFieldName(sortExpr.Expression())] {
+			continue
+		}
+		sortExpr = CloneExpression(sortExpr).(*SortExpr)
+		renameCollection(sortExpr, col, alias)
+		sub.AddSort(sortExpr)
+	}
+
+	sel.FilterAnd(NewFilter(NewColFieldIdExpr(col, pk), OPERATOR_EQ, sub))
+	sel.SetDistinctOn(nil)
+
+	return nil
+}
+
+// renameCollection changes the collection of the field identifiers in an
+// expression tree from one collection to another.
+// Nested select statements are not changed.
+func renameCollection(expr Expression, from, to string) {
+	switch e := expr.(type) {
+	case *ColFieldIdentifierExpr:
+		if e.Collection() == from {
+			e.SetCollection(to)
+		}
+		return
+
+	case *SelectStmt:
+		return
+
+	case *Filter:
+		renameCollection(e.Field(), from, to)
+		renameCollection(e.Clause(), from, to)
+		return
+
+	case *NotExpr:
+		renameCollection(e.Not(), from, to)
+		return
+	}
+
+	if multi, ok := expr.(MultiExpression); ok {
+		for _, child := range multi.Expressions() {
+			renameCollection(child, from, to)
+		}
+	}
+	if nested, ok := expr.(NestedExpression); ok {
+		renameCollection(nested.Expression(), from, to)
+	}
+}
+
+// identifierFieldName returns the field name for plain identifier expressions,
+// or an empty string for all other expressions.
+func identifierFieldName(expr Expression) string {
+	switch e := expr.(type) {
+	case *IdentifierExpr:
+		return e.Identifier()
+	case *ColFieldIdentifierExpr:
+		return e.Field()
+	}
+	return ""
+}
+
+// limitByRowId rewrites an update or delete statement with sorts, a limit or
+// an offset for databases that do not support them in UPDATE and DELETE.
+// The statement is restricted to the rows selected by a subquery on the
+// passed row id column, like ctid for postgres or rowid for sqlite.
+func limitByRowId(e Expression, rowId string) {
+	var sel *SelectStmt
+	switch s := e.(type) {
+	case *UpdateStmt:
+		sel = s.Select()
+	case *DeleteStmt:
+		sel = s.SelectStmt()
+	}
+	if sel == nil || (len(sel.Sorts()) == 0 && sel.Limit() == 0 && sel.Offset() == 0) {
+		return
+	}
+
+	sub := sel.Clone()
+	sub.SetFields([]Expression{NewIdExpr(rowId)})
+
+	limited := NewSelectStmt(sel.Collection())
+	limited.SetFilter(NewFilter(NewIdExpr(rowId), OPERATOR_IN, sub))
+
+	switch s := e.(type) {
+	case *UpdateStmt:
+		s.SetSelect(limited)
+	case *DeleteStmt:
+		s.SetSelectStmt(limited)
+	}
+}
+
 type MysqlDialect struct {
 	baseDialect
 }
 
-func (MysqlDialect) New() Dialect {
-	return &MysqlDialect{}
+// Ensure MysqlDialect supports index hints.
+var _ IndexHintTranslator = (*MysqlDialect)(nil)
+
+func NewMysqlDialect(b *Backend) Dialect {
+	d := &MysqlDialect{}
+	d.SqlTranslator = NewSqlTranslator(d)
+	d.backend = b
+	d.modelInfo = b.ModelInfos()
+	return d
+}
+
+func (d *MysqlDialect) New() Dialect {
+	return NewMysqlDialect(d.backend)
+}
+
+func (MysqlDialect) Name() string {
+	return "mysql"
+}
+
+// Translate emulates NULLS FIRST/LAST, which MySQL does not support, by
+// sorting by "field IS NULL" first.
+// Field types are changed with MODIFY COLUMN, and upserts use
+// ON DUPLICATE KEY UPDATE.
+func (d *MysqlDialect) Translate(expression Expression) apperror.Error {
+	switch e := expression.(type) {
+	case *SortExpr:
+		if e.Raw() || e.Nulls() == NULLS_DEFAULT {
+			break
+		}
+		if err := d.Translate(e.Expression()); err != nil {
+			return err
+		}
+		if e.Nulls() == NULLS_FIRST {
+			d.W(" IS NULL DESC, ")
+		} else {
+			d.W(" IS NULL ASC, ")
+		}
+		return d.SqlTranslator.Translate(NewSortExpr(e.Expression(), e.Ascending()))
+
+	case *AlterFieldStmt:
+		d.W("ALTER TABLE ")
+		d.WQ(e.Collection())
+		d.W(" MODIFY COLUMN ")
+		d.WQ(e.Field())
+		d.W(" ")
+		return d.Translate(e.FieldType())
+
+	case *UpsertStmt:
+		return d.translateUpsert(e)
+	}
+
+	return d.SqlTranslator.Translate(expression)
+}
+
+// translateUpsert writes an INSERT with ON DUPLICATE KEY UPDATE.
+// MySQL detects conflicts on all unique indexes, so the conflict target of
+// the statement is not used.
+func (d *MysqlDialect) translateUpsert(e *UpsertStmt) apperror.Error {
+	if err := d.Translate(NewCreateStmt(e.Collection(), e.Values())); err != nil {
+		return err
+	}
+
+	d.W(" ON DUPLICATE KEY UPDATE ")
+	values := e.UpdateValues()
+	if len(values) < 1 {
+		// Update all inserted values with the new data.
+		values = make([]*FieldValueExpr, 0)
+		for _, val := range e.Values() {
+			id, ok := val.Field().(*IdentifierExpr)
+			if !ok {
+				return apperror.New("unsupported_upsert_field", "Upsert fields must be identifiers")
+			}
+			values = append(values, NewFieldValExpr(id, NewFuncExpr("VALUES", id)))
+		}
+	}
+
+	for i, val := range values {
+		if i > 0 {
+			d.W(", ")
+		}
+		if err := d.Translate(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var mysqlDuplicateRegexp = regexp.MustCompile(`Error 1062.*: Duplicate entry '.*' for key '([^']+)'`)
+
+func (MysqlDialect) TranslateError(err error) apperror.Error {
+	if match := mysqlDuplicateRegexp.FindStringSubmatch(err.Error()); match != nil {
+		return notUniqueErr(err, match[1])
+	}
+	return apperror.Wrap(err, "sql_error")
+}
+
+func (d *MysqlDialect) TranslateIndexHint(stmt *SelectStmt) apperror.Error {
+	d.W(" ", INDEX_HINT_MAP[stmt.IndexHintMode()], " (")
+	d.WQ(stmt.IndexHint())
+	d.W(")")
+	return nil
 }
 
 type SqliteDialect struct {
 	baseDialect
 }
 
-func (SqliteDialect) New() Dialect {
-	return &SqliteDialect{}
+func NewSqliteDialect(b *Backend) Dialect {
+	d := &SqliteDialect{}
+	d.SqlTranslator = NewSqlTranslator(d)
+	d.backend = b
+	d.modelInfo = b.ModelInfos()
+	return d
+}
+
+func (d *SqliteDialect) New() Dialect {
+	return NewSqliteDialect(d.backend)
+}
+
+func (SqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// PrepareExpression restricts updates and deletes with sorts or a limit by
+// the rowid, since sqlite only supports ORDER BY and LIMIT in UPDATE and
+// DELETE when compiled with SQLITE_ENABLE_UPDATE_DELETE_LIMIT.
+func (d *SqliteDialect) PrepareExpression(e Expression) apperror.Error {
+	limitByRowId(e, "rowid")
+	return d.baseDialect.PrepareExpression(e)
+}
+
+// Translate rejects field type changes and upserts on a named constraint,
+// which sqlite does not support.
+func (d *SqliteDialect) Translate(expression Expression) apperror.Error {
+	switch e := expression.(type) {
+	case *AlterFieldStmt:
+		return apperror.New("unsupported_alter_field",
+			fmt.Sprintf("The sqlite dialect can not change the type of %v.%v", e.Collection(), e.Field()))
+
+	case *UpsertStmt:
+		if e.ConflictConstraint() != "" {
+			return apperror.New("unsupported_upsert_constraint",
+				"The sqlite dialect only supports upserts with conflict fields")
+		}
+	}
+	return d.SqlTranslator.Translate(expression)
+}
+
+var sqliteUniqueRegexp = regexp.MustCompile(`UNIQUE constraint failed: (.+)$`)
+
+// TranslateError returns the violated columns as the constraint for unique
+// constraint violations, since sqlite does not report the constraint name.
+func (SqliteDialect) TranslateError(err error) apperror.Error {
+	if match := sqliteUniqueRegexp.FindStringSubmatch(err.Error()); match != nil {
+		return notUniqueErr(err, match[1])
+	}
+	return apperror.Wrap(err, "sql_error")
 }
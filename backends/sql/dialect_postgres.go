@@ -1,7 +1,10 @@
 package sql
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -30,6 +33,48 @@ func (d *PostgresDialect) New() Dialect {
 	return NewPostgresDialect(d.backend)
 }
 
+func (PostgresDialect) Name() string {
+	return "postgres"
+}
+
+var postgresUniqueRegexp = regexp.MustCompile(`duplicate key value violates unique constraint "([^"]+)"`)
+
+// TranslateError detects unique violations by the SQLSTATE 23505 if the
+// driver error exposes the fields of the error response (like lib/pq),
+// or by the error message otherwise.
+func (PostgresDialect) TranslateError(err error) apperror.Error {
+	if pgErr, ok := err.(interface {
+		Get(field byte) string
+	}); ok {
+		if pgErr.Get('C') == "23505" {
+			return notUniqueErr(err, pgErr.Get('n'))
+		}
+		return apperror.Wrap(err, "sql_error")
+	}
+
+	if match := postgresUniqueRegexp.FindStringSubmatch(err.Error()); match != nil {
+		return notUniqueErr(err, match[1])
+	}
+	return apperror.Wrap(err, "sql_error")
+}
+
+// DetermineColumnType adds support for array columns, which use the column
+// type of the slice items.
+func (d *PostgresDialect) DetermineColumnType(attr *db.Attribute) (string, apperror.Error) {
+	if attr.BackendType() != "" || !attr.BackendArray() {
+		return d.baseDialect.DetermineColumnType(attr)
+	}
+
+	item := *attr
+	item.SetType(attr.Type().Elem())
+	item.SetBackendArray(false)
+	typ, err := d.baseDialect.DetermineColumnType(&item)
+	if err != nil {
+		return "", err
+	}
+	return typ + "[]", nil
+}
+
 func (d *PostgresDialect) AfterCollectionCreate(info *db.ModelInfo) apperror.Error {
 	for _, attr := range info.Attributes() {
 		// Alter sequences to start at 1 instead of 0.
@@ -47,14 +92,14 @@ func (d *PostgresDialect) AfterCollectionCreate(info *db.ModelInfo) apperror.Err
 func (d *PostgresDialect) PrepareExpression(expression Expression) apperror.Error {
 	switch e := expression.(type) {
 	case *CreateStmt:
-		// Add RETURNING clause for id.
-		info := d.modelInfo.Find(e.Collection())
-		if info != nil {
-			pk := info.PkAttribute()
-			if pk != nil && pk.AutoIncrement() {
-				e.AddField(NewFieldSelector(pk.Name(), info.BackendName(), pk.BackendName(), pk.Type()))
-			}
-		}
+		d.addReturningId(e.Collection(), e)
+
+	case *UpsertStmt:
+		d.addReturningId(e.Collection(), e)
+
+	case *UpdateStmt, *DeleteStmt:
+		// Postgres does not support ORDER BY and LIMIT in UPDATE and DELETE.
+		limitByRowId(e, "ctid")
 
 	case *SelectStmt:
 		if len(e.Fields()) == 0 {
@@ -73,6 +118,37 @@ func (d *PostgresDialect) PrepareExpression(expression Expression) apperror.Erro
 	return nil
 }
 
+// translateReturning writes a RETURNING clause with the fields of an insert
+// statement, if there are any.
+func (d *PostgresDialect) translateReturning(fields []Expression) apperror.Error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	d.W(" RETURNING ")
+	for i, field := range fields {
+		if i > 0 {
+			d.W(", ")
+		}
+		if err := d.SqlTranslator.Translate(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addReturningId adds the auto increment primary key as a field to a
+// statement, so it ends up in a RETURNING clause.
+func (d *PostgresDialect) addReturningId(collection string, e FieldedExpression) {
+	info := d.modelInfo.Find(collection)
+	if info != nil {
+		pk := info.PkAttribute()
+		if pk != nil && pk.AutoIncrement() {
+			e.AddField(NewFieldSelector(pk.Name(), info.BackendName(), pk.BackendName(), pk.Type()))
+		}
+	}
+}
+
 func (d *PostgresDialect) Translate(expression Expression) apperror.Error {
 	switch e := expression.(type) {
 	case *ConstraintExpr:
@@ -86,23 +162,176 @@ func (d *PostgresDialect) Translate(expression Expression) apperror.Error {
 		}
 
 	case *CreateStmt:
-		d.SqlTranslator.Translate(e)
-
-		// Add returning fields.
-		fields := e.Fields()
-		if len(fields) > 0 {
-			d.W(" RETURNING ")
-			for _, f := range fields {
-				d.SqlTranslator.Translate(f)
+		if err := d.SqlTranslator.Translate(e); err != nil {
+			return err
+		}
+		return d.translateReturning(e.Fields())
+
+	case *JSONSetExpr:
+		// Marshalled fields are stored as text, so the document is cast
+		// to jsonb and back.
+		value, err := json.Marshal(e.Value())
+		if err != nil {
+			return apperror.Wrap(err, "json_marshal_error")
+		}
+
+		d.W("CAST(jsonb_set(CAST(")
+		if err := d.Translate(e.Field()); err != nil {
+			return err
+		}
+		d.W(" AS jsonb), CAST(")
+		d.Translate(NewValueExpr("{" + strings.Join(e.Path(), ",") + "}"))
+		d.W(" AS text[]), CAST(")
+		d.Translate(NewValueExpr(string(value)))
+		d.W(" AS jsonb), true) AS text)")
+		return nil
+
+	case *DateTruncExpr:
+		if err := e.Validate(); err != nil {
+			return err
+		}
+		// The unit is validated, so it can be written as a literal, which
+		// keeps the expression identical in selects and group bys.
+		d.W("date_trunc('", e.Unit(), "', ")
+		if err := d.Translate(e.Expression()); err != nil {
+			return err
+		}
+		d.W(")")
+		return nil
+
+	case *SearchExpr:
+		// Use the native full text search.
+		d.W("to_tsvector(CONCAT_WS(' ', ")
+		lastIndex := len(e.Expressions()) - 1
+		for i, field := range e.Expressions() {
+			if err := d.Translate(field); err != nil {
+				return err
+			}
+			if i < lastIndex {
+				d.W(", ")
 			}
 		}
+		d.W(")) @@ plainto_tsquery(")
+		d.Translate(NewValueExpr(e.Term()))
+		d.W(")")
+		return nil
+
+	case *CursorExpr:
+		if err := e.Validate(); err != nil {
+			return err
+		}
+		if !e.SameDirection() {
+			return d.SqlTranslator.Translate(e)
+		}
 
+		// Use a row value comparison: (a, b) > (?, ?).
+		d.W("(")
+		for i, field := range e.Expressions() {
+			if i > 0 {
+				d.W(", ")
+			}
+			if err := d.Translate(field); err != nil {
+				return err
+			}
+		}
+		if e.Directions()[0] {
+			d.W(") > (")
+		} else {
+			d.W(") < (")
+		}
+		for i, val := range e.Values() {
+			if i > 0 {
+				d.W(", ")
+			}
+			if err := d.Translate(NewValueExpr(val)); err != nil {
+				return err
+			}
+		}
+		d.W(")")
 		return nil
+
+	case *UpsertStmt:
+		if err := d.SqlTranslator.Translate(e); err != nil {
+			return err
+		}
+		return d.translateReturning(e.Fields())
+
+	case *ValueExpr:
+		// Array column values are sent as array literals, since the drivers
+		// do not support slices as arguments.
+		if isArrayValue(e.Value()) {
+			d.W(d.Placeholder())
+			if reflect.ValueOf(e.Value()).IsNil() {
+				d.Arg(NewValueExpr(nil))
+			} else {
+				d.Arg(NewValueExpr(db.FormatArrayLiteral(e.Value())))
+			}
+			return nil
+		}
+
+	case FilterExpression:
+		if IsArrayOperator(e.Operator()) {
+			return d.translateArrayFilter(e)
+		}
 	}
 
 	return d.SqlTranslator.Translate(expression)
 }
 
+// translateArrayFilter translates the array operators to ANY(), @> and &&.
+func (d *PostgresDialect) translateArrayFilter(e FilterExpression) apperror.Error {
+	valExpr, ok := e.Clause().(*ValueExpr)
+	if !ok {
+		return apperror.New("invalid_array_filter", "Array filters require a value clause")
+	}
+
+	values := []interface{}{valExpr.Value()}
+	if isArrayValue(valExpr.Value()) {
+		values = values[:0]
+		v := reflect.ValueOf(valExpr.Value())
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, v.Index(i).Interface())
+		}
+	}
+	if len(values) < 1 {
+		return apperror.New("invalid_array_filter_no_values")
+	}
+
+	if e.Operator() == OPERATOR_CONTAINS && len(values) == 1 {
+		d.W(d.Placeholder(), " = ANY(")
+		d.Arg(NewValueExpr(values[0]))
+		if err := d.Translate(e.Field()); err != nil {
+			return err
+		}
+		d.W(")")
+		return nil
+	}
+
+	if err := d.Translate(e.Field()); err != nil {
+		return err
+	}
+	if e.Operator() == OPERATOR_CONTAINS {
+		d.W(" @> ARRAY[")
+	} else {
+		d.W(" && ARRAY[")
+	}
+	for i, val := range values {
+		if i > 0 {
+			d.W(", ")
+		}
+		d.W(d.Placeholder())
+		d.Arg(NewValueExpr(val))
+	}
+	d.W("]")
+	return nil
+}
+
+// isArrayValue returns true for slices except []byte.
+func isArrayValue(val interface{}) bool {
+	typ := reflect.TypeOf(val)
+	return typ != nil && typ.Kind() == reflect.Slice && typ.Elem().Kind() != reflect.Uint8
+}
+
 func (PostgresDialect) Placeholder() string {
 	return "${}$"
 }
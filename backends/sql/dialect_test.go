@@ -0,0 +1,162 @@
+package sql_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	db "github.com/theduke/go-dukedb"
+	. "github.com/theduke/go-dukedb/backends/sql"
+	. "github.com/theduke/go-dukedb/expressions"
+)
+
+type Item struct {
+	Id      uint64
+	GroupId uint64
+	Created int64
+}
+
+var _ = Describe("Dialects", func() {
+	upsert := func() *UpsertStmt {
+		values := []*FieldValueExpr{NewFieldVal("a", 1), NewFieldVal("b", 2)}
+		return NewUpsertStmt("col", values, []Expression{NewIdExpr("a")})
+	}
+
+	Describe("Postgres", func() {
+		var d Dialect
+
+		BeforeEach(func() {
+			d = NewPostgresDialect(&Backend{})
+		})
+
+		It("Should return the dialect name", func() {
+			Expect(d.Name()).To(Equal("postgres"))
+			Expect(d.New().Name()).To(Equal("postgres"))
+		})
+
+		It("Should translate upserts with returning fields", func() {
+			sql := `INSERT INTO "col"("a", "b") VALUES($1,$2) ON CONFLICT ("a") DO UPDATE SET "a" = "excluded"."a", "b" = "excluded"."b" RETURNING "id", "b"`
+			stmt := upsert()
+			stmt.AddField(NewIdExpr("id"))
+			stmt.AddField(NewIdExpr("b"))
+			Expect(d.Translate(stmt)).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(sql))
+		})
+
+		It("Should translate upserts on a constraint", func() {
+			sql := `INSERT INTO "col"("a") VALUES($1) ON CONFLICT ON CONSTRAINT "col_a" DO UPDATE SET "a" = "excluded"."a"`
+			stmt := NewConstraintUpsertStmt("col", []*FieldValueExpr{NewFieldVal("a", 1)}, "col_a")
+			Expect(d.Translate(stmt)).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(sql))
+		})
+
+		It("Should ignore index hints", func() {
+			sel := NewSelectStmt("col")
+			sel.AddField(NewIdExpr("id"))
+			sel.SetIndexHint("col_idx", INDEX_HINT_FORCE)
+			Expect(d.Translate(sel)).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(`SELECT "id" FROM "col"`))
+		})
+	})
+
+	Describe("Mysql", func() {
+		var d Dialect
+
+		BeforeEach(func() {
+			d = NewMysqlDialect(&Backend{})
+		})
+
+		It("Should return the dialect name", func() {
+			Expect(d.Name()).To(Equal("mysql"))
+			Expect(d.New().Name()).To(Equal("mysql"))
+		})
+
+		It("Should translate upserts with ON DUPLICATE KEY UPDATE", func() {
+			sql := `INSERT INTO "col"("a", "b") VALUES(?,?) ON DUPLICATE KEY UPDATE "a" = VALUES("a"), "b" = VALUES("b")`
+			Expect(d.Translate(upsert())).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(sql))
+		})
+
+		It("Should translate upserts with update values", func() {
+			sql := `INSERT INTO "col"("a", "b") VALUES(?,?) ON DUPLICATE KEY UPDATE "b" = ?`
+			stmt := upsert()
+			stmt.SetUpdateValues([]*FieldValueExpr{NewFieldVal("b", 3)})
+			Expect(d.Translate(stmt)).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(sql))
+		})
+
+		It("Should emulate the nulls placement in deletes", func() {
+			sql := `DELETE FROM "col" ORDER BY "f" IS NULL DESC, "f" ASC LIMIT 10`
+			sel := NewSelectStmt("col")
+			sort := NewSortExpr(NewIdExpr("f"), true)
+			sort.SetNulls(NULLS_FIRST)
+			sel.AddSort(sort)
+			sel.SetLimit(10)
+			Expect(d.Translate(NewDeleteStmt("col", sel))).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(sql))
+		})
+
+		It("Should translate index hints", func() {
+			sel := NewSelectStmt("col")
+			sel.AddField(NewIdExpr("id"))
+			sel.SetIndexHint("col_idx", INDEX_HINT_FORCE)
+			Expect(d.Translate(sel)).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(`SELECT "id" FROM "col" FORCE INDEX ("col_idx")`))
+		})
+
+		It("Should reject unknown index hint modes", func() {
+			sel := NewSelectStmt("col")
+			sel.SetIndexHint("col_idx", "prefer")
+			Expect(d.Translate(sel)).To(HaveOccurred())
+		})
+	})
+
+	Describe("Sqlite", func() {
+		var d Dialect
+
+		BeforeEach(func() {
+			d = NewSqliteDialect(&Backend{})
+		})
+
+		It("Should return the dialect name", func() {
+			Expect(d.Name()).To(Equal("sqlite"))
+			Expect(d.New().Name()).To(Equal("sqlite"))
+		})
+
+		It("Should translate upserts", func() {
+			sql := `INSERT INTO "col"("a", "b") VALUES(?,?) ON CONFLICT ("a") DO UPDATE SET "a" = "excluded"."a", "b" = "excluded"."b"`
+			Expect(d.Translate(upsert())).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(sql))
+		})
+
+		It("Should emulate DISTINCT ON with a correlated subquery", func() {
+			b := &Backend{}
+			b.BaseBackend = db.NewBaseBackend(b)
+			_, err := b.RegisterModel(&Item{})
+			Expect(err).ToNot(HaveOccurred())
+			d = NewSqliteDialect(b)
+
+			sql := `SELECT "items"."id" FROM "items" WHERE ("items"."created" > ? AND "items"."id" = ` +
+				`(SELECT "latest"."id" FROM "items" AS "latest" WHERE (("latest"."group_id" = "items"."group_id" OR ` +
+				`("latest"."group_id" is null AND "items"."group_id" is null)) AND "latest"."created" > ?) ` +
+				`ORDER BY "latest"."created" DESC LIMIT 1)) ORDER BY "items"."group_id" ASC, "items"."created" DESC`
+
+			sel := NewSelectStmt("items")
+			sel.AddField(NewColFieldIdExpr("items", "id"))
+			sel.SetFilter(NewFieldValFilter("items", "created", OPERATOR_GT, 5))
+			sel.SetDistinctOn([]Expression{NewColFieldIdExpr("items", "group_id")})
+			sel.AddSort(NewSortExpr(NewColFieldIdExpr("items", "group_id"), true))
+			sel.AddSort(NewSortExpr(NewColFieldIdExpr("items", "created"), false))
+
+			Expect(d.PrepareExpression(sel)).ToNot(HaveOccurred())
+			Expect(d.Translate(sel)).ToNot(HaveOccurred())
+			Expect(d.String()).To(Equal(sql))
+		})
+
+		It("Should reject upserts on a constraint", func() {
+			stmt := NewConstraintUpsertStmt("col", []*FieldValueExpr{NewFieldVal("a", 1)}, "col_a")
+			err := d.Translate(stmt)
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("unsupported_upsert_constraint"))
+		})
+	})
+})
@@ -1,11 +1,16 @@
 package sql
 
 import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/theduke/go-apperror"
 
 	db "github.com/theduke/go-dukedb"
+	. "github.com/theduke/go-dukedb/expressions"
 )
 
 /**
@@ -51,6 +56,323 @@ func (b Backend) MigrationsSetup() apperror.Error {
 	return nil
 }
 
+func (b *Backend) MigrationPlan(collections ...string) (*db.SchemaDiff, apperror.Error) {
+	if len(collections) == 0 {
+		collections = b.Collections(true)
+	}
+	collections = append([]string{}, collections...)
+	sort.Strings(collections)
+
+	diff := db.NewSchemaDiff()
+	for _, collection := range collections {
+		info := b.ModelInfo(collection)
+		if info == nil {
+			return nil, b.unknownCollection(collection)
+		}
+
+		columns, err := b.describeCollection(info.BackendName())
+		if err != nil {
+			return nil, err
+		}
+		if columns == nil {
+			diff.CreateCollections = append(diff.CreateCollections, info.Collection())
+			continue
+		}
+
+		attrs := make(map[string]bool)
+		createFields := make([]string, 0)
+		alterFields := make([]string, 0)
+		for _, attr := range info.Attributes() {
+			attrs[attr.BackendName()] = true
+			typ, ok := columns[attr.BackendName()]
+			if !ok {
+				createFields = append(createFields, attr.BackendName())
+			} else if normalizeColumnType(b.dialect.Name(), typ) != normalizeColumnType(b.dialect.Name(), attr.BackendType()) {
+				alterFields = append(alterFields, attr.BackendName())
+			}
+		}
+
+		dropFields := make([]string, 0)
+		for column := range columns {
+			if !attrs[column] {
+				dropFields = append(dropFields, column)
+			}
+		}
+
+		indexes, err := b.describeIndexes(info.BackendName())
+		if err != nil {
+			return nil, err
+		}
+		createIndexes := make([]string, 0)
+		for _, stmt := range info.BuildIndexStmts() {
+			if !indexes[stmt.IndexName()] {
+				createIndexes = append(createIndexes, stmt.IndexName())
+			}
+		}
+
+		if len(createFields) > 0 {
+			sort.Strings(createFields)
+			diff.CreateFields[info.Collection()] = createFields
+		}
+		if len(alterFields) > 0 {
+			sort.Strings(alterFields)
+			diff.AlterFields[info.Collection()] = alterFields
+		}
+		if len(createIndexes) > 0 {
+			sort.Strings(createIndexes)
+			diff.CreateIndexes[info.Collection()] = createIndexes
+		}
+		if len(dropFields) > 0 {
+			sort.Strings(dropFields)
+			diff.DropFields[info.Collection()] = dropFields
+		}
+	}
+
+	return diff, nil
+}
+
+func (b *Backend) ApplyPlan(plan *db.SchemaDiff) apperror.Error {
+	if len(plan.CreateCollections) > 0 {
+		if err := b.CreateCollection(plan.CreateCollections...); err != nil {
+			return err
+		}
+	}
+
+	for _, collection := range sortedKeys(plan.CreateFields) {
+		for _, field := range plan.CreateFields[collection] {
+			if err := b.CreateField(collection, field); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, collection := range sortedKeys(plan.AlterFields) {
+		info := b.ModelInfo(collection)
+		if info == nil {
+			return b.unknownCollection(collection)
+		}
+		for _, field := range plan.AlterFields[collection] {
+			attr := info.FindAttribute(field)
+			if attr == nil {
+				return apperror.New("unknown_field", fmt.Sprintf("Collection %v does not have a field %v", collection, field))
+			}
+			typ := NewFieldTypeExpr(normalizeColumnType(b.dialect.Name(), attr.BackendType()), attr.Type())
+			if err := b.Exec(NewAlterFieldStmt(info.BackendName(), attr.BackendName(), typ)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, collection := range sortedKeys(plan.CreateIndexes) {
+		info := b.ModelInfo(collection)
+		if info == nil {
+			return b.unknownCollection(collection)
+		}
+		create := make(map[string]bool)
+		for _, name := range plan.CreateIndexes[collection] {
+			create[name] = true
+		}
+		for _, stmt := range info.BuildIndexStmts() {
+			if !create[stmt.IndexName()] {
+				continue
+			}
+			if err := b.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	if plan.AllowDrops {
+		for _, collection := range sortedKeys(plan.DropFields) {
+			for _, field := range plan.DropFields[collection] {
+				if err := b.DropField(collection, field); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// sortedKeys returns the sorted collection names of a schema diff map.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unknownCollection returns the error for a collection that was not
+// registered.
+func (b *Backend) unknownCollection(collection string) apperror.Error {
+	return apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with the backend", collection), true)
+}
+
+// describeCollection returns the column types of a table, keyed by column
+// name, or nil if the table does not exist.
+func (b *Backend) describeCollection(table string) (map[string]string, apperror.Error) {
+	var query string
+	switch b.dialect.Name() {
+	case "postgres":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1"
+	case "mysql":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	case "sqlite":
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	default:
+		return nil, apperror.New("unsupported_dialect", fmt.Sprintf("Can not describe collections with the %v dialect", b.dialect.Name()))
+	}
+
+	rows, err := b.SqlQuery(query, table)
+	if err != nil {
+		return nil, apperror.Wrap(err, "sql_error")
+	}
+	count := 0
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			rows.Close()
+			return nil, apperror.Wrap(err, "sql_scan_error")
+		}
+	}
+	rows.Close()
+	if count == 0 {
+		return nil, nil
+	}
+
+	var args []interface{}
+	switch b.dialect.Name() {
+	case "postgres":
+		query = "SELECT a.attname, format_type(a.atttypid, a.atttypmod) FROM pg_attribute a " +
+			"WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped"
+		args = []interface{}{b.dialect.QuoteIdentifier(table)}
+	case "mysql":
+		query = "SELECT column_name, column_type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?"
+		args = []interface{}{table}
+	case "sqlite":
+		query = "SELECT name, type FROM pragma_table_info(?)"
+		args = []interface{}{table}
+	}
+
+	rows, err = b.SqlQuery(query, args...)
+	if err != nil {
+		return nil, apperror.Wrap(err, "sql_error")
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, apperror.Wrap(err, "sql_scan_error")
+		}
+		columns[name] = typ
+	}
+	if err := rows.Err(); err != nil {
+		return nil, apperror.Wrap(err, "sql_error")
+	}
+	return columns, nil
+}
+
+// describeIndexes returns the names of the indexes of a table.
+func (b *Backend) describeIndexes(table string) (map[string]bool, apperror.Error) {
+	var query string
+	switch b.dialect.Name() {
+	case "postgres":
+		query = "SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND tablename = $1"
+	case "mysql":
+		query = "SELECT DISTINCT index_name FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ?"
+	case "sqlite":
+		query = "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ?"
+	default:
+		return nil, apperror.New("unsupported_dialect", fmt.Sprintf("Can not describe indexes with the %v dialect", b.dialect.Name()))
+	}
+
+	rows, err := b.SqlQuery(query, table)
+	if err != nil {
+		return nil, apperror.Wrap(err, "sql_error")
+	}
+	defer rows.Close()
+
+	indexes := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, apperror.Wrap(err, "sql_scan_error")
+		}
+		indexes[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, apperror.Wrap(err, "sql_error")
+	}
+	return indexes, nil
+}
+
+// columnTypeAliases maps column types to the name the database reports for
+// them, per dialect.
+// Entries are looked up with the full type first, and then with the type
+// name without arguments like the length.
+var columnTypeAliases = map[string]map[string]string{
+	"postgres": {
+		"serial":      "integer",
+		"bigserial":   "bigint",
+		"smallserial": "smallint",
+		"int":         "integer",
+		"int4":        "integer",
+		"int8":        "bigint",
+		"bool":        "boolean",
+		"varchar":     "character varying",
+		"timestamptz": "timestamp with time zone",
+		"decimal":     "numeric",
+	},
+	"mysql": {
+		"numeric":           "decimal(10,0)",
+		"decimal":           "decimal(10,0)",
+		"integer":           "int",
+		"serial":            "bigint",
+		"bigserial":         "bigint",
+		"boolean":           "tinyint",
+		"bool":              "tinyint",
+		"character varying": "varchar",
+	},
+}
+
+// mysqlIntegerWidthRegexp matches the display width of MySQL integer types,
+// which does not affect the stored values.
+var mysqlIntegerWidthRegexp = regexp.MustCompile(`^(tinyint|smallint|mediumint|int|bigint)\(\d+\)`)
+
+// normalizeColumnType converts a column type to the form reported by the
+// database, so that the types of models and tables can be compared.
+func normalizeColumnType(dialect, typ string) string {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if dialect == "mysql" {
+		typ = mysqlIntegerWidthRegexp.ReplaceAllString(typ, "$1")
+		typ = strings.TrimSuffix(typ, " unsigned")
+	}
+
+	suffix := ""
+	if strings.HasSuffix(typ, "[]") {
+		suffix = "[]"
+		typ = strings.TrimSuffix(typ, "[]")
+	}
+
+	aliases := columnTypeAliases[dialect]
+	if alias, ok := aliases[typ]; ok {
+		return alias + suffix
+	}
+
+	name, args := typ, ""
+	if index := strings.Index(typ, "("); index != -1 {
+		name, args = strings.TrimSpace(typ[:index]), typ[index:]
+	}
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	return name + args + suffix
+}
+
 func (b Backend) IsMigrationLocked() (bool, apperror.Error) {
 	var lastAttempt *MigrationAttempt
 	if model, err := b.Q("migration_attempts").Last(); err != nil {
@@ -0,0 +1,184 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/theduke/go-apperror"
+	db "github.com/theduke/go-dukedb"
+)
+
+/**
+ * Named SQL queries.
+ *
+ * Named queries allow to register hand written SQL once and execute it
+ * by name, with the result converted to models of a collection.
+ */
+
+type namedSQL struct {
+	collection string
+	sql        string
+}
+
+// namedQueries holds the registered named queries.
+// It is shared by all clones of a backend, so access is guarded by a lock.
+type namedQueries struct {
+	sync.RWMutex
+	queries map[string]*namedSQL
+}
+
+func newNamedQueries() *namedQueries {
+	return &namedQueries{
+		queries: make(map[string]*namedSQL),
+	}
+}
+
+func (n *namedQueries) get(name string) (*namedSQL, bool) {
+	n.RLock()
+	defer n.RUnlock()
+	named, ok := n.queries[name]
+	return named, ok
+}
+
+func (n *namedQueries) set(name string, named *namedSQL) {
+	n.Lock()
+	defer n.Unlock()
+	n.queries[name] = named
+}
+
+// stmtCache holds prepared statements keyed by their SQL text.
+// It is shared by all clones of a backend, including transactions, which
+// use the statements with Tx.Stmt().
+type stmtCache struct {
+	sync.Mutex
+	conn  *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(conn *sql.DB) *stmtCache {
+	return &stmtCache{
+		conn:  conn,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// prepare returns the cached statement for the query, and prepares it on
+// the connection pool if it is not cached yet.
+func (c *stmtCache) prepare(query string) (*sql.Stmt, apperror.Error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, apperror.Wrap(err, "sql_prepare_error")
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// RegisterNamedSQL registers a raw SQL query under a name.
+// The result rows of the query are converted to models of the collection.
+// The query is prepared right away and kept in the statement cache.
+func (b *Backend) RegisterNamedSQL(name, collection, query string) apperror.Error {
+	if name == "" || query == "" {
+		return apperror.New("invalid_named_sql", "Named sql queries need a name and a query")
+	}
+	if b.ModelInfo(collection) == nil {
+		return apperror.New("unknown_collection", fmt.Sprintf("Collection %v was not registered with backend", collection))
+	}
+
+	named := &namedSQL{
+		collection: collection,
+		sql:        query,
+	}
+
+	if b.stmtCache != nil {
+		if _, err := b.stmtCache.prepare(query); err != nil {
+			return err
+		}
+	}
+
+	b.namedSQL.set(name, named)
+
+	return nil
+}
+
+// RunNamed executes a query registered with RegisterNamedSQL and returns
+// the resulting models.
+func (b *Backend) RunNamed(name string, args ...interface{}) ([]interface{}, apperror.Error) {
+	named, ok := b.namedSQL.get(name)
+	if !ok {
+		return nil, apperror.New("unknown_named_sql", fmt.Sprintf("No sql query with name %v was registered", name))
+	}
+
+	var started time.Time
+	if b.ProfilingEnabled() {
+		started = time.Now()
+	}
+
+	var rows *sql.Rows
+	var err error
+	if b.stmtCache == nil {
+		rows, err = b.SqlQuery(named.sql, args...)
+	} else {
+		stmt, err2 := b.stmtCache.prepare(named.sql)
+		if err2 != nil {
+			return nil, err2
+		}
+		if b.Tx != nil {
+			// The transaction specific statement must be closed, the
+			// cached one is kept.
+			stmt = b.Tx.Stmt(stmt)
+			defer stmt.Close()
+		}
+		rows, err = stmt.QueryContext(b.Context(), args...)
+		if err != nil {
+			b.Logger().Errorf("SQL error: %v: %v | %+v", err, named.sql, args)
+		}
+	}
+	if err != nil {
+		return nil, b.dialect.TranslateError(err)
+	}
+	defer rows.Close()
+
+	result, err2 := b.scanRows(rows, nil)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	info := b.ModelInfo(named.collection)
+	models := result
+	if info.HasStruct() {
+		models = make([]interface{}, 0, len(result))
+		for _, data := range result {
+			model, err := info.ModelFromMap(data.(map[string]interface{}))
+			if err != nil {
+				return nil, err
+			}
+			models = append(models, model)
+		}
+	}
+
+	for _, model := range models {
+		if err := db.CallModelHook(b, model, "AfterQuery"); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.ProfilingEnabled() {
+		b.Logger().WithFields(logrus.Fields{
+			"action": "named_sql",
+			"name":   name,
+			"ms":     time.Now().Sub(started).Nanoseconds() / 1000,
+		}).Debugf("Executed named sql query %v on collection %v", name, named.collection)
+	}
+
+	return models, nil
+}
@@ -49,7 +49,7 @@ func main() {
 	b.RegisterModel(&Project{})
 	b.RegisterModel(&Tag{})
 	b.EnableProfiling()
-	b.Build()
+	mustNot(b.Build())
 	//b.EnableSqlProfiling()
 
 	fmt.Printf("rels: %+v\n", b.ModelInfo("projects").Relations())
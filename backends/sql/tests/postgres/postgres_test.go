@@ -1,8 +1,11 @@
 package postgres_test
 
 import (
+	"reflect"
+	"time"
+
 	. "github.com/onsi/ginkgo"
-	//. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega"
 
 	_ "github.com/lib/pq"
 
@@ -12,10 +15,154 @@ import (
 	"github.com/theduke/go-dukedb/backends/tests"
 )
 
+type ArrayModel struct {
+	Id     uint64
+	Tags   []string `db:"array"`
+	Scores []int64  `db:"array"`
+}
+
+// Code is a custom type with a registered column type mapping.
+type Code string
+
+type MappedModel struct {
+	Id        uint64
+	Code      Code
+	OptCode   *Code
+	TagCode   Code `db:"type:char(3)"`
+	CreatedAt time.Time
+	Data      []byte
+}
+
 func builder() (db.Backend, apperror.Error) {
 	return sql.New("postgres", "postgres://@localhost:10001/test?sslmode=disable")
 }
 
 var _ = Describe("Postgres", func() {
 	tests.TestBackend(&setupFailed, builder)
+
+	It("Should use type mappings for column types", func() {
+		backend, err := builder()
+		Expect(err).ToNot(HaveOccurred())
+		backend.RegisterTypeMapping(reflect.TypeOf(Code("")), "varchar(10)")
+		Expect(backend.RegisterAndBuild(&MappedModel{})).ToNot(HaveOccurred())
+
+		info := backend.ModelInfo("mapped_models")
+		Expect(info.Attribute("Code").BackendType()).To(Equal("varchar(10)"))
+		Expect(info.Attribute("OptCode").BackendType()).To(Equal("varchar(10)"))
+		// Explicit types in the struct tag take precedence.
+		Expect(info.Attribute("TagCode").BackendType()).To(Equal("char(3)"))
+		// Default mappings of the dialect.
+		Expect(info.Attribute("CreatedAt").BackendType()).To(Equal("timestamp with time zone"))
+		Expect(info.Attribute("Data").BackendType()).To(Equal("bytea"))
+	})
+
+	It("Should run named sql queries", func() {
+		if setupFailed {
+			Skip("Postgres setup failed")
+		}
+
+		backend, err := sql.New("postgres", "postgres://@localhost:10001/test?sslmode=disable")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.RegisterAndBuild(&tests.TestModel{})).ToNot(HaveOccurred())
+		Expect(backend.DropCollection("test_models", true, true)).ToNot(HaveOccurred())
+		Expect(backend.CreateCollection("test_models")).ToNot(HaveOccurred())
+
+		m := tests.NewTestModel(1)
+		Expect(backend.Create(&m)).ToNot(HaveOccurred())
+
+		Expect(backend.RegisterNamedSQL("by_int", "test_models", "SELECT * FROM test_models WHERE int_val = $1")).ToNot(HaveOccurred())
+		res, err := backend.RunNamed("by_int", m.IntVal)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		Expect(res[0].(*tests.TestModel).Id).To(Equal(m.Id))
+
+		// Run again inside a transaction with the cached statement.
+		tx, err := backend.Begin()
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 2; i++ {
+			res, err = tx.(*sql.Backend).RunNamed("by_int", m.IntVal)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+		}
+		Expect(tx.Commit()).ToNot(HaveOccurred())
+
+		_, err = backend.RunNamed("unknown")
+		Expect(err.GetCode()).To(Equal("unknown_named_sql"))
+
+		// Database errors are translated by the dialect.
+		Expect(backend.RegisterNamedSQL("copy", "test_models", "INSERT INTO test_models SELECT * FROM test_models WHERE id = $1 RETURNING *")).ToNot(HaveOccurred())
+		_, err = backend.RunNamed("copy", m.Id)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("not_unique"))
+	})
+
+	It("Should map the rows of raw queries to models", func() {
+		if setupFailed {
+			Skip("Postgres setup failed")
+		}
+
+		backend, err := builder()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.RegisterAndBuild(&tests.TestModel{})).ToNot(HaveOccurred())
+
+		m := &tests.TestModel{StrVal: "raw", IntVal: 42}
+		Expect(backend.Create(m)).ToNot(HaveOccurred())
+
+		res, err := backend.QueryRaw("test_models", "SELECT * FROM test_models WHERE int_val = $1 AND str_val = $2", 42, "raw")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		Expect(res[0].(*tests.TestModel).Id).To(Equal(m.Id))
+		Expect(res[0].(*tests.TestModel).StrVal).To(Equal("raw"))
+
+		_, err = backend.QueryRaw("unknown", "SELECT 1")
+		Expect(err.GetCode()).To(Equal("unknown_model"))
+	})
+
+	It("Should return not_unique errors for unique constraint violations", func() {
+		if setupFailed {
+			Skip("Postgres setup failed")
+		}
+
+		backend, err := builder()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.RegisterAndBuild(&tests.TestModel{})).ToNot(HaveOccurred())
+		Expect(backend.DropCollection("test_models", true, true)).ToNot(HaveOccurred())
+		Expect(backend.CreateCollection("test_models")).ToNot(HaveOccurred())
+
+		_, err2 := backend.(*sql.Backend).SqlExec("CREATE UNIQUE INDEX test_models_str_val_key ON test_models (str_val)")
+		Expect(err2).ToNot(HaveOccurred())
+
+		Expect(backend.Create(&tests.TestModel{StrVal: "a"})).ToNot(HaveOccurred())
+		err = backend.Create(&tests.TestModel{StrVal: "a"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("not_unique"))
+		Expect(err.GetData()).To(Equal("test_models_str_val_key"))
+	})
+
+	It("Should store and filter array columns", func() {
+		if setupFailed {
+			Skip("Postgres setup failed")
+		}
+
+		backend, err := builder()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.RegisterAndBuild(&ArrayModel{})).ToNot(HaveOccurred())
+		Expect(backend.ModelInfo("array_models").Attribute("Tags").BackendType()).To(Equal("text[]"))
+		Expect(backend.DropCollection("array_models", true, true)).ToNot(HaveOccurred())
+		Expect(backend.CreateCollection("array_models")).ToNot(HaveOccurred())
+
+		m := &ArrayModel{Tags: []string{"go", "sql, \"quoted\""}, Scores: []int64{1, 2}}
+		Expect(backend.Create(m)).ToNot(HaveOccurred())
+		Expect(backend.Create(&ArrayModel{Tags: []string{"rust"}})).ToNot(HaveOccurred())
+
+		res, err := backend.FindOne("array_models", m.Id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.(*ArrayModel).Tags).To(Equal(m.Tags))
+		Expect(res.(*ArrayModel).Scores).To(Equal(m.Scores))
+
+		Expect(backend.Q("array_models").FilterCond("tags", "contains", "go").Count()).To(Equal(1))
+		Expect(backend.Q("array_models").FilterCond("tags", "contains", []string{"go", "rust"}).Count()).To(Equal(0))
+		Expect(backend.Q("array_models").FilterCond("tags", "overlaps", []string{"go", "rust"}).Count()).To(Equal(2))
+		Expect(backend.Q("array_models").FilterCond("scores", "contains", 2).Count()).To(Equal(1))
+	})
 })
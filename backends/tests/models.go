@@ -28,6 +28,9 @@ type Project struct {
 
 	// has-many with struct pointer slice
 	ArchviedTodos []*Task
+
+	// polymorphic has-many.
+	Comments []Comment `db:"polymorphic:CommentableType:CommentableId"`
 }
 
 type Task struct {
@@ -55,6 +58,110 @@ type Task struct {
 	categories []*Tag `db:"m2m"`
 }
 
+// Notes are soft deleted.
+type Note struct {
+	Id    uint64
+	Title string `db:"required"`
+
+	// m2m with struct slice.
+	Tags []Tag `db:"m2m"`
+
+	// has-many with struct slice.
+	Attachments []Attachment
+
+	DeletedAt *time.Time `db:"soft-delete"`
+}
+
+type Attachment struct {
+	Id       uint64
+	NoteId   uint64
+	Filename string `db:"required"`
+}
+
+// Milestone names are unique per project.
+type Milestone struct {
+	Id uint64
+
+	Name string `db:"required;unique-with:Project"`
+
+	Project   *Project
+	ProjectId uint64
+}
+
+// Account emails are unique ignoring case.
+type Account struct {
+	Id    uint64
+	Email string `db:"required;unique-ci"`
+}
+
+// Subscriber emails are unique among subscribers that were not deleted.
+type Subscriber struct {
+	Id        uint64
+	Email     string     `db:"required;unique;unique-where:deleted_at IS NULL"`
+	DeletedAt *time.Time `db:"soft-delete"`
+}
+
+// Product variants are stored in a map keyed by the SKU.
+type Product struct {
+	Id   uint64
+	Name string
+
+	Variants map[string]Variant `db:"map-key:Sku"`
+}
+
+type Variant struct {
+	Id        uint64
+	ProductId uint64
+	Sku       string
+}
+
+// Memberships have a composite primary key.
+type Membership struct {
+	UserId  uint64 `db:"primary-key"`
+	GroupId uint64 `db:"primary-key"`
+	Role    string
+
+	// m2m with a pivot keyed by the composite primary key.
+	Tags []Tag `db:"m2m"`
+}
+
+// Comments belong to either a task or a project.
+type Comment struct {
+	Id   uint64
+	Body string
+
+	CommentableType string
+	CommentableId   uint64
+	Commentable     interface{} `db:"polymorphic:CommentableType:CommentableId"`
+}
+
+// Categories form a tree with relations to their own collection.
+type Category struct {
+	Id   uint64
+	Name string
+
+	Parent   *Category
+	ParentId uint64 `db:"ignore-zero"`
+
+	Children []Category
+}
+
+// Sessions have a UUID primary key that is generated on create.
+type Session struct {
+	Id   string `db:"pk-uuid"`
+	Name string
+}
+
+// sequenceIDGenerator generates the ids "seq-1", "seq-2", ...
+type sequenceIDGenerator struct {
+	next int
+}
+
+func (g *sequenceIDGenerator) GenerateID() (string, apperror.Error) {
+	g.next++
+	return fmt.Sprintf("seq-%v", g.next), nil
+}
+
 type File struct {
 	Id       uint64
 	TaskId   uint64
@@ -103,6 +210,18 @@ func (h *HooksModel) Validate() error {
 	return nil
 }
 
+func (h *HooksModel) BeforeSave(Backend) error {
+	h.CalledHooks = append(h.CalledHooks, "before_save")
+	if h.HookError {
+		return apperror.New("before_save")
+	}
+	return nil
+}
+
+func (h *HooksModel) AfterSave(Backend) {
+	h.CalledHooks = append(h.CalledHooks, "after_save")
+}
+
 func (h *HooksModel) BeforeCreate(Backend) error {
 	h.CalledHooks = append(h.CalledHooks, "before_create")
 	if h.HookError {
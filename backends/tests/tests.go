@@ -1,7 +1,10 @@
 package tests
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -9,6 +12,7 @@ import (
 	"github.com/theduke/go-apperror"
 
 	db "github.com/theduke/go-dukedb"
+	"github.com/theduke/go-dukedb/expressions"
 )
 
 var _ = fmt.Printf
@@ -17,6 +21,10 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 	doSkip := false
 	var backend db.Backend
 
+	// hasPartialUnique is false if the backend can not create the
+	// subscribers collection, which needs a partial unique index.
+	hasPartialUnique := true
+
 	BeforeEach(func() {
 		if *skipFlag || doSkip {
 			Skip("Skipping due to previous error.")
@@ -28,17 +36,30 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 
 		backend.SetDebug(true)
 
-		backend.RegisterModel(&Tag{})
-		backend.RegisterModel(&Project{})
-		backend.RegisterModel(&Task{})
-		backend.RegisterModel(&File{})
-
-		backend.RegisterModel(&TestModel{})
-		backend.RegisterModel(&TestParent{})
-		backend.RegisterModel(&HooksModel{})
-		backend.RegisterModel(&ValidationsModel{})
-		backend.RegisterModel(&MarshalledModel{})
-		backend.Build()
+		err = backend.RegisterAndBuild(
+			&Tag{},
+			&Project{},
+			&Task{},
+			&File{},
+			&Note{},
+			&Attachment{},
+			&Milestone{},
+			&Account{},
+			&Subscriber{},
+			&Product{},
+			&Variant{},
+			&Membership{},
+			&Session{},
+			&Category{},
+			&Comment{},
+
+			&TestModel{},
+			&TestParent{},
+			&HooksModel{},
+			&ValidationsModel{},
+			&MarshalledModel{},
+		)
+		Expect(err).ToNot(HaveOccurred())
 	})
 
 	It("Should drop all collections", func() {
@@ -48,6 +69,27 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 		doSkip = false
 	})
 
+	It("Should drop all collections with progress, pivots last", func() {
+		doSkip = true
+		dropped := make([]string, 0)
+		res, err := backend.DropAllCollectionsWithProgress(func(col string, index, total int, err apperror.Error) {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(index).To(Equal(len(dropped)))
+			Expect(total).To(Equal(len(backend.Collections(true))))
+			dropped = append(dropped, col)
+		}, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Failed).To(BeEmpty())
+		Expect(res.Dropped).To(Equal(dropped))
+
+		models := backend.Collections(false)
+		Expect(dropped[:len(models)]).To(Equal(models))
+		for _, col := range dropped[len(models):] {
+			Expect(backend.ModelInfo(col).IsPivot()).To(BeTrue())
+		}
+		doSkip = false
+	})
+
 	It("Should create collections", func() {
 		doSkip = true
 		err := backend.CreateCollection(
@@ -60,8 +102,24 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 			"projects",
 			"tasks",
 			"files",
+			"notes",
+			"attachments",
+			"milestones",
+			"accounts",
+			"products",
+			"variants",
+			"memberships",
+			"sessions",
+			"categories",
+			"comments",
 		)
 		Expect(err).ToNot(HaveOccurred())
+
+		err = backend.CreateCollection("subscribers")
+		if err != nil {
+			Expect(err.GetCode()).To(Equal("unsupported_partial_unique"))
+			hasPartialUnique = false
+		}
 		doSkip = false
 	})
 
@@ -82,6 +140,29 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 		Expect(*m.(*TestModel)).To(Equal(testModel))
 	})
 
+	It("Should not modify the query when counting", func() {
+		Expect(backend.Create(&Project{Name: "P1"})).ToNot(HaveOccurred())
+		Expect(backend.Create(&Project{Name: "P2"})).ToNot(HaveOccurred())
+
+		q := backend.Q("projects").Field("Name").Sort("name", true)
+		Expect(q.Count()).To(Equal(2))
+
+		res, err := q.Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(2))
+		Expect(res[0].(*Project).Name).To(Equal("P1"))
+		Expect(q.GetStatement().Fields()).To(HaveLen(1))
+
+		grouped := backend.Q("projects").Group("name")
+		Expect(grouped.Count()).To(Equal(2))
+		Expect(grouped.Count()).To(Equal(2))
+
+		// All groups are counted, independent of the limit and offset.
+		paginated := backend.Q("projects").Group("name").Sort("name", true).Limit(1).Offset(1)
+		Expect(paginated.Count()).To(Equal(2))
+		Expect(paginated.GetLimit()).To(Equal(1))
+	})
+
 	It("Should count with 1 entry", func() {
 		Expect(backend.Create(&Project{Name: "Test"})).ToNot(HaveOccurred())
 		Expect(backend.Q("projects").Count()).To(Equal(1))
@@ -126,17 +207,322 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 		Expect(backend.Create(&m3)).ToNot(HaveOccurred())
 
 		err := backend.Q("test_models").Delete()
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("missing_filter"))
+
+		err = backend.Q("test_models").AllowAll().Delete()
 		Expect(err).ToNot(HaveOccurred())
 		Expect(backend.Q("test_models").Count()).To(Equal(0))
 	})
 
+	It("Should enforce case insensitive uniqueness", func() {
+		Expect(backend.Create(&Account{Email: "alice@x.com"})).ToNot(HaveOccurred())
+
+		err := backend.Create(&Account{Email: "Alice@X.com"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unique_constraint_violation"))
+
+		bob := &Account{Email: "bob@x.com"}
+		Expect(backend.Create(bob)).ToNot(HaveOccurred())
+
+		bob.Email = "BOB@x.com"
+		Expect(backend.Update(bob)).ToNot(HaveOccurred())
+		bob.Email = "ALICE@x.com"
+		err = backend.Update(bob)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unique_constraint_violation"))
+	})
+
+	It("Should enforce uniqueness only among models matching unique-where", func() {
+		if !hasPartialUnique {
+			Skip("Partial unique indexes are not supported")
+		}
+		s := &Subscriber{Email: "alice@x.com"}
+		Expect(backend.Create(s)).ToNot(HaveOccurred())
+
+		err := backend.Create(&Subscriber{Email: "alice@x.com"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unique_constraint_violation"))
+
+		Expect(backend.Delete(s)).ToNot(HaveOccurred())
+		Expect(backend.Create(&Subscriber{Email: "alice@x.com"})).ToNot(HaveOccurred())
+		Expect(backend.Q("subscribers").WithDeleted().Filter("email", "alice@x.com").Count()).To(Equal(2))
+
+		bob := &Subscriber{Email: "bob@x.com"}
+		Expect(backend.Create(bob)).ToNot(HaveOccurred())
+		Expect(backend.Update(bob)).ToNot(HaveOccurred())
+		bob.Email = "alice@x.com"
+		err = backend.Update(bob)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unique_constraint_violation"))
+	})
+
+	It("Should deregister and replace models", func() {
+		err := backend.DeregisterModel("tags")
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("model_still_referenced"))
+
+		Expect(backend.DeregisterModel("accounts")).ToNot(HaveOccurred())
+		Expect(backend.HasCollection("accounts")).To(BeFalse())
+
+		info, err := backend.RegisterModel(&Tag{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.ModelInfo("tags") == info).To(BeTrue())
+		Expect(backend.ModelInfo("tasks").Relation("Tags").RelatedModel() == info).To(BeTrue())
+	})
+
+	It("Should call bulk hooks", func() {
+		calls := make([]string, 0)
+		for _, hook := range []string{db.HOOK_BEFORE_BULK_CREATE, db.HOOK_AFTER_BULK_CREATE, db.HOOK_AFTER_BULK_DELETE} {
+			name := hook
+			backend.RegisterHook(name, func(b db.Backend, obj interface{}) apperror.Error {
+				op := obj.(*db.BulkOperation)
+				Expect(op.Collection).To(Equal("test_models"))
+				calls = append(calls, name)
+				return nil
+			})
+		}
+		backend.RegisterHook(db.HOOK_BEFORE_BULK_UPDATE, func(b db.Backend, obj interface{}) apperror.Error {
+			return apperror.New("bulk_update_denied")
+		})
+
+		m1 := NewTestModel(80)
+		m2 := NewTestModel(81)
+		Expect(backend.Create(&m1, &m2)).ToNot(HaveOccurred())
+
+		err := backend.UpdateByMap(backend.Q("test_models").Filter("id", m1.Id), map[string]interface{}{"str_val": "x"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("bulk_update_denied"))
+
+		Expect(backend.Q("test_models").Filter("id", m1.Id).Delete()).ToNot(HaveOccurred())
+		Expect(calls).To(Equal([]string{db.HOOK_BEFORE_BULK_CREATE, db.HOOK_AFTER_BULK_CREATE, db.HOOK_AFTER_BULK_DELETE}))
+	})
+
+	It("Should pass statements to the statement interceptor", func() {
+		m1 := &TestModel{StrVal: "intercepted", IntVal: 1}
+		m2 := &TestModel{StrVal: "intercepted", IntVal: 2}
+		Expect(backend.Create(m1, m2)).ToNot(HaveOccurred())
+
+		backend.SetStatementInterceptor(func(stmt expressions.Expression) (expressions.Expression, apperror.Error) {
+			switch s := stmt.(type) {
+			case *expressions.SelectStmt:
+				if s.Collection() == "test_models" {
+					s.FilterAnd(expressions.NewFieldValFilter("test_models", "int_val", expressions.OPERATOR_EQ, int64(2)))
+				}
+			case *expressions.DeleteStmt:
+				return nil, apperror.New("delete_denied")
+			}
+			return stmt, nil
+		})
+
+		res, err := backend.Q("test_models").Filter("str_val", "intercepted").Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		Expect(res[0].(*TestModel).Id).To(Equal(m2.Id))
+
+		// Grouped counts are intercepted as well.
+		Expect(backend.Q("test_models").Filter("str_val", "intercepted").Group("int_val").Count()).To(Equal(1))
+
+		err = backend.Delete(m1)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("delete_denied"))
+
+		backend.SetStatementInterceptor(nil)
+		Expect(backend.Q("test_models").Filter("str_val", "intercepted").Count()).To(Equal(2))
+	})
+
+	It("Should refuse to update all rows without a filter", func() {
+		err := backend.UpdateByMap(backend.Q("test_models"), map[string]interface{}{"str_val": "x"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("missing_filter"))
+	})
+
+	It("Should return the number of updated models with UpdateByMapCount()", func() {
+		for i := 1; i <= 3; i++ {
+			Expect(backend.Create(&TestModel{StrVal: "mass_update", IntVal: int64(i)})).ToNot(HaveOccurred())
+		}
+
+		q := backend.Q("test_models").Filter("str_val", "mass_update").FilterCond("int_val", ">", 1)
+		count, err := backend.UpdateByMapCount(q, map[string]interface{}{"int_val": 10})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(int64(2)))
+
+		count, err = backend.UpdateByMapCount(backend.Q("test_models").Filter("str_val", "none"), map[string]interface{}{"int_val": 10})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+
+		Expect(backend.Q("test_models").Filter("str_val", "mass_update").Filter("int_val", 10).Count()).To(Equal(2))
+	})
+
+	It("Should update only the first models by sort and limit with UpdateByMap()", func() {
+		for i := 1; i <= 5; i++ {
+			Expect(backend.Create(&TestModel{StrVal: "bounded", IntVal: int64(i)})).ToNot(HaveOccurred())
+		}
+
+		q := backend.Q("test_models").Filter("str_val", "bounded").Sort("IntVal", false).Limit(2)
+		Expect(backend.UpdateByMap(q, map[string]interface{}{"str_val": "bounded_top"})).ToNot(HaveOccurred())
+
+		models, err := backend.Q("test_models").Filter("str_val", "bounded_top").Sort("IntVal", true).Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(models).To(HaveLen(2))
+		Expect(models[0].(*TestModel).IntVal).To(Equal(int64(4)))
+		Expect(models[1].(*TestModel).IntVal).To(Equal(int64(5)))
+	})
+
+	It("Should delete only the first models by sort and limit with DeleteMany()", func() {
+		for i := 1; i <= 5; i++ {
+			Expect(backend.Create(&TestModel{StrVal: "chunked", IntVal: int64(i)})).ToNot(HaveOccurred())
+		}
+
+		q := backend.Q("test_models").Filter("str_val", "chunked").Sort("IntVal", true).Limit(2)
+		Expect(backend.DeleteMany(q)).ToNot(HaveOccurred())
+
+		models, err := backend.Q("test_models").Filter("str_val", "chunked").Sort("IntVal", true).Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(models).To(HaveLen(3))
+		Expect(models[0].(*TestModel).IntVal).To(Equal(int64(3)))
+	})
+
+	It("Should honor the nulls placement of sorts with DeleteMany()", func() {
+		now := time.Now()
+		withTime := &Project{Name: "delete_nulls", UpdatedAt: &now}
+		Expect(backend.Create(withTime)).ToNot(HaveOccurred())
+		withoutTime := &Project{Name: "delete_nulls"}
+		Expect(backend.Create(withoutTime)).ToNot(HaveOccurred())
+
+		q := backend.Q("projects").Filter("name", "delete_nulls").SortNulls("UpdatedAt", true, true).Limit(1)
+		Expect(backend.DeleteMany(q)).ToNot(HaveOccurred())
+
+		models, err := backend.Q("projects").Filter("name", "delete_nulls").Find()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(models).To(HaveLen(1))
+		Expect(models[0].(*Project).Id).To(Equal(withTime.Id))
+	})
+
+	It("Should match nothing with an empty IN filter", func() {
+		Expect(backend.Create(&TestModel{StrVal: "empty_in"})).ToNot(HaveOccurred())
+
+		q := backend.Q("test_models").Filter("str_val", "empty_in")
+		Expect(q.Clone().FilterCond("int_val", "in", []int64{}).Count()).To(Equal(0))
+		Expect(q.Clone().NotCond("int_val", "in", []int64{}).Count()).To(Equal(1))
+	})
+
+	It("Should return the number of deleted models with DeleteManyCount()", func() {
+		for i := 1; i <= 3; i++ {
+			Expect(backend.Create(&TestModel{StrVal: "purged", IntVal: int64(i)})).ToNot(HaveOccurred())
+		}
+
+		count, err := backend.DeleteManyCount(backend.Q("test_models").Filter("str_val", "purged").FilterCond("int_val", "<", 3))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(int64(2)))
+
+		count, err = backend.DeleteManyCount(backend.Q("test_models").Filter("str_val", "none"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+
+		Expect(backend.Q("test_models").Filter("str_val", "purged").Count()).To(Equal(1))
+	})
+
+	It("Should paginate with the total count using FindPaginated()", func() {
+		for i := 1; i <= 5; i++ {
+			Expect(backend.Create(&TestModel{StrVal: "paginated", IntVal: int64(i)})).ToNot(HaveOccurred())
+		}
+
+		q := backend.Q("test_models").Filter("str_val", "paginated").Sort("IntVal", true).Paginate(2, 2)
+		models, total, err := q.FindPaginated()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(total).To(Equal(5))
+		Expect(models).To(HaveLen(2))
+		Expect(models[0].(*TestModel).IntVal).To(Equal(int64(3)))
+		Expect(q.GetLimit()).To(Equal(2))
+		Expect(q.GetOffset()).To(Equal(2))
+
+		models, total, err = backend.Q("test_models").Filter("str_val", "paginated").Paginate(3, 2).FindPaginated()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(total).To(Equal(5))
+		Expect(models).To(HaveLen(1))
+
+		Expect(backend.Q("test_models").Paginate(0, 10).GetOffset()).To(Equal(0))
+	})
+
+	It("Should create many models with CreateMany()", func() {
+		m1 := &TestModel{StrVal: "many", IntVal: 1}
+		m2 := &TestModel{StrVal: "many", IntVal: 2}
+		tag := &Tag{Tag: "many"}
+		Expect(backend.CreateMany(m1, tag, m2)).ToNot(HaveOccurred())
+
+		Expect(m1.Id).ToNot(BeZero())
+		Expect(m2.Id).ToNot(BeZero())
+		Expect(m1.Id).ToNot(Equal(m2.Id))
+		Expect(tag.Id).ToNot(BeZero())
+
+		m, err := backend.FindOne("test_models", m2.Id)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.(*TestModel).IntVal).To(Equal(int64(2)))
+
+		Expect(backend.CreateMany(&TestModel{StrVal: "many", IntVal: 3}, &Project{})).To(HaveOccurred())
+		if _, ok := backend.(db.TransactionBackend); ok {
+			// The test model created before the failing project is rolled back.
+			Expect(backend.Q("test_models").Filter("int_val", 3).Count()).To(Equal(0))
+		}
+	})
+
+	It("Should load positional rows with BulkLoad()", func() {
+		rows := [][]interface{}{
+			{"bulk", int64(1)},
+			{"bulk", int64(2)},
+		}
+		n, err := backend.BulkLoad("test_models", []string{"str_val", "int_val"}, rows)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(2))
+
+		count, err := backend.Q("test_models").Filter("str_val", "bulk").Count()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(2))
+
+		n, err = backend.BulkLoad("test_models", []string{"str_val"}, [][]interface{}{{"a"}, {"a", "b"}})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("invalid_row"))
+		Expect(n).To(Equal(0))
+		Expect(backend.Q("test_models").Filter("str_val", "a").Count()).To(Equal(0))
+	})
+
+	It("Should validate and convert data in CreateByMap()", func() {
+		m, err := backend.CreateByMap("test_models", map[string]interface{}{"str_val": "by_map", "int_val": "7"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.(*TestModel).IntVal).To(Equal(int64(7)))
+
+		_, err = backend.CreateByMap("test_models", map[string]interface{}{"str_val": "by_map", "inexistant": 1})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unknown_field"))
+
+		pivot := backend.ModelInfo("tasks").Relation("Tags").BackendName()
+		_, err = backend.CreateByMap(pivot, map[string]interface{}{"tasks_id": 1, "inexistant": 2})
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unknown_field"))
+	})
+
+	It("Should return a map from CreateByMap() for collections without a struct", func() {
+		relation := backend.ModelInfo("tasks").Relation("Tags")
+		res, err := backend.CreateByMap(relation.BackendName(), map[string]interface{}{
+			relation.PivotLocalField():   1,
+			relation.PivotForeignField(): 2,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		row, ok := res.(map[string]interface{})
+		Expect(ok).To(BeTrue())
+		Expect(row[relation.PivotLocalField()]).To(BeEquivalentTo(1))
+		Expect(row[relation.PivotForeignField()]).To(BeEquivalentTo(2))
+	})
+
 	It("Should should work with marshalled fields", func() {
 
 	})
 
 	Describe("Marshalled fields", func() {
 		BeforeEach(func() {
-			Expect(backend.Q("marshalled_models").Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("marshalled_models").AllowAll().Delete()).ToNot(HaveOccurred())
 		})
 
 		It("Should persist marshalled field with MAP and unmarshal on query", func() {
@@ -153,6 +539,24 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 			Expect(rawModel.(*MarshalledModel).MapVal).To(Equal(data))
 		})
 
+		It("Should update a JSON path of a marshalled field", func() {
+			m := &MarshalledModel{
+				MapVal: map[string]interface{}{"key1": float64(22)},
+			}
+			Expect(backend.Create(m)).ToNot(HaveOccurred())
+
+			q := backend.Q("marshalled_models").Filter("id", m.Id)
+			Expect(backend.UpdateJSONPath(q, "MapVal", "nested.key2", "lala")).ToNot(HaveOccurred())
+
+			rawModel, err := backend.FindOne("marshalled_models", m.Id)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(rawModel.(*MarshalledModel).MapVal).To(Equal(map[string]interface{}{
+				"key1":   float64(22),
+				"nested": map[string]interface{}{"key2": "lala"},
+			}))
+		})
+
 		It("Should persist marshalled field with STRUCT and unmarshal on query", func() {
 			data := MarshalledData{
 				IntVal:    22,
@@ -186,6 +590,24 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 
 			Expect(rawModel.(*MarshalledModel).StructPtrVal).To(Equal(data))
 		})
+
+		It("Should skip rows with invalid marshalled data with .SkipErrors()", func() {
+			Expect(backend.Create(&MarshalledModel{MapVal: map[string]interface{}{"a": "b"}})).ToNot(HaveOccurred())
+
+			if _, err := backend.CreateByMap("marshalled_models", map[string]interface{}{"map_val": "{invalid"}); err != nil {
+				Skip("Backend does not store invalid marshalled data")
+			}
+
+			_, err := backend.Q("marshalled_models").Find()
+			Expect(err).To(HaveOccurred())
+
+			q := backend.Q("marshalled_models").SkipErrors()
+			res, err := q.Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].(*MarshalledModel).MapVal).To(Equal(map[string]interface{}{"a": "b"}))
+			Expect(q.GetRowErrors()).To(HaveLen(1))
+		})
 	})
 
 	Describe("Querying", func() {
@@ -216,6 +638,755 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 			Expect(m.(*TestModel).Id).To(Equal(model.Id))
 		})
 
+		It("Should return the normalized statement", func() {
+			empty := &MarshalledModel{}
+			filled := &MarshalledModel{StructPtrVal: &MarshalledData{IntVal: 5, StringVal: "ptr"}}
+			Expect(backend.Create(empty)).ToNot(HaveOccurred())
+			Expect(backend.Create(filled)).ToNot(HaveOccurred())
+
+			q := backend.Q("marshalled_models").FilterCond("Id", "in", []uint64{empty.Id, filled.Id}).Sort("Id", true)
+
+			stmt, err := q.NormalizedStatement()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stmt).To(BeIdenticalTo(q.GetStatement()))
+			Expect(stmt.Sorts()).To(HaveLen(1))
+			Expect(stmt.Sorts()[0].Expression()).To(Equal(expressions.NewColFieldIdExpr("marshalled_models", "id")))
+
+			// Normalizing again must not change the statement.
+			_, err = q.NormalizedStatement()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stmt.Sorts()).To(HaveLen(1))
+
+			// The normalized statement must still run and reload the models.
+			res, err := q.Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(2))
+			Expect(res[0].(*MarshalledModel).Id).To(Equal(empty.Id))
+			Expect(res[0].(*MarshalledModel).StructPtrVal).To(BeNil())
+			Expect(res[1].(*MarshalledModel).Id).To(Equal(filled.Id))
+			Expect(res[1].(*MarshalledModel).StructPtrVal).To(Equal(&MarshalledData{IntVal: 5, StringVal: "ptr"}))
+		})
+
+		It("Should .Count() grouped results", func() {
+			for _, val := range []string{"a", "a", "b"} {
+				model := &TestModel{StrVal: val}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			Expect(backend.Q("test_models").Count()).To(Equal(3))
+			Expect(backend.Q("test_models").Group("StrVal").Count()).To(Equal(2))
+			Expect(backend.Q("test_models").Filter("str_val", "a").Group("str_val").Count()).To(Equal(1))
+		})
+
+		It("Should filter groups with .Having()", func() {
+			for _, val := range []string{"a", "a", "b"} {
+				model := &TestModel{StrVal: val}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			Expect(backend.Q("test_models").Group("str_val").Having("count", ">", 1).Count()).To(Equal(1))
+
+			type groupCount struct {
+				StrVal string
+				Num    int
+			}
+
+			var rows []groupCount
+			err := backend.Q("test_models").
+				Group("str_val").
+				Field("str_val").
+				FieldExpr(expressions.NewFieldSelectorExpr("num", expressions.NewFuncExpr("COUNT", expressions.NewTextExpr("*")), reflect.TypeOf(0))).
+				Having("num", "<", 2).
+				PluckInto(&rows)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal([]groupCount{{StrVal: "b", Num: 1}}))
+		})
+
+		It("Should select per group counts", func() {
+			for _, val := range []string{"a", "a", "b"} {
+				model := &TestModel{StrVal: val}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			type groupCount struct {
+				StrVal string
+				Count  int
+			}
+
+			var rows []groupCount
+			err := backend.Q("test_models").
+				Group("str_val").
+				Field("str_val").
+				FieldExpr(expressions.NewFieldSelectorExpr("count", expressions.NewFuncExpr("COUNT", expressions.NewTextExpr("*")), reflect.TypeOf(0))).
+				PluckInto(&rows)
+			Expect(err).ToNot(HaveOccurred())
+
+			counts := make(map[string]int)
+			for _, row := range rows {
+				counts[row.StrVal] = row.Count
+			}
+			Expect(counts).To(Equal(map[string]int{"a": 2, "b": 1}))
+		})
+
+		It("Should filter with .IsNull() and .IsNotNull()", func() {
+			now := time.Now()
+			p1 := &Project{Name: "null_check"}
+			p2 := &Project{Name: "null_check", UpdatedAt: &now}
+			Expect(backend.Create(p1, p2)).ToNot(HaveOccurred())
+
+			res, err := backend.Q("projects").Filter("name", "null_check").IsNull("updated_at").Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].(*Project).Id).To(Equal(p1.Id))
+
+			res, err = backend.Q("projects").Filter("name", "null_check").IsNotNull("updated_at").Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].(*Project).Id).To(Equal(p2.Id))
+		})
+
+		It("Should select distinct values with .Distinct()", func() {
+			for _, val := range []string{"a", "a", "b"} {
+				model := &TestModel{StrVal: val}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			rows, err := backend.Q("test_models").Distinct("str_val").Pluck()
+			Expect(err).ToNot(HaveOccurred())
+
+			vals := make([]interface{}, 0)
+			for _, row := range rows {
+				vals = append(vals, row["str_val"])
+			}
+			Expect(vals).To(ConsistOf("a", "b"))
+
+			Expect(backend.Q("test_models").Distinct("str_val").Count()).To(Equal(2))
+		})
+
+		It("Should select the latest row per group with .LatestPer()", func() {
+			models := []*TestModel{
+				&TestModel{IntVal: 1, StrVal: "a"},
+				&TestModel{IntVal: 1, StrVal: "b"},
+				&TestModel{IntVal: 2, StrVal: "c"},
+				&TestModel{IntVal: 2, StrVal: "d"},
+				&TestModel{IntVal: 3, StrVal: "e"},
+			}
+			for _, model := range models {
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			strVals := func(q *db.Query) []string {
+				res, err := q.Find()
+				Expect(err).ToNot(HaveOccurred())
+				vals := make([]string, 0)
+				for _, m := range res {
+					vals = append(vals, m.(*TestModel).StrVal)
+				}
+				return vals
+			}
+
+			Expect(strVals(backend.Q("test_models").LatestPer("int_val", "id"))).To(Equal([]string{"b", "d", "e"}))
+
+			// The latest row is picked among the filtered rows.
+			q := backend.Q("test_models").FilterCond("str_val", "!=", "d").LatestPer("int_val", "id")
+			Expect(strVals(q)).To(Equal([]string{"b", "c", "e"}))
+
+			// Counts and pagination totals include one row per group.
+			Expect(backend.Q("test_models").LatestPer("int_val", "id").Count()).To(Equal(3))
+			res, total, err := backend.Q("test_models").LatestPer("int_val", "id").Limit(2).FindPaginated()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(2))
+			Expect(total).To(Equal(3))
+		})
+
+		It("Should check for matching rows with .Exists()", func() {
+			model := &TestModel{StrVal: "exists"}
+			Expect(backend.Create(model)).ToNot(HaveOccurred())
+
+			exists, err := backend.Q("test_models").Filter("str_val", "exists").Exists()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+
+			exists, err = backend.Q("test_models").Filter("str_val", "missing").Exists()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeFalse())
+
+			// Pivot collections do not have a primary key.
+			tag := Tag{Tag: "exists"}
+			Expect(backend.Create(&tag)).ToNot(HaveOccurred())
+			task := &Task{Name: "exists", Tags: []Tag{tag}}
+			Expect(backend.Create(task)).ToNot(HaveOccurred())
+
+			pivot := backend.ModelInfo("tasks").Relation("Tags").BackendName()
+			exists, err = backend.Q(pivot).Filter("tasks_id", task.Id).Exists()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+		})
+
+		It("Should generate UUID primary keys", func() {
+			s := &Session{Name: "a"}
+			Expect(backend.Create(s)).ToNot(HaveOccurred())
+			Expect(s.Id).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+
+			m, err := backend.FindOne("sessions", s.Id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.(*Session).Name).To(Equal("a"))
+
+			// Existing ids are kept.
+			s2 := &Session{Id: "fixed", Name: "b"}
+			Expect(backend.Create(s2)).ToNot(HaveOccurred())
+			Expect(s2.Id).To(Equal("fixed"))
+		})
+
+		It("Should keep a custom id generator in transactions and context copies", func() {
+			backend.SetIDGenerator(&sequenceIDGenerator{})
+
+			s := &Session{Name: "a"}
+			Expect(backend.WithContext(context.Background()).Create(s)).ToNot(HaveOccurred())
+			Expect(s.Id).To(Equal("seq-1"))
+
+			if transactionBackend, ok := backend.(db.TransactionBackend); ok {
+				tx, err := transactionBackend.Begin()
+				Expect(err).ToNot(HaveOccurred())
+				s2 := &Session{Name: "b"}
+				Expect(tx.Create(s2)).ToNot(HaveOccurred())
+				Expect(s2.Id).To(Equal("seq-2"))
+				Expect(tx.Rollback()).ToNot(HaveOccurred())
+			}
+		})
+
+		It("Should find models with composite primary keys by map", func() {
+			m := &Membership{UserId: 4, GroupId: 5, Role: "admin"}
+			Expect(backend.Create(m)).ToNot(HaveOccurred())
+
+			found, err := backend.FindOne("memberships", map[string]interface{}{"UserId": 4, "group_id": 5})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found.(*Membership).Role).To(Equal("admin"))
+
+			_, err = backend.FindOne("memberships", map[string]interface{}{"UserId": 4})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_composite_id"))
+		})
+
+		It("Should manage m2m relations of models with composite primary keys", func() {
+			tags := []Tag{{Tag: "a"}, {Tag: "b"}}
+			Expect(backend.Create(&tags[0], &tags[1])).ToNot(HaveOccurred())
+
+			m1 := &Membership{UserId: 6, GroupId: 7}
+			m2 := &Membership{UserId: 6, GroupId: 8}
+			Expect(backend.Create(m1, m2)).ToNot(HaveOccurred())
+
+			col1, err := backend.M2M(m1, "Tags")
+			Expect(err).ToNot(HaveOccurred())
+			col2, err := backend.M2M(m2, "Tags")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(col1.Add(tags[0], tags[1])).ToNot(HaveOccurred())
+			Expect(col2.Add(tags[0])).ToNot(HaveOccurred())
+			Expect(col1.Count()).To(Equal(2))
+			Expect(col2.Count()).To(Equal(1))
+			Expect(col1.Contains(tags[1])).To(BeTrue())
+			Expect(col2.Contains(tags[1])).To(BeFalse())
+
+			Expect(col1.Remove(tags[0])).ToNot(HaveOccurred())
+			Expect(col1.Count()).To(Equal(1))
+			Expect(col2.ContainsId(tags[0].Id)).To(BeTrue())
+
+			Expect(col1.Clear()).ToNot(HaveOccurred())
+			Expect(col1.Count()).To(Equal(0))
+			Expect(col2.Count()).To(Equal(1))
+
+			// Relations are persisted with the pivot keyed by both fields.
+			m3 := &Membership{UserId: 6, GroupId: 9, Tags: []Tag{tags[0], tags[1]}}
+			Expect(backend.Create(m3)).ToNot(HaveOccurred())
+			col3, err := backend.M2M(m3, "Tags")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(col3.Count()).To(Equal(2))
+			Expect(col2.Count()).To(Equal(1))
+
+			// Composite m2m relations can not be joined.
+			_, err = backend.Q("memberships").Join("Tags").Find()
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("unsupported_composite_m2m"))
+		})
+
+		It("Should support composite primary keys", func() {
+			m1 := &Membership{UserId: 1, GroupId: 2, Role: "admin"}
+			Expect(backend.Create(m1)).ToNot(HaveOccurred())
+			m2 := &Membership{UserId: 1, GroupId: 3, Role: "member"}
+			Expect(backend.Create(m2)).ToNot(HaveOccurred())
+
+			m, err := backend.FindOne("memberships", []uint64{1, 3})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.(*Membership).Role).To(Equal("member"))
+
+			m1.Role = "owner"
+			Expect(backend.Update(m1)).ToNot(HaveOccurred())
+			m, err = backend.FindOne("memberships", []interface{}{1, 2})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.(*Membership).Role).To(Equal("owner"))
+
+			Expect(backend.Delete(m1)).ToNot(HaveOccurred())
+			Expect(backend.Q("memberships").Count()).To(Equal(1))
+
+			_, err = backend.FindOne("memberships", 1)
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_composite_id"))
+		})
+
+		It("Should soft delete models with a soft-delete attribute", func() {
+			n1 := &Note{Title: "N1"}
+			Expect(backend.Create(n1)).ToNot(HaveOccurred())
+			n2 := &Note{Title: "N2"}
+			Expect(backend.Create(n2)).ToNot(HaveOccurred())
+
+			Expect(backend.Delete(n1)).ToNot(HaveOccurred())
+			Expect(n1.DeletedAt).ToNot(BeNil())
+
+			res, err := backend.Q("notes").Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].(*Note).Id).To(Equal(n2.Id))
+			Expect(backend.Q("notes").WithDeleted().Count()).To(Equal(2))
+
+			Expect(backend.Q("notes").Filter("title", "N2").Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("notes").Count()).To(Equal(0))
+			Expect(backend.Q("notes").WithDeleted().Count()).To(Equal(2))
+		})
+
+		It("Should only find soft deleted models with .OnlyTrashed()", func() {
+			n1 := &Note{Title: "N1"}
+			Expect(backend.Create(n1)).ToNot(HaveOccurred())
+			n2 := &Note{Title: "N2"}
+			Expect(backend.Create(n2)).ToNot(HaveOccurred())
+			Expect(backend.Delete(n1)).ToNot(HaveOccurred())
+
+			res, err := backend.Q("notes").OnlyTrashed().Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].(*Note).Id).To(Equal(n1.Id))
+
+			Expect(backend.Q("notes").OnlyTrashed().Filter("title", "N2").Count()).To(Equal(0))
+			Expect(backend.Q("notes").WithDeleted().OnlyTrashed().Count()).To(Equal(1))
+		})
+
+		It("Should keep the relations of soft deleted models", func() {
+			backend.ModelInfo("notes").Relation("Tags").SetAutoDelete(true)
+			attachments := backend.ModelInfo("notes").Relation("Attachments")
+			attachments.SetAutoCreate(true)
+			attachments.SetAutoDelete(true)
+
+			tags := []Tag{{Tag: "S1"}, {Tag: "S2"}}
+			Expect(backend.Create(&tags[0], &tags[1])).ToNot(HaveOccurred())
+
+			n := &Note{
+				Title:       "N1",
+				Tags:        tags,
+				Attachments: []Attachment{{Filename: "a"}, {Filename: "b"}},
+			}
+			Expect(backend.Create(n)).ToNot(HaveOccurred())
+			Expect(backend.Delete(n)).ToNot(HaveOccurred())
+
+			// Restore the note.
+			q := backend.Q("notes").WithDeleted().Filter("id", n.Id)
+			Expect(backend.UpdateByMap(q, map[string]interface{}{"deleted_at": nil})).ToNot(HaveOccurred())
+			Expect(backend.Q("notes").Count()).To(Equal(1))
+
+			col, err := backend.M2M(n, "Tags")
+			Expect(err).ToNot(HaveOccurred())
+			all, err := col.All()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(all).To(HaveLen(2))
+
+			Expect(backend.Q("attachments").Filter("note_id", n.Id).Count()).To(Equal(2))
+		})
+
+		It("Should create a model only if the filter does not match with .CreateUnlessExists()", func() {
+			filter := func(q *db.Query) {
+				q.Filter("str_val", "lock")
+			}
+
+			created, err := backend.CreateUnlessExists(&TestModel{StrVal: "lock"}, filter)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(BeTrue())
+
+			created, err = backend.CreateUnlessExists(&TestModel{StrVal: "lock"}, filter)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(BeFalse())
+
+			Expect(backend.Q("test_models").Filter("str_val", "lock").Count()).To(Equal(1))
+		})
+
+		It("Should compute aggregates with .Sum(), .Avg(), .Min() and .Max()", func() {
+			for _, val := range []int64{2, 4, 9} {
+				model := &TestModel{StrVal: "aggregate", IntVal: val}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			q := backend.Q("test_models").Filter("str_val", "aggregate")
+			Expect(q.Sum("IntVal")).To(Equal(float64(15)))
+			Expect(q.Avg("int_val")).To(Equal(float64(5)))
+			Expect(q.Min("int_val")).To(Equal(float64(2)))
+			Expect(q.Max("int_val")).To(Equal(float64(9)))
+
+			Expect(backend.Q("test_models").Filter("str_val", "none").Sum("int_val")).To(Equal(float64(0)))
+
+			_, err := q.Sum("unknown")
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("unknown_field"))
+		})
+
+		It("Should filter with a composite cursor with .AfterCursor()", func() {
+			models := []TestModel{
+				{StrVal: "cursor", IntVal: 1},
+				{StrVal: "cursor", IntVal: 2},
+				{StrVal: "cursor", IntVal: 2},
+				{StrVal: "cursor", IntVal: 3},
+			}
+			for i := range models {
+				Expect(backend.Create(&models[i])).ToNot(HaveOccurred())
+			}
+
+			ids := func(q *db.Query) []uint64 {
+				res, err := q.Find()
+				Expect(err).ToNot(HaveOccurred())
+				ids := make([]uint64, 0)
+				for _, m := range res {
+					ids = append(ids, m.(*TestModel).Id)
+				}
+				return ids
+			}
+
+			// Rows after the first model with int_val 2, in (int_val, id) order.
+			q := backend.Q("test_models").Filter("str_val", "cursor").
+				AfterCursor([]string{"int_val", "id"}, []interface{}{2, models[1].Id}, []bool{true, true})
+			Expect(ids(q)).To(ConsistOf(models[2].Id, models[3].Id))
+
+			// Descending int_val, ascending id.
+			q = backend.Q("test_models").Filter("str_val", "cursor").
+				AfterCursor([]string{"int_val", "id"}, []interface{}{2, models[1].Id}, []bool{false, true})
+			Expect(ids(q)).To(ConsistOf(models[0].Id, models[2].Id))
+		})
+
+		It("Should .Chunk() results", func() {
+			for i := 0; i < 5; i++ {
+				model := &TestModel{StrVal: "chunk", IntVal: int64(i)}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			sizes := make([]int, 0)
+			ids := make(map[uint64]bool)
+			err := backend.Q("test_models").Filter("str_val", "chunk").Chunk(2, func(batch []interface{}) apperror.Error {
+				sizes = append(sizes, len(batch))
+				for _, m := range batch {
+					ids[m.(*TestModel).Id] = true
+				}
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sizes).To(Equal([]int{2, 2, 1}))
+			Expect(ids).To(HaveLen(5))
+
+			sizes = make([]int, 0)
+			err = backend.Q("test_models").Filter("str_val", "chunk").Sort("int_val", false).Chunk(3, func(batch []interface{}) apperror.Error {
+				sizes = append(sizes, len(batch))
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sizes).To(Equal([]int{3, 2}))
+
+			err = backend.Q("test_models").Chunk(2, func(batch []interface{}) apperror.Error {
+				return apperror.New("stop")
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("stop"))
+		})
+
+		It("Should .Chunk() models with a composite primary key", func() {
+			for _, ids := range [][]uint64{{1, 2}, {1, 3}, {1, 4}, {2, 1}, {2, 2}} {
+				m := &Membership{UserId: ids[0], GroupId: ids[1]}
+				Expect(backend.Create(m)).ToNot(HaveOccurred())
+			}
+
+			sizes := make([]int, 0)
+			keys := make(map[string]bool)
+			err := backend.Q("memberships").Chunk(2, func(batch []interface{}) apperror.Error {
+				sizes = append(sizes, len(batch))
+				for _, m := range batch {
+					keys[fmt.Sprintf("%v-%v", m.(*Membership).UserId, m.(*Membership).GroupId)] = true
+				}
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sizes).To(Equal([]int{2, 2, 1}))
+			Expect(keys).To(HaveLen(5))
+		})
+
+		It("Should not return soft deleted models from .Chunk()", func() {
+			notes := make([]*Note, 0)
+			for i := 0; i < 5; i++ {
+				note := &Note{Title: fmt.Sprintf("chunk%v", i)}
+				Expect(backend.Create(note)).ToNot(HaveOccurred())
+				notes = append(notes, note)
+			}
+			Expect(backend.Delete(notes[3])).ToNot(HaveOccurred())
+
+			// Sorted by title, so the batches use limit and offset.
+			for _, q := range []*db.Query{backend.Q("notes"), backend.Q("notes").Sort("title", true)} {
+				ids := make([]uint64, 0)
+				err := q.Chunk(2, func(batch []interface{}) apperror.Error {
+					for _, m := range batch {
+						ids = append(ids, m.(*Note).Id)
+					}
+					return nil
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ids).To(HaveLen(4))
+				Expect(ids).ToNot(ContainElement(notes[3].Id))
+
+				// The query itself is not modified.
+				Expect(q.Count()).To(Equal(4))
+			}
+		})
+
+		It("Should .EachRow() and .Each()", func() {
+			for i := 0; i < 3; i++ {
+				model := &TestModel{StrVal: "each", IntVal: int64(i)}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			rows := 0
+			err := backend.Q("test_models").Filter("str_val", "each").EachRow(func(row map[string]interface{}) apperror.Error {
+				Expect(row).To(HaveKey("int_val"))
+				rows++
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal(3))
+
+			sum := int64(0)
+			err = backend.Q("test_models").Filter("str_val", "each").Each(func(model interface{}) error {
+				sum += model.(*TestModel).IntVal
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sum).To(Equal(int64(3)))
+		})
+
+		It("Should stop .EachRow() early and release the cursor", func() {
+			for i := 0; i < 3; i++ {
+				model := &TestModel{StrVal: "each_stop", IntVal: int64(i)}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			rows := 0
+			err := backend.Q("test_models").Filter("str_val", "each_stop").EachRow(func(row map[string]interface{}) apperror.Error {
+				rows++
+				return apperror.New("stop")
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("stop"))
+			Expect(rows).To(Equal(1))
+
+			// The backend must still be usable after the early return.
+			count, err := backend.Q("test_models").Filter("str_val", "each_stop").Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(3))
+		})
+
+		It("Should scan rows into structs with .PluckInto()", func() {
+			for i := 0; i < 2; i++ {
+				model := &TestModel{StrVal: "pluck_into", IntVal: int64(i + 1)}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			type row struct {
+				StrVal string
+				IntVal int
+			}
+
+			var rows []row
+			err := backend.Q("test_models").Field("str_val", "int_val").Filter("str_val", "pluck_into").Sort("int_val", true).PluckInto(&rows)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal([]row{{"pluck_into", 1}, {"pluck_into", 2}}))
+
+			var ptrs []*row
+			Expect(backend.Q("test_models").Filter("str_val", "pluck_into").PluckInto(&ptrs)).ToNot(HaveOccurred())
+			Expect(ptrs).To(HaveLen(2))
+
+			var invalid []int
+			Expect(backend.Q("test_models").PluckInto(&invalid)).To(HaveOccurred())
+		})
+
+		It("Should pluck a single column with .PluckColumn()", func() {
+			for i := 0; i < 3; i++ {
+				model := &TestModel{StrVal: "pluck_column", IntVal: int64(i + 1)}
+				Expect(backend.Create(model)).ToNot(HaveOccurred())
+			}
+
+			var vals []int
+			err := backend.Q("test_models").Filter("str_val", "pluck_column").Sort("int_val", false).PluckColumn("int_val", &vals)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(vals).To(Equal([]int{3, 2, 1}))
+
+			var strs []string
+			Expect(backend.Q("test_models").Filter("int_val", 2).PluckColumn("StrVal", &strs)).ToNot(HaveOccurred())
+			Expect(strs).To(ContainElement("pluck_column"))
+
+			var invalid []int
+			Expect(backend.Q("test_models").PluckColumn("int_val", invalid)).To(HaveOccurred())
+		})
+
+		It("Should alias fields with .FieldAs()", func() {
+			Expect(backend.Create(&TestModel{StrVal: "field_as", IntVal: 5})).ToNot(HaveOccurred())
+
+			type report struct {
+				Amount int
+			}
+
+			var rows []report
+			err := backend.Q("test_models").FieldAs("int_val", "amount").Filter("str_val", "field_as").PluckInto(&rows)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal([]report{{5}}))
+
+			err = backend.Q("test_models").FieldAs("inexistant", "amount").PluckInto(&rows)
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("unknown_field"))
+		})
+
+		It("Should select window functions", func() {
+			models := []TestModel{
+				{StrVal: "window_a", IntVal: 5010},
+				{StrVal: "window_a", IntVal: 5020},
+				{StrVal: "window_a", IntVal: 5020},
+				{StrVal: "window_b", IntVal: 5005},
+			}
+			for i := range models {
+				Expect(backend.Create(&models[i])).ToNot(HaveOccurred())
+			}
+
+			window := expressions.NewWindowExpr(
+				expressions.WINDOW_RANK,
+				[]expressions.Expression{expressions.NewIdExpr("str_val")},
+				expressions.NewSortExpr(expressions.NewIdExpr("int_val"), false))
+
+			type ranked struct {
+				StrVal string
+				IntVal int64
+				Rank   int
+			}
+
+			var rows []ranked
+			err := backend.Q("test_models").
+				Field("str_val", "int_val").
+				FieldExpr(expressions.NewFieldSelectorExpr("rank", window, reflect.TypeOf(0))).
+				FilterCond("int_val", ">=", 5000).
+				PluckInto(&rows)
+			Expect(err).ToNot(HaveOccurred())
+
+			results := make([]string, 0)
+			for _, row := range rows {
+				results = append(results, fmt.Sprintf("%v-%v-%v", row.StrVal, row.IntVal, row.Rank))
+			}
+			Expect(results).To(ConsistOf("window_a-5020-1", "window_a-5020-1", "window_a-5010-3", "window_b-5005-1"))
+		})
+
+		It("Should filter and select cast fields", func() {
+			Expect(backend.Create(&TestModel{StrVal: "cast", IntVal: 7001})).ToNot(HaveOccurred())
+			Expect(backend.Create(&TestModel{StrVal: "cast", IntVal: 7002})).ToNot(HaveOccurred())
+
+			type casted struct {
+				IntVal  int64
+				IntText string
+			}
+
+			var rows []casted
+			err := backend.Q("test_models").
+				Field("int_val").
+				FieldExpr(expressions.NewFieldSelectorExpr("int_text", expressions.Cast(expressions.NewIdExpr("int_val"), "text"), reflect.TypeOf(""))).
+				FilterExpr(expressions.NewFilter(
+					expressions.Cast(expressions.NewColFieldIdExpr("test_models", "int_val"), "text"),
+					"=",
+					expressions.NewValueExpr("7002"))).
+				PluckInto(&rows)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal([]casted{{IntVal: 7002, IntText: "7002"}}))
+		})
+
+		It("Should group by truncated dates", func() {
+			dates := []time.Time{
+				time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC),
+				time.Date(2020, 3, 1, 18, 30, 0, 0, time.UTC),
+				time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC),
+			}
+			for _, date := range dates {
+				Expect(backend.Create(&Project{Name: "date_trunc", CreatedAt: date})).ToNot(HaveOccurred())
+			}
+
+			type dayCount struct {
+				Day   time.Time
+				Count int
+			}
+
+			var rows []dayCount
+			err := backend.Q("projects").
+				Filter("name", "date_trunc").
+				GroupExpr(expressions.DateTrunc("created_at", expressions.DATE_TRUNC_DAY)).
+				FieldExpr(expressions.NewFieldSelectorExpr("day", expressions.DateTrunc("created_at", expressions.DATE_TRUNC_DAY), reflect.TypeOf(time.Time{}))).
+				FieldExpr(expressions.NewFieldSelectorExpr("count", expressions.NewFuncExpr("COUNT", expressions.NewTextExpr("*")), reflect.TypeOf(0))).
+				PluckInto(&rows)
+			Expect(err).ToNot(HaveOccurred())
+
+			counts := make(map[string]int)
+			for _, row := range rows {
+				counts[row.Day.Format("2006-01-02")] = row.Count
+			}
+			Expect(counts).To(Equal(map[string]int{"2020-03-01": 2, "2020-03-02": 1}))
+		})
+
+		It("Should .Search() fields", func() {
+			Expect(backend.Create(&TestModel{StrVal: "The quick brown fox", IntVal: 6001})).ToNot(HaveOccurred())
+			Expect(backend.Create(&TestModel{StrVal: "Lazy dogs sleep", IntVal: 6002})).ToNot(HaveOccurred())
+
+			res, err := backend.Q("test_models").Search([]string{"str_val"}, "Fox").Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].(*TestModel).IntVal).To(Equal(int64(6001)))
+
+			Expect(backend.Q("test_models").Search([]string{"StrVal"}, "cat").Count()).To(Equal(0))
+		})
+
+		It("Should sort by a list of ids with .OrderByIds()", func() {
+			models := []TestModel{{StrVal: "order_ids"}, {StrVal: "order_ids"}, {StrVal: "order_ids"}}
+			for i := range models {
+				Expect(backend.Create(&models[i])).ToNot(HaveOccurred())
+			}
+
+			ids := []interface{}{models[2].Id, models[0].Id, models[1].Id}
+			res, err := backend.Q("test_models").Filter("str_val", "order_ids").OrderByIds("id", ids).Find()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(3))
+			for i, m := range res {
+				Expect(m.(*TestModel).Id).To(Equal(ids[i]))
+			}
+		})
+
+		It("Should place nulls with .SortNulls()", func() {
+			now := time.Now()
+			withTime := &Project{Name: "sort_nulls", UpdatedAt: &now}
+			Expect(backend.Create(withTime)).ToNot(HaveOccurred())
+			withoutTime := &Project{Name: "sort_nulls"}
+			Expect(backend.Create(withoutTime)).ToNot(HaveOccurred())
+
+			m, err := backend.Q("projects").Filter("name", "sort_nulls").SortNulls("UpdatedAt", true, true).First()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.(*Project).Id).To(Equal(withoutTime.Id))
+
+			m, err = backend.Q("projects").Filter("name", "sort_nulls").SortNulls("UpdatedAt", true, false).First()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.(*Project).Id).To(Equal(withTime.Id))
+		})
+
 		It("Should .Query() with target slice", func() {
 			model := NewTestModel(64)
 			Expect(backend.Create(&model)).ToNot(HaveOccurred())
@@ -425,14 +1596,77 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 
 		BeforeEach(func() {
 			// Clear models.
-			Expect(backend.Q("tags").Delete()).ToNot(HaveOccurred())
-			Expect(backend.Q("projects").Delete()).ToNot(HaveOccurred())
-			Expect(backend.Q("tasks").Delete()).ToNot(HaveOccurred())
-			Expect(backend.Q("files").Delete()).ToNot(HaveOccurred())
-			Expect(backend.Q("tasks_tags").Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("tags").AllowAll().Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("projects").AllowAll().Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("tasks").AllowAll().Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("files").AllowAll().Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("tasks_tags").AllowAll().Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("categories").AllowAll().Delete()).ToNot(HaveOccurred())
+			Expect(backend.Q("comments").AllowAll().Delete()).ToNot(HaveOccurred())
 
 			// Rebuild relation info.
-			backend.Build()
+			Expect(backend.Build()).ToNot(HaveOccurred())
+		})
+
+		Describe("Self-referential", func() {
+			It("Should join children and parents of a tree", func() {
+				root := &Category{Name: "root"}
+				Expect(backend.Create(root)).ToNot(HaveOccurred())
+				a := &Category{Name: "a", ParentId: root.Id}
+				b := &Category{Name: "b", ParentId: root.Id}
+				Expect(backend.Create(a, b)).ToNot(HaveOccurred())
+				leaf := &Category{Name: "leaf", ParentId: a.Id}
+				Expect(backend.Create(leaf)).ToNot(HaveOccurred())
+
+				res, err := backend.Q("categories").Filter("id", root.Id).Join("Children").Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(1))
+				children := res[0].(*Category).Children
+				Expect(children).To(HaveLen(2))
+				Expect([]string{children[0].Name, children[1].Name}).To(ConsistOf("a", "b"))
+
+				res, err = backend.Q("categories").Filter("id", leaf.Id).Join("Parent").Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(1))
+				Expect(res[0].(*Category).Parent).ToNot(BeNil())
+				Expect(res[0].(*Category).Parent.Name).To(Equal("a"))
+			})
+		})
+
+		Describe("Polymorphic", func() {
+			It("Should query the owner and the comments of polymorphic relations", func() {
+				task := &Task{Name: "task"}
+				project := &Project{Name: "project"}
+				Expect(backend.Create(task, project)).ToNot(HaveOccurred())
+
+				taskComment := &Comment{Body: "on task", CommentableType: "tasks", CommentableId: task.Id}
+				projectComment := &Comment{Body: "on project", CommentableType: "projects", CommentableId: project.Id}
+				Expect(backend.Create(taskComment, projectComment)).ToNot(HaveOccurred())
+
+				q, err := backend.Related(taskComment, "Commentable")
+				Expect(err).ToNot(HaveOccurred())
+				owner, err := q.First()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(owner.(*Task).Id).To(Equal(task.Id))
+
+				q, _ = backend.Related(projectComment, "Commentable")
+				owner, err = q.First()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(owner.(*Project).Name).To(Equal("project"))
+
+				q, _ = backend.Related(project, "Comments")
+				comments, err := q.Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(comments).To(HaveLen(1))
+				Expect(comments[0].(*Comment).Body).To(Equal("on project"))
+
+				relations := backend.ModelInfo("comments").PolymorphicRelations()
+				Expect(relations).To(HaveLen(1))
+				Expect(relations[0].PolymorphicTypeField()).To(Equal("CommentableType"))
+
+				_, err = backend.Q("comments").Join("Commentable").Find()
+				Expect(err).To(HaveOccurred())
+			})
 		})
 
 		Describe("Has one", func() {
@@ -487,6 +1721,26 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 				Expect(tm.(*Task).ProjectId).To(Equal(t.Project.Id))
 			})
 
+			It("Should not persist relations when disabled", func() {
+				backend.ModelInfo("tasks").Relation("Project").SetAutoCreate(true)
+
+				t := &Task{Name: "T1", Project: Project{Name: "skipped"}}
+				Expect(backend.WithoutRelationPersistence().Create(t)).ToNot(HaveOccurred())
+				Expect(t.Project.Id).To(BeZero())
+				Expect(backend.AutoPersistRelations()).To(BeTrue())
+
+				backend.SetAutoPersistRelations(false)
+				t2 := &Task{Name: "T2", Project: Project{Name: "skipped"}}
+				Expect(backend.Create(t2)).ToNot(HaveOccurred())
+				Expect(t2.Project.Id).To(BeZero())
+				Expect(backend.Q("projects").Filter("name", "skipped").Count()).To(Equal(0))
+
+				backend.SetAutoPersistRelations(true)
+				t3 := &Task{Name: "T3", Project: Project{Name: "persisted"}}
+				Expect(backend.Create(t3)).ToNot(HaveOccurred())
+				Expect(t3.Project.Id).ToNot(BeZero())
+			})
+
 			It("Should auto-update has-one", func() {
 				// Enable auto-create.
 				rel := backend.ModelInfo("tasks").Relation("Project")
@@ -558,11 +1812,31 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 					},
 				}
 
-				Expect(backend.Create(t)).ToNot(HaveOccurred())
+				Expect(backend.Create(t)).ToNot(HaveOccurred())
+
+				m, err := backend.Q("tasks").Filter("id", t.Id).Join("Project").First()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.(*Task).Project.Id).To(Equal(t.Project.Id))
+			})
+
+			It("Should respect the join type for has-one joins", func() {
+				rel := backend.ModelInfo("tasks").Relation("Project")
+				rel.SetAutoCreate(true)
+
+				t1 := &Task{Name: "T1", Project: Project{Name: "test"}}
+				t2 := &Task{Name: "T2"}
+				Expect(backend.Create(t1, t2)).ToNot(HaveOccurred())
 
-				m, err := backend.Q("tasks").Filter("id", t.Id).Join("Project").First()
+				res, err := backend.Q("tasks").Join("Project", expressions.JOIN_LEFT).Sort("id", true).Find()
 				Expect(err).ToNot(HaveOccurred())
-				Expect(m.(*Task).Project.Id).To(Equal(t.Project.Id))
+				Expect(res).To(HaveLen(2))
+				Expect(res[0].(*Task).Project.Id).To(Equal(t1.Project.Id))
+				Expect(res[1].(*Task).Project.Id).To(BeZero())
+
+				res, err = backend.Q("tasks").Join("Project", expressions.JOIN_INNER).Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(1))
+				Expect(res[0].(*Task).Id).To(Equal(t1.Id))
 			})
 
 			It("Should .Related() with model", func() {
@@ -895,6 +2169,50 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 				Expect(todos).To(HaveLen(2))
 			})
 
+			It("Should sort by relation count with .SortByRelationCount()", func() {
+				rel := backend.ModelInfo("projects").Relation("Todos")
+				rel.SetAutoCreate(true)
+
+				p1 := &Project{Name: "P1", Todos: []Task{Task{Name: "T1"}}}
+				p2 := &Project{Name: "P2", Todos: []Task{Task{Name: "T2"}, Task{Name: "T3"}}}
+				p3 := &Project{Name: "P3"}
+				Expect(backend.Create(p1, p2, p3)).ToNot(HaveOccurred())
+
+				var projects []*Project
+				_, err := backend.Q("projects").SortByRelationCount("Todos", false).Find(&projects)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(projects).To(HaveLen(3))
+				Expect([]string{projects[0].Name, projects[1].Name, projects[2].Name}).To(Equal([]string{"P2", "P1", "P3"}))
+
+				_, err = backend.Q("projects").SortByRelationCount("Todos", true).Find(&projects)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(projects[0].Name).To(Equal("P3"))
+			})
+
+			It("Should respect the join type for has-many joins", func() {
+				rel := backend.ModelInfo("projects").Relation("Todos")
+				rel.SetAutoCreate(true)
+
+				p1 := &Project{
+					Name:  "P1",
+					Todos: []Task{Task{Name: "T1"}, Task{Name: "T2"}},
+				}
+				p2 := &Project{Name: "P2"}
+				Expect(backend.Create(p1, p2)).ToNot(HaveOccurred())
+
+				res, err := backend.Q("projects").Join("Todos", expressions.JOIN_LEFT).Sort("id", true).Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(2))
+				Expect(res[0].(*Project).Todos).To(HaveLen(2))
+				Expect(res[1].(*Project).Todos).To(BeEmpty())
+
+				res, err = backend.Q("projects").Join("Todos", expressions.JOIN_INNER).Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(1))
+				Expect(res[0].(*Project).Id).To(Equal(p1.Id))
+				Expect(res[0].(*Project).Todos).To(HaveLen(2))
+			})
+
 			It("Should .Related() with model", func() {
 				// Enable auto-create.
 				rel := backend.ModelInfo("projects").Relation("Todos")
@@ -930,6 +2248,116 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 
 				Expect(m).To(BeEquivalentTo([]interface{}{&p.Todos[0], &p.Todos[1]}))
 			})
+
+			It("Should .AttachMany() has-many", func() {
+				p := &Project{Name: "P1"}
+				Expect(backend.Create(p)).ToNot(HaveOccurred())
+
+				t1 := &Task{Name: "T1"}
+				t2 := &Task{Name: "T2"}
+				t3 := &Task{Name: "T3"}
+				Expect(backend.Create(t1, t2, t3)).ToNot(HaveOccurred())
+
+				Expect(backend.AttachMany(p, "Todos", t1.Id, t3.Id)).ToNot(HaveOccurred())
+
+				tasks, err := backend.Q(p).Related("Todos").Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tasks).To(HaveLen(2))
+			})
+
+			It("Should .Detach() has-many", func() {
+				rel := backend.ModelInfo("projects").Relation("Todos")
+				rel.SetAutoCreate(true)
+
+				p := &Project{
+					Name:  "P1",
+					Todos: []Task{Task{Name: "T1"}, Task{Name: "T2"}},
+				}
+				Expect(backend.Create(p)).ToNot(HaveOccurred())
+
+				Expect(backend.Detach(p, "Todos", p.Todos[0].Id)).ToNot(HaveOccurred())
+				Expect(backend.Q(p).Related("Todos").Count()).To(Equal(1))
+
+				Expect(backend.Detach(p, "Todos")).ToNot(HaveOccurred())
+				Expect(backend.Q("tasks").Count()).To(Equal(2))
+				Expect(backend.Q("tasks").Filter("project_id", p.Id).Count()).To(Equal(0))
+			})
+
+			It("Should enforce unique-with on a relation foreign key", func() {
+				p1 := &Project{Name: "P1"}
+				Expect(backend.Create(p1)).ToNot(HaveOccurred())
+				p2 := &Project{Name: "P2"}
+				Expect(backend.Create(p2)).ToNot(HaveOccurred())
+
+				Expect(backend.Create(&Milestone{Name: "M1", ProjectId: p1.Id})).ToNot(HaveOccurred())
+				Expect(backend.Create(&Milestone{Name: "M1", ProjectId: p2.Id})).ToNot(HaveOccurred())
+				Expect(backend.Create(&Milestone{Name: "M1", ProjectId: p1.Id})).To(HaveOccurred())
+				Expect(backend.Q("milestones").Count()).To(Equal(2))
+
+				// Updates are checked too, but a model does not conflict with itself.
+				m := &Milestone{Name: "M2", ProjectId: p1.Id}
+				Expect(backend.Create(m)).ToNot(HaveOccurred())
+				Expect(backend.Update(m)).ToNot(HaveOccurred())
+				m.Name = "M1"
+				Expect(backend.Update(m)).To(HaveOccurred())
+			})
+
+			It("Should join has-many into a map field", func() {
+				p := &Product{Name: "P1"}
+				Expect(backend.Create(p)).ToNot(HaveOccurred())
+				Expect(backend.Create(&Variant{ProductId: p.Id, Sku: "A-1"})).ToNot(HaveOccurred())
+				Expect(backend.Create(&Variant{ProductId: p.Id, Sku: "B-2"})).ToNot(HaveOccurred())
+
+				m, err := backend.Q("products").Filter("id", p.Id).Join("Variants").First()
+				Expect(err).ToNot(HaveOccurred())
+				variants := m.(*Product).Variants
+				Expect(variants).To(HaveLen(2))
+				Expect(variants["A-1"].Sku).To(Equal("A-1"))
+				Expect(variants["B-2"].ProductId).To(Equal(p.Id))
+
+				Expect(backend.Create(&Variant{ProductId: p.Id, Sku: "A-1"})).ToNot(HaveOccurred())
+				_, err = backend.Q("products").Filter("id", p.Id).Join("Variants").First()
+				Expect(err).To(HaveOccurred())
+				Expect(err.GetCode()).To(Equal("duplicate_relation_map_key"))
+			})
+
+			It("Should .Load() has-many", func() {
+				rel := backend.ModelInfo("projects").Relation("Todos")
+				rel.SetAutoCreate(true)
+
+				p := &Project{
+					Name:  "P1",
+					Todos: []Task{Task{Name: "T1"}, Task{Name: "T2"}},
+				}
+				Expect(backend.Create(p)).ToNot(HaveOccurred())
+
+				m, err := backend.FindOne("projects", p.Id)
+				Expect(err).ToNot(HaveOccurred())
+				loaded := m.(*Project)
+				Expect(loaded.Todos).To(HaveLen(0))
+
+				Expect(backend.Load(loaded, "Todos")).ToNot(HaveOccurred())
+				Expect(loaded.Todos).To(HaveLen(2))
+			})
+
+			It("Should clear stale relations in .Load()", func() {
+				rel := backend.ModelInfo("projects").Relation("Todos")
+				rel.SetAutoCreate(true)
+
+				p := &Project{
+					Name:  "P1",
+					Todos: []Task{Task{Name: "T1"}, Task{Name: "T2"}},
+				}
+				Expect(backend.Create(p)).ToNot(HaveOccurred())
+
+				Expect(backend.Load(p, "Todos")).ToNot(HaveOccurred())
+				Expect(p.Todos).To(HaveLen(2))
+
+				Expect(backend.Q("tasks").Filter("project_id", p.Id).Delete()).ToNot(HaveOccurred())
+				Expect(backend.Load(p, "Todos")).ToNot(HaveOccurred())
+				Expect(p.Todos).ToNot(BeNil())
+				Expect(p.Todos).To(HaveLen(0))
+			})
 		})
 
 		Describe("M2M Collection", func() {
@@ -1028,6 +2456,33 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 				Expect(col.Count()).To(Equal(0))
 			})
 
+			It("Should count related models with .RelatedCount()", func() {
+				t1 := &Task{Name: "t1"}
+				t2 := &Task{Name: "t2"}
+				Expect(backend.Create(t1, t2)).ToNot(HaveOccurred())
+				tags := []Tag{Tag{Tag: "T1"}, {Tag: "T2"}, {Tag: "T3"}}
+				Expect(backend.Create(&tags[0], &tags[1], &tags[2])).ToNot(HaveOccurred())
+
+				Expect(backend.RelatedCount(t1, "Tags")).To(Equal(0))
+
+				col, _ := backend.M2M(t1, "Tags")
+				Expect(col.Add(tags[0], tags[1], tags[2])).ToNot(HaveOccurred())
+				col, _ = backend.M2M(t2, "Tags")
+				Expect(col.Add(tags[0])).ToNot(HaveOccurred())
+
+				Expect(backend.RelatedCount(t1, "Tags")).To(Equal(3))
+				Expect(backend.RelatedCount(t2, "Tags")).To(Equal(1))
+				Expect(backend.Q("tasks").Related("Tags").CountRelated()).To(Equal(4))
+				Expect(backend.Q("tasks").Filter("name", "t2").Related("Tags").CountRelated()).To(Equal(1))
+
+				Expect(backend.Create(&File{TaskId: t1.Id, Filename: "f1"})).ToNot(HaveOccurred())
+				Expect(backend.RelatedCount(t1, "File")).To(Equal(1))
+				Expect(backend.RelatedCount(t2, "File")).To(Equal(0))
+
+				_, err := backend.RelatedCount(t1, "Unknown")
+				Expect(err).To(HaveOccurred())
+			})
+
 			It("Should .Contains()", func() {
 				t := &Task{Name: "test"}
 				Expect(backend.Create(t)).ToNot(HaveOccurred())
@@ -1043,6 +2498,25 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 				Expect(col.Contains(&tags[3])).To(BeTrue())
 			})
 
+			It("Should return the pivot rows with .PivotRows()", func() {
+				t := &Task{Name: "test"}
+				Expect(backend.Create(t)).ToNot(HaveOccurred())
+				tags := []Tag{Tag{Tag: "T1"}, {Tag: "T2"}}
+				Expect(backend.Create(&tags[0], &tags[1])).ToNot(HaveOccurred())
+
+				col, _ := backend.M2M(t, "Tags")
+				Expect(col.PivotRows()).To(BeEmpty())
+
+				Expect(col.Add(tags[1])).ToNot(HaveOccurred())
+
+				relation := backend.ModelInfo("tasks").Relation("Tags")
+				rows, err := col.PivotRows()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rows).To(HaveLen(1))
+				Expect(rows[0][relation.PivotLocalField()]).To(BeEquivalentTo(t.Id))
+				Expect(rows[0][relation.PivotForeignField()]).To(BeEquivalentTo(tags[1].Id))
+			})
+
 			It("Should .ContainsId()", func() {
 				t := &Task{Name: "test"}
 				Expect(backend.Create(t)).ToNot(HaveOccurred())
@@ -1122,6 +2596,19 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 				Expect(col.Count()).To(Equal(2))
 			})
 
+			It("Should .AttachMany() m2m", func() {
+				tags := []Tag{Tag{Tag: "T1"}, {Tag: "T2"}, {Tag: "T3"}}
+				Expect(backend.Create(&tags[0], &tags[1], &tags[2])).ToNot(HaveOccurred())
+
+				t := &Task{Name: "test"}
+				Expect(backend.Create(t)).ToNot(HaveOccurred())
+
+				Expect(backend.AttachMany(t, "Tags", tags[0].Id, tags[2].Id)).ToNot(HaveOccurred())
+
+				col, _ := backend.M2M(t, "Tags")
+				Expect(col.Count()).To(Equal(2))
+			})
+
 			It("Should auto-persist m2m", func() {
 				rel := backend.ModelInfo("tasks").Relation("Tags")
 				rel.SetAutoCreate(true)
@@ -1180,11 +2667,79 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 
 				// If a m2m collection exists, check that is was cleared properly.
 				if backend.HasCollection("tasks_tags") {
-					q := backend.Q("tasks_tags").Filter("tasks.id", t.Id)
+					q := backend.Q("tasks_tags").Filter("tasks_id", t.Id)
 					Expect(q.Count()).To(Equal(0))
 				}
 			})
 
+			It("Should list collections with and without pivots", func() {
+				rel := backend.ModelInfo("tasks").Relation("Tags")
+
+				all := backend.Collections(true)
+				Expect(all).To(ContainElement("tasks"))
+				Expect(all).To(ContainElement(rel.BackendName()))
+				Expect(backend.ModelInfo(rel.BackendName()).IsPivot()).To(BeTrue())
+
+				models := backend.Collections(false)
+				Expect(models).To(ContainElement("tasks"))
+				Expect(models).ToNot(ContainElement(rel.BackendName()))
+				Expect(backend.ModelInfo("tasks").IsPivot()).To(BeFalse())
+			})
+
+			It("Should use the same pivot columns for building, adding and joining", func() {
+				rel := backend.ModelInfo("tasks").Relation("Tags")
+				Expect(rel.PivotLocalField()).To(Equal("tasks_id"))
+				Expect(rel.PivotForeignField()).To(Equal("tags_id"))
+
+				pivot := backend.ModelInfo(rel.BackendName())
+				Expect(pivot).ToNot(BeNil())
+				Expect(pivot.HasAttribute(rel.PivotLocalField())).To(BeTrue())
+				Expect(pivot.HasAttribute(rel.PivotForeignField())).To(BeTrue())
+
+				tags := []Tag{Tag{Tag: "T1"}, {Tag: "T2"}, {Tag: "T3"}}
+				Expect(backend.Create(&tags[0], &tags[1], &tags[2])).ToNot(HaveOccurred())
+
+				t := &Task{Name: "test"}
+				Expect(backend.Create(t)).ToNot(HaveOccurred())
+
+				col, err := backend.M2M(t, "Tags")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(col.Add(&tags[0], &tags[2])).ToNot(HaveOccurred())
+
+				Expect(backend.Q(rel.BackendName()).Filter(rel.PivotLocalField(), t.Id).Count()).To(Equal(2))
+
+				m, err := backend.Q("tasks").Filter("id", t.Id).Join("Tags").First()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.(*Task).Tags).To(HaveLen(2))
+			})
+
+			It("Should filter by m2m counts with .HavingCount()", func() {
+				tags := []Tag{Tag{Tag: "T1"}, {Tag: "T2"}, {Tag: "T3"}}
+				Expect(backend.Create(&tags[0], &tags[1], &tags[2])).ToNot(HaveOccurred())
+
+				t1 := &Task{Name: "t1"}
+				t2 := &Task{Name: "t2"}
+				t3 := &Task{Name: "t3"}
+				Expect(backend.Create(t1, t2, t3)).ToNot(HaveOccurred())
+
+				col, _ := backend.M2M(t1, "Tags")
+				Expect(col.Add(&tags[0], &tags[1], &tags[2])).ToNot(HaveOccurred())
+				col, _ = backend.M2M(t2, "Tags")
+				Expect(col.Add(&tags[0])).ToNot(HaveOccurred())
+
+				res, err := backend.Q("tasks").HavingCount("Tags", ">", 1).Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(1))
+				Expect(res[0].(*Task).Id).To(Equal(t1.Id))
+
+				Expect(backend.Q("tasks").HavingCount("Tags", ">=", 1).Count()).To(Equal(2))
+
+				res, err = backend.Q("tasks").HavingCount("Tags", "=", 0).Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(1))
+				Expect(res[0].(*Task).Id).To(Equal(t3.Id))
+			})
+
 			It("Should join m2m", func() {
 				rel := backend.ModelInfo("tasks").Relation("Tags")
 				rel.SetAutoDelete(true)
@@ -1269,11 +2824,110 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 				Expect(m.Todos[0].Tags).To(Equal([]Tag{tags[0], tags[1]}))
 				Expect(m.Todos[1].Tags).To(Equal([]Tag{tags[2], tags[3]}))
 			})
+
+			It("Should load nested joins with one query per relation level", func() {
+				backend.ModelInfo("projects").Relation("Todos").SetAutoCreate(true)
+
+				tags := []Tag{Tag{Tag: "T1"}, {Tag: "T2"}, {Tag: "T3"}}
+				Expect(backend.Create(&tags[0], &tags[1], &tags[2])).ToNot(HaveOccurred())
+
+				for i := 0; i < 3; i++ {
+					p := &Project{
+						Name: fmt.Sprintf("P%v", i),
+						Todos: []Task{
+							Task{Name: "Task 1", Tags: []Tag{tags[0], tags[1]}},
+							Task{Name: "Task 2", Tags: []Tag{tags[1], tags[2]}},
+						},
+					}
+					Expect(backend.Create(p)).ToNot(HaveOccurred())
+				}
+
+				collections := make([]string, 0)
+				backend.RegisterHook(db.HOOK_BEFORE_QUERY, func(b db.Backend, obj interface{}) apperror.Error {
+					collections = append(collections, obj.(*db.Query).GetCollection())
+					return nil
+				})
+
+				res, err := backend.Q("projects").Join("Todos.Tags").Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(3))
+				for _, raw := range res {
+					m := raw.(*Project)
+					Expect(m.Todos).To(HaveLen(2))
+					Expect(m.Todos[0].Tags).To(Equal([]Tag{tags[0], tags[1]}))
+					Expect(m.Todos[1].Tags).To(Equal([]Tag{tags[1], tags[2]}))
+				}
+
+				// One query for the projects, one for all todos and one for
+				// all tags.
+				Expect(collections).To(HaveLen(3))
+				Expect(collections[0]).To(Equal("projects"))
+			})
+
+			It("Should preload relations with one query per relation", func() {
+				backend.ModelInfo("projects").Relation("Todos").SetAutoCreate(true)
+
+				for i := 0; i < 100; i++ {
+					p := &Project{
+						Name:  fmt.Sprintf("P%v", i),
+						Todos: []Task{Task{Name: fmt.Sprintf("Task %v", i)}},
+					}
+					Expect(backend.Create(p)).ToNot(HaveOccurred())
+				}
+
+				collections := make([]string, 0)
+				backend.RegisterHook(db.HOOK_BEFORE_QUERY, func(b db.Backend, obj interface{}) apperror.Error {
+					collections = append(collections, obj.(*db.Query).GetCollection())
+					return nil
+				})
+
+				res, err := backend.Q("projects").Preload("Todos").Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(100))
+				for _, raw := range res {
+					m := raw.(*Project)
+					Expect(m.Todos).To(HaveLen(1))
+					Expect(m.Todos[0].ProjectId).To(Equal(m.Id))
+				}
+				Expect(collections).To(HaveLen(2))
+
+				// To-one relations are preloaded with a separate query too.
+				collections = collections[:0]
+				res, err = backend.Q("tasks").Preload("Project").Find()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(100))
+				for _, raw := range res {
+					m := raw.(*Task)
+					Expect(m.Project.Id).To(Equal(m.ProjectId))
+				}
+				Expect(collections).To(Equal([]string{"tasks", "projects"}))
+			})
+
+			It("Should preload always-load relations", func() {
+				backend.ModelInfo("tasks").Relation("Project").SetAlwaysLoad(true)
+
+				p := &Project{Name: "P"}
+				Expect(backend.Create(p)).ToNot(HaveOccurred())
+				t := &Task{Name: "T", ProjectId: p.Id}
+				Expect(backend.Create(t)).ToNot(HaveOccurred())
+
+				m, err := backend.FindOne("tasks", t.Id)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.(*Task).Project.Name).To(Equal("P"))
+
+				m, err = backend.Q("tasks").Filter("id", t.Id).WithoutRelation("Project").First()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.(*Task).Project.Id).To(BeZero())
+			})
 		})
 	})
 
 	Describe("Transactions", func() {
-		transactionBackend, _ := backend.(db.TransactionBackend)
+		var transactionBackend db.TransactionBackend
+		BeforeEach(func() {
+			// The backend is only built in the outer BeforeEach.
+			transactionBackend, _ = backend.(db.TransactionBackend)
+		})
 
 		It("Should successfully commit a transaction", func() {
 			if transactionBackend == nil {
@@ -1312,6 +2966,144 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 			Expect(err).ToNot(HaveOccurred())
 			Expect(m).To(BeNil())
 		})
+
+		It("Should discard deletes of a rolled back transaction", func() {
+			if transactionBackend == nil {
+				Skip("Not a transaction backend")
+			}
+
+			model := NewTestModel(103)
+			Expect(backend.Create(&model)).ToNot(HaveOccurred())
+
+			tx, err := transactionBackend.Begin()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(tx.Delete(&model)).ToNot(HaveOccurred())
+			Expect(tx.Q("test_models").Filter("id", model.Id).Count()).To(Equal(0))
+
+			Expect(tx.Rollback()).ToNot(HaveOccurred())
+			Expect(backend.Q("test_models").Filter("id", model.Id).Count()).To(Equal(1))
+		})
+
+		It("Should begin a transaction with an isolation level", func() {
+			if transactionBackend == nil {
+				Skip("Not a transaction backend")
+			}
+
+			_, err := transactionBackend.BeginTx(&db.TxOptions{Isolation: "invalid"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_isolation_level"))
+
+			tx, err := transactionBackend.BeginTx(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tx.Rollback()).ToNot(HaveOccurred())
+
+			tx, err = transactionBackend.BeginTx(&db.TxOptions{Isolation: db.ISOLATION_SERIALIZABLE})
+			Expect(err).ToNot(HaveOccurred())
+
+			model := NewTestModel(102)
+			Expect(tx.Create(&model)).ToNot(HaveOccurred())
+			Expect(tx.Commit()).ToNot(HaveOccurred())
+
+			m, err := backend.FindOne("test_models", model.Id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).ToNot(BeNil())
+		})
+	})
+
+	Describe("Schema diffs", func() {
+		It("Should build and apply a migration plan", func() {
+			diffBackend, ok := backend.(db.SchemaDiffBackend)
+			if !ok {
+				Skip("Not a schema diff backend")
+			}
+
+			plan, err := diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.IsEmpty()).To(BeTrue())
+
+			Expect(backend.DropField("test_models", "str_val")).ToNot(HaveOccurred())
+
+			plan, err = diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.CreateFields).To(Equal(map[string][]string{"test_models": []string{"str_val"}}))
+			Expect(plan.DropFields).To(BeEmpty())
+
+			Expect(diffBackend.ApplyPlan(plan)).ToNot(HaveOccurred())
+
+			plan, err = diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.IsEmpty()).To(BeTrue())
+		})
+
+		It("Should plan missing indexes", func() {
+			diffBackend, ok := backend.(db.SchemaDiffBackend)
+			if !ok {
+				Skip("Not a schema diff backend")
+			}
+
+			Expect(backend.DropIndex("accounts_email_unique_ci")).ToNot(HaveOccurred())
+
+			plan, err := diffBackend.MigrationPlan("accounts")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.CreateIndexes).To(Equal(map[string][]string{"accounts": []string{"accounts_email_unique_ci"}}))
+
+			Expect(diffBackend.ApplyPlan(plan)).ToNot(HaveOccurred())
+
+			plan, err = diffBackend.MigrationPlan("accounts")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.IsEmpty()).To(BeTrue())
+		})
+
+		It("Should plan changed field types", func() {
+			diffBackend, ok := backend.(db.SchemaDiffBackend)
+			if !ok {
+				Skip("Not a schema diff backend")
+			}
+
+			Expect(backend.DropField("test_models", "int_val")).ToNot(HaveOccurred())
+			field := expressions.NewFieldExpr("int_val", expressions.NewFieldTypeExpr("text", nil))
+			Expect(backend.Exec(expressions.NewCreateFieldStmt("test_models", field))).ToNot(HaveOccurred())
+
+			plan, err := diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.AlterFields).To(Equal(map[string][]string{"test_models": []string{"int_val"}}))
+
+			if err := diffBackend.ApplyPlan(plan); err != nil && err.GetCode() == "unsupported_alter_field" {
+				Skip("Backend can not change field types")
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			plan, err = diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.IsEmpty()).To(BeTrue())
+		})
+
+		It("Should only drop fields when allowed", func() {
+			diffBackend, ok := backend.(db.SchemaDiffBackend)
+			if !ok {
+				Skip("Not a schema diff backend")
+			}
+
+			field := expressions.NewFieldExpr("extra", expressions.NewFieldTypeExpr("text", nil))
+			Expect(backend.Exec(expressions.NewCreateFieldStmt("test_models", field))).ToNot(HaveOccurred())
+
+			plan, err := diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.DropFields).To(Equal(map[string][]string{"test_models": []string{"extra"}}))
+
+			Expect(diffBackend.ApplyPlan(plan)).ToNot(HaveOccurred())
+			plan, err = diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.DropFields).To(HaveKey("test_models"))
+
+			plan.AllowDrops = true
+			Expect(diffBackend.ApplyPlan(plan)).ToNot(HaveOccurred())
+			plan, err = diffBackend.MigrationPlan("test_models")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.IsEmpty()).To(BeTrue())
+		})
 	})
 
 	Describe("Hooks", func() {
@@ -1322,6 +3114,40 @@ func TestBackend(skipFlag *bool, backendBuilder func() (db.Backend, apperror.Err
 			Expect(m.CalledHooks).To(Equal([]string{"before_create", "validate", "after_create"}))
 		})
 
+		It("Should only call bulk hooks in CreateMany()", func() {
+			calls := make([]string, 0)
+			for _, hook := range []string{db.HOOK_BEFORE_CREATE, db.HOOK_AFTER_CREATE, db.HOOK_BEFORE_BULK_CREATE, db.HOOK_AFTER_BULK_CREATE} {
+				name := hook
+				backend.RegisterHook(name, func(b db.Backend, obj interface{}) apperror.Error {
+					calls = append(calls, name)
+					return nil
+				})
+			}
+
+			m1 := &HooksModel{}
+			m2 := &HooksModel{}
+			Expect(backend.CreateMany(m1, m2)).ToNot(HaveOccurred())
+			Expect(calls).To(Equal([]string{db.HOOK_BEFORE_BULK_CREATE, db.HOOK_AFTER_BULK_CREATE}))
+			Expect(m1.CalledHooks).To(Equal([]string{"validate"}))
+			Expect(m2.CalledHooks).To(Equal([]string{"validate"}))
+		})
+
+		It("Should call before/afterSave hooks around the create and update hooks", func() {
+			m := &HooksModel{}
+			Expect(backend.Save(m)).ToNot(HaveOccurred())
+			Expect(m.CalledHooks).To(Equal([]string{"before_save", "before_create", "validate", "after_create", "after_save"}))
+
+			m.CalledHooks = nil
+			Expect(backend.Save(m)).ToNot(HaveOccurred())
+			Expect(m.CalledHooks).To(Equal([]string{"before_save", "before_update", "validate", "after_update", "after_save"}))
+		})
+
+		It("Should stop on error in BeforeSave()", func() {
+			m := &HooksModel{HookError: true}
+			Expect(backend.Save(m)).To(Equal(&apperror.Err{Code: "before_save"}))
+			Expect(m.CalledHooks).To(Equal([]string{"before_save"}))
+		})
+
 		It("Should stop on error in BeforeCreate()", func() {
 			m := &HooksModel{HookError: true}
 			Expect(backend.Create(m)).To(Equal(&apperror.Err{Code: "before_create"}))
@@ -30,6 +30,85 @@ func getIdentifiers(expr Expression) []Expression {
 	return nil
 }
 
+// CloneExpression returns a deep copy of an expression tree, which can be
+// modified without affecting the original.
+// Filters, NOT expressions, select statements, identifiers, values and all
+// multi and nested expressions are copied recursively. Other expressions are
+// shared with the original.
+func CloneExpression(expr Expression) Expression {
+	switch e := expr.(type) {
+	case nil:
+		return nil
+
+	case *SelectStmt:
+		return e.Clone()
+
+	case *JoinStmt:
+		return e.Clone()
+
+	case *Filter:
+		clone := *e
+		clone.field = CloneExpression(e.field)
+		clone.clause = CloneExpression(e.clause)
+		return &clone
+
+	case *NotExpr:
+		return &NotExpr{not: CloneExpression(e.not)}
+
+	case *IdentifierExpr:
+		clone := *e
+		return &clone
+
+	case *ColFieldIdentifierExpr:
+		clone := *e
+		return &clone
+
+	case *ValueExpr:
+		clone := *e
+		return &clone
+	}
+
+	multi, isMulti := expr.(MultiExpression)
+	_, isNested := expr.(NestedExpression)
+	if !isMulti && !isNested {
+		return expr
+	}
+
+	// Copy the struct, and then replace the sub-expressions with copies.
+	val := reflect.ValueOf(expr)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return expr
+	}
+	cloneVal := reflect.New(val.Elem().Type())
+	cloneVal.Elem().Set(val.Elem())
+	clone := cloneVal.Interface().(Expression)
+
+	if isMulti {
+		clone.(MultiExpression).SetExpressions(cloneExpressions(multi.Expressions()))
+	}
+	if isNested {
+		if setter, ok := clone.(interface {
+			SetExpression(Expression)
+		}); ok {
+			setter.SetExpression(CloneExpression(expr.(NestedExpression).Expression()))
+		}
+	}
+
+	return clone
+}
+
+// cloneExpressions returns a slice with deep copies of the expressions.
+func cloneExpressions(exprs []Expression) []Expression {
+	if exprs == nil {
+		return nil
+	}
+	clones := make([]Expression, len(exprs))
+	for i, expr := range exprs {
+		clones[i] = CloneExpression(expr)
+	}
+	return clones
+}
+
 /**
  * FieldedExpression.
  */
@@ -134,6 +213,10 @@ func (e *nestedExprMixin) Expression() Expression {
 	return e.expression
 }
 
+func (e *nestedExprMixin) SetExpression(expr Expression) {
+	e.expression = expr
+}
+
 func (e *nestedExprMixin) GetIdentifiers() []Expression {
 	return getIdentifiers(e.expression)
 }
@@ -264,6 +347,10 @@ func (e *ValueExpr) Value() interface{} {
 	return e.value
 }
 
+func (e *ValueExpr) SetValue(value interface{}) {
+	e.value = value
+}
+
 func NewValueExpr(value interface{}, typ ...reflect.Type) *ValueExpr {
 	e := &ValueExpr{value: value}
 	if len(typ) > 0 {
@@ -594,6 +681,33 @@ func NewUniqueFieldsConstraint(fields ...Expression) *UniqueFieldsConstraint {
 	}
 }
 
+/**
+ * PrimaryKeyFieldsConstraint.
+ */
+
+// PrimaryKeyFieldsConstraint is a collection constraint for composite
+// primary keys.
+type PrimaryKeyFieldsConstraint struct {
+	fields []Expression
+}
+
+func (c *PrimaryKeyFieldsConstraint) PrimaryKeyFields() []Expression {
+	return c.fields
+}
+
+func (c *PrimaryKeyFieldsConstraint) Validate() apperror.Error {
+	if len(c.fields) < 1 {
+		return apperror.New("no_primary_key_fields")
+	}
+	return nil
+}
+
+func NewPrimaryKeyFieldsConstraint(fields ...Expression) *PrimaryKeyFieldsConstraint {
+	return &PrimaryKeyFieldsConstraint{
+		fields: fields,
+	}
+}
+
 /**
  * FieldExpression.
  */
@@ -618,6 +732,10 @@ func (e *FieldExpr) Constraints() []Expression {
 	return e.constraints
 }
 
+func (e *FieldExpr) SetConstraints(constraints []Expression) {
+	e.constraints = constraints
+}
+
 func (e *FieldExpr) AddConstraint(constraint Expression) {
 	e.constraints = append(e.constraints, constraint)
 }
@@ -692,6 +810,58 @@ func NewFieldVal(field string, value interface{}, typ ...reflect.Type) *FieldVal
 	return NewFieldValExpr(NewIdExpr(field), NewValueExpr(value, typ...))
 }
 
+/**
+ * JSONSetExpression.
+ */
+
+// JSONSetExpr represents the value of a JSON document field with the value
+// at a path replaced, for example for updating a single key of a
+// marshalled field.
+type JSONSetExpr struct {
+	field Expression
+	path  []string
+	value interface{}
+}
+
+func (e *JSONSetExpr) Field() Expression {
+	return e.field
+}
+
+// Path returns the keys leading to the value to set.
+func (e *JSONSetExpr) Path() []string {
+	return e.path
+}
+
+func (e *JSONSetExpr) Value() interface{} {
+	return e.value
+}
+
+func (e *JSONSetExpr) Validate() apperror.Error {
+	if e.field == nil {
+		return apperror.New("empty_field")
+	} else if len(e.path) < 1 {
+		return apperror.New("empty_json_path")
+	}
+	for _, key := range e.path {
+		if key == "" {
+			return apperror.New("invalid_json_path", fmt.Sprintf("Invalid JSON path %v", strings.Join(e.path, ".")))
+		}
+	}
+	return nil
+}
+
+func (e *JSONSetExpr) GetIdentifiers() []Expression {
+	return getIdentifiers(e.field)
+}
+
+func NewJSONSetExpr(field Expression, path []string, value interface{}) *JSONSetExpr {
+	return &JSONSetExpr{
+		field: field,
+		path:  path,
+		value: value,
+	}
+}
+
 /**
  * FunctionExpression.
  */
@@ -728,6 +898,232 @@ func NewFuncExpr(function string, expr Expression) *FunctionExpr {
 	return e
 }
 
+/**
+ * CastExpression.
+ */
+
+// CastExpr converts an expression to a database type, like
+// CAST(created_at AS date).
+type CastExpr struct {
+	nestedExprMixin
+	targetType string
+}
+
+func (e *CastExpr) TargetType() string {
+	return e.targetType
+}
+
+// Validate checks that the target type only consists of letters, digits,
+// spaces, parentheses, brackets and commas, since translators write it into
+// the query verbatim.
+func (e *CastExpr) Validate() apperror.Error {
+	if e.targetType == "" {
+		return apperror.New("empty_cast_type")
+	} else if e.expression == nil {
+		return apperror.New("empty_cast_expression")
+	}
+	for _, c := range e.targetType {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !isDigit && !strings.ContainsRune(" ()[],", c) {
+			return apperror.New("invalid_cast_type", fmt.Sprintf("Invalid cast type %q", e.targetType), true)
+		}
+	}
+	return nil
+}
+
+func (e *CastExpr) GetIdentifiers() []Expression {
+	return getIdentifiers(e.expression)
+}
+
+func NewCastExpr(expr Expression, targetType string) *CastExpr {
+	e := &CastExpr{
+		targetType: targetType,
+	}
+	e.expression = expr
+	return e
+}
+
+func Cast(expr Expression, targetType string) *CastExpr {
+	return NewCastExpr(expr, targetType)
+}
+
+/**
+ * DateTruncExpression.
+ */
+
+const (
+	DATE_TRUNC_DAY   = "day"
+	DATE_TRUNC_WEEK  = "week"
+	DATE_TRUNC_MONTH = "month"
+	DATE_TRUNC_YEAR  = "year"
+)
+
+// DateTruncExpr truncates a timestamp to the start of its day, week, month
+// or year, which allows grouping by time periods.
+// Weeks start on Monday.
+type DateTruncExpr struct {
+	nestedExprMixin
+	unit string
+}
+
+func (e *DateTruncExpr) Unit() string {
+	return e.unit
+}
+
+func (e *DateTruncExpr) Validate() apperror.Error {
+	switch e.unit {
+	case DATE_TRUNC_DAY, DATE_TRUNC_WEEK, DATE_TRUNC_MONTH, DATE_TRUNC_YEAR:
+	default:
+		return apperror.New("invalid_date_trunc_unit", fmt.Sprintf("Unknown date_trunc unit %v", e.unit))
+	}
+	if e.expression == nil {
+		return apperror.New("empty_date_trunc_expression")
+	}
+	return nil
+}
+
+func (e *DateTruncExpr) GetIdentifiers() []Expression {
+	return getIdentifiers(e.expression)
+}
+
+func NewDateTruncExpr(expr Expression, unit string) *DateTruncExpr {
+	e := &DateTruncExpr{
+		unit: unit,
+	}
+	e.expression = expr
+	return e
+}
+
+// DateTrunc truncates the timestamp field to the unit, one of the
+// DATE_TRUNC_* constants.
+func DateTrunc(field, unit string) *DateTruncExpr {
+	return NewDateTruncExpr(NewIdExpr(field), unit)
+}
+
+/**
+ * WindowExpr.
+ */
+
+const (
+	WINDOW_ROW_NUMBER = "ROW_NUMBER"
+	WINDOW_RANK       = "RANK"
+)
+
+// WindowExpr represents a window function, like
+// ROW_NUMBER() OVER (PARTITION BY x ORDER BY y).
+type WindowExpr struct {
+	function    string
+	partitionBy []Expression
+	sorts       []*SortExpr
+}
+
+func (e *WindowExpr) Function() string {
+	return e.function
+}
+
+func (e *WindowExpr) PartitionBy() []Expression {
+	return e.partitionBy
+}
+
+func (e *WindowExpr) SetPartitionBy(exprs []Expression) {
+	e.partitionBy = exprs
+}
+
+func (e *WindowExpr) Sorts() []*SortExpr {
+	return e.sorts
+}
+
+func (e *WindowExpr) SetSorts(sorts []*SortExpr) {
+	e.sorts = sorts
+}
+
+func (e *WindowExpr) Validate() apperror.Error {
+	if e.function == "" {
+		return apperror.New("empty_function")
+	}
+	return nil
+}
+
+func (e *WindowExpr) GetIdentifiers() []Expression {
+	ids := make([]Expression, 0)
+	for _, expr := range e.partitionBy {
+		ids = append(ids, getIdentifiers(expr)...)
+	}
+	for _, sort := range e.sorts {
+		ids = append(ids, getIdentifiers(sort.Expression())...)
+	}
+	return ids
+}
+
+// NewWindowExpr creates a window function expression.
+// function should be one of the WINDOW_* constants.
+func NewWindowExpr(function string, partitionBy []Expression, sorts ...*SortExpr) *WindowExpr {
+	return &WindowExpr{
+		function:    function,
+		partitionBy: partitionBy,
+		sorts:       sorts,
+	}
+}
+
+/**
+ * CaseExpr.
+ */
+
+// CaseExpr represents a CASE WHEN x THEN y ELSE z END expression.
+type CaseExpr struct {
+	whens    []Expression
+	thens    []Expression
+	elseExpr Expression
+}
+
+// When adds a WHEN condition THEN result clause.
+func (e *CaseExpr) When(condition, result Expression) *CaseExpr {
+	e.whens = append(e.whens, condition)
+	e.thens = append(e.thens, result)
+	return e
+}
+
+func (e *CaseExpr) Whens() []Expression {
+	return e.whens
+}
+
+func (e *CaseExpr) Thens() []Expression {
+	return e.thens
+}
+
+func (e *CaseExpr) Else() Expression {
+	return e.elseExpr
+}
+
+func (e *CaseExpr) SetElse(expr Expression) {
+	e.elseExpr = expr
+}
+
+func (e *CaseExpr) Validate() apperror.Error {
+	if len(e.whens) == 0 {
+		return apperror.New("empty_case")
+	}
+	return nil
+}
+
+func (e *CaseExpr) GetIdentifiers() []Expression {
+	ids := make([]Expression, 0)
+	for i := range e.whens {
+		ids = append(ids, getIdentifiers(e.whens[i])...)
+		ids = append(ids, getIdentifiers(e.thens[i])...)
+	}
+	return append(ids, getIdentifiers(e.elseExpr)...)
+}
+
+// NewCaseExpr creates a new CASE expression.
+// elseExpr may be nil.
+func NewCaseExpr(elseExpr Expression) *CaseExpr {
+	return &CaseExpr{
+		elseExpr: elseExpr,
+	}
+}
+
 /**
  * Logical AND, OR, NOT expressions.
  */
@@ -828,6 +1224,17 @@ const (
 	OPERATOR_GTE  = ">="
 	OPERATOR_LT   = "<"
 	OPERATOR_LTE  = "<="
+
+	// The null operators check if a field is NULL and ignore the clause.
+	OPERATOR_IS_NULL     = "is null"
+	OPERATOR_IS_NOT_NULL = "is not null"
+
+	// The array operators filter array fields.
+	// OPERATOR_CONTAINS matches if the array contains the value, or all
+	// values of a slice. OPERATOR_OVERLAPS matches if the array contains
+	// any of the values.
+	OPERATOR_CONTAINS = "contains"
+	OPERATOR_OVERLAPS = "overlaps"
 )
 
 var OPERATOR_MAP map[string]string = map[string]string{
@@ -839,19 +1246,50 @@ var OPERATOR_MAP map[string]string = map[string]string{
 	OPERATOR_GTE:  "gte",
 	OPERATOR_LT:   "lt",
 	OPERATOR_LTE:  "lte",
+
+	OPERATOR_IS_NULL:     "is_null",
+	OPERATOR_IS_NOT_NULL: "is_not_null",
+
+	OPERATOR_CONTAINS: "contains",
+	OPERATOR_OVERLAPS: "overlaps",
 }
 
 func MapOperator(op string) string {
 	switch strings.ToLower(op) {
 	case "==":
 		return "="
-	case "=", "!=", "<", "<=", ">", ">=", "like", "in":
+	case "=", "!=", "<", "<=", ">", ">=", "like", "in", "is null", "is not null", "contains", "overlaps":
 		return op
 	default:
 		return ""
 	}
 }
 
+// IsNullOperator returns true for OPERATOR_IS_NULL and OPERATOR_IS_NOT_NULL.
+func IsNullOperator(op string) bool {
+	return op == OPERATOR_IS_NULL || op == OPERATOR_IS_NOT_NULL
+}
+
+// IsArrayOperator returns true for OPERATOR_CONTAINS and OPERATOR_OVERLAPS.
+func IsArrayOperator(op string) bool {
+	return op == OPERATOR_CONTAINS || op == OPERATOR_OVERLAPS
+}
+
+// IsEmptyInFilter returns true for OPERATOR_IN filters with an empty list of
+// values. Such filters never match, and negated with NotExpr, they match
+// all rows.
+func IsEmptyInFilter(f FilterExpression) bool {
+	if f.Operator() != OPERATOR_IN {
+		return false
+	}
+	val, ok := f.Clause().(*ValueExpr)
+	if !ok {
+		return false
+	}
+	v := reflect.ValueOf(val.Value())
+	return (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Len() == 0
+}
+
 /**
  * FilterExpression.
  */
@@ -877,6 +1315,10 @@ func (f *Filter) Field() Expression {
 	return f.field
 }
 
+func (f *Filter) SetField(field Expression) {
+	f.field = field
+}
+
 func (f *Filter) Operator() string {
 	return f.operator
 }
@@ -931,6 +1373,113 @@ func NewFieldValFilter(collection, field, operator string, value interface{}) *F
 	return NewFieldFilter(collection, field, operator, NewValueExpr(value))
 }
 
+/**
+ * SearchExpr.
+ */
+
+// SearchExpr is a full text search for a term in one or more fields.
+// Translators use the full text search capabilities of the database if
+// available, and fall back to case insensitive substring matching.
+type SearchExpr struct {
+	multiExprMixin
+	term string
+}
+
+func (e *SearchExpr) Term() string {
+	return e.term
+}
+
+func (e *SearchExpr) SetTerm(term string) {
+	e.term = term
+}
+
+func (e *SearchExpr) Validate() apperror.Error {
+	if len(e.expressions) == 0 {
+		return apperror.New("empty_search_fields")
+	}
+	return nil
+}
+
+func NewSearchExpr(term string, fields ...Expression) *SearchExpr {
+	e := &SearchExpr{
+		term: term,
+	}
+	e.expressions = fields
+	return e
+}
+
+/**
+ * CursorExpr.
+ */
+
+// CursorExpr is a keyset pagination filter that matches all rows after a
+// cursor position in a composite sort order, like (a, b) > (1, 2).
+// Each field has a direction, true for ascending.
+//
+// Translators may emit a row value comparison if all directions are equal,
+// and otherwise use the equivalent expression returned by Expand().
+type CursorExpr struct {
+	multiExprMixin
+	values     []interface{}
+	directions []bool
+}
+
+func (e *CursorExpr) Values() []interface{} {
+	return e.values
+}
+
+func (e *CursorExpr) Directions() []bool {
+	return e.directions
+}
+
+// SameDirection returns true if all fields are sorted in the same direction.
+func (e *CursorExpr) SameDirection() bool {
+	for _, dir := range e.directions {
+		if dir != e.directions[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// Expand returns the cursor as a combination of simple filters:
+// (a > ?) OR (a = ? AND b > ?).
+func (e *CursorExpr) Expand() Expression {
+	or := NewOrExpr()
+	for i, field := range e.expressions {
+		and := NewAndExpr()
+		for j := 0; j < i; j++ {
+			and.Add(NewFilter(e.expressions[j], OPERATOR_EQ, NewValueExpr(e.values[j])))
+		}
+		operator := OPERATOR_GT
+		if !e.directions[i] {
+			operator = OPERATOR_LT
+		}
+		and.Add(NewFilter(field, operator, NewValueExpr(e.values[i])))
+		or.Add(and)
+	}
+	return or
+}
+
+func (e *CursorExpr) Validate() apperror.Error {
+	if len(e.expressions) == 0 {
+		return apperror.New("empty_cursor_fields")
+	}
+	if len(e.values) != len(e.expressions) || len(e.directions) != len(e.expressions) {
+		return apperror.New("invalid_cursor", "Cursor fields, values and directions must have the same length")
+	}
+	return nil
+}
+
+func NewCursorExpr(fields []Expression, values []interface{}, directions []bool) *CursorExpr {
+	e := &CursorExpr{
+		values:     values,
+		directions: directions,
+	}
+	e.expressions = fields
+	return e
+}
+
 /**
  * Eq.
  */
@@ -999,9 +1548,18 @@ func Gte(collection, field string, val interface{}) *Filter {
  * SortExpression.
  */
 
+const (
+	// NULLS_DEFAULT leaves the placement of null values to the backend.
+	NULLS_DEFAULT = ""
+	NULLS_FIRST   = "first"
+	NULLS_LAST    = "last"
+)
+
 type SortExpr struct {
 	nestedExprMixin
 	ascending bool
+	nulls     string
+	raw       bool
 }
 
 func (s *SortExpr) Ascending() bool {
@@ -1012,6 +1570,22 @@ func (s *SortExpr) SetAscending(asc bool) {
 	s.ascending = asc
 }
 
+// Nulls returns the placement of null values, either NULLS_FIRST, NULLS_LAST
+// or NULLS_DEFAULT.
+func (s *SortExpr) Nulls() string {
+	return s.nulls
+}
+
+func (s *SortExpr) SetNulls(nulls string) {
+	s.nulls = nulls
+}
+
+// Raw returns true if the expression is a raw sort fragment that already
+// contains the direction, so translators must emit it as is.
+func (s *SortExpr) Raw() bool {
+	return s.raw
+}
+
 func (s *SortExpr) SetExpression(expr Expression) {
 	s.expression = expr
 }
@@ -1020,6 +1594,9 @@ func (e *SortExpr) Validate() apperror.Error {
 	if e.expression == nil {
 		return apperror.New("empty_field_expression")
 	}
+	if e.nulls != NULLS_DEFAULT && e.nulls != NULLS_FIRST && e.nulls != NULLS_LAST {
+		return apperror.New("invalid_nulls_placement", fmt.Sprintf("Invalid nulls placement %v", e.nulls))
+	}
 	return nil
 }
 
@@ -1034,3 +1611,11 @@ func NewSortExpr(expr Expression, ascending bool) *SortExpr {
 func NewSort(collection, field string, ascending bool) *SortExpr {
 	return NewSortExpr(BuildIdExpr(collection, field), ascending)
 }
+
+// NewRawSortExpr creates a sort expression from a raw fragment, like
+// "LENGTH(name) DESC".
+func NewRawSortExpr(fragment string) *SortExpr {
+	e := NewSortExpr(NewTextExpr(fragment), true)
+	e.raw = true
+	return e
+}
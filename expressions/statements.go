@@ -210,6 +210,48 @@ func NewRenameFieldStmt(collection, field, newName string) *RenameFieldStmt {
 	}
 }
 
+/**
+ * AlterFieldStatement.
+ */
+
+// AlterFieldStmt changes the type of a collection field.
+type AlterFieldStmt struct {
+	collection string
+	field      string
+	fieldType  *FieldTypeExpr
+}
+
+func (s *AlterFieldStmt) Collection() string {
+	return s.collection
+}
+
+func (s *AlterFieldStmt) Field() string {
+	return s.field
+}
+
+func (s *AlterFieldStmt) FieldType() *FieldTypeExpr {
+	return s.fieldType
+}
+
+func (e *AlterFieldStmt) Validate() apperror.Error {
+	if e.collection == "" {
+		return apperror.New("empty_collection")
+	} else if e.field == "" {
+		return apperror.New("empty_field")
+	} else if e.fieldType == nil {
+		return apperror.New("empty_field_type")
+	}
+	return nil
+}
+
+func NewAlterFieldStmt(collection, field string, fieldType *FieldTypeExpr) *AlterFieldStmt {
+	return &AlterFieldStmt{
+		collection: collection,
+		field:      field,
+		fieldType:  fieldType,
+	}
+}
+
 /**
  * DropFieldStatement.
  */
@@ -266,6 +308,8 @@ type CreateIndexStmt struct {
 	unique          bool
 	// Indexing method.
 	method string
+	// Filter for partial indexes.
+	filter Expression
 }
 
 func (s *CreateIndexStmt) IndexName() string {
@@ -288,6 +332,16 @@ func (s *CreateIndexStmt) Method() string {
 	return s.method
 }
 
+// Filter returns the predicate of a partial index, or nil if the index
+// covers all rows.
+func (s *CreateIndexStmt) Filter() Expression {
+	return s.filter
+}
+
+func (s *CreateIndexStmt) SetFilter(val Expression) {
+	s.filter = val
+}
+
 func (e *CreateIndexStmt) Validate() apperror.Error {
 	if len(e.expressions) < 1 {
 		return apperror.New("no_index_expressions")
@@ -353,11 +407,32 @@ type SelectStmt struct {
 	namedExprMixin
 
 	collection string
+	// alias is the name the collection is referred to by in the statement,
+	// which correlated subqueries on the same collection need.
+	alias string
 	// Fields are arbitrary field expressions.
 	fields []Expression
 	filter Expression
 	sorts  []*SortExpr
 
+	// groupBy holds the expressions the result is grouped by.
+	groupBy []Expression
+
+	// having is a filter that is applied to the groups of a grouped select.
+	having Expression
+
+	// distinct removes duplicate rows from the result.
+	distinct bool
+
+	// distinctOn holds expressions for which only the first row of each
+	// distinct value combination is returned (according to the sorts).
+	distinctOn []Expression
+
+	// indexHint holds the name of an index the database should use.
+	// Only honored by backends that support index hints.
+	indexHint     string
+	indexHintMode string
+
 	limit  int
 	offset int
 
@@ -370,6 +445,34 @@ func NewSelectStmt(collection string) *SelectStmt {
 	}
 }
 
+// Clone returns a deep copy of the statement that can be modified without
+// affecting the original.
+// Fields, the filter tree, sorts, groupings and joins are copied
+// recursively with CloneExpression().
+func (s *SelectStmt) Clone() *SelectStmt {
+	clone := *s
+	clone.fields = cloneExpressions(s.fields)
+	clone.filter = CloneExpression(s.filter)
+	clone.groupBy = cloneExpressions(s.groupBy)
+	clone.having = CloneExpression(s.having)
+	clone.distinctOn = cloneExpressions(s.distinctOn)
+
+	if s.sorts != nil {
+		clone.sorts = make([]*SortExpr, len(s.sorts))
+		for i, sort := range s.sorts {
+			clone.sorts[i] = CloneExpression(sort).(*SortExpr)
+		}
+	}
+	if s.joins != nil {
+		clone.joins = make([]*JoinStmt, len(s.joins))
+		for i, join := range s.joins {
+			clone.joins[i] = join.Clone()
+		}
+	}
+
+	return &clone
+}
+
 func (s *SelectStmt) Collection() string {
 	return s.collection
 }
@@ -378,6 +481,14 @@ func (s *SelectStmt) SetCollection(col string) {
 	s.collection = col
 }
 
+func (s *SelectStmt) Alias() string {
+	return s.alias
+}
+
+func (s *SelectStmt) SetAlias(alias string) {
+	s.alias = alias
+}
+
 /**
  * Fields.
  */
@@ -442,6 +553,99 @@ func (s *SelectStmt) AddSort(sort *SortExpr) {
 	s.sorts = append(s.sorts, sort)
 }
 
+/**
+ * GroupBy.
+ */
+
+func (s *SelectStmt) GroupBy() []Expression {
+	return s.groupBy
+}
+
+func (s *SelectStmt) SetGroupBy(exprs []Expression) {
+	s.groupBy = exprs
+}
+
+func (s *SelectStmt) AddGroupBy(exprs ...Expression) {
+	s.groupBy = append(s.groupBy, exprs...)
+}
+
+/**
+ * Having.
+ */
+
+func (s *SelectStmt) Having() Expression {
+	return s.having
+}
+
+func (s *SelectStmt) SetHaving(having Expression) {
+	s.having = having
+}
+
+// HavingAnd adds a having filter, combining it with an existing one
+// with AND.
+func (s *SelectStmt) HavingAnd(having Expression) {
+	if s.having == nil {
+		s.having = having
+	} else if andExpr, ok := s.having.(*AndExpr); ok {
+		andExpr.Add(having)
+	} else {
+		s.having = NewAndExpr(s.having, having)
+	}
+}
+
+/**
+ * Distinct.
+ */
+
+func (s *SelectStmt) IsDistinct() bool {
+	return s.distinct
+}
+
+func (s *SelectStmt) SetDistinct(distinct bool) {
+	s.distinct = distinct
+}
+
+/**
+ * DistinctOn.
+ */
+
+func (s *SelectStmt) DistinctOn() []Expression {
+	return s.distinctOn
+}
+
+func (s *SelectStmt) SetDistinctOn(exprs []Expression) {
+	s.distinctOn = exprs
+}
+
+/**
+ * IndexHint.
+ */
+
+const (
+	INDEX_HINT_USE    = "use"
+	INDEX_HINT_FORCE  = "force"
+	INDEX_HINT_IGNORE = "ignore"
+)
+
+var INDEX_HINT_MAP map[string]string = map[string]string{
+	"use":    "USE INDEX",
+	"force":  "FORCE INDEX",
+	"ignore": "IGNORE INDEX",
+}
+
+func (s *SelectStmt) IndexHint() string {
+	return s.indexHint
+}
+
+func (s *SelectStmt) IndexHintMode() string {
+	return s.indexHintMode
+}
+
+func (s *SelectStmt) SetIndexHint(index, mode string) {
+	s.indexHint = index
+	s.indexHintMode = mode
+}
+
 /**
  * Limit.
  */
@@ -486,6 +690,11 @@ func (e *SelectStmt) Validate() apperror.Error {
 	if e.collection == "" {
 		return apperror.New("empty_collection")
 	}
+	if e.indexHint != "" {
+		if _, ok := INDEX_HINT_MAP[e.indexHintMode]; !ok {
+			return apperror.New("invalid_index_hint_mode", fmt.Sprintf("Unknown index hint mode %v", e.indexHintMode))
+		}
+	}
 	return nil
 }
 
@@ -501,6 +710,16 @@ func (s *SelectStmt) GetIdentifiers() []Expression {
 	for _, sort := range s.sorts {
 		ids = append(ids, getIdentifiers(sort)...)
 	}
+	// Group by.
+	for _, group := range s.groupBy {
+		ids = append(ids, getIdentifiers(group)...)
+	}
+	// Having.
+	ids = append(ids, getIdentifiers(s.having)...)
+	// Distinct on.
+	for _, expr := range s.distinctOn {
+		ids = append(ids, getIdentifiers(expr)...)
+	}
 	// Joins.
 	for _, join := range s.joins {
 		ids = append(ids, join.GetIdentifiers()...)
@@ -564,6 +783,14 @@ func (s *JoinStmt) SelectStatement() *SelectStmt {
 	return &s.SelectStmt
 }
 
+// Clone returns a deep copy of the join statement.
+func (s *JoinStmt) Clone() *JoinStmt {
+	clone := *s
+	clone.SelectStmt = *s.SelectStmt.Clone()
+	clone.joinCondition = CloneExpression(s.joinCondition)
+	return &clone
+}
+
 func (e *JoinStmt) Validate() apperror.Error {
 	if err := e.SelectStmt.Validate(); err != nil {
 		return err
@@ -652,11 +879,26 @@ func (s mutationStmt) GetIdentifiers() []Expression {
 
 type CreateStmt struct {
 	mutationStmt
+
+	// rows holds the values of additional rows inserted by the statement.
+	// All rows must have the same fields in the same order as the values.
+	rows [][]*FieldValueExpr
 }
 
 // Ensure CreateStatement implements FieldedExpression.
 var _ FieldedExpression = (*CreateStmt)(nil)
 
+// Rows returns the values of all rows, starting with Values().
+func (e *CreateStmt) Rows() [][]*FieldValueExpr {
+	rows := [][]*FieldValueExpr{e.values}
+	return append(rows, e.rows...)
+}
+
+// AddRow adds the values of an additional row.
+func (e *CreateStmt) AddRow(values []*FieldValueExpr) {
+	e.rows = append(e.rows, values)
+}
+
 func NewCreateStmt(collection string, values []*FieldValueExpr) *CreateStmt {
 	stmt := &CreateStmt{}
 	stmt.collection = collection
@@ -664,6 +906,89 @@ func NewCreateStmt(collection string, values []*FieldValueExpr) *CreateStmt {
 	return stmt
 }
 
+/**
+ * UpsertStatement.
+ */
+
+// UpsertStmt inserts a new row, or updates the existing row if the insert
+// conflicts with a unique constraint.
+// The conflict target is either a list of fields or the name of a constraint.
+type UpsertStmt struct {
+	mutationStmt
+
+	conflictFields     []Expression
+	conflictConstraint string
+
+	// updateValues are the values set if a conflict occurs.
+	// If empty, all values are updated.
+	updateValues []*FieldValueExpr
+}
+
+// Ensure UpsertStmt implements FieldedExpression.
+var _ FieldedExpression = (*UpsertStmt)(nil)
+
+func (s *UpsertStmt) ConflictFields() []Expression {
+	return s.conflictFields
+}
+
+func (s *UpsertStmt) SetConflictFields(x []Expression) {
+	s.conflictFields = x
+}
+
+func (s *UpsertStmt) ConflictConstraint() string {
+	return s.conflictConstraint
+}
+
+func (s *UpsertStmt) SetConflictConstraint(x string) {
+	s.conflictConstraint = x
+}
+
+func (s *UpsertStmt) UpdateValues() []*FieldValueExpr {
+	return s.updateValues
+}
+
+func (s *UpsertStmt) SetUpdateValues(x []*FieldValueExpr) {
+	s.updateValues = x
+}
+
+func (e *UpsertStmt) Validate() apperror.Error {
+	if err := e.mutationStmt.Validate(); err != nil {
+		return err
+	} else if len(e.conflictFields) < 1 && e.conflictConstraint == "" {
+		return apperror.New("no_conflict_target")
+	}
+	return nil
+}
+
+func (s *UpsertStmt) GetIdentifiers() []Expression {
+	ids := s.mutationStmt.GetIdentifiers()
+	for _, field := range s.conflictFields {
+		ids = append(ids, getIdentifiers(field)...)
+	}
+	for _, val := range s.updateValues {
+		ids = append(ids, getIdentifiers(val)...)
+	}
+	return ids
+}
+
+func NewUpsertStmt(collection string, values []*FieldValueExpr, conflictFields []Expression) *UpsertStmt {
+	stmt := &UpsertStmt{}
+	stmt.collection = collection
+	stmt.values = values
+	stmt.conflictFields = conflictFields
+	return stmt
+}
+
+// NewConstraintUpsertStmt returns an UpsertStmt that uses the unique
+// constraint or index with the given name as conflict target.
+func NewConstraintUpsertStmt(collection string, values []*FieldValueExpr, constraint string) *UpsertStmt {
+	stmt := &UpsertStmt{}
+	stmt.collection = collection
+	stmt.values = values
+	stmt.conflictConstraint = constraint
+	return stmt
+}
+
 /**
  * UpdateStatement.
  */
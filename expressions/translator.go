@@ -11,6 +11,12 @@ import (
 	"github.com/theduke/go-reflector"
 )
 
+// IndexHintTranslator is implemented by translators for databases that
+// support index hints.
+type IndexHintTranslator interface {
+	TranslateIndexHint(stmt *SelectStmt) apperror.Error
+}
+
 type ExpressionTranslator interface {
 	QuoteIdentifier(id string) string
 	QuoteValue(val interface{}) string
@@ -204,6 +210,19 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 		}
 		t.W(")")
 
+	case *PrimaryKeyFieldsConstraint:
+		t.W("PRIMARY KEY(")
+		lastIndex := len(e.PrimaryKeyFields()) - 1
+		for i, field := range e.PrimaryKeyFields() {
+			if err := t.translator.Translate(field); err != nil {
+				return err
+			}
+			if i < lastIndex {
+				t.W(", ")
+			}
+		}
+		t.W(")")
+
 	case *DefaultValueConstraint:
 		t.W("DEFAULT ")
 		if err := t.translator.Translate(e.DefaultValue()); err != nil {
@@ -251,6 +270,9 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 			return err
 		}
 
+	case *JSONSetExpr:
+		return apperror.New("unsupported_json_set", "JSON path updates are not supported by this database")
+
 	case *FunctionExpr:
 		t.W(e.Function(), "(")
 		if err := t.translator.Translate(e.Expression()); err != nil {
@@ -258,6 +280,72 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 		}
 		t.W(")")
 
+	case *DateTruncExpr:
+		return apperror.New("unsupported_date_trunc", "Truncating dates is not supported by this database")
+
+	case *CastExpr:
+		// The target type is written verbatim, so it must be validated
+		// even if the expression was not.
+		if err := e.Validate(); err != nil {
+			return err
+		}
+		t.W("CAST(")
+		if err := t.translator.Translate(e.Expression()); err != nil {
+			return err
+		}
+		t.W(" AS ", e.TargetType(), ")")
+
+	case *CaseExpr:
+		t.W("CASE")
+		for i, when := range e.Whens() {
+			t.W(" WHEN ")
+			if err := t.translator.Translate(when); err != nil {
+				return err
+			}
+			t.W(" THEN ")
+			if err := t.translator.Translate(e.Thens()[i]); err != nil {
+				return err
+			}
+		}
+		if e.Else() != nil {
+			t.W(" ELSE ")
+			if err := t.translator.Translate(e.Else()); err != nil {
+				return err
+			}
+		}
+		t.W(" END")
+
+	case *WindowExpr:
+		t.W(e.Function(), "() OVER (")
+		if len(e.PartitionBy()) > 0 {
+			t.W("PARTITION BY ")
+			lastIndex := len(e.PartitionBy()) - 1
+			for i, expr := range e.PartitionBy() {
+				if err := t.translator.Translate(expr); err != nil {
+					return err
+				}
+				if i < lastIndex {
+					t.W(", ")
+				}
+			}
+		}
+		if len(e.Sorts()) > 0 {
+			if len(e.PartitionBy()) > 0 {
+				t.W(" ")
+			}
+			t.W("ORDER BY ")
+			lastIndex := len(e.Sorts()) - 1
+			for i, sort := range e.Sorts() {
+				if err := t.translator.Translate(sort); err != nil {
+					return err
+				}
+				if i < lastIndex {
+					t.W(", ")
+				}
+			}
+		}
+		t.W(")")
+
 	case *AndExpr:
 		lastIndex := len(e.Expressions()) - 1
 		if lastIndex > 0 {
@@ -294,6 +382,33 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 			t.W(")")
 		}
 
+	case *SearchExpr:
+		// Generic fallback: case insensitive substring matching.
+		term := NewValueExpr("%" + strings.ToLower(e.Term()) + "%")
+		t.W("(")
+		lastIndex := len(e.Expressions()) - 1
+		for i, field := range e.Expressions() {
+			t.W("LOWER(")
+			if err := t.translator.Translate(field); err != nil {
+				return err
+			}
+			t.W(") LIKE ")
+			if err := t.translator.Translate(term); err != nil {
+				return err
+			}
+			if i < lastIndex {
+				t.W(" OR ")
+			}
+		}
+		t.W(")")
+
+	case *CursorExpr:
+		// Generic fallback: expand to simple comparisons, which works
+		// without row value support and with mixed directions.
+		if err := t.translator.Translate(e.Expand()); err != nil {
+			return err
+		}
+
 	case *NotExpr:
 		t.W("NOT ")
 		if err := t.translator.Translate(e.Not()); err != nil {
@@ -301,15 +416,37 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 		}
 
 	case FilterExpression:
+		if IsEmptyInFilter(e) {
+			// IN () is a syntax error, so use a condition that never matches.
+			t.W("1=0")
+			return nil
+		}
+
 		if err := t.translator.Translate(e.Field()); err != nil {
 			return err
 		}
+
+		if IsNullOperator(e.Operator()) {
+			// Null checks do not have a clause.
+			t.W(" ", e.Operator())
+			return nil
+		}
+
+		if IsArrayOperator(e.Operator()) {
+			return apperror.New("unsupported_operator",
+				fmt.Sprintf("The operator %v is only supported by databases with array columns", e.Operator()))
+		}
+
 		t.W(" ", e.Operator(), " ")
 
 		if e.Operator() != OPERATOR_IN {
 			if err := t.translator.Translate(e.Clause()); err != nil {
 				return err
 			}
+		} else if sub, ok := e.Clause().(*SelectStmt); ok {
+			if err := t.translator.Translate(sub); err != nil {
+				return err
+			}
 		} else {
 			val, ok := e.Clause().(*ValueExpr)
 			if !ok {
@@ -321,10 +458,6 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 				return apperror.New("invalid_in_filter_value")
 			}
 
-			if r.Len() < 1 {
-				return apperror.New("invalid_in_filter_no_values")
-			}
-
 			t.W("(")
 
 			lastIndex := r.Len() - 1
@@ -343,12 +476,22 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 		if err := t.translator.Translate(e.Expression()); err != nil {
 			return err
 		}
+		if e.Raw() {
+			return nil
+		}
 		if e.Ascending() {
 			t.W(" ASC")
 		} else {
 			t.W(" DESC")
 		}
 
+		switch e.Nulls() {
+		case NULLS_FIRST:
+			t.W(" NULLS FIRST")
+		case NULLS_LAST:
+			t.W(" NULLS LAST")
+		}
+
 	case *CreateCollectionStmt:
 		t.W("CREATE TABLE ")
 		if e.IfNotExists() {
@@ -426,6 +569,23 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 		t.W(" TO ")
 		t.WQ(e.NewName())
 
+	case *AlterFieldStmt:
+		// Existing values are cast to the new type.
+		t.W("ALTER TABLE ")
+		t.WQ(e.Collection())
+		t.W(" ALTER COLUMN ")
+		t.WQ(e.Field())
+		t.W(" TYPE ")
+		if err := t.translator.Translate(e.FieldType()); err != nil {
+			return err
+		}
+		t.W(" USING ")
+		t.WQ(e.Field())
+		t.W("::")
+		if err := t.translator.Translate(e.FieldType()); err != nil {
+			return err
+		}
+
 	case *CreateIndexStmt:
 		t.W("CREATE ")
 		if e.Unique() {
@@ -453,6 +613,13 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 		}
 		t.W(")")
 
+		if e.Filter() != nil {
+			t.W(" WHERE ")
+			if err := t.translator.Translate(e.Filter()); err != nil {
+				return err
+			}
+		}
+
 	case *DropIndexStmt:
 		t.W("DROP INDEX ")
 		if e.IfExists() {
@@ -473,6 +640,22 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 
 		t.W("SELECT ")
 
+		if e.IsDistinct() {
+			t.W("DISTINCT ")
+		} else if len(e.DistinctOn()) > 0 {
+			t.W("DISTINCT ON (")
+			lastIndex := len(e.DistinctOn()) - 1
+			for i, expr := range e.DistinctOn() {
+				if err := t.translator.Translate(expr); err != nil {
+					return err
+				}
+				if i < lastIndex {
+					t.W(", ")
+				}
+			}
+			t.W(") ")
+		}
+
 		// Field expressions.
 		lastIndex := len(e.Fields()) - 1
 		for i, expr := range e.Fields() {
@@ -504,6 +687,19 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 
 		t.W(" FROM ")
 		t.WQ(e.Collection())
+		if e.Alias() != "" {
+			t.W(" AS ")
+			t.WQ(e.Alias())
+		}
+
+		if e.IndexHint() != "" {
+			// Index hints are ignored by translators that do not support them.
+			if hinter, ok := t.translator.(IndexHintTranslator); ok {
+				if err := hinter.TranslateIndexHint(e); err != nil {
+					return err
+				}
+			}
+		}
 
 		// Join clauses.
 		for _, join := range e.Joins() {
@@ -520,6 +716,26 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 			}
 		}
 
+		if len(e.GroupBy()) > 0 {
+			t.W(" GROUP BY ")
+			lastIndex := len(e.GroupBy()) - 1
+			for i, group := range e.GroupBy() {
+				if err := t.translator.Translate(group); err != nil {
+					return err
+				}
+				if i < lastIndex {
+					t.W(", ")
+				}
+			}
+		}
+
+		if e.Having() != nil {
+			t.W(" HAVING ")
+			if err := t.translator.Translate(e.Having()); err != nil {
+				return err
+			}
+		}
+
 		if len(e.Sorts()) > 0 {
 			t.W(" ORDER BY ")
 			lastIndex := len(e.Sorts()) - 1
@@ -567,16 +783,72 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 				t.W(", ")
 			}
 		}
-		t.W(") VALUES(")
-		for i, field := range e.Values() {
-			if err := t.translator.Translate(field.Value()); err != nil {
+		t.W(") VALUES")
+		for rowIndex, row := range e.Rows() {
+			if len(row) != len(e.Values()) {
+				return apperror.New("invalid_create_row", "All rows of a create statement must have the same fields")
+			}
+			if rowIndex > 0 {
+				t.W(", ")
+			}
+			t.W("(")
+			for i, field := range row {
+				if err := t.translator.Translate(field.Value()); err != nil {
+					return err
+				}
+				if i < lastIndex {
+					t.W(",")
+				}
+			}
+			t.W(")")
+		}
+
+	case *UpsertStmt:
+		if err := t.translator.Translate(NewCreateStmt(e.Collection(), e.Values())); err != nil {
+			return err
+		}
+
+		t.W(" ON CONFLICT ")
+		if e.ConflictConstraint() != "" {
+			t.W("ON CONSTRAINT ")
+			t.WQ(e.ConflictConstraint())
+		} else {
+			t.W("(")
+			lastIndex := len(e.ConflictFields()) - 1
+			for i, field := range e.ConflictFields() {
+				if err := t.translator.Translate(field); err != nil {
+					return err
+				}
+				if i < lastIndex {
+					t.W(", ")
+				}
+			}
+			t.W(")")
+		}
+
+		t.W(" DO UPDATE SET ")
+		values := e.UpdateValues()
+		if len(values) < 1 {
+			// Update all inserted values with the new data.
+			values = make([]*FieldValueExpr, 0)
+			for _, val := range e.Values() {
+				id, ok := val.Field().(*IdentifierExpr)
+				if !ok {
+					return apperror.New("unsupported_upsert_field", "Upsert fields must be identifiers")
+				}
+				values = append(values, NewFieldValExpr(id, NewColFieldIdExpr("excluded", id.Identifier())))
+			}
+		}
+
+		lastIndex := len(values) - 1
+		for i, val := range values {
+			if err := t.translator.Translate(val); err != nil {
 				return err
 			}
 			if i < lastIndex {
-				t.W(",")
+				t.W(", ")
 			}
 		}
-		t.W(")")
 
 	case *UpdateStmt:
 		t.W("UPDATE ")
@@ -600,15 +872,14 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 				if err := t.translator.Translate(sel.Filter()); err != nil {
 					return err
 				}
-				t.W(" ")
 			}
 
 			if len(sel.Sorts()) > 0 {
-				t.W("ORDER BY ")
+				t.W(" ORDER BY ")
 				lastIndex := len(sel.Sorts()) - 1
 				for i, sort := range sel.Sorts() {
 					if err := t.translator.Translate(sort); err != nil {
-						return nil
+						return err
 					}
 					if i < lastIndex {
 						t.W(", ")
@@ -642,7 +913,7 @@ func (t *SqlTranslator) Translate(expression Expression) apperror.Error {
 				lastIndex := len(sel.Sorts()) - 1
 				for i, sort := range sel.Sorts() {
 					if err := t.translator.Translate(sort); err != nil {
-						return nil
+						return err
 					}
 					if i < lastIndex {
 						t.W(", ")
@@ -92,6 +92,13 @@ var _ = Describe("ExpressionTranslater", func() {
 			Expect(t.String()).To(Equal(sql))
 		})
 
+		It("Should translate PrimaryKeyFieldsConstraint", func() {
+			sql := `PRIMARY KEY("field1", "field2")`
+			expr := NewPrimaryKeyFieldsConstraint(NewIdExpr("field1"), NewIdExpr("field2"))
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
 		It("Should translate AutoIncrementConstraint", func() {
 			sql := `AUTO_INCREMENT`
 			expr := NewConstraintExpr(CONSTRAINT_AUTO_INCREMENT)
@@ -244,6 +251,14 @@ var _ = Describe("ExpressionTranslater", func() {
 			Expect(t.String()).To(Equal(sql))
 		})
 
+		It("Should translate SortExpression with nulls placement", func() {
+			sql := `"myfield" DESC NULLS LAST`
+			sort := NewSortExpr(NewIdExpr("myfield"), false)
+			sort.SetNulls(NULLS_LAST)
+			Expect(t.Translate(sort)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
 		/**
 		 * Statements.
 		 */
@@ -292,6 +307,13 @@ var _ = Describe("ExpressionTranslater", func() {
 			Expect(t.String()).To(Equal(sql))
 		})
 
+		It("Should translate AlterFieldStmt", func() {
+			sql := `ALTER TABLE "col" ALTER COLUMN "field" TYPE bigint USING "field"::bigint`
+			expr := NewAlterFieldStmt("col", "field", NewFieldTypeExpr("bigint", nil))
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
 		It("Should translate DropFieldStmt", func() {
 			sql := `ALTER TABLE "col" DROP COLUMN IF EXISTS "field" CASCADE`
 			expr := NewDropFieldStmt("col", "field", true, true)
@@ -313,6 +335,15 @@ var _ = Describe("ExpressionTranslater", func() {
 			Expect(t.String()).To(Equal(sql))
 		})
 
+		It("Should translate partial CreateIndexStatement", func() {
+			sql := `CREATE UNIQUE INDEX "index" ON "col" ("field") WHERE "deleted_at" is null`
+			expr := NewCreateIndexStmt("index", NewIdExpr("col"), []Expression{NewIdExpr("field")}, true, "")
+			expr.SetFilter(NewFieldValFilter("", "deleted_at", OPERATOR_IS_NULL, nil))
+
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
 		It("Should translate DropIndexStatement", func() {
 			sql := `DROP INDEX IF EXISTS "index" CASCADE`
 			expr := NewDropIndexStmt("index", true, true)
@@ -338,6 +369,177 @@ var _ = Describe("ExpressionTranslater", func() {
 			Expect(t.String()).To(Equal(sql))
 		})
 
+		It("Should translate CreateStatement with multiple rows", func() {
+			sql := `INSERT INTO "col"("a", "b") VALUES(?,?), (?,?)`
+
+			expr := NewCreateStmt("col", []*FieldValueExpr{NewFieldVal("a", 1), NewFieldVal("b", 2)})
+			expr.AddRow([]*FieldValueExpr{NewFieldVal("a", 3), NewFieldVal("b", 4)})
+
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+			Expect(t.RawArguments()).To(Equal([]interface{}{1, 2, 3, 4}))
+		})
+
+		It("Should translate SelectStatement with DISTINCT", func() {
+			sql := `SELECT DISTINCT "field1" FROM "col"`
+
+			expr := NewSelectStmt("col")
+			expr.SetDistinct(true)
+			expr.AddField(NewIdExpr("field1"))
+
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
+		It("Should translate SelectStatement with an alias", func() {
+			sql := `SELECT "latest"."field1" FROM "col" AS "latest"`
+
+			expr := NewSelectStmt("col")
+			expr.SetAlias("latest")
+			expr.AddField(NewColFieldIdExpr("latest", "field1"))
+
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
+		It("Should translate SelectStatement with GROUP BY and HAVING", func() {
+			sql := `SELECT "field1" FROM "col" GROUP BY "field1" HAVING COUNT(*) > ?`
+
+			expr := NewSelectStmt("col")
+			expr.AddField(NewIdExpr("field1"))
+			expr.AddGroupBy(NewIdExpr("field1"))
+			expr.HavingAnd(NewFilter(NewFuncExpr("COUNT", NewTextExpr("*")), ">", NewValueExpr(5)))
+
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+			Expect(t.RawArguments()).To(Equal([]interface{}{5}))
+		})
+
+		It("Should translate SearchExpr", func() {
+			sql := `(LOWER("title") LIKE ? OR LOWER("body") LIKE ?)`
+			expr := NewSearchExpr("Term", NewIdExpr("title"), NewIdExpr("body"))
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+			Expect(t.RawArguments()).To(Equal([]interface{}{"%term%", "%term%"}))
+		})
+
+		It("Should translate CursorExpr", func() {
+			sql := `("a" < ? OR ("a" = ? AND "b" > ?))`
+			expr := NewCursorExpr([]Expression{NewIdExpr("a"), NewIdExpr("b")}, []interface{}{5, 10}, []bool{false, true})
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+			Expect(t.RawArguments()).To(Equal([]interface{}{5, 5, 10}))
+		})
+
+		It("Should translate casts", func() {
+			filter := NewFilter(Cast(NewIdExpr("created_at"), "date"), OPERATOR_EQ, NewValueExpr("2020-01-01"))
+			Expect(t.Translate(filter)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(`CAST("created_at" AS date) = ?`))
+			Expect(t.RawArguments()).To(Equal([]interface{}{"2020-01-01"}))
+		})
+
+		It("Should reject invalid cast types", func() {
+			Expect(Cast(NewIdExpr("amount"), "numeric(10, 2)").Validate()).ToNot(HaveOccurred())
+			Expect(Cast(NewIdExpr("tags"), "text[]").Validate()).ToNot(HaveOccurred())
+
+			err := t.Translate(Cast(NewIdExpr("id"), "int); DROP TABLE users; --"))
+			Expect(err).To(HaveOccurred())
+			Expect(t.String()).To(BeEmpty())
+		})
+
+		It("Should not support date truncation", func() {
+			err := t.Translate(DateTrunc("created_at", DATE_TRUNC_DAY))
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("unsupported_date_trunc"))
+		})
+
+		It("Should validate date truncation units", func() {
+			Expect(DateTrunc("created_at", DATE_TRUNC_WEEK).Validate()).ToNot(HaveOccurred())
+			err := DateTrunc("created_at", "decade").Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_date_trunc_unit"))
+		})
+
+		It("Should translate empty IN filters to a condition that never matches", func() {
+			Expect(t.Translate(NewFieldValFilter("", "field", OPERATOR_IN, []int{}))).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(`1=0`))
+			Expect(t.RawArguments()).To(BeEmpty())
+		})
+
+		It("Should translate negated empty IN filters", func() {
+			Expect(t.Translate(NewNotExpr(NewFieldValFilter("", "field", OPERATOR_IN, []string{})))).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(`NOT 1=0`))
+		})
+
+		It("Should translate null filters", func() {
+			Expect(t.Translate(NewFieldValFilter("", "field", OPERATOR_IS_NULL, nil))).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(`"field" is null`))
+			Expect(t.RawArguments()).To(BeEmpty())
+		})
+
+		It("Should translate CaseExpr", func() {
+			sql := `CASE WHEN "id" = ? THEN ? WHEN "id" = ? THEN ? ELSE ? END`
+			expr := NewCaseExpr(NewValueExpr(2))
+			expr.When(NewFieldValFilter("", "id", "=", 5), NewValueExpr(0))
+			expr.When(NewFieldValFilter("", "id", "=", 3), NewValueExpr(1))
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+			Expect(t.RawArguments()).To(Equal([]interface{}{5, 0, 3, 1, 2}))
+		})
+
+		It("Should translate UpdateStmt with sort and limit", func() {
+			sql := `UPDATE "col" SET "f1" = ? ORDER BY "f2" ASC LIMIT 10`
+			sel := NewSelectStmt("col")
+			sel.AddSort(NewSortExpr(NewIdExpr("f2"), true))
+			sel.SetLimit(10)
+			stmt := NewUpdateStmt("col", []*FieldValueExpr{NewFieldVal("f1", "x")}, sel)
+			Expect(t.Translate(stmt)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
+		It("Should translate DeleteStmt with filter, sort and limit", func() {
+			sql := `DELETE FROM "col" WHERE "f1" = ? ORDER BY "f2" DESC LIMIT 5`
+			sel := NewSelectStmt("col")
+			sel.SetFilter(NewFieldValFilter("", "f1", "=", 1))
+			sel.AddSort(NewSortExpr(NewIdExpr("f2"), false))
+			sel.SetLimit(5)
+			Expect(t.Translate(NewDeleteStmt("col", sel))).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
+		It("Should translate DeleteStmt with nulls placement", func() {
+			sql := `DELETE FROM "col" ORDER BY "f2" ASC NULLS FIRST LIMIT 5`
+			sel := NewSelectStmt("col")
+			sort := NewSortExpr(NewIdExpr("f2"), true)
+			sort.SetNulls(NULLS_FIRST)
+			sel.AddSort(sort)
+			sel.SetLimit(5)
+			Expect(t.Translate(NewDeleteStmt("col", sel))).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
+		It("Should translate IN filter with subquery", func() {
+			sql := `"id" in (SELECT "id" FROM "col" LIMIT 5)`
+			sub := NewSelectStmt("col")
+			sub.AddField(NewIdExpr("id"))
+			sub.SetLimit(5)
+			Expect(t.Translate(NewFilter(NewIdExpr("id"), OPERATOR_IN, sub))).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
+		It("Should translate WindowExpr", func() {
+			sql := `RANK() OVER (PARTITION BY "group" ORDER BY "score" DESC)`
+			expr := NewWindowExpr(WINDOW_RANK, []Expression{NewIdExpr("group")}, NewSortExpr(NewIdExpr("score"), false))
+			Expect(t.Translate(expr)).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal(sql))
+		})
+
+		It("Should not translate array operators", func() {
+			err := t.Translate(NewFilter(NewIdExpr("tags"), OPERATOR_CONTAINS, NewValueExpr("go")))
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("unsupported_operator"))
+		})
+
 	})
 })
 
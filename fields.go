@@ -27,6 +27,7 @@ import (
 // insid the db:"" tag.
 type fieldTag struct {
 	ignore      bool
+	transient   bool
 	name        string
 	typ         string
 	marshalName string
@@ -35,29 +36,41 @@ type fieldTag struct {
 	ignoreIfZero  bool
 	autoIncrement bool
 	unique        bool
+	uniqueCi      bool
 	uniqueWith    []string
+	uniqueWhere   []string
 	required      bool
 	index         bool
 	indexName     string
 	defaultVal    string
 	min           float64
 	max           float64
+	softDelete    bool
+	generateUUID  bool
 
 	marshal bool
 	embed   bool
+	array   bool
 
 	m2m          bool
 	m2mName      string
+	m2mColumns   []string
 	hasOne       bool
 	hasMany      bool
 	belongsTo    bool
 	localField   string
 	foreignField string
+	mapKey       string
+
+	polymorphic     bool
+	polymorphicType string
+	polymorphicId   string
 
 	autoPersist bool
 	autoCreate  bool
 	autoUpdate  bool
 	autoDelete  bool
+	alwaysLoad  bool
 }
 
 /**
@@ -105,6 +118,9 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 			tag.ignore = true
 			return nil
 
+		case "transient":
+			tag.transient = true
+
 		case "name":
 			if value == "" {
 				return apperror.New("invalid_name", "name specifier must be in format name:the_name")
@@ -124,6 +140,10 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 		case "primary-key":
 			tag.primaryKey = true
 
+		case "pk-uuid":
+			tag.primaryKey = true
+			tag.generateUUID = true
+
 		case "ignore-zero":
 			tag.ignoreIfZero = true
 
@@ -133,6 +153,9 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 		case "unique":
 			tag.unique = true
 
+		case "unique-ci":
+			tag.uniqueCi = true
+
 		case "unique-with":
 			parts := strings.Split(value, ",")
 			if parts[0] == "" {
@@ -140,6 +163,13 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 			}
 			tag.uniqueWith = parts
 
+		case "unique-where":
+			field, operator := parseUniqueWhere(value)
+			if field == "" {
+				return apperror.New("invalid_unique_where", "unique-where must be in format unique-where:field IS [NOT] NULL")
+			}
+			tag.uniqueWhere = []string{field, operator}
+
 		case "required":
 			tag.required = true
 
@@ -169,12 +199,18 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 			}
 			tag.max = x
 
+		case "soft-delete":
+			tag.softDelete = true
+
 		case "marshal":
 			tag.marshal = true
 
 		case "embed":
 			tag.embed = true
 
+		case "array":
+			tag.array = true
+
 		case "m2m":
 			tag.m2m = true
 			parts := strings.Split(value, ":")
@@ -188,6 +224,13 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 				return apperror.New("invalid_m2m_tag", "Invalid m2m tag, must be either 'm2m' or 'm2m:m2mCollectionName' or 'm2m:colName:localField:foreignField'")
 			}
 
+		case "m2m-columns":
+			parts := strings.Split(value, ",")
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return apperror.New("invalid_m2m_columns", "m2m-columns must be in format 'm2m-columns:localColumn,foreignColumn'")
+			}
+			tag.m2mColumns = parts
+
 		case "has-one":
 			tag.hasOne = true
 			if len(itemParts) < 3 {
@@ -215,6 +258,21 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 			tag.localField = itemParts[1]
 			tag.foreignField = itemParts[2]
 
+		case "polymorphic":
+			if len(itemParts) != 3 || itemParts[1] == "" || itemParts[2] == "" {
+				return apperror.New("invalid_polymorphic",
+					"Polymorphic relations need to be in format 'polymorphic:TypeField:IdField'")
+			}
+			tag.polymorphic = true
+			tag.polymorphicType = itemParts[1]
+			tag.polymorphicId = itemParts[2]
+
+		case "map-key":
+			if value == "" {
+				return apperror.New("invalid_map_key", "map-key specifier must be in format map-key:FieldName")
+			}
+			tag.mapKey = value
+
 		case "auto-persist":
 			tag.autoPersist = true
 
@@ -227,6 +285,9 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 		case "auto-delete":
 			tag.autoDelete = true
 
+		case "always-load":
+			tag.alwaysLoad = true
+
 		default:
 			return apperror.New("invalid_tag", "Invalid field tag: %v", specifier)
 		}
@@ -235,6 +296,24 @@ func (f *Field) parseTag(tagContent string) apperror.Error {
 	return nil
 }
 
+// parseUniqueWhere parses a unique-where predicate in the format
+// "field IS NULL" or "field IS NOT NULL", and returns the field and the
+// operator. An empty field is returned for invalid predicates.
+func parseUniqueWhere(predicate string) (string, string) {
+	parts := strings.Fields(predicate)
+	if len(parts) < 3 || strings.ToUpper(parts[1]) != "IS" {
+		return "", ""
+	}
+
+	switch strings.ToUpper(strings.Join(parts[2:], " ")) {
+	case "NULL":
+		return parts[0], OPERATOR_IS_NULL
+	case "NOT NULL":
+		return parts[0], OPERATOR_IS_NOT_NULL
+	}
+	return "", ""
+}
+
 /**
  * Name.
  */
@@ -342,16 +421,21 @@ type Attribute struct {
 	backendType    string
 	backendMarshal bool
 	backendEmbed   bool
+	backendArray   bool
 	isPrimaryKey   bool
 	autoIncrement  bool
 	isUnique       bool
+	isUniqueCi     bool
 	isUniqueWith   []string
+	uniqueWhere    []string
 	ignoreIfZero   bool
 	isIndex        bool
 	indexName      string
 	min            float64
 	max            float64
 	defaultValue   interface{}
+	isSoftDelete   bool
+	generateUUID   bool
 }
 
 // buildAttribute builds up an attribute based on a field.
@@ -383,7 +467,9 @@ func (a *Attribute) readTag() {
 	a.ignoreIfZero = tag.ignoreIfZero
 	a.autoIncrement = tag.autoIncrement
 	a.isUnique = tag.unique
+	a.isUniqueCi = tag.uniqueCi
 	a.isUniqueWith = tag.uniqueWith
+	a.uniqueWhere = tag.uniqueWhere
 	a.isRequired = tag.required
 	a.isIndex = tag.index
 	a.indexName = tag.indexName
@@ -392,9 +478,13 @@ func (a *Attribute) readTag() {
 	}
 	a.min = tag.min
 	a.max = tag.max
+	a.isSoftDelete = tag.softDelete
+	a.generateUUID = tag.generateUUID
 
+	a.backendType = tag.typ
 	a.backendMarshal = tag.marshal
 	a.backendEmbed = tag.embed
+	a.backendArray = tag.array
 
 	if a.backendMarshal || a.backendEmbed {
 		a.ignoreIfZero = true
@@ -437,6 +527,20 @@ func (a *Attribute) SetBackendEmbed(val bool) {
 	a.backendEmbed = val
 }
 
+/**
+ * BackendArray.
+ */
+
+// BackendArray returns true if the slice attribute is stored in a native
+// array column, instead of being treated as a relation or marshalled.
+func (a *Attribute) BackendArray() bool {
+	return a.backendArray
+}
+
+func (a *Attribute) SetBackendArray(val bool) {
+	a.backendArray = val
+}
+
 /**
  * IsPrimaryKey.
  */
@@ -473,6 +577,20 @@ func (a *Attribute) SetIsUnique(val bool) {
 	a.isUnique = val
 }
 
+/**
+ * IsUniqueCi.
+ */
+
+// IsUniqueCi returns true if the attribute must be unique ignoring case,
+// as specified with the unique-ci tag.
+func (a *Attribute) IsUniqueCi() bool {
+	return a.isUniqueCi
+}
+
+func (a *Attribute) SetIsUniqueCi(val bool) {
+	a.isUniqueCi = val
+}
+
 /**
  * IsUniqueWith.
  */
@@ -485,6 +603,67 @@ func (a *Attribute) SetIsUniqueWith(val []string) {
 	a.isUniqueWith = val
 }
 
+/**
+ * UniqueWhere.
+ */
+
+// UniqueWhere returns the field and the null operator of the predicate
+// specified with unique-where, or empty strings if uniqueness is not
+// restricted.
+func (a *Attribute) UniqueWhere() (string, string) {
+	if len(a.uniqueWhere) != 2 {
+		return "", ""
+	}
+	return a.uniqueWhere[0], a.uniqueWhere[1]
+}
+
+func (a *Attribute) SetUniqueWhere(field, operator string) {
+	if field == "" {
+		a.uniqueWhere = nil
+		return
+	}
+	a.uniqueWhere = []string{field, operator}
+}
+
+// UniqueWhereFilter returns the unique-where predicate as a filter, or nil
+// if uniqueness is not restricted.
+func (a *Attribute) UniqueWhereFilter() Expression {
+	field, operator := a.UniqueWhere()
+	if field == "" {
+		return nil
+	}
+	return NewFieldValFilter("", field, operator, nil)
+}
+
+/**
+ * IsSoftDelete.
+ */
+
+// IsSoftDelete returns true if the attribute holds the deletion time of
+// soft deleted models, as specified with the soft-delete tag.
+func (a *Attribute) IsSoftDelete() bool {
+	return a.isSoftDelete
+}
+
+func (a *Attribute) SetIsSoftDelete(val bool) {
+	a.isSoftDelete = val
+}
+
+/**
+ * GenerateUUID.
+ */
+
+// GenerateUUID returns true if an empty value of the attribute is generated
+// with the IDGenerator of the backend on create, as specified with the
+// pk-uuid tag.
+func (a *Attribute) GenerateUUID() bool {
+	return a.generateUUID
+}
+
+func (a *Attribute) SetGenerateUUID(val bool) {
+	a.generateUUID = val
+}
+
 /**
  * IgnoreIfZero.
  */
@@ -566,7 +745,9 @@ func (a *Attribute) BuildFieldExpression() *FieldExpr {
 	if a.autoIncrement {
 		constraints = append(constraints, NewConstraintExpr(CONSTRAINT_AUTO_INCREMENT))
 	}
-	if a.isUnique && len(a.isUniqueWith) == 0 {
+	// Unique attributes with a unique-where predicate are enforced with a
+	// partial index instead.
+	if a.isUnique && len(a.isUniqueWith) == 0 && a.uniqueWhere == nil {
 		constraints = append(constraints, NewConstraintExpr(CONSTRAINT_UNIQUE))
 	}
 	if a.isRequired {
@@ -588,13 +769,18 @@ const (
 	RELATION_TYPE_HAS_MANY   = "has_many"
 	RELATION_TYPE_BELONGS_TO = "belongs_to"
 	RELATION_TYPE_M2M        = "m2m"
+
+	// Polymorphic relations reference models of different collections with
+	// a type field holding the collection and an id field.
+	RELATION_TYPE_POLYMORPHIC = "polymorphic"
 )
 
 var RELATION_TYPE_MAP map[string]bool = map[string]bool{
-	"has_one":    true,
-	"has_many":   true,
-	"belongs_to": true,
-	"m2m":        true,
+	"has_one":     true,
+	"has_many":    true,
+	"belongs_to":  true,
+	"m2m":         true,
+	"polymorphic": true,
 }
 
 type Relation struct {
@@ -607,9 +793,36 @@ type Relation struct {
 	autoCreate     bool
 	autoUpdate     bool
 	autoDelete     bool
+	alwaysLoad     bool
 	localField     string
 	foreignField   string
 	inversingField string
+
+	// mapKey is the field of the related model that holds the keys for
+	// relations stored in a map field.
+	mapKey string
+
+	// pivotLocalField and pivotForeignField hold the column names in the m2m
+	// collection that reference the local and the foreign field.
+	pivotLocalField   string
+	pivotForeignField string
+
+	// For m2m relations between models with composite primary keys, the
+	// local and foreign fields hold all primary key fields, and the pivot
+	// fields all columns that reference them, in the same order.
+	localFields        []string
+	foreignFields      []string
+	pivotLocalFields   []string
+	pivotForeignFields []string
+
+	// pivotInfo holds the generated model info of the m2m collection.
+	pivotInfo *ModelInfo
+
+	// polymorphicTypeField and polymorphicIdField hold the fields of
+	// polymorphic relations that store the collection and the id of the
+	// owning model.
+	polymorphicTypeField string
+	polymorphicIdField   string
 }
 
 // buildRelation builds up a relation based on a field.
@@ -634,20 +847,30 @@ func (r *Relation) readTag() {
 		if tag.m2mName != "" {
 			r.backendName = tag.m2mName
 		}
+		if len(tag.m2mColumns) == 2 {
+			r.pivotLocalField = tag.m2mColumns[0]
+			r.pivotForeignField = tag.m2mColumns[1]
+		}
 	} else if tag.hasMany {
 		r.relationType = RELATION_TYPE_HAS_MANY
 	} else if tag.hasOne {
 		r.relationType = RELATION_TYPE_HAS_ONE
 	} else if tag.belongsTo {
 		r.relationType = RELATION_TYPE_BELONGS_TO
+	} else if tag.polymorphic {
+		r.relationType = RELATION_TYPE_POLYMORPHIC
+		r.polymorphicTypeField = tag.polymorphicType
+		r.polymorphicIdField = tag.polymorphicId
 	}
 
 	r.localField = tag.localField
 	r.foreignField = tag.foreignField
+	r.mapKey = tag.mapKey
 
 	r.autoCreate = tag.autoCreate
 	r.autoUpdate = tag.autoUpdate
 	r.autoDelete = tag.autoDelete
+	r.alwaysLoad = tag.alwaysLoad
 	if tag.autoPersist {
 		r.autoCreate = true
 		r.autoUpdate = true
@@ -693,11 +916,14 @@ func (r *Relation) SetRelationType(val string) {
 
 func (f *Relation) IsMany() bool {
 	if f.relationType != "" {
+		if f.relationType == RELATION_TYPE_POLYMORPHIC {
+			return f.Type().Kind() == reflect.Slice || f.Type().Kind() == reflect.Map
+		}
 		return f.relationType == RELATION_TYPE_HAS_MANY || f.relationType == RELATION_TYPE_M2M
 	} else {
 		// Type not determined yet.
-		// Assume that a many relationship requires a slice.
-		return f.Type().Kind() == reflect.Slice
+		// Assume that a many relationship requires a slice or a map.
+		return f.Type().Kind() == reflect.Slice || f.Type().Kind() == reflect.Map
 	}
 }
 
@@ -749,6 +975,54 @@ func (r *Relation) SetAutoDelete(val bool) {
 	r.autoDelete = val
 }
 
+/**
+ * AlwaysLoad.
+ */
+
+// AlwaysLoad returns true if the relation is preloaded by all queries on
+// the model, unless excluded with query.WithoutRelation().
+// It can be set with the always-load tag.
+func (r *Relation) AlwaysLoad() bool {
+	return r.alwaysLoad
+}
+
+func (r *Relation) SetAlwaysLoad(val bool) {
+	r.alwaysLoad = val
+}
+
+/**
+ * Polymorphic relations.
+ */
+
+// PolymorphicTypeField returns the field that holds the collection of the
+// owning model for polymorphic relations.
+// For the owning side, stored in an interface{} field, it is a field of the
+// model, otherwise a field of the related model.
+func (r *Relation) PolymorphicTypeField() string {
+	return r.polymorphicTypeField
+}
+
+func (r *Relation) SetPolymorphicTypeField(val string) {
+	r.polymorphicTypeField = val
+}
+
+// PolymorphicIdField returns the field that holds the id of the owning
+// model for polymorphic relations.
+func (r *Relation) PolymorphicIdField() string {
+	return r.polymorphicIdField
+}
+
+func (r *Relation) SetPolymorphicIdField(val string) {
+	r.polymorphicIdField = val
+}
+
+// IsPolymorphicOwner returns true for polymorphic relations to the owning
+// model, which can belong to different collections.
+// These relations do not have a related model.
+func (r *Relation) IsPolymorphicOwner() bool {
+	return r.relationType == RELATION_TYPE_POLYMORPHIC && r.Type().Kind() == reflect.Interface
+}
+
 /**
  * LocalField.
  */
@@ -772,3 +1046,131 @@ func (r *Relation) ForeignField() string {
 func (r *Relation) SetForeignField(val string) {
 	r.foreignField = val
 }
+
+/**
+ * MapKey.
+ */
+
+// MapKey returns the field of the related model whose values are used as
+// keys for relations stored in a map field, as specified with the map-key tag.
+func (r *Relation) MapKey() string {
+	return r.mapKey
+}
+
+func (r *Relation) SetMapKey(val string) {
+	r.mapKey = val
+}
+
+/**
+ * PivotLocalField.
+ */
+
+// PivotLocalField returns the column name in the m2m collection that
+// holds the value of the local field.
+func (r *Relation) PivotLocalField() string {
+	return r.pivotLocalField
+}
+
+func (r *Relation) SetPivotLocalField(val string) {
+	r.pivotLocalField = val
+}
+
+/**
+ * PivotForeignField.
+ */
+
+// PivotForeignField returns the column name in the m2m collection that
+// holds the value of the foreign field.
+func (r *Relation) PivotForeignField() string {
+	return r.pivotForeignField
+}
+
+func (r *Relation) SetPivotForeignField(val string) {
+	r.pivotForeignField = val
+}
+
+/**
+ * Composite m2m fields.
+ */
+
+// LocalFields returns all local fields of the relation.
+// Only m2m relations of models with a composite primary key, and the
+// back-relations of their pivot collections, have more than one.
+func (r *Relation) LocalFields() []string {
+	if len(r.localFields) == 0 {
+		return []string{r.localField}
+	}
+	return r.localFields
+}
+
+func (r *Relation) SetLocalFields(val []string) {
+	r.localFields = val
+}
+
+// ForeignFields returns all foreign fields of the relation.
+// Only m2m relations to models with a composite primary key, and the
+// back-relations of their pivot collections, have more than one.
+func (r *Relation) ForeignFields() []string {
+	if len(r.foreignFields) == 0 {
+		return []string{r.foreignField}
+	}
+	return r.foreignFields
+}
+
+func (r *Relation) SetForeignFields(val []string) {
+	r.foreignFields = val
+}
+
+// PivotLocalFields returns the columns in the m2m collection that hold the
+// values of LocalFields().
+func (r *Relation) PivotLocalFields() []string {
+	if len(r.pivotLocalFields) == 0 {
+		return []string{r.pivotLocalField}
+	}
+	return r.pivotLocalFields
+}
+
+func (r *Relation) SetPivotLocalFields(val []string) {
+	r.pivotLocalFields = val
+}
+
+// PivotForeignFields returns the columns in the m2m collection that hold
+// the values of ForeignFields().
+func (r *Relation) PivotForeignFields() []string {
+	if len(r.pivotForeignFields) == 0 {
+		return []string{r.pivotForeignField}
+	}
+	return r.pivotForeignFields
+}
+
+func (r *Relation) SetPivotForeignFields(val []string) {
+	r.pivotForeignFields = val
+}
+
+// IsCompositeM2M returns true for m2m relations where one of the models is
+// referenced by multiple pivot columns.
+func (r *Relation) IsCompositeM2M() bool {
+	return r.relationType == RELATION_TYPE_M2M && (len(r.LocalFields()) > 1 || len(r.ForeignFields()) > 1)
+}
+
+// IsSelfReferential returns true for relations of a model to its own
+// collection, like the parent of a tree node.
+func (r *Relation) IsSelfReferential() bool {
+	return r.model != nil && r.model == r.relatedModel
+}
+
+/**
+ * PivotInfo.
+ */
+
+// PivotInfo returns the model info of the m2m collection that is generated
+// when analyzing the relations, or nil for other relation types.
+// The pivot info is also registered with the other model infos under the
+// relation's backend name, so it can be queried with Q(relation.BackendName()).
+func (r *Relation) PivotInfo() *ModelInfo {
+	return r.pivotInfo
+}
+
+func (r *Relation) SetPivotInfo(info *ModelInfo) {
+	r.pivotInfo = info
+}
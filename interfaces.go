@@ -1,6 +1,9 @@
 package dukedb
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -15,6 +18,21 @@ const (
 	HOOK_AFTER_UPDATE  = "after_update"
 	HOOK_BEFORE_DELETE = "before_delete"
 	HOOK_AFTER_DELETE  = "after_delete"
+
+	// Bulk hooks are called once per bulk operation with a *BulkOperation.
+	// Create() with more than one model calls the bulk create hooks in
+	// addition to the per-model create hooks.
+	// CreateMany(), UpdateByMap() and DeleteMany() only call the bulk hooks.
+	HOOK_BEFORE_BULK_CREATE = "before_bulk_create"
+	HOOK_AFTER_BULK_CREATE  = "after_bulk_create"
+	HOOK_BEFORE_BULK_UPDATE = "before_bulk_update"
+	HOOK_AFTER_BULK_UPDATE  = "after_bulk_update"
+	HOOK_BEFORE_BULK_DELETE = "before_bulk_delete"
+	HOOK_AFTER_BULK_DELETE  = "after_bulk_delete"
+
+	// HOOK_BEFORE_QUERY is called with the *Query before a query is executed.
+	// This includes the separate queries that load joined relations.
+	HOOK_BEFORE_QUERY = "before_query"
 )
 
 type Cursor interface {
@@ -31,13 +49,25 @@ type Cursor interface {
 	Next(targetModel ...interface{}) (interface{}, apperror.Error)
 }
 
-type JoinAssigner func(relation *Relation, joinQ *RelationQuery, resultQuery *Query, objs, joinedModels []interface{})
+type JoinAssigner func(relation *Relation, joinQ *RelationQuery, resultQuery *Query, objs, joinedModels []interface{}) apperror.Error
 
 type Backend interface {
 	// Returns the name of the backend.
 	Name() string
 	SetName(name string)
 
+	// RegisterTypeMapping registers the database column type used for
+	// attributes of the given Go type when creating collections and fields.
+	RegisterTypeMapping(goType reflect.Type, dbType string)
+
+	// TypeMapping returns the registered column type for a Go type.
+	TypeMapping(goType reflect.Type) (string, bool)
+
+	// Dialect returns a stable identifier for the type of database, like
+	// "postgres", "mysql", "sqlite", "memory" or "orientdb".
+	// Unlike Name(), it can not be changed.
+	Dialect() string
+
 	// Returns true if the backend uses string Ids like MongoDB.
 	HasStringIds() bool
 
@@ -61,17 +91,70 @@ type Backend interface {
 	// Duplicate the backend.
 	Clone() Backend
 
+	// IDGenerator returns the generator for pk-uuid primary keys.
+	// It defaults to a UUIDGenerator.
+	IDGenerator() IDGenerator
+	SetIDGenerator(generator IDGenerator)
+
+	/**
+	 * Context.
+	 */
+
+	// Context returns the context used for executing statements.
+	// It defaults to context.Background().
+	Context() context.Context
+	SetContext(ctx context.Context)
+
+	// WithContext returns a copy of the backend that uses the given context.
+	WithContext(ctx context.Context) Backend
+
+	// CreateCtx is like Create, but uses the given context.
+	CreateCtx(ctx context.Context, models ...interface{}) apperror.Error
+
+	// QueryCtx is like Query, but uses the given context.
+	QueryCtx(ctx context.Context, q *Query, targetSlice ...interface{}) ([]interface{}, apperror.Error)
+
+	// ExecCtx is like Exec, but uses the given context.
+	ExecCtx(ctx context.Context, statement Expression) apperror.Error
+
 	/**
 	 * Hooks.
 	 */
 
 	// RegisterHook registers a hook function that will be called for a model.
-	// The available hooks are: (before/after)_(create/update/delete).
+	// The available hooks are: (before/after)_(create/update/delete) and
+	// (before/after)_bulk_(create/update/delete).
 	RegisterHook(hook string, handler HookHandler)
 
 	// GetHooks returns a slice with all hooks of the hook type.
 	GetHooks(hook string) []HookHandler
 
+	// SetStatementInterceptor sets a function that is called by Exec() and
+	// ExecQuery() with every statement before it is translated.
+	// The interceptor may inspect the statement, or return a modified
+	// statement that is executed instead. Returning an error aborts the
+	// execution.
+	SetStatementInterceptor(interceptor StatementInterceptor)
+
+	// StatementInterceptor returns the statement interceptor, or nil.
+	StatementInterceptor() StatementInterceptor
+
+	// AutoPersistRelations returns true if loaded relations are created,
+	// updated and deleted together with a model, which is the default.
+	AutoPersistRelations() bool
+
+	// SetAutoPersistRelations enables or disables persisting relations.
+	// When disabled, Create(), Update() and Delete() skip the relation
+	// persistence passes, so related models are not automatically created,
+	// updated or deleted, and m2m and has-many relations are not
+	// updated. This avoids the reflection overhead for high-throughput
+	// writes of models without loaded relations.
+	SetAutoPersistRelations(persist bool)
+
+	// WithoutRelationPersistence returns a copy of the backend that does not
+	// persist relations, to opt a single operation out.
+	WithoutRelationPersistence() Backend
+
 	/**
 	 * ModelInfo and registration.
 	 */
@@ -86,6 +169,11 @@ type Backend interface {
 	// Retrieve the ModelInfo for a model instance.
 	InfoForModel(model interface{}) (*ModelInfo, apperror.Error)
 
+	// Get the sorted names of all registered collections.
+	// Automatically generated m2m pivot collections are only included if
+	// includePivots is true. Use ModelInfo(name).IsPivot() to tell them apart.
+	Collections(includePivots bool) []string
+
 	// Determine if a collection is registered with the backend.
 	HasCollection(collection string) bool
 
@@ -93,14 +181,29 @@ type Backend interface {
 	//
 	// The first argument must be a pointer to an instance of the model,
 	// for example: &MyModel{}
-	RegisterModel(model interface{}) *ModelInfo
+	//
+	// Registering a model for an existing collection replaces it.
+	// Returns an error if the model is invalid, or if it can not replace
+	// the existing model.
+	RegisterModel(model interface{}) (*ModelInfo, apperror.Error)
+
+	// RegisterModels registers multiple model types with the backend.
+	// Stops at the first model that can not be registered.
+	RegisterModels(models ...interface{}) apperror.Error
+
+	// DeregisterModel removes a collection from the backend.
+	// Fails if another collection still has a relation to it.
+	DeregisterModel(collection string) apperror.Error
+
+	// RegisterAndBuild registers the models and then calls Build().
+	RegisterAndBuild(models ...interface{}) apperror.Error
 
 	// Build analyzes the relationships between models and does all neccessary
 	// preparations for using the backend.
 	//
 	// Build MUST be called AFTER all models have been registered with
 	// backend.RegisterModel() and BEFORE the backend is used.
-	Build()
+	Build() apperror.Error
 
 	// NewModel creates a new model instance of the specified collection.
 	NewModel(collection string) (interface{}, apperror.Error)
@@ -119,6 +222,10 @@ type Backend interface {
 	// The result will be nil for all statements except a SelectStatement.
 	Exec(statement Expression) apperror.Error
 
+	// ExecCount executes an expression like Exec, and returns the number of
+	// affected rows for update and delete statements.
+	ExecCount(statement Expression) (int64, apperror.Error)
+
 	ExecQuery(statement FieldedExpression) (result []interface{}, err apperror.Error)
 
 	// Create the specified collection in the backend.
@@ -130,6 +237,14 @@ type Backend interface {
 	DropCollection(collection string, ifExists, cascade bool) apperror.Error
 	DropAllCollections() apperror.Error
 
+	// DropAllCollectionsWithProgress drops all collections in a deterministic
+	// order, with pivot collections last.
+	// progress is called after each drop attempt and may be nil.
+	// If continueOnError is false, the first failure aborts the operation.
+	// The returned result lists dropped and failed collections, even
+	// if an error is returned.
+	DropAllCollectionsWithProgress(progress DropProgressFunc, continueOnError bool) (*DropResult, apperror.Error)
+
 	// CreateField creates the specified field on a collection.
 	// Note that the field must already be on the model struct, or an error
 	// will be returned.
@@ -169,6 +284,12 @@ type Backend interface {
 	// returns an iterable cursor.
 	Query(q *Query, targetSlice ...interface{}) ([]interface{}, apperror.Error)
 
+	// QueryRaw executes a native query of the backend, and converts the
+	// resulting rows to models of the collection.
+	// Backends that do not implement RawQueryBackend return an unsupported
+	// error.
+	QueryRaw(collection string, raw string, args ...interface{}) ([]interface{}, apperror.Error)
+
 	// Executes a query, and returns a cursor.
 	QueryCursor(q *Query) (Cursor, apperror.Error)
 
@@ -182,6 +303,8 @@ type Backend interface {
 	FindBy(collection, field string, value interface{}, targetSlice ...interface{}) ([]interface{}, apperror.Error)
 
 	// Find a model in a collection by Id.
+	// For composite primary keys, id must be a slice with a value for each
+	// primary key field in field order, or a map keyed by the field names.
 	FindOne(collection string, id interface{}, targetModel ...interface{}) (interface{}, apperror.Error)
 
 	// Find a model  in a collection based on a field value.
@@ -194,6 +317,14 @@ type Backend interface {
 	// map.
 	Pluck(q *Query) ([]map[string]interface{}, apperror.Error)
 
+	// EachRow executes the query and calls fn with the data map of each row,
+	// until all rows were processed or fn returns an error.
+	EachRow(q *Query, fn func(row map[string]interface{}) apperror.Error) apperror.Error
+
+	// Each executes the query and calls fn with each model, until all models
+	// were processed or fn returns an error.
+	Each(q *Query, fn func(model interface{}) apperror.Error) apperror.Error
+
 	// Based on a RelationQuery, return a query for the specified
 	// relation.
 	BuildRelationQuery(q *RelationQuery) (*Query, apperror.Error)
@@ -201,6 +332,30 @@ type Backend interface {
 	// Retrieve a query for a relationship.
 	Related(model interface{}, name string) (*RelationQuery, apperror.Error)
 
+	// RelatedCount returns the number of models related to the model by the
+	// relation with the given name, without loading them.
+	// For m2m relations, the entries of the m2m collection are counted.
+	RelatedCount(model interface{}, name string) (int, apperror.Error)
+
+	// Load the relation with the given name from the backend and assign
+	// the result to the relation field of the model.
+	Load(model interface{}, name string) apperror.Error
+
+	// AttachMany attaches existing related models, identified by their
+	// primary keys, to a has-many or m2m relation of the model.
+	// For has-many, the foreign keys are set with a single update.
+	// For m2m, a pivot row is created for each id. The ids must be values
+	// of the relations foreign field, which is the primary key by default.
+	AttachMany(model interface{}, name string, ids ...interface{}) apperror.Error
+
+	// Detach removes related models, identified by their primary keys, from
+	// a has-many or m2m relation of the model without deleting them.
+	// If no ids are given, all related models are detached.
+	// For has-many, the foreign keys are set to NULL if the foreign key
+	// field is a pointer, or to the zero value otherwise.
+	// For m2m, the pivot rows are deleted.
+	Detach(model interface{}, name string, ids ...interface{}) apperror.Error
+
 	// Return a M2MCollection instance for a model, which allows
 	// to add/remove/clear items in the m2m relationship.
 	M2M(model interface{}, name string) (M2MCollection, apperror.Error)
@@ -210,8 +365,37 @@ type Backend interface {
 	// Create creates the model in the backend.
 	Create(model ...interface{}) apperror.Error
 
+	// CreateMany creates many models with as few statements as possible.
+	// Relations of the models are not persisted, and only the bulk create
+	// hooks are called.
+	CreateMany(models ...interface{}) apperror.Error
+
+	// BulkLoad creates a row for each entry of rows, which hold the values
+	// in the order of columns. Returns the number of created rows, which
+	// is 0 if an error occurs.
+	// Backends may load the rows without building models, so model hooks
+	// and validations are not guaranteed to run.
+	BulkLoad(collection string, columns []string, rows [][]interface{}) (int, apperror.Error)
+
+	// CreateByMap creates a new entry in the collection from a data map.
+	// For collections with a struct, the created model is returned.
+	// Otherwise, the result is a map[string]interface{} with the data,
+	// including a generated id if the backend returned one.
 	CreateByMap(collection string, data map[string]interface{}) (result interface{}, err apperror.Error)
 
+	// CreateUnlessExists creates the model unless the query built by filter
+	// on the collection of the model matches a row.
+	// Returns true if the model was created.
+	CreateUnlessExists(model interface{}, filter func(q *Query)) (created bool, err apperror.Error)
+
+	// Upsert creates the model, or updates the existing row with the same
+	// values for the conflict fields.
+	Upsert(model interface{}, conflictFields ...string) apperror.Error
+
+	// UpsertOnConstraint creates the model, or updates the existing row if
+	// the insert violates the unique constraint or index with the given name.
+	UpsertOnConstraint(model interface{}, constraintName string) apperror.Error
+
 	// Update a model.
 	Update(model interface{}) apperror.Error
 
@@ -220,17 +404,64 @@ type Backend interface {
 	Save(model interface{}) apperror.Error
 
 	// Updat all models matching a query by values in a map.
+	// Sorts and a limit on the query restrict the update to the first n
+	// matching models. The nulls placement of sorts added with SortNulls()
+	// is respected. This is supported by the memory backend and the sql
+	// backend with the mysql, postgres and sqlite dialects. MySQL does not
+	// support an offset.
 	UpdateByMap(query *Query, data map[string]interface{}) apperror.Error
 
+	// UpdateByMapCount updates like UpdateByMap(), and returns the number of
+	// updated models. MySQL only counts models whose values changed.
+	UpdateByMapCount(query *Query, data map[string]interface{}) (int64, apperror.Error)
+
+	// UpdateJSONPath sets the value at a dotted path, like "address.city",
+	// in the marshalled field of all models matching the query, without
+	// rewriting the whole document.
+	UpdateJSONPath(query *Query, field, path string, value interface{}) apperror.Error
+
 	// Delete deletes the model from the backend.
+	// Models with a soft-delete attribute are only marked as deleted, and
+	// their relations are kept.
 	Delete(model interface{}) apperror.Error
 
 	// DeleteQ deletes all models that match the passed query.
+	// Sorts and a limit are honored like for UpdateByMap(), which allows
+	// deleting large amounts of rows in chunks, like the oldest 1000.
 	DeleteMany(*Query) apperror.Error
+
+	// DeleteManyCount deletes like DeleteMany(), and returns the number of
+	// deleted models.
+	DeleteManyCount(*Query) (int64, apperror.Error)
 }
 
 type HookHandler func(backend Backend, obj interface{}) apperror.Error
 
+// StatementInterceptor receives every statement before execution and
+// returns the statement to execute.
+type StatementInterceptor func(stmt Expression) (Expression, apperror.Error)
+
+// IDGenerator generates the values of primary keys with the pk-uuid tag,
+// which are set on models without a primary key before they are created.
+type IDGenerator interface {
+	GenerateID() (string, apperror.Error)
+}
+
+// BulkOperation is passed to bulk hooks.
+type BulkOperation struct {
+	// Collection is the collection affected by the operation.
+	Collection string
+
+	// Models holds the models of a bulk create.
+	Models []interface{}
+
+	// Query holds the query of a bulk update or delete.
+	Query *Query
+
+	// Data holds the values of a bulk update.
+	Data map[string]interface{}
+}
+
 type M2MCollection interface {
 	Add(models ...interface{}) apperror.Error
 	Remove(models ...interface{}) apperror.Error
@@ -242,6 +473,10 @@ type M2MCollection interface {
 	ContainsId(id interface{}) (bool, apperror.Error)
 	All() ([]interface{}, apperror.Error)
 
+	// PivotRows returns the rows of the m2m collection for the model, with
+	// all pivot columns keyed by their backend names.
+	PivotRows() ([]map[string]interface{}, apperror.Error)
+
 	Q() *Query
 }
 
@@ -251,10 +486,76 @@ type Transaction interface {
 	Commit() apperror.Error
 }
 
+// Transaction isolation levels for TxOptions.
+// ISOLATION_DEFAULT uses the default isolation level of the backend.
+const (
+	ISOLATION_DEFAULT         = ""
+	ISOLATION_READ_COMMITTED  = "READ COMMITTED"
+	ISOLATION_REPEATABLE_READ = "REPEATABLE READ"
+	ISOLATION_SERIALIZABLE    = "SERIALIZABLE"
+)
+
+// TxOptions configure a transaction started with BeginTx().
+// Nil options use the defaults of the backend.
+type TxOptions struct {
+	// Isolation is one of the ISOLATION_* constants.
+	Isolation string
+
+	// ReadOnly starts a read only transaction.
+	ReadOnly bool
+}
+
+func (o *TxOptions) Validate() apperror.Error {
+	if o == nil {
+		return nil
+	}
+	switch o.Isolation {
+	case ISOLATION_DEFAULT, ISOLATION_READ_COMMITTED, ISOLATION_REPEATABLE_READ, ISOLATION_SERIALIZABLE:
+		return nil
+	}
+	return apperror.New("invalid_isolation_level", fmt.Sprintf("Unknown transaction isolation level %v", o.Isolation))
+}
+
+// BatchCreateBackend is implemented by backends that can insert multiple
+// rows with a single CreateStmt, returning one result row per inserted row.
+type BatchCreateBackend interface {
+	HasBatchCreate() bool
+}
+
+// RawQueryBackend is implemented by backends that can execute native
+// queries, like plain SQL.
+type RawQueryBackend interface {
+	// ExecRaw executes the native query and returns the resulting rows.
+	ExecRaw(raw string, args []interface{}) ([]map[string]interface{}, apperror.Error)
+}
+
+// RowStreamBackend is implemented by backends that can stream the rows of a
+// query from a cursor instead of loading the complete result.
+type RowStreamBackend interface {
+	// ExecQueryEach executes the query statement and calls fn with each
+	// resulting row, until all rows were read or fn returns an error.
+	// The cursor is closed before returning.
+	ExecQueryEach(statement FieldedExpression, fn func(row interface{}) apperror.Error) apperror.Error
+}
+
+// RowCountBackend is implemented by backends that can count the rows of a
+// query without loading them, for example with a subquery.
+type RowCountBackend interface {
+	// ExecQueryCount executes the query statement and returns the number of
+	// resulting rows.
+	ExecQueryCount(statement FieldedExpression) (int, apperror.Error)
+}
+
 type TransactionBackend interface {
 	Backend
+	// Begin starts a transaction with the default isolation level of the backend.
 	Begin() (Transaction, apperror.Error)
+	// BeginTx starts a transaction with the given isolation level and access mode.
+	// Nil options use the defaults of the backend.
+	BeginTx(opts *TxOptions) (Transaction, apperror.Error)
 	MustBegin() Transaction
+	// IsTransaction returns true if the backend is a running transaction.
+	IsTransaction() bool
 }
 
 type MigrationAttempt interface {
@@ -283,6 +584,24 @@ type MigrationBackend interface {
 	NewMigrationAttempt() MigrationAttempt
 }
 
+// SchemaDiffBackend is implemented by backends that can compare the
+// database schema with the registered models.
+type SchemaDiffBackend interface {
+	Backend
+
+	// MigrationPlan compares the given collections, or all registered
+	// collections if none are given, with the database.
+	// Nothing is changed in the database.
+	MigrationPlan(collections ...string) (*SchemaDiff, apperror.Error)
+
+	// ApplyPlan creates the missing collections, fields and indexes of a
+	// plan, and changes the field types.
+	// The fields that do not belong to a model attribute are only dropped
+	// if plan.AllowDrops is true.
+	// The changes are applied in a fixed order, sorted by collection.
+	ApplyPlan(plan *SchemaDiff) apperror.Error
+}
+
 type ModelCollectionHook interface {
 	Collection() string
 }
@@ -315,6 +634,28 @@ type ModelValidateHook interface {
 	Validate() error
 }
 
+// DropProgressFunc is called by DropAllCollectionsWithProgress() after each
+// collection. index is zero based, err is nil if the drop succeeded.
+type DropProgressFunc func(collection string, index, total int, err apperror.Error)
+
+// DropResult holds the outcome of DropAllCollectionsWithProgress().
+type DropResult struct {
+	Dropped []string
+	Failed  map[string]apperror.Error
+}
+
+// ModelBeforeSaveHook is called by Save() before the BeforeCreate or
+// BeforeUpdate hook.
+type ModelBeforeSaveHook interface {
+	BeforeSave(Backend) error
+}
+
+// ModelAfterSaveHook is called by Save() after the AfterCreate or
+// AfterUpdate hook.
+type ModelAfterSaveHook interface {
+	AfterSave(Backend)
+}
+
 type ModelBeforeCreateHook interface {
 	BeforeCreate(Backend) error
 }
@@ -96,7 +96,8 @@ func (handler *MigrationHandler) RunMigration(m *Migration) apperror.Error {
 	txCapableBackend, hasTransactions := handler.Backend.(TransactionBackend)
 	if hasTransactions && m.WrapTransaction {
 		useTransaction = true
-		tx, err := txCapableBackend.Begin()
+		var err apperror.Error
+		tx, err = txCapableBackend.Begin()
 		if err != nil {
 			return err
 		}
@@ -231,3 +232,52 @@ func (a *BaseMigrationAttemptIntId) SetId(x string) error {
 	a.Id = id
 	return nil
 }
+
+/**
+ * SchemaDiff.
+ */
+
+// SchemaDiff describes the differences between the registered models and the
+// collections in the database, as determined by SchemaDiffBackend.MigrationPlan().
+//
+// All maps are keyed by collection name, and their field and index names
+// are sorted.
+type SchemaDiff struct {
+	// CreateCollections holds the sorted collections that do not exist yet.
+	CreateCollections []string
+
+	// CreateFields holds the backend names of the fields that need to be
+	// created.
+	CreateFields map[string][]string
+
+	// AlterFields holds the backend names of the fields whose type in the
+	// database differs from the type of the model attribute.
+	AlterFields map[string][]string
+
+	// CreateIndexes holds the names of the indexes that need to be created.
+	CreateIndexes map[string][]string
+
+	// DropFields holds the names of the fields that exist in the database
+	// but do not belong to a model attribute.
+	DropFields map[string][]string
+
+	// AllowDrops must be set to true explicitly to drop the DropFields when
+	// the plan is applied. Otherwise, they are kept.
+	AllowDrops bool
+}
+
+func NewSchemaDiff() *SchemaDiff {
+	return &SchemaDiff{
+		CreateCollections: make([]string, 0),
+		CreateFields:      make(map[string][]string),
+		AlterFields:       make(map[string][]string),
+		CreateIndexes:     make(map[string][]string),
+		DropFields:        make(map[string][]string),
+	}
+}
+
+// IsEmpty returns true if the database schema matches the models.
+func (d *SchemaDiff) IsEmpty() bool {
+	return len(d.CreateCollections) == 0 && len(d.CreateFields) == 0 && len(d.AlterFields) == 0 &&
+		len(d.CreateIndexes) == 0 && len(d.DropFields) == 0
+}
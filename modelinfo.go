@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/theduke/go-reflector"
 
@@ -32,13 +34,28 @@ type ModelInfo struct {
 	backendName    string
 	marshalName    string
 
+	// isPivot is true for the collections generated for m2m relations.
+	isPivot bool
+
+	// defaultFields are selected by queries that do not specify fields.
+	defaultFields []string
+
 	// transientFields store fields which are not determined to be either
 	// a relationship or an attribute.
 	// See buildFields() for an explanation.
 	transientFields map[string]*Field
 
+	// transientAttributes are fields tagged with 'transient'.
+	// They are never persisted or loaded by backends, but included when
+	// converting a model to a map for marshalling.
+	transientAttributes map[string]*Attribute
+
 	attributes map[string]*Attribute
 	relations  map[string]*Relation
+
+	// meta holds arbitrary data attached by code built on top of dukedb,
+	// like display labels or permissions.
+	meta map[string]interface{}
 }
 
 /**
@@ -89,6 +106,20 @@ func (m *ModelInfo) SetFullStructName(val string) {
 	m.fullStructName = val
 }
 
+/**
+ * IsPivot.
+ */
+
+// IsPivot returns true if the info describes an automatically generated
+// m2m pivot collection rather than a registered model.
+func (m *ModelInfo) IsPivot() bool {
+	return m.isPivot
+}
+
+func (m *ModelInfo) SetIsPivot(val bool) {
+	m.isPivot = val
+}
+
 /**
  * Collection.
  */
@@ -125,6 +156,24 @@ func (m *ModelInfo) SetMarshalName(val string) {
 	m.marshalName = val
 }
 
+/**
+ * DefaultFields.
+ */
+
+func (m *ModelInfo) DefaultFields() []string {
+	return m.defaultFields
+}
+
+// SetDefaultFields sets the fields that are selected by queries which do
+// not specify any fields. This allows excluding large, rarely needed fields
+// by default. Use Query.WithHidden() to select all fields.
+//
+// Note that models retrieved with the default fields will have zero values
+// for the excluded fields, so updating them will overwrite the stored values.
+func (m *ModelInfo) SetDefaultFields(fields ...string) {
+	m.defaultFields = fields
+}
+
 func (m *ModelInfo) New() interface{} {
 	return m.reflector.New().Addr().Interface()
 }
@@ -149,6 +198,35 @@ func (m *ModelInfo) SetTransientFields(x map[string]*Field) {
 	m.transientFields = x
 }
 
+/**
+ * TransientAttributes.
+ */
+
+func (m *ModelInfo) TransientAttributes() map[string]*Attribute {
+	return m.transientAttributes
+}
+
+func (m *ModelInfo) TransientAttribute(name string) *Attribute {
+	return m.transientAttributes[name]
+}
+
+/**
+ * Meta.
+ */
+
+// SetMeta attaches an arbitrary value to the model info.
+func (m *ModelInfo) SetMeta(key string, val interface{}) {
+	if m.meta == nil {
+		m.meta = make(map[string]interface{})
+	}
+	m.meta[key] = val
+}
+
+// Meta returns the value set with SetMeta, or nil if the key is not set.
+func (m *ModelInfo) Meta(key string) interface{} {
+	return m.meta[key]
+}
+
 /**
  * Attributes.
  */
@@ -174,9 +252,68 @@ func (m *ModelInfo) Attribute(name string) *Attribute {
 	return m.attributes[name]
 }
 
+// PkAttribute returns the primary key attribute.
+// For composite primary keys, the first attribute is returned.
 func (m *ModelInfo) PkAttribute() *Attribute {
-	for _, attr := range m.attributes {
+	attrs := m.PkAttributes()
+	if len(attrs) < 1 {
+		return nil
+	}
+	return attrs[0]
+}
+
+// PkAttributes returns all primary key attributes, in the order of the
+// struct fields.
+func (m *ModelInfo) PkAttributes() []*Attribute {
+	attrs := make([]*Attribute, 0, 1)
+
+	if m.itemType != nil && m.itemType.Kind() == reflect.Struct {
+		for _, name := range structFieldNames(m.itemType) {
+			if attr := m.attributes[name]; attr != nil && attr.IsPrimaryKey() {
+				attrs = append(attrs, attr)
+			}
+		}
+		return attrs
+	}
+
+	names := make([]string, 0)
+	for name, attr := range m.attributes {
 		if attr.IsPrimaryKey() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, m.attributes[name])
+	}
+	return attrs
+}
+
+// HasCompositePk returns true if the primary key consists of multiple attributes.
+func (m *ModelInfo) HasCompositePk() bool {
+	return len(m.PkAttributes()) > 1
+}
+
+// structFieldNames returns the names of all fields of a struct type in
+// order, including the fields of embedded structs.
+func structFieldNames(typ reflect.Type) []string {
+	names := make([]string, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			names = append(names, structFieldNames(field.Type)...)
+			continue
+		}
+		names = append(names, field.Name)
+	}
+	return names
+}
+
+// SoftDeleteAttribute returns the attribute marked with the soft-delete tag,
+// or nil if models of the collection are deleted physically.
+func (m *ModelInfo) SoftDeleteAttribute() *Attribute {
+	for _, attr := range m.attributes {
+		if attr.IsSoftDelete() {
 			return attr
 		}
 	}
@@ -219,6 +356,17 @@ func (m *ModelInfo) Relation(name string) *Relation {
 	return m.relations[name]
 }
 
+// PolymorphicRelations returns the polymorphic relations of the model.
+func (m *ModelInfo) PolymorphicRelations() []*Relation {
+	relations := make([]*Relation, 0)
+	for _, relation := range m.relations {
+		if relation.RelationType() == RELATION_TYPE_POLYMORPHIC {
+			relations = append(relations, relation)
+		}
+	}
+	return relations
+}
+
 func (m *ModelInfo) FindRelation(name string) *Relation {
 	for _, relation := range m.Relations() {
 		if relation.Name() == name || relation.BackendName() == name || relation.MarshalName() == name {
@@ -249,9 +397,10 @@ func BuildModelInfo(model interface{}) (*ModelInfo, apperror.Error) {
 		structName:     structReflector.Name(),
 		collection:     collection,
 
-		transientFields: make(map[string]*Field),
-		attributes:      make(map[string]*Attribute),
-		relations:       make(map[string]*Relation),
+		transientFields:     make(map[string]*Field),
+		transientAttributes: make(map[string]*Attribute),
+		attributes:          make(map[string]*Attribute),
+		relations:           make(map[string]*Relation),
 	}
 
 	// Determine BackendName.
@@ -291,11 +440,37 @@ func BuildModelInfo(model interface{}) (*ModelInfo, apperror.Error) {
 		}
 	}
 
+	composite := info.HasCompositePk()
 	for _, attr := range info.attributes {
+		if attr.GenerateUUID() && attr.Type().Kind() != reflect.String {
+			return nil, &apperror.Err{
+				Code:    "invalid_uuid_field",
+				Message: fmt.Sprintf("The pk-uuid field %v.%v must be a string", info.StructName(), attr.Name()),
+			}
+		}
+
+		if attr.BackendArray() && (attr.Type().Kind() != reflect.Slice || attr.Type().Elem().Kind() == reflect.Uint8) {
+			return nil, &apperror.Err{
+				Code:    "invalid_array_field",
+				Message: fmt.Sprintf("The array field %v.%v must be a slice", info.StructName(), attr.Name()),
+			}
+		} else if attr.BackendArray() && !isBasicArrayItem(attr.Type().Elem()) {
+			return nil, &apperror.Err{
+				Code:    "invalid_array_field",
+				Message: fmt.Sprintf("The array field %v.%v must be a slice of strings, numbers or booleans", info.StructName(), attr.Name()),
+			}
+		}
+
 		if attr.IsPrimaryKey() {
 			attr.SetIsRequired(true)
 			attr.SetIgnoreIfZero(true)
 
+			// Fields of composite primary keys are only unique together,
+			// and their values are never generated.
+			if composite {
+				continue
+			}
+
 			// Only set unique to true if no unique-with was specified.
 			if attr.IsUniqueWith() == nil {
 				attr.SetIsUnique(true)
@@ -342,16 +517,18 @@ func (info *ModelInfo) buildFields(modelVal *reflector.StructReflector, embedded
 		//  * a pointer to a struct
 		//  * a slice of structs
 		//  * a slice of pointers to structs
+		//  * a map of structs or pointers to structs
 		var structType reflect.Type
 
 		fieldR := modelVal.Field(name)
 
-		// Ignore invalid fields (for example fields that only contain an interface{} variable).
+		// Ignore invalid fields (for example fields that only contain an interface{} variable),
+		// unless they hold a polymorphic relation.
 		if fieldR == nil {
-			continue
-		}
-
-		if fieldR.IsStruct() {
+			if fieldInfo.Type.Kind() != reflect.Interface || !strings.Contains(fieldInfo.Tag.Get("db"), "polymorphic:") {
+				continue
+			}
+		} else if fieldR.IsStruct() {
 			structType = fieldR.Type()
 		} else if fieldR.IsStructPtr() {
 			structType = fieldR.Type().Elem()
@@ -362,6 +539,13 @@ func (info *ModelInfo) buildFields(modelVal *reflector.StructReflector, embedded
 			} else if sliceItemType.Kind() == reflect.Ptr && sliceItemType.Elem().Kind() == reflect.Struct {
 				structType = sliceItemType.Elem()
 			}
+		} else if fieldR.IsMap() {
+			mapItemType := fieldR.Type().Elem()
+			if mapItemType.Kind() == reflect.Struct {
+				structType = mapItemType
+			} else if mapItemType.Kind() == reflect.Ptr && mapItemType.Elem().Kind() == reflect.Struct {
+				structType = mapItemType.Elem()
+			}
 		}
 
 		// Build the base field.
@@ -390,9 +574,15 @@ func (info *ModelInfo) buildFields(modelVal *reflector.StructReflector, embedded
 			continue
 		}
 
-		if structType == nil {
-			// No struct type found, so this field cannot possibly be a
-			// relation and must be an attribute.
+		// Transient fields are only relevant for marshalling.
+		if field.tag.transient {
+			info.transientAttributes[field.name] = BuildAttribute(field)
+			continue
+		}
+
+		if (structType == nil && !field.tag.polymorphic) || field.tag.array {
+			// No struct type found, or an array column, so this field cannot
+			// possibly be a relation and must be an attribute.
 			// Construct attribute now.
 
 			attr := BuildAttribute(field)
@@ -414,6 +604,10 @@ func (info *ModelInfo) buildFields(modelVal *reflector.StructReflector, embedded
 	return nil
 }
 
+// DetermineModelId returns the primary key value of the model, or nil if
+// it is not set.
+// For composite primary keys, the id is a []interface{} with the values
+// in the order of PkAttributes(), and nil if any of the values is not set.
 func (info *ModelInfo) DetermineModelId(model interface{}) (interface{}, apperror.Error) {
 	if hook, ok := model.(ModelIdGetterHook); ok {
 		return hook.GetId(), nil
@@ -423,6 +617,19 @@ func (info *ModelInfo) DetermineModelId(model interface{}) (interface{}, apperro
 	if err != nil {
 		return nil, apperror.Wrap(err, "invalid_model")
 	}
+
+	if info.HasCompositePk() {
+		ids := make([]interface{}, 0)
+		for _, attr := range info.PkAttributes() {
+			field := r.Field(attr.Name())
+			if field.IsZero() {
+				return nil, nil
+			}
+			ids = append(ids, field.Interface())
+		}
+		return ids, nil
+	}
+
 	field := r.Field(info.PkAttribute().Name())
 
 	if field.IsZero() {
@@ -475,6 +682,51 @@ func (info *ModelInfo) ModelHasId(model interface{}) (bool, apperror.Error) {
 	return id != "", nil
 }
 
+// EqualAttributes returns true if two instances of the model have the same
+// values for all persisted attributes.
+// Relations and transient fields are ignored, and times are compared
+// with time.Equal().
+// Returns false if a or b is not an instance of the model.
+func (info *ModelInfo) EqualAttributes(a, b interface{}) bool {
+	ra, err := reflector.Reflect(a).Struct()
+	if err != nil || ra.Type() != info.itemType {
+		return false
+	}
+	rb, err := reflector.Reflect(b).Struct()
+	if err != nil || rb.Type() != info.itemType {
+		return false
+	}
+
+	for name := range info.attributes {
+		x := ra.Field(name).Interface()
+		y := rb.Field(name).Interface()
+
+		if tx, ok := x.(time.Time); ok {
+			if !tx.Equal(y.(time.Time)) {
+				return false
+			}
+			continue
+		}
+		if tx, ok := x.(*time.Time); ok {
+			ty := y.(*time.Time)
+			if tx == nil || ty == nil {
+				if tx != ty {
+					return false
+				}
+			} else if !tx.Equal(*ty) {
+				return false
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (info *ModelInfo) SetModelId(model, id interface{}) apperror.Error {
 	// If Id is string, check if model implements SetStrId.
 	if strId, ok := id.(string); ok {
@@ -500,6 +752,21 @@ func (info *ModelInfo) SetModelId(model, id interface{}) apperror.Error {
 	if err != nil {
 		return apperror.Wrap(err, "invalid_model")
 	}
+
+	if info.HasCompositePk() {
+		ids, err := info.compositeId(id)
+		if err != nil {
+			return err
+		}
+		for i, attr := range info.PkAttributes() {
+			if err := r.SetFieldValue(attr.Name(), ids[i], true); err != nil {
+				return apperror.Wrap(err, "model_set_id_error",
+					fmt.Sprintf("Could not set %v.%v to value %v", info.Collection(), attr.Name(), ids[i]))
+			}
+		}
+		return nil
+	}
+
 	if err := r.SetFieldValue(info.PkAttribute().Name(), id, true); err != nil {
 		return apperror.Wrap(err, err.Error(),
 			fmt.Sprintf("Could not set %v.%v to value %v: %v", info.Collection(), info.PkAttribute().Name(), id))
@@ -507,6 +774,68 @@ func (info *ModelInfo) SetModelId(model, id interface{}) apperror.Error {
 	return nil
 }
 
+// compositeId converts an id for a composite primary key, which must be a
+// slice with a value for each primary key attribute or a map keyed by the
+// attribute names or backend names, to a []interface{}.
+func (info *ModelInfo) compositeId(id interface{}) ([]interface{}, apperror.Error) {
+	pks := info.PkAttributes()
+	count := len(pks)
+
+	if data, ok := id.(map[string]interface{}); ok {
+		ids := make([]interface{}, 0, count)
+		for _, attr := range pks {
+			val, ok := data[attr.Name()]
+			if !ok {
+				val, ok = data[attr.BackendName()]
+			}
+			if !ok {
+				return nil, &apperror.Err{
+					Public:  true,
+					Code:    "invalid_composite_id",
+					Message: fmt.Sprintf("The id for %v is missing the primary key field %v", info.Collection(), attr.Name()),
+				}
+			}
+			ids = append(ids, val)
+		}
+		return ids, nil
+	}
+
+	slice, err := reflector.Reflect(id).Slice()
+	if err != nil || slice.Len() != count {
+		return nil, &apperror.Err{
+			Public:  true,
+			Code:    "invalid_composite_id",
+			Message: fmt.Sprintf("The primary key of %v consists of %v fields, so the id must be a slice with %v values or a map", info.Collection(), count, count),
+		}
+	}
+
+	ids := make([]interface{}, 0, count)
+	for _, item := range slice.Items() {
+		ids = append(ids, item.Interface())
+	}
+	return ids, nil
+}
+
+// PkFilter builds a filter that matches the given id.
+// For composite primary keys, id must be a slice with a value for each
+// primary key attribute, or a map keyed by the attribute names.
+func (info *ModelInfo) PkFilter(id interface{}) (Expression, apperror.Error) {
+	if !info.HasCompositePk() {
+		pk := info.PkAttribute()
+		return NewFieldValFilter(info.BackendName(), pk.BackendName(), OPERATOR_EQ, id), nil
+	}
+
+	ids, err := info.compositeId(id)
+	if err != nil {
+		return nil, err
+	}
+	filters := make([]Expression, 0, len(ids))
+	for i, attr := range info.PkAttributes() {
+		filters = append(filters, NewFieldValFilter(info.BackendName(), attr.BackendName(), OPERATOR_EQ, ids[i]))
+	}
+	return NewAndExpr(filters...), nil
+}
+
 func (info *ModelInfo) ModelToMap(model interface{}, forBackend, marshal bool, includeRelations bool) (map[string]interface{}, apperror.Error) {
 	data := make(map[string]interface{})
 
@@ -550,6 +879,17 @@ func (info *ModelInfo) ModelToMap(model interface{}, forBackend, marshal bool, i
 		data[name] = val
 	}
 
+	// Transient attributes are never sent to the backend.
+	if !forBackend {
+		for fieldName, attr := range info.TransientAttributes() {
+			name := fieldName
+			if marshal {
+				name = attr.MarshalName()
+			}
+			data[name] = r.Field(fieldName).Interface()
+		}
+	}
+
 	if !includeRelations {
 		return data, nil
 	}
@@ -604,6 +944,15 @@ func (info *ModelInfo) UpdateModelFromData(model interface{}, data map[string]in
 				}
 			}
 
+			// Array columns can be returned in the text representation.
+			if attr.BackendArray() {
+				if arr, err := arrayFromLiteral(val, attr.Type()); err != nil {
+					return err
+				} else if arr != nil {
+					val = arr
+				}
+			}
+
 			if err := r.SetFieldValue(attr.Name(), val, true); err != nil {
 				msg := fmt.Sprintf("Data for field %v (%v) could not be converted to %v", attr.Name(), val, attr.Type())
 				return apperror.Wrap(err, "unconvertable_field_value", msg)
@@ -646,11 +995,33 @@ func (info *ModelInfo) BuildCreateStmt(withReferences bool) *CreateCollectionStm
 	fieldsMap := make(map[string]*FieldExpr, 0)
 	constraints := make([]Expression, 0)
 
+	pks := info.PkAttributes()
+	if len(pks) > 1 {
+		// Composite primary keys need a collection constraint.
+		fields := make([]Expression, 0, len(pks))
+		for _, attr := range pks {
+			fields = append(fields, NewIdExpr(attr.BackendName()))
+		}
+		constraints = append(constraints, NewPrimaryKeyFieldsConstraint(fields...))
+	}
+
 	for name, attr := range info.Attributes() {
-		fieldsMap[name] = attr.BuildFieldExpression()
+		field := attr.BuildFieldExpression()
+		if len(pks) > 1 && attr.IsPrimaryKey() {
+			// Remove the field primary key constraint.
+			fieldConstraints := make([]Expression, 0)
+			for _, constraint := range field.Constraints() {
+				if c, ok := constraint.(*ConstraintExpr); !ok || c.Constraint() != CONSTRAINT_PRIMARY_KEY {
+					fieldConstraints = append(fieldConstraints, constraint)
+				}
+			}
+			field.SetConstraints(fieldConstraints)
+		}
+		fieldsMap[name] = field
 
 		// Add unique fields constraint to collection if specified.
-		if len(attr.isUniqueWith) > 0 {
+		// Unique-where attributes are enforced with a partial index instead.
+		if len(attr.isUniqueWith) > 0 && attr.uniqueWhere == nil {
 			fields := []Expression{NewIdExpr(attr.BackendName())}
 			for _, name := range attr.isUniqueWith {
 				fields = append(fields, NewIdExpr(name))
@@ -678,6 +1049,45 @@ func (info *ModelInfo) BuildCreateStmt(withReferences bool) *CreateCollectionStm
 	return stmt
 }
 
+// BuildIndexStmts builds the indexes of the collection that are not part of
+// the create statement: functional indexes for case insensitive unique
+// attributes, and partial indexes for unique-where attributes.
+// The statements are sorted by attribute name.
+func (info *ModelInfo) BuildIndexStmts() []*CreateIndexStmt {
+	names := make([]string, 0, len(info.attributes))
+	for name := range info.attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stmts := make([]*CreateIndexStmt, 0)
+	for _, name := range names {
+		attr := info.attributes[name]
+		filter := attr.UniqueWhereFilter()
+
+		if attr.IsUniqueCi() {
+			indexName := info.BackendName() + "_" + attr.BackendName() + "_unique_ci"
+			expr := NewFuncExpr("LOWER", NewIdExpr(attr.BackendName()))
+			stmt := NewCreateIndexStmt(indexName, NewIdExpr(info.BackendName()), []Expression{expr}, true, "")
+			stmt.SetFilter(filter)
+			stmts = append(stmts, stmt)
+		}
+
+		if filter != nil && (attr.IsUnique() || len(attr.IsUniqueWith()) > 0) {
+			indexName := info.BackendName() + "_" + attr.BackendName() + "_unique"
+			fields := []Expression{NewIdExpr(attr.BackendName())}
+			for _, field := range attr.IsUniqueWith() {
+				fields = append(fields, NewIdExpr(field))
+			}
+			stmt := NewCreateIndexStmt(indexName, NewIdExpr(info.BackendName()), fields, true, "")
+			stmt.SetFilter(filter)
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	return stmts
+}
+
 func (info *ModelInfo) ModelToFieldExpressions(model interface{}) ([]*FieldValueExpr, apperror.Error) {
 	exprs := make([]*FieldValueExpr, 0)
 
@@ -693,13 +1103,21 @@ func (info *ModelInfo) ModelToFieldExpressions(model interface{}) ([]*FieldValue
 }
 
 func (info *ModelInfo) ModelFilter(model interface{}) Expression {
-	id := reflector.Reflect(model).MustStruct().Field(info.PkAttribute().Name())
-	if id.IsZero() {
-		return nil
+	r := reflector.Reflect(model).MustStruct()
+
+	filters := make([]Expression, 0, 1)
+	for _, attr := range info.PkAttributes() {
+		id := r.Field(attr.Name())
+		if id.IsZero() {
+			return nil
+		}
+		filters = append(filters, NewFieldValFilter(info.BackendName(), attr.BackendName(), OPERATOR_EQ, id.Interface()))
 	}
 
-	f := NewFieldValFilter(info.BackendName(), info.PkAttribute().BackendName(), OPERATOR_EQ, id.Interface())
-	return f
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return NewAndExpr(filters...)
 }
 
 func (info *ModelInfo) ModelSelect(model interface{}) *SelectStmt {
@@ -819,6 +1237,95 @@ func (i ModelInfos) Has(collection string) bool {
 	return ok
 }
 
+// Collections returns the sorted names of all collections.
+// m2m pivot collections are only included if includePivots is true.
+func (i ModelInfos) Collections(includePivots bool) []string {
+	names := make([]string, 0, len(i))
+	for name, info := range i {
+		if info.IsPivot() && !includePivots {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove removes a collection and the pivot collections of its m2m
+// relations.
+func (i ModelInfos) Remove(collection string) apperror.Error {
+	info := i.Find(collection)
+	if info == nil {
+		return apperror.New("unknown_collection", fmt.Sprintf("The collection %v is not registered", collection))
+	}
+
+	for _, other := range i {
+		if other == info || other.IsPivot() {
+			continue
+		}
+		for _, relation := range other.relations {
+			if relation.RelatedModel() == info {
+				msg := fmt.Sprintf("The collection %v is still referenced by the relation %v.%v", info.Collection(), other.Collection(), relation.Name())
+				return apperror.New("model_still_referenced", msg)
+			}
+		}
+	}
+
+	i.removePivots(info)
+	delete(i, info.Collection())
+	return nil
+}
+
+// Replace replaces the registered model of a collection with an
+// unanalyzed one, after the relations were already analyzed.
+// The relations of the new model are analyzed, and relations of other
+// models to the collection are updated to the new model.
+func (i ModelInfos) Replace(info *ModelInfo) apperror.Error {
+	old := i.Get(info.Collection())
+	if old == nil {
+		return apperror.New("unknown_collection", fmt.Sprintf("The collection %v is not registered", info.Collection()))
+	}
+
+	// Verify that relations to the collection are still valid before
+	// changing anything.
+	references := make([]*Relation, 0)
+	for _, other := range i {
+		if other == old {
+			continue
+		}
+		for _, relation := range other.relations {
+			if relation.RelatedModel() != old {
+				continue
+			}
+			if !info.HasAttribute(relation.ForeignField()) {
+				msg := fmt.Sprintf("The relation %v.%v references the removed field %v.%v", other.Collection(), relation.Name(), info.Collection(), relation.ForeignField())
+				return apperror.New("invalid_relation_foreign_field", msg)
+			}
+			references = append(references, relation)
+		}
+	}
+
+	i.removePivots(old)
+	i.Add(info)
+	for _, relation := range references {
+		relation.SetRelatedModel(info)
+	}
+
+	if err := i.analyzeModelRelations(info); err != nil {
+		return err
+	}
+	return info.resolveUniqueWith()
+}
+
+// removePivots removes the pivot collections of the m2m relations of info.
+func (i ModelInfos) removePivots(info *ModelInfo) {
+	for _, relation := range info.relations {
+		if relation.RelationType() == RELATION_TYPE_M2M {
+			delete(i, relation.BackendName())
+		}
+	}
+}
+
 func (i ModelInfos) Find(name string) *ModelInfo {
 	for _, info := range i {
 		if info.Collection() == name || info.BackendName() == name || info.MarshalName() == name {
@@ -838,6 +1345,72 @@ func (m ModelInfos) AnalyzeRelations() apperror.Error {
 			return err
 		}
 	}
+
+	// Unique-with fields can only be resolved once all relations are known,
+	// since they may reference a relation instead of an attribute.
+	for _, info := range m {
+		if err := info.resolveUniqueWith(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveUniqueWith converts the field names specified with unique-with
+// and unique-where to backend names.
+// A name may either reference an attribute, or a has-one relation, in which
+// case the foreign key attribute of the relation is used.
+func (info *ModelInfo) resolveUniqueWith() apperror.Error {
+	for _, attr := range info.attributes {
+		if err := info.resolveUniqueWhere(attr); err != nil {
+			return err
+		}
+
+		if len(attr.isUniqueWith) < 1 {
+			continue
+		}
+
+		names := make([]string, 0)
+		for _, name := range attr.isUniqueWith {
+			uniqueAttr := info.FindAttribute(name)
+			if uniqueAttr == nil {
+				if relation := info.FindRelation(name); relation != nil && relation.RelationType() == RELATION_TYPE_HAS_ONE {
+					uniqueAttr = info.Attribute(relation.LocalField())
+				}
+			}
+			if uniqueAttr == nil {
+				msg := fmt.Sprintf("%v.%v is unique-with %v, but no such attribute or has-one relation exists", info.StructName(), attr.Name(), name)
+				return apperror.New("invalid_unique_with", msg)
+			}
+			names = append(names, uniqueAttr.BackendName())
+		}
+		attr.isUniqueWith = names
+	}
+
+	return nil
+}
+
+// resolveUniqueWhere converts the field of a unique-where predicate to the
+// backend name, and verifies that the attribute is actually unique.
+func (info *ModelInfo) resolveUniqueWhere(attr *Attribute) apperror.Error {
+	field, operator := attr.UniqueWhere()
+	if field == "" {
+		return nil
+	}
+
+	if !(attr.isUnique || attr.isUniqueCi || len(attr.isUniqueWith) > 0) {
+		msg := fmt.Sprintf("%v.%v specifies unique-where, but is not unique, unique-ci or unique-with", info.StructName(), attr.Name())
+		return apperror.New("invalid_unique_where", msg)
+	}
+
+	whereAttr := info.FindAttribute(field)
+	if whereAttr == nil {
+		msg := fmt.Sprintf("%v.%v is unique-where %v, but no such attribute exists", info.StructName(), attr.Name(), field)
+		return apperror.New("invalid_unique_where", msg)
+	}
+	attr.SetUniqueWhere(whereAttr.BackendName(), operator)
+
 	return nil
 }
 
@@ -847,6 +1420,12 @@ func (m ModelInfos) AnalyzeRelations() apperror.Error {
 // relations.
 func (m ModelInfos) analyzeModelRelations(model *ModelInfo) apperror.Error {
 	for fieldName, field := range model.transientFields {
+		if field.tag.polymorphic {
+			if err := m.buildPolymorphicRelation(model, field); err != nil {
+				return err
+			}
+			continue
+		}
 
 		relatedItem := reflect.New(field.structType)
 
@@ -877,6 +1456,17 @@ func (m ModelInfos) analyzeModelRelations(model *ModelInfo) apperror.Error {
 		modelName := model.StructName()
 		relatedName := relatedInfo.StructName()
 
+		// Relations stored in a map need a related field for the keys.
+		if relation.Type().Kind() == reflect.Map {
+			if relation.MapKey() == "" {
+				msg := fmt.Sprintf("Relation %v.%v is a map, but no key field was specified. Specify with map-key:FieldName", modelName, fieldName)
+				return apperror.New("missing_relation_map_key", msg)
+			} else if !relatedInfo.HasAttribute(relation.MapKey()) {
+				msg := fmt.Sprintf("Map key field %v.%v of relation %v.%v does not exist", relatedName, relation.MapKey(), modelName, fieldName)
+				return apperror.New("invalid_relation_map_key", msg)
+			}
+		}
+
 		// If an explicit relation type was specified, verify the fields.
 		if relation.RelationType() != "" {
 			// Relation was set explicitly. Verify fields.
@@ -886,6 +1476,9 @@ func (m ModelInfos) analyzeModelRelations(model *ModelInfo) apperror.Error {
 
 				if relation.LocalField() == "" {
 					relation.SetLocalField(model.PkAttribute().Name())
+					if model.HasCompositePk() {
+						relation.SetLocalFields(attributeNames(model.PkAttributes()))
+					}
 				} else if !model.HasAttribute(relation.LocalField()) {
 					msg := fmt.Sprintf("Specified inexistant %v.%v as m2m field", modelName, relation.LocalField())
 					return apperror.New("invalid_m2m_field", msg)
@@ -893,6 +1486,9 @@ func (m ModelInfos) analyzeModelRelations(model *ModelInfo) apperror.Error {
 				if relation.ForeignField() == "" {
 					// Set fields to respective PKs.
 					relation.SetForeignField(relatedInfo.PkAttribute().Name())
+					if relatedInfo.HasCompositePk() {
+						relation.SetForeignFields(attributeNames(relatedInfo.PkAttributes()))
+					}
 				} else if !relatedInfo.HasAttribute(relation.ForeignField()) {
 					msg := fmt.Sprintf("Specified inexistant %v.%v as m2m field", relatedName, relation.ForeignField())
 					return apperror.New("invalid_m2m_field", msg)
@@ -948,6 +1544,12 @@ func (m ModelInfos) analyzeModelRelations(model *ModelInfo) apperror.Error {
 					}
 				}
 
+				if relField == "" && relatedInfo == model {
+					// Self-referential relation, like the children in a tree.
+					// Use the key of the to-one relation to the same type.
+					relField = model.selfReferenceField(field.structType)
+				}
+
 				if relField == "" {
 					msg := fmt.Sprintf("Model %v has has-many relationship to %v in field %v, but could not determine the relationship type. Specify explicitly with has-many:LocalField:ForeignField", modelName, relatedName, fieldName)
 					return apperror.New("relationship_not_determined", msg)
@@ -955,6 +1557,8 @@ func (m ModelInfos) analyzeModelRelations(model *ModelInfo) apperror.Error {
 			} else if !relatedInfo.HasAttribute(relation.ForeignField()) {
 				msg := fmt.Sprintf("%v.%v was specified for has-many relationship, but does not exist", relatedInfo.StructName(), relation.ForeignField())
 				return apperror.New("invalid_relationship", msg)
+			} else {
+				relField = relation.ForeignField()
 			}
 
 			relation.SetForeignField(relField)
@@ -1028,6 +1632,118 @@ func (m ModelInfos) analyzeModelRelations(model *ModelInfo) apperror.Error {
 	return nil
 }
 
+// buildPolymorphicRelation builds a polymorphic relation.
+// Relations stored in an interface{} field reference the owning model, with
+// the type and id field on the model. Otherwise, the type and id field are
+// on the related model, and reference the model.
+func (m ModelInfos) buildPolymorphicRelation(model *ModelInfo, field *Field) apperror.Error {
+	relation := BuildRelation(field)
+	relation.SetModel(model)
+
+	info := model
+	if !relation.IsPolymorphicOwner() {
+		if field.structType == nil {
+			msg := fmt.Sprintf("The polymorphic relation %v.%v must be an interface{} or hold structs", model.StructName(), field.name)
+			return apperror.New("invalid_polymorphic_relation", msg)
+		}
+		relatedCollection, err := GetModelCollection(reflect.New(field.structType).Interface())
+		if err != nil {
+			return err
+		}
+		if info = m.Get(relatedCollection); info == nil {
+			msg := fmt.Sprintf("The polymorphic relation %v.%v references the unregistered collection %v", model.StructName(), field.name, relatedCollection)
+			return apperror.New("invalid_polymorphic_relation", msg)
+		}
+		relation.SetRelatedModel(info)
+	}
+
+	for _, name := range []string{relation.PolymorphicTypeField(), relation.PolymorphicIdField()} {
+		if !info.HasAttribute(name) {
+			msg := fmt.Sprintf("The field %v.%v of the polymorphic relation %v.%v does not exist", info.StructName(), name, model.StructName(), field.name)
+			return apperror.New("invalid_polymorphic_field", msg)
+		}
+	}
+	if info.Attribute(relation.PolymorphicTypeField()).Type().Kind() != reflect.String {
+		msg := fmt.Sprintf("The polymorphic type field %v.%v must be a string", info.StructName(), relation.PolymorphicTypeField())
+		return apperror.New("invalid_polymorphic_field", msg)
+	}
+
+	if relation.IsPolymorphicOwner() {
+		relation.SetLocalField(relation.PolymorphicIdField())
+	} else {
+		relation.SetLocalField(model.PkAttribute().Name())
+		relation.SetForeignField(relation.PolymorphicIdField())
+	}
+
+	model.relations[field.name] = relation
+	return nil
+}
+
+// selfReferenceField returns the key field of the to-one relation of the
+// model to its own struct type typ, for example ParentId for a Parent field.
+// Returns an empty string if there is no such relation, or more than one.
+func (m *ModelInfo) selfReferenceField(typ reflect.Type) string {
+	relField := ""
+	for name, field := range m.transientFields {
+		kind := field.typ.Kind()
+		if field.structType != typ || kind == reflect.Slice || kind == reflect.Map {
+			continue
+		}
+		if m.HasAttribute(name + "Id") {
+			if relField != "" {
+				return ""
+			}
+			relField = name + "Id"
+		}
+	}
+	return relField
+}
+
+// M2MPivotColumnName returns the default name of the column in a m2m
+// collection that references the attribute attr of the collection info,
+// for example "tasks_id".
+// The pivot column names of a m2m relation are stored on the relation and
+// must be retrieved with relation.PivotLocalField() and
+// relation.PivotForeignField(), since they can be customized with the
+// m2m-columns tag.
+func M2MPivotColumnName(info *ModelInfo, attr *Attribute) string {
+	return info.BackendName() + "_" + attr.BackendName()
+}
+
+// m2mPivotColumns returns the pivot columns for the fields of a m2m
+// relation. A single field uses the column specified with the m2m-columns
+// tag, if any.
+func m2mPivotColumns(info *ModelInfo, fields []string, column string, columns []string) ([]string, apperror.Error) {
+	if len(fields) == 1 {
+		if column == "" {
+			column = M2MPivotColumnName(info, info.Attribute(fields[0]))
+		}
+		return []string{column}, nil
+	}
+
+	if len(columns) == len(fields) {
+		return columns, nil
+	} else if column != "" {
+		msg := fmt.Sprintf("m2m-columns is not supported for the composite primary key of %v", info.Collection())
+		return nil, apperror.New("invalid_m2m_columns", msg)
+	}
+
+	columns = make([]string, 0, len(fields))
+	for _, field := range fields {
+		columns = append(columns, M2MPivotColumnName(info, info.Attribute(field)))
+	}
+	return columns, nil
+}
+
+// attributeNames returns the names of the attributes.
+func attributeNames(attrs []*Attribute) []string {
+	names := make([]string, 0, len(attrs))
+	for _, attr := range attrs {
+		names = append(names, attr.Name())
+	}
+	return names
+}
+
 func (m ModelInfos) buildM2MRelation(relation *Relation) apperror.Error {
 	colName := relation.BackendName()
 	if colName == utils.CamelCaseToUnderscore(relation.Name()) {
@@ -1040,69 +1756,113 @@ func (m ModelInfos) buildM2MRelation(relation *Relation) apperror.Error {
 		return apperror.New("m2m_collection_exists", msg)
 	}
 
-	localField := relation.Model().Attribute(relation.LocalField())
-	localFieldName := relation.Model().BackendName() + "." + localField.BackendName()
-	localAttr := &Attribute{
-		Field: Field{
-			typ:         localField.Type(),
-			name:        localFieldName,
-			backendName: localFieldName,
-			isRequired:  true,
-		},
+	localFields := relation.LocalFields()
+	localColumns, err := m2mPivotColumns(relation.Model(), localFields, relation.pivotLocalField, relation.pivotLocalFields)
+	if err != nil {
+		return err
+	}
+	relation.SetPivotLocalField(localColumns[0])
+	if len(localColumns) > 1 {
+		relation.SetPivotLocalFields(localColumns)
 	}
 
-	fk := relation.RelatedModel().Attribute(relation.ForeignField())
-	fkName := relation.RelatedModel().BackendName() + "." + fk.BackendName()
-	fkAttr := &Attribute{
-		Field: Field{
-			typ:         fk.Type(),
-			name:        fkName,
-			backendName: fkName,
-			isRequired:  true,
-		},
-		isUniqueWith: []string{localFieldName},
+	foreignFields := relation.ForeignFields()
+	foreignColumns, err := m2mPivotColumns(relation.RelatedModel(), foreignFields, relation.pivotForeignField, relation.pivotForeignFields)
+	if err != nil {
+		return err
+	}
+	relation.SetPivotForeignField(foreignColumns[0])
+	if len(foreignColumns) > 1 {
+		relation.SetPivotForeignFields(foreignColumns)
+	}
+
+	for _, name := range localColumns {
+		for _, fkName := range foreignColumns {
+			if name == fkName {
+				msg := fmt.Sprintf("Could not build m2m relationship %v: both pivot columns are named %v", relation.Name(), fkName)
+				return apperror.New("m2m_column_conflict", msg)
+			}
+		}
 	}
 
+	attributes := make(map[string]*Attribute)
+	for i, name := range localColumns {
+		attributes[name] = &Attribute{
+			Field: Field{
+				typ:         relation.Model().Attribute(localFields[i]).Type(),
+				name:        name,
+				backendName: name,
+				isRequired:  true,
+			},
+		}
+	}
+	for i, name := range foreignColumns {
+		attributes[name] = &Attribute{
+			Field: Field{
+				typ:         relation.RelatedModel().Attribute(foreignFields[i]).Type(),
+				name:        name,
+				backendName: name,
+				isRequired:  true,
+			},
+		}
+	}
+
+	// Each combination of local and foreign keys may only exist once.
+	uniqueWith := append(append([]string{}, localColumns...), foreignColumns[1:]...)
+	attributes[foreignColumns[0]].isUniqueWith = uniqueWith
+
 	col := &ModelInfo{
 		collection:  colName,
 		backendName: colName,
 		item:        map[string]interface{}{},
 		itemType:    reflect.TypeOf(map[string]interface{}{}),
-		attributes: map[string]*Attribute{
-			localFieldName: localAttr,
-			fkName:         fkAttr,
-		},
+		isPivot:     true,
+		attributes:  attributes,
 	}
 
-	col.relations = map[string]*Relation{
-		"BaseItem": &Relation{
-			Field: Field{
-				name:        "BaseItem",
-				backendName: "base_item",
-				marshalName: "base_item",
-			},
-			model:        col,
-			relatedModel: relation.Model(),
-			relationType: RELATION_TYPE_HAS_ONE,
-			localField:   localFieldName,
-			foreignField: relation.LocalField(),
+	// The back-relations from the pivot reference all key columns, so they
+	// also work for composite primary keys.
+	baseItem := &Relation{
+		Field: Field{
+			name:        "BaseItem",
+			backendName: "base_item",
+			marshalName: "base_item",
 		},
+		model:        col,
+		relatedModel: relation.Model(),
+		relationType: RELATION_TYPE_HAS_ONE,
+		localField:   localColumns[0],
+		foreignField: relation.LocalField(),
+	}
+	if len(localColumns) > 1 {
+		baseItem.SetLocalFields(localColumns)
+		baseItem.SetForeignFields(localFields)
+	}
 
-		"RelatedItem": &Relation{
-			Field: Field{
-				name:        "RelatedItem",
-				backendName: "related_item",
-				marshalName: "related_item",
-			},
-			model:        col,
-			relatedModel: relation.RelatedModel(),
-			relationType: RELATION_TYPE_HAS_ONE,
-			localField:   fkName,
-			foreignField: relation.ForeignField(),
+	relatedItem := &Relation{
+		Field: Field{
+			name:        "RelatedItem",
+			backendName: "related_item",
+			marshalName: "related_item",
 		},
+		model:        col,
+		relatedModel: relation.RelatedModel(),
+		relationType: RELATION_TYPE_HAS_ONE,
+		localField:   foreignColumns[0],
+		foreignField: relation.ForeignField(),
+	}
+	if len(foreignColumns) > 1 {
+		relatedItem.SetLocalFields(foreignColumns)
+		relatedItem.SetForeignFields(foreignFields)
+	}
+
+	col.relations = map[string]*Relation{
+		"BaseItem":    baseItem,
+		"RelatedItem": relatedItem,
 	}
 
 	m[colName] = col
+	relation.SetPivotInfo(col)
 
 	// Add new relationships to infos.
 	/*
@@ -1139,3 +1899,20 @@ func (m ModelInfos) buildM2MRelation(relation *Relation) apperror.Error {
 
 	return nil
 }
+
+// isBasicArrayItem returns true if typ can be stored as the item of an array
+// column, which only holds strings, numbers and booleans.
+func isBasicArrayItem(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package dukedb_test
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -128,5 +130,388 @@ var _ = Describe("Modelinfo", func() {
 				Expect(err.GetCode()).To(Equal("invalid_relation_foreign_field"))
 			})
 		})
+
+		Describe("has-many map", func() {
+			It("Should error out on missing or unknown map keys", func() {
+				type Child struct {
+					Id       uint64
+					ParentId uint64
+					Sku      string
+				}
+				type Parent struct {
+					Id       uint64
+					Children map[string]Child
+				}
+
+				_, err := buildInfo(&Parent{}, &Child{})
+				Expect(err).To(HaveOccurred())
+				Expect(err.GetCode()).To(Equal("missing_relation_map_key"))
+
+				type Parent2 struct {
+					Id       uint64
+					Children map[string]*Child `db:"map-key:Missing"`
+				}
+
+				_, err = buildInfo(&Parent2{}, &Child{})
+				Expect(err).To(HaveOccurred())
+				Expect(err.GetCode()).To(Equal("invalid_relation_map_key"))
+			})
+		})
+
+		Describe("Self-referential", func() {
+			It("Should detect relations to the own collection", func() {
+				type Category struct {
+					Id       uint64
+					Parent   *Category
+					ParentId uint64
+					Children []Category
+				}
+
+				infos, err := buildInfo(&Category{})
+				Expect(err).ToNot(HaveOccurred())
+
+				info := infos.Get("categories")
+				Expect(info).ToNot(BeNil())
+
+				parent := info.Relation("Parent")
+				Expect(parent.RelationType()).To(Equal(RELATION_TYPE_HAS_ONE))
+				Expect(parent.RelatedModel()).To(BeIdenticalTo(info))
+				Expect(parent.LocalField()).To(Equal("ParentId"))
+				Expect(parent.ForeignField()).To(Equal("Id"))
+
+				children := info.Relation("Children")
+				Expect(children.RelationType()).To(Equal(RELATION_TYPE_HAS_MANY))
+				Expect(children.RelatedModel()).To(BeIdenticalTo(info))
+				Expect(children.LocalField()).To(Equal("Id"))
+				Expect(children.ForeignField()).To(Equal("ParentId"))
+			})
+		})
+
+		Describe("Polymorphic", func() {
+			It("Should build both sides of polymorphic relations", func() {
+				type Comment struct {
+					Id        uint64
+					OwnerType string
+					OwnerId   uint64
+					Owner     interface{} `db:"polymorphic:OwnerType:OwnerId"`
+				}
+				type Post struct {
+					Id       uint64
+					Comments []Comment `db:"polymorphic:OwnerType:OwnerId"`
+				}
+
+				infos, err := buildInfo(&Comment{}, &Post{})
+				Expect(err).ToNot(HaveOccurred())
+
+				owner := infos.Get("comments").Relation("Owner")
+				Expect(owner.RelationType()).To(Equal(RELATION_TYPE_POLYMORPHIC))
+				Expect(owner.IsPolymorphicOwner()).To(BeTrue())
+				Expect(owner.IsMany()).To(BeFalse())
+				Expect(owner.LocalField()).To(Equal("OwnerId"))
+
+				comments := infos.Get("posts").Relation("Comments")
+				Expect(comments.IsPolymorphicOwner()).To(BeFalse())
+				Expect(comments.IsMany()).To(BeTrue())
+				Expect(comments.RelatedModel()).To(BeIdenticalTo(infos.Get("comments")))
+				Expect(comments.ForeignField()).To(Equal("OwnerId"))
+				Expect(comments.PolymorphicTypeField()).To(Equal("OwnerType"))
+			})
+
+			It("Should error out on missing polymorphic fields", func() {
+				type Comment struct {
+					Id    uint64
+					Owner interface{} `db:"polymorphic:OwnerType:OwnerId"`
+				}
+
+				_, err := buildInfo(&Comment{})
+				Expect(err).To(HaveOccurred())
+				Expect(err.GetCode()).To(Equal("invalid_polymorphic_field"))
+			})
+		})
+
+		Describe("m2m", func() {
+			It("Should expose the registered pivot info", func() {
+				type Child struct{ Id uint64 }
+				type Parent struct {
+					Id       uint64
+					Children []Child `db:"m2m"`
+				}
+
+				infos, err := buildInfo(&Parent{}, &Child{})
+				Expect(err).ToNot(HaveOccurred())
+
+				rel := infos.Get("parents").Relation("Children")
+				pivot := rel.PivotInfo()
+				Expect(pivot).ToNot(BeNil())
+				Expect(infos.Find(rel.BackendName())).To(BeIdenticalTo(pivot))
+				Expect(pivot.HasAttribute(rel.PivotLocalField())).To(BeTrue())
+				Expect(pivot.HasAttribute(rel.PivotForeignField())).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Composite primary keys", func() {
+		It("Should return the primary key attributes in field order", func() {
+			type Membership struct {
+				UserId  uint64 `db:"primary-key"`
+				GroupId uint64 `db:"primary-key"`
+				Role    string
+			}
+
+			infos, err := buildInfo(&Membership{})
+			Expect(err).ToNot(HaveOccurred())
+			info := infos.Get("memberships")
+
+			Expect(info.HasCompositePk()).To(BeTrue())
+			pks := info.PkAttributes()
+			Expect(pks).To(HaveLen(2))
+			Expect(pks[0].Name()).To(Equal("UserId"))
+			Expect(pks[1].Name()).To(Equal("GroupId"))
+			Expect(pks[0].AutoIncrement()).To(BeFalse())
+
+			m := &Membership{}
+			Expect(info.SetModelId(m, []uint64{1, 2})).ToNot(HaveOccurred())
+			Expect(m.GroupId).To(Equal(uint64(2)))
+			Expect(info.DetermineModelId(m)).To(Equal([]interface{}{uint64(1), uint64(2)}))
+
+			Expect(info.SetModelId(m, 1)).To(HaveOccurred())
+		})
+	})
+
+	Describe("Composite m2m relations", func() {
+		It("Should build a pivot with a column for each primary key field", func() {
+			type Tag struct {
+				Id  uint64
+				Tag string
+			}
+			type Membership struct {
+				UserId  uint64 `db:"primary-key"`
+				GroupId uint64 `db:"primary-key"`
+				Tags    []Tag  `db:"m2m"`
+			}
+
+			infos, err := buildInfo(&Membership{}, &Tag{})
+			Expect(err).ToNot(HaveOccurred())
+
+			relation := infos.Get("memberships").Relation("Tags")
+			Expect(relation.IsCompositeM2M()).To(BeTrue())
+			Expect(relation.LocalFields()).To(Equal([]string{"UserId", "GroupId"}))
+			Expect(relation.PivotLocalFields()).To(Equal([]string{"memberships_user_id", "memberships_group_id"}))
+			Expect(relation.PivotForeignFields()).To(Equal([]string{"tags_id"}))
+
+			pivot := relation.PivotInfo()
+			Expect(pivot.Attributes()).To(HaveLen(3))
+			Expect(pivot.Attribute("tags_id").IsUniqueWith()).To(Equal([]string{"memberships_user_id", "memberships_group_id"}))
+
+			baseItem := pivot.Relation("BaseItem")
+			Expect(baseItem.LocalFields()).To(Equal([]string{"memberships_user_id", "memberships_group_id"}))
+			Expect(baseItem.ForeignFields()).To(Equal([]string{"UserId", "GroupId"}))
+			relatedItem := pivot.Relation("RelatedItem")
+			Expect(relatedItem.LocalFields()).To(Equal([]string{"tags_id"}))
+			Expect(relatedItem.ForeignFields()).To(Equal([]string{"Id"}))
+		})
+	})
+
+	Describe("UUID primary keys", func() {
+		It("Should mark pk-uuid fields as primary key", func() {
+			type Session struct {
+				Id   string `db:"pk-uuid"`
+				Name string
+			}
+
+			infos, err := buildInfo(&Session{})
+			Expect(err).ToNot(HaveOccurred())
+			pk := infos.Get("sessions").PkAttribute()
+			Expect(pk.Name()).To(Equal("Id"))
+			Expect(pk.GenerateUUID()).To(BeTrue())
+			Expect(pk.AutoIncrement()).To(BeFalse())
+		})
+
+		It("Should fail for pk-uuid fields that are not strings", func() {
+			type Session struct {
+				Id uint64 `db:"pk-uuid"`
+			}
+
+			_, err := buildInfo(&Session{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_uuid_field"))
+		})
+	})
+
+	Describe("Array attributes", func() {
+		It("Should mark array fields as attributes", func() {
+			type Model struct {
+				Id   uint64
+				Tags []string `db:"array"`
+				Ids  []*int64 `db:"array"`
+			}
+
+			infos, err := buildInfo(&Model{})
+			Expect(err).ToNot(HaveOccurred())
+			info := infos.Get("models")
+			Expect(info.Attribute("Tags").BackendArray()).To(BeTrue())
+			Expect(info.Attribute("Ids").BackendArray()).To(BeTrue())
+		})
+
+		It("Should fail for array fields with struct items", func() {
+			type Item struct{ Id uint64 }
+			type Model struct {
+				Id    uint64
+				Items []Item `db:"array"`
+			}
+
+			_, err := buildInfo(&Model{}, &Item{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_array_field"))
+		})
+
+		It("Should fail for array fields that are not slices", func() {
+			type Model struct {
+				Id   uint64
+				Tags string `db:"array"`
+			}
+
+			_, err := buildInfo(&Model{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_array_field"))
+		})
+
+		It("Should format and parse array literals", func() {
+			literal := FormatArrayLiteral([]string{"a", "b c", `"q"`})
+			Expect(literal).To(Equal(`{"a","b c","\"q\""}`))
+
+			one := 1
+			Expect(FormatArrayLiteral([]*int{&one, nil})).To(Equal(`{"1",NULL}`))
+
+			items, err := ParseArrayLiteral(literal)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(items).To(HaveLen(3))
+			Expect(*items[2]).To(Equal(`"q"`))
+
+			items, err = ParseArrayLiteral("{1, NULL,3}")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(items).To(HaveLen(3))
+			Expect(*items[0]).To(Equal("1"))
+			Expect(items[1]).To(BeNil())
+
+			_, err = ParseArrayLiteral("1,2")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Unique-where", func() {
+		It("Should resolve the unique-where predicate and skip the unique constraint", func() {
+			type Subscriber struct {
+				Id        uint64
+				Email     string     `db:"unique;unique-where:DeletedAt IS NULL"`
+				DeletedAt *time.Time `db:"soft-delete"`
+			}
+
+			infos, err := buildInfo(&Subscriber{})
+			Expect(err).ToNot(HaveOccurred())
+			info := infos.Get("subscribers")
+
+			field, operator := info.Attribute("Email").UniqueWhere()
+			Expect(field).To(Equal("deleted_at"))
+			Expect(operator).To(Equal("is null"))
+			Expect(info.Attribute("Email").BuildFieldExpression().Constraints()).To(BeEmpty())
+		})
+
+		It("Should fail for invalid predicates", func() {
+			type Subscriber struct {
+				Id    uint64
+				Email string `db:"unique;unique-where:deleted_at = 1"`
+			}
+
+			_, err := buildInfo(&Subscriber{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_unique_where"))
+		})
+
+		It("Should fail for attributes that are not unique", func() {
+			type Subscriber struct {
+				Id        uint64
+				Email     string `db:"unique-where:deleted_at IS NOT NULL"`
+				DeletedAt *time.Time
+			}
+
+			_, err := buildInfo(&Subscriber{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.GetCode()).To(Equal("invalid_unique_where"))
+		})
+	})
+
+	Describe("Transient attributes", func() {
+		It("Should exclude transient fields from the backend data but marshal them", func() {
+			type Child struct{ Id uint64 }
+			type Model struct {
+				Id    uint64
+				Name  string
+				Cache string `db:"transient"`
+				Child *Child `db:"transient"`
+			}
+
+			infos, err := buildInfo(&Model{})
+			Expect(err).ToNot(HaveOccurred())
+
+			info := infos.Get("models")
+			Expect(info.HasAttribute("Cache")).To(BeFalse())
+			Expect(info.HasRelation("Child")).To(BeFalse())
+			Expect(info.TransientAttribute("Cache")).ToNot(BeNil())
+
+			m := &Model{Id: 1, Name: "x", Cache: "cached"}
+
+			data, err := info.ModelToMap(m, true, false, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal(map[string]interface{}{"id": uint64(1), "name": "x"}))
+
+			data, err = info.ModelToMap(m, false, true, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveKeyWithValue("cache", "cached"))
+			Expect(data).To(HaveKeyWithValue("child", (*Child)(nil)))
+		})
+	})
+
+	Describe("Attribute equality", func() {
+		It("Should compare only the attribute values with EqualAttributes()", func() {
+			type Child struct{ Id uint64 }
+			type Model struct {
+				Id        uint64
+				Name      string
+				CreatedAt time.Time
+				Cache     string `db:"transient"`
+
+				Children []Child `db:"m2m"`
+			}
+
+			infos, err := buildInfo(&Model{}, &Child{})
+			Expect(err).ToNot(HaveOccurred())
+			info := infos.Get("models")
+
+			now := time.Now()
+			a := &Model{Id: 1, Name: "x", CreatedAt: now, Cache: "a"}
+			b := Model{Id: 1, Name: "x", CreatedAt: now.UTC(), Children: []Child{{Id: 2}}}
+			Expect(info.EqualAttributes(a, b)).To(BeTrue())
+
+			b.Name = "y"
+			Expect(info.EqualAttributes(a, b)).To(BeFalse())
+			Expect(info.EqualAttributes(a, &Child{})).To(BeFalse())
+		})
+	})
+
+	Describe("Meta", func() {
+		It("Should store arbitrary metadata", func() {
+			type Model struct {
+				Id uint64
+			}
+
+			infos, err := buildInfo(&Model{})
+			Expect(err).ToNot(HaveOccurred())
+			info := infos.Get("models")
+
+			Expect(info.Meta("label")).To(BeNil())
+			info.SetMeta("label", "Models")
+			Expect(info.Meta("label")).To(Equal("Models"))
+		})
 	})
 })
@@ -1,16 +1,29 @@
 package dukedb
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/theduke/go-apperror"
+	"github.com/theduke/go-reflector"
 	"github.com/theduke/go-utils"
 
 	. "github.com/theduke/go-dukedb/expressions"
 )
 
+// Read consistency levels for Query.Consistency().
+// CONSISTENCY_DEFAULT leaves the choice to the backend.
+const (
+	CONSISTENCY_DEFAULT  = ""
+	CONSISTENCY_STRONG   = "strong"
+	CONSISTENCY_EVENTUAL = "eventual"
+)
+
 /**
  * Query.
  */
@@ -41,6 +54,45 @@ type Query struct {
 	joinResultAssigner JoinAssigner
 
 	rawResult []interface{}
+
+	// fieldAliases holds the names of custom, named field expressions
+	// (like an aliased COUNT) that can be referenced by sorts and filters.
+	// It is populated by Normalize().
+	fieldAliases map[string]bool
+
+	// allowAll must be set with AllowAll() to update or delete with
+	// a query that has no filter.
+	allowAll bool
+
+	// withHidden disables the default fields of the collection.
+	withHidden bool
+
+	// consistency is the requested read consistency, one of the
+	// CONSISTENCY_* constants.
+	consistency string
+
+	// skipErrors makes the query skip rows that can not be converted to
+	// models. The errors are collected in rowErrors.
+	skipErrors bool
+	rowErrors  []apperror.Error
+
+	// withDeleted disables the filter for soft deleted models.
+	withDeleted bool
+
+	// onlyTrashed restricts the result to soft deleted models.
+	onlyTrashed bool
+
+	// softDeleteFiltered is true once Normalize() added the filter for
+	// soft deleted models.
+	softDeleteFiltered bool
+
+	// withoutRelations holds always-load relations that are not preloaded.
+	withoutRelations []string
+
+	// isRelation is true for the queries of relation queries, which do not
+	// preload always-load relations, so relations that always load each
+	// other do not recurse.
+	isRelation bool
 }
 
 func NewQuery(collection string, backend Backend) *Query {
@@ -52,6 +104,23 @@ func NewQuery(collection string, backend Backend) *Query {
 	}
 }
 
+// Clone returns a deep copy of the query, so fields, filters, sorts, limits
+// and joins can be changed without affecting the original query.
+// Only the backend and the attached models are shared with the original.
+func (q *Query) Clone() *Query {
+	clone := *q
+	clone.statement = q.statement.Clone()
+	clone.fieldAliases = nil
+	clone.withoutRelations = append([]string(nil), q.withoutRelations...)
+
+	clone.joins = make(map[string]*RelationQuery, len(q.joins))
+	for name, join := range q.joins {
+		clone.joins[name] = join.clone(&clone)
+	}
+
+	return &clone
+}
+
 func (q *Query) GetStatement() *SelectStmt {
 	return q.statement
 }
@@ -124,6 +193,22 @@ func (q *Query) GetOffset() int {
 	return q.statement.Offset()
 }
 
+/**
+ * Pagination.
+ */
+
+// Paginate sets the limit and offset for the given page, starting at 1.
+// Pages smaller than 1 are treated as the first page.
+// Use FindPaginated() to also retrieve the total count.
+func (q *Query) Paginate(page, perPage int) *Query {
+	if page < 1 {
+		page = 1
+	}
+	q.Limit(perPage)
+	q.Offset((page - 1) * perPage)
+	return q
+}
+
 /**
  * Fields methods.
  */
@@ -135,6 +220,13 @@ func (q *Query) Field(fields ...string) *Query {
 	return q
 }
 
+// FieldAs selects a field under a different name.
+// The result maps of Pluck() will use the alias as key.
+func (q *Query) FieldAs(field, alias string) *Query {
+	q.statement.AddField(NewFieldSelectorExpr(alias, NewIdExpr(field), nil))
+	return q
+}
+
 func (q *Query) FieldExpr(exprs ...Expression) *Query {
 	q.statement.AddField(exprs...)
 	return q
@@ -150,6 +242,18 @@ func (q *Query) SetFieldExpressions(expressions []Expression) *Query {
 	return q
 }
 
+// WithHidden selects all fields of the collection, including the ones
+// excluded by ModelInfo.SetDefaultFields().
+// Has no effect if fields were specified explicitly.
+func (q *Query) WithHidden() *Query {
+	q.withHidden = true
+	return q
+}
+
+func (q *Query) GetWithHidden() bool {
+	return q.withHidden
+}
+
 /**
  * Sort methods.
  */
@@ -159,6 +263,49 @@ func (q *Query) Sort(field string, asc bool) *Query {
 	return q
 }
 
+// SortNulls sorts by a field and places null values first or last.
+// The memory backend places nil values accordingly, the SQL backend emits
+// NULLS FIRST/LAST, which is emulated for MySQL.
+func (q *Query) SortNulls(field string, asc bool, nullsFirst bool) *Query {
+	sort := NewSortExpr(NewIdExpr(field), asc)
+	if nullsFirst {
+		sort.SetNulls(NULLS_FIRST)
+	} else {
+		sort.SetNulls(NULLS_LAST)
+	}
+	q.statement.AddSort(sort)
+	return q
+}
+
+// SortRaw adds a raw sort fragment, like "LENGTH(name) DESC", that is
+// passed to the backend as is.
+func (q *Query) SortRaw(fragment string) *Query {
+	q.statement.AddSort(NewRawSortExpr(fragment))
+	return q
+}
+
+// OrderByIds sorts the result in the order of the given ids, for example to
+// preserve the order of the ids used with an IN filter.
+// Items with other values for field are sorted last.
+func (q *Query) OrderByIds(field string, ids []interface{}) *Query {
+	if len(ids) == 0 {
+		return q
+	}
+
+	order := NewCaseExpr(NewValueExpr(len(ids)))
+	for index, id := range ids {
+		order.When(NewFieldValFilter(q.collection, field, OPERATOR_EQ, id), NewValueExpr(index))
+	}
+	return q.SortExpr(NewSortExpr(order, true))
+}
+
+// SortByRelationCount sorts by the number of related models of a relation.
+// For example, Q("projects").SortByRelationCount("Todos", false) returns the
+// projects with the most tasks first.
+func (q *Query) SortByRelationCount(relationName string, asc bool) *Query {
+	return q.SortExpr(NewSortExpr(NewFuncExpr("COUNT", NewIdExpr(relationName)), asc))
+}
+
 func (q *Query) SortExpr(expr *SortExpr) *Query {
 	q.statement.AddSort(expr)
 	return q
@@ -169,6 +316,149 @@ func (q *Query) SetSorts(exprs []*SortExpr) *Query {
 	return q
 }
 
+/**
+ * Group methods.
+ */
+
+// Group the result by the given fields.
+func (q *Query) Group(fields ...string) *Query {
+	for _, field := range fields {
+		q.statement.AddGroupBy(NewIdExpr(field))
+	}
+	return q
+}
+
+func (q *Query) GroupExpr(exprs ...Expression) *Query {
+	q.statement.AddGroupBy(exprs...)
+	return q
+}
+
+// Having filters the groups of a grouped query.
+// field may be an attribute, the alias of a selected field expression, or
+// "count" for the number of rows in each group:
+//
+//	Q("tasks").Group("project_id").Having("count", ">", 5)
+func (q *Query) Having(field, operator string, val interface{}) *Query {
+	return q.HavingExpr(NewFieldValFilter(q.collection, field, operator, val))
+}
+
+// HavingExpr adds an arbitrary having filter expression.
+func (q *Query) HavingExpr(expr Expression) *Query {
+	q.statement.HavingAnd(expr)
+	return q
+}
+
+func (q *Query) GetGroupBy() []Expression {
+	return q.statement.GroupBy()
+}
+
+func (q *Query) IsGrouped() bool {
+	return len(q.statement.GroupBy()) > 0
+}
+
+/**
+ * Distinct methods.
+ */
+
+// Distinct selects the given fields and removes duplicate rows, for
+// example to get all distinct project ids used by tasks:
+//
+//	Q("tasks").Distinct("project_id").Pluck()
+func (q *Query) Distinct(fields ...string) *Query {
+	q.statement.SetDistinct(true)
+	return q.Field(fields...)
+}
+
+func (q *Query) IsDistinct() bool {
+	return q.statement.IsDistinct()
+}
+
+// LatestPer restricts the result to one row for each distinct value of
+// groupField, namely the one with the highest value for orderField.
+// The sorts are prepended with groupField ascending and orderField descending.
+//
+// Backend specific behaviour:
+// Postgres uses DISTINCT ON (groupField).
+// Other SQL databases emulate it with a correlated subquery that selects the
+// primary key of the latest row in each group, so the collection must have a
+// single primary key.
+// The memory backend picks the maximum for each group itself.
+func (q *Query) LatestPer(groupField, orderField string) *Query {
+	q.statement.SetDistinctOn([]Expression{NewIdExpr(groupField)})
+
+	sorts := []*SortExpr{
+		NewSortExpr(NewIdExpr(groupField), true),
+		NewSortExpr(NewIdExpr(orderField), false),
+	}
+	q.statement.SetSorts(append(sorts, q.statement.Sorts()...))
+
+	return q
+}
+
+/**
+ * Index hints.
+ */
+
+// IndexHint tells the database to use, force or ignore an index.
+// mode must be one of INDEX_HINT_USE, INDEX_HINT_FORCE or INDEX_HINT_IGNORE.
+//
+// Index hints are only emitted by the MySQL dialect of the SQL backend.
+// Other backends, including memory and Postgres, ignore them and log a
+// debug message.
+func (q *Query) IndexHint(index string, mode string) *Query {
+	q.statement.SetIndexHint(index, mode)
+	return q
+}
+
+// AllowAll allows UpdateByMap() and DeleteMany() to affect all rows of
+// the collection when the query has no filter.
+// Without it, they return a missing_filter error to prevent accidentally
+// updating or deleting a whole collection.
+func (q *Query) AllowAll() *Query {
+	q.allowAll = true
+	return q
+}
+
+func (q *Query) GetAllowAll() bool {
+	return q.allowAll
+}
+
+// SkipErrors makes the query skip rows that can not be converted to models,
+// for example because of invalid JSON in a marshalled field, instead of
+// failing the whole query.
+// The errors of skipped rows are available with GetRowErrors() after
+// the query was executed.
+func (q *Query) SkipErrors() *Query {
+	q.skipErrors = true
+	return q
+}
+
+func (q *Query) GetSkipErrors() bool {
+	return q.skipErrors
+}
+
+// GetRowErrors returns the errors of the rows skipped by the last execution
+// of a query with SkipErrors().
+func (q *Query) GetRowErrors() []apperror.Error {
+	return q.rowErrors
+}
+
+// Consistency requests a read consistency level for the query.
+// level must be one of CONSISTENCY_DEFAULT, CONSISTENCY_STRONG or
+// CONSISTENCY_EVENTUAL.
+//
+// Backends with replicas or eventual consistency can use it to route
+// strong reads to the primary, for example to read your own writes.
+// Backends that are always consistent, like memory and SQL, ignore it.
+func (q *Query) Consistency(level string) *Query {
+	q.consistency = level
+	return q
+}
+
+func (q *Query) GetConsistency() string {
+	return q.consistency
+}
+
 /**
  * Filter methods.
  */
@@ -213,6 +503,93 @@ func (q *Query) Filter(field string, val interface{}) *Query {
 	return q.FilterCond(field, OPERATOR_EQ, val)
 }
 
+// IsNull filters for models where the field is NULL.
+// For example, Q("files").IsNull("task_id") returns all files without a task.
+func (q *Query) IsNull(field string) *Query {
+	return q.FilterCond(field, OPERATOR_IS_NULL, nil)
+}
+
+// IsNotNull filters for models where the field is not NULL.
+func (q *Query) IsNotNull(field string) *Query {
+	return q.FilterCond(field, OPERATOR_IS_NOT_NULL, nil)
+}
+
+// WithDeleted includes soft deleted models in the result.
+// Without it, Normalize() filters out models of collections with a
+// soft-delete attribute that have a deletion time set.
+func (q *Query) WithDeleted() *Query {
+	q.withDeleted = true
+	return q
+}
+
+func (q *Query) GetWithDeleted() bool {
+	return q.withDeleted
+}
+
+// OnlyTrashed restricts the result to soft deleted models, which is useful
+// for restoring them.
+// Normalize() filters for models that have a deletion time set.
+func (q *Query) OnlyTrashed() *Query {
+	q.onlyTrashed = true
+	return q
+}
+
+func (q *Query) GetOnlyTrashed() bool {
+	return q.onlyTrashed
+}
+
+// WithoutRelation disables preloading the given always-load relations.
+func (q *Query) WithoutRelation(relations ...string) *Query {
+	q.withoutRelations = append(q.withoutRelations, relations...)
+	return q
+}
+
+func (q *Query) GetWithoutRelations() []string {
+	return q.withoutRelations
+}
+
+// HavingCount filters by the number of related models of a relation.
+// For example, Q("tasks").HavingCount("Tags", ">", 2) only returns tasks
+// with more than two tags.
+//
+// The relation count is turned into a COUNT subquery on the related
+// collection (or the pivot collection for m2m relations) by Normalize().
+func (q *Query) HavingCount(relationName string, operator string, n int) *Query {
+	return q.FilterExpr(NewFilter(NewFuncExpr("COUNT", NewIdExpr(relationName)), operator, NewValueExpr(n)))
+}
+
+// Search filters by a full text search for term in the given fields.
+// The SQL backend uses the native full text search on Postgres, and case
+// insensitive substring matching on other databases.
+// The memory backend does case insensitive substring matching.
+func (q *Query) Search(fields []string, term string) *Query {
+	exprs := make([]Expression, 0)
+	for _, field := range fields {
+		exprs = append(exprs, NewColFieldIdExpr(q.collection, field))
+	}
+	return q.FilterExpr(NewSearchExpr(term, exprs...))
+}
+
+// AfterCursor filters for keyset pagination with a composite cursor.
+// It matches the rows that come after values in the order of fields, where
+// directions holds true for ascending fields.
+// Add a unique tiebreaker like the primary key as the last field to not
+// skip or duplicate rows with equal sort values:
+//
+//	q.Sort("priority", false).Sort("id", true).
+//		AfterCursor([]string{"priority", "id"}, []interface{}{last.Priority, last.Id}, []bool{false, true})
+//
+// The Postgres dialect emits a row value comparison like (a, b) > (?, ?) if
+// all directions are equal. Otherwise, the equivalent OR/AND combination of
+// simple filters is used.
+func (q *Query) AfterCursor(fields []string, values []interface{}, directions []bool) *Query {
+	exprs := make([]Expression, 0)
+	for _, field := range fields {
+		exprs = append(exprs, NewColFieldIdExpr(q.collection, field))
+	}
+	return q.FilterExpr(NewCursorExpr(exprs, values, directions))
+}
+
 func (q *Query) AndExpr(filters ...Expression) *Query {
 	return q.FilterExpr(filters...)
 }
@@ -293,6 +670,14 @@ func (q *Query) JoinQ(jqs ...*RelationQuery) *Query {
 	return q
 }
 
+// Join loads the relation relationName for the resulting models.
+// The optional joinType defaults to JOIN_LEFT, which also returns models
+// without related models. With JOIN_INNER, those models are excluded.
+//
+// To-one relations are joined natively if the backend supports it.
+// To-many relations, and all relations on backends without native joins
+// like the memory backend, are loaded with a separate query. Inner joins
+// on those are enforced with a relation count filter on the main query.
 func (q *Query) Join(relationName string, joinType ...string) *Query {
 	typ := JOIN_LEFT
 	if len(joinType) > 0 {
@@ -305,6 +690,33 @@ func (q *Query) Join(relationName string, joinType ...string) *Query {
 	return q
 }
 
+// Preload loads the relations for the resulting models like Join(), but
+// always with a separate query per relation for all models, which avoids
+// duplicating the rows of the main query for to-one relations.
+// Nested relations like "Todos.Tags" preload each level, so loading
+// projects with their todos and the tags of the todos runs three queries.
+func (q *Query) Preload(relations ...string) *Query {
+	for _, name := range relations {
+		q.preload(name)
+	}
+	return q
+}
+
+func (q *Query) preload(relationName string) {
+	left, right := utils.StrSplitLeft(relationName, ".")
+
+	join := q.joins[left]
+	if join == nil {
+		join = RelQ(q, left, "", JOIN_LEFT)
+		q.JoinQ(join)
+	}
+	join.SetPreload(true)
+
+	if right != "" {
+		join.Query.preload(right)
+	}
+}
+
 // Retrieve a join query for the specified field.
 // Returns a *RelationQuery, or nil if not found.
 // Supports nested Joins like 'Parent.Tags'.
@@ -362,6 +774,32 @@ func (q *Query) Find(targetSlice ...interface{}) ([]interface{}, apperror.Error)
 	return q.backend.Query(q, targetSlice...)
 }
 
+// FindPaginated runs the query like Find(), and also returns the total
+// count of models matching the query without limit and offset.
+//
+//	tasks, total, err := backend.Q("tasks").Filter("done", false).Paginate(2, 20).FindPaginated()
+func (q *Query) FindPaginated(targetSlice ...interface{}) ([]interface{}, int, apperror.Error) {
+	if q.backend == nil {
+		panic("Calling .FindPaginated() on query without backend")
+	}
+
+	// Count on a clone, so limit and offset do not affect the total.
+	countQ := q.Clone()
+	countQ.GetStatement().SetLimit(0)
+	countQ.GetStatement().SetOffset(0)
+
+	total, err := q.backend.Count(countQ)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	models, err := q.backend.Query(q, targetSlice...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return models, total, nil
+}
+
 func (q *Query) First(targetModel ...interface{}) (interface{}, apperror.Error) {
 	if q.backend == nil {
 		panic("Calling .First() on query without backend")
@@ -384,6 +822,132 @@ func (q *Query) Pluck() ([]map[string]interface{}, apperror.Error) {
 	return q.backend.Pluck(q)
 }
 
+// PluckInto runs the query like Pluck(), and scans the resulting rows into
+// dest, which must be a pointer to a slice of structs or struct pointers.
+// The struct does not have to be registered with the backend.
+// Row keys are matched against the struct field names, backend names and
+// marshal names, and values are converted to the field types just like for
+// regular models.
+func (q *Query) PluckInto(dest interface{}) apperror.Error {
+	if q.backend == nil {
+		panic("Calling .PluckInto() on query without backend")
+	}
+
+	typ := reflect.TypeOf(dest)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Slice {
+		return apperror.New("invalid_pluck_target", fmt.Sprintf("PluckInto() requires a pointer to a slice, got %v", typ))
+	}
+	itemType := typ.Elem().Elem()
+	if itemType.Kind() == reflect.Ptr {
+		itemType = itemType.Elem()
+	}
+	if itemType.Kind() != reflect.Struct {
+		return apperror.New("invalid_pluck_target", fmt.Sprintf("PluckInto() requires a slice of structs, got %v", typ))
+	}
+
+	info, err := BuildModelInfo(reflect.New(itemType).Interface())
+	if err != nil {
+		return apperror.Wrap(err, "invalid_pluck_target")
+	}
+
+	// Pluck() does not normalize the query.
+	if err := q.Normalize(); err != nil {
+		return err
+	}
+	rows, err := q.backend.Pluck(q)
+	if err != nil {
+		return err
+	}
+
+	models := make([]interface{}, len(rows))
+	for i, row := range rows {
+		model, err := info.ModelFromMap(row)
+		if err != nil {
+			return err
+		}
+		models[i] = model
+	}
+	SetSlicePointer(dest, models)
+
+	return nil
+}
+
+// PluckColumn selects only the given field, and scans the values into dest,
+// which must be a pointer to a slice. Values are converted to the item type
+// of the slice, and nil values result in the zero value.
+//
+//	var ids []uint64
+//	err := backend.Q("tasks").Filter("project_id", 1).PluckColumn("id", &ids)
+func (q *Query) PluckColumn(field string, dest interface{}) apperror.Error {
+	if q.backend == nil {
+		panic("Calling .PluckColumn() on query without backend")
+	}
+
+	target := reflect.ValueOf(dest)
+	if !target.IsValid() || target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Slice {
+		return apperror.New("invalid_pluck_target", fmt.Sprintf("PluckColumn() requires a pointer to a slice, got %T", dest))
+	}
+	itemType := target.Elem().Type().Elem()
+
+	// The field is resolved, so the value can be found in the rows no matter
+	// which name the backend uses as key.
+	keys := []string{field}
+	if info := q.backend.ModelInfos().Find(q.collection); info != nil {
+		if attr := info.FindAttribute(field); attr != nil {
+			keys = []string{attr.BackendName(), attr.MarshalName(), attr.Name()}
+		}
+	}
+
+	pq := q.Clone()
+	pq.SetFields([]string{field})
+	// Pluck() does not normalize the query.
+	if err := pq.Normalize(); err != nil {
+		return err
+	}
+	rows, err := q.backend.Pluck(pq)
+	if err != nil {
+		return err
+	}
+
+	slice := reflect.MakeSlice(target.Elem().Type(), 0, len(rows))
+	for _, row := range rows {
+		val, ok := pluckColumnValue(row, keys)
+		if !ok {
+			return apperror.New("pluck_column_not_found", fmt.Sprintf("Field %v is missing in the plucked rows", field))
+		}
+
+		item := reflect.New(itemType).Elem()
+		if val != nil {
+			converted, err := reflector.Reflect(val).ConvertToType(itemType)
+			if err != nil {
+				return apperror.Wrap(err, "pluck_conversion_error",
+					fmt.Sprintf("Could not convert value of field %v to %v", field, itemType))
+			}
+			item.Set(reflect.ValueOf(converted))
+		}
+		slice = reflect.Append(slice, item)
+	}
+	target.Elem().Set(slice)
+
+	return nil
+}
+
+// pluckColumnValue returns the value of the first key present in the row.
+// Rows with a single value are returned as is.
+func pluckColumnValue(row map[string]interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		if val, ok := row[key]; ok {
+			return val, true
+		}
+	}
+	if len(row) == 1 {
+		for _, val := range row {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
 func (q *Query) Count() (int, apperror.Error) {
 	if q.backend == nil {
 		panic("Calling .Count() on query without backend")
@@ -391,6 +955,276 @@ func (q *Query) Count() (int, apperror.Error) {
 	return q.backend.Count(q)
 }
 
+// Shape returns a hash of the structure of the query: the collection, fields,
+// filter fields and operators, sorts and joins.
+// Queries that only differ in filter values, limit or offset have the same
+// shape, so it can be used to group queries for caching and metrics.
+// Returns an empty string if the query can not be normalized.
+func (q *Query) Shape() string {
+	if q.backend == nil {
+		panic("Calling .Shape() on query without backend")
+	}
+	return q.ShapeWith(q.backend.ModelInfos())
+}
+
+// ShapeWith is like Shape, but normalizes the query against the given model
+// info registry instead of the registry of the query's backend.
+func (q *Query) ShapeWith(infos ModelInfos) string {
+	shaped := q.Clone()
+	if err := shaped.NormalizeWith(infos); err != nil {
+		return ""
+	}
+	shape, err := shaped.shape()
+	if err != nil {
+		return ""
+	}
+
+	sum := sha1.Sum([]byte(shape))
+	return hex.EncodeToString(sum[:])
+}
+
+// shape translates the statement of the query and its joins with all values
+// replaced by placeholders.
+func (q *Query) shape() (string, apperror.Error) {
+	stmt := q.statement.Clone()
+	stmt.SetLimit(0)
+	stmt.SetOffset(0)
+
+	t := &shapeTranslator{}
+	t.SqlTranslator = NewSqlTranslator(t)
+	if err := t.PrepareExpression(stmt); err != nil {
+		return "", err
+	}
+	if err := t.Translate(stmt); err != nil {
+		return "", err
+	}
+
+	shape := t.String()
+	if q.statement.Limit() > 0 {
+		shape += " LIMIT ?"
+	}
+	if q.statement.Offset() > 0 {
+		shape += " OFFSET ?"
+	}
+
+	names := make([]string, 0, len(q.joins))
+	for name := range q.joins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		joinShape, err := q.joins[name].Query.shape()
+		if err != nil {
+			return "", err
+		}
+		shape += " JOIN " + name + " (" + joinShape + ")"
+	}
+
+	return shape, nil
+}
+
+// shapeTranslator is a SQL translator that writes placeholders instead of
+// collecting the values.
+// IN filters get a single placeholder, independent of the number of values.
+type shapeTranslator struct {
+	SqlTranslator
+}
+
+func (t *shapeTranslator) Translate(expression Expression) apperror.Error {
+	switch e := expression.(type) {
+	case *ValueExpr:
+		t.W("?")
+		return nil
+
+	case FilterExpression:
+		if e.Operator() == OPERATOR_IN {
+			if err := t.Translate(e.Field()); err != nil {
+				return err
+			}
+			t.W(" ", e.Operator(), " (?)")
+			return nil
+		}
+	}
+
+	return t.SqlTranslator.Translate(expression)
+}
+
+// Exists returns true if the query matches at least one row.
+// Unlike Count(), only the primary key of a single row is selected.
+func (q *Query) Exists() (bool, apperror.Error) {
+	if q.backend == nil {
+		panic("Calling .Exists() on query without backend")
+	}
+
+	info := q.backend.ModelInfo(q.collection)
+	if info == nil {
+		return false, &apperror.Err{
+			Public:  true,
+			Code:    "unknown_collection",
+			Message: fmt.Sprintf("Collection %v was not registered with the backend", q.collection),
+		}
+	}
+
+	exists := q.Clone()
+	exists.SetFieldExpressions(nil)
+	// Collections without a primary key, like pivots, select all fields,
+	// which is fine for a single row.
+	if pk := info.PkAttribute(); pk != nil {
+		exists.Field(pk.Name())
+	}
+	exists.SetSorts(nil)
+	exists.Offset(0)
+	exists.Limit(1)
+	// Pluck() does not normalize the query.
+	if err := exists.Normalize(); err != nil {
+		return false, err
+	}
+
+	rows, err := q.backend.Pluck(exists)
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// Sum returns the sum of field for the matched rows, or 0 if no rows match.
+func (q *Query) Sum(field string) (float64, apperror.Error) {
+	return q.aggregate("SUM", field)
+}
+
+// Avg returns the average of field for the matched rows, or 0 if no rows
+// match.
+func (q *Query) Avg(field string) (float64, apperror.Error) {
+	return q.aggregate("AVG", field)
+}
+
+// Min returns the minimum of field for the matched rows, or 0 if no rows
+// match.
+func (q *Query) Min(field string) (float64, apperror.Error) {
+	return q.aggregate("MIN", field)
+}
+
+// Max returns the maximum of field for the matched rows, or 0 if no rows
+// match.
+func (q *Query) Max(field string) (float64, apperror.Error) {
+	return q.aggregate("MAX", field)
+}
+
+// MinValue returns the minimum of field for the matched rows converted to
+// the type of the field, like a time.Time for date fields.
+// Returns nil if no rows match.
+func (q *Query) MinValue(field string) (interface{}, apperror.Error) {
+	return q.typedAggregate("MIN", field)
+}
+
+// MaxValue returns the maximum of field for the matched rows converted to
+// the type of the field, like a time.Time for date fields.
+// Returns nil if no rows match.
+func (q *Query) MaxValue(field string) (interface{}, apperror.Error) {
+	return q.typedAggregate("MAX", field)
+}
+
+// aggregate computes an aggregate function over a numeric field on a clone
+// of the query.
+func (q *Query) aggregate(function, field string) (float64, apperror.Error) {
+	val, err := q.aggregateValue(function, field, reflect.TypeOf(float64(0)))
+	if err != nil {
+		return 0, err
+	} else if val == nil {
+		return 0, nil
+	}
+
+	converted, err2 := reflector.R(val).ConvertTo(float64(0))
+	if err2 != nil {
+		return 0, apperror.Wrap(err2, "aggregate_conversion_error")
+	}
+	return converted.(float64), nil
+}
+
+// typedAggregate computes an aggregate function on a clone of the query and
+// converts the result to the type of the field.
+func (q *Query) typedAggregate(function, field string) (interface{}, apperror.Error) {
+	val, err := q.aggregateValue(function, field, nil)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	typ := q.backend.ModelInfo(q.collection).FindAttribute(field).Type()
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if reflect.TypeOf(val) == typ {
+		return val, nil
+	}
+
+	converted, err2 := reflector.R(val).ConvertTo(reflect.New(typ).Elem().Interface())
+	if err2 != nil {
+		return nil, apperror.Wrap(err2, "aggregate_conversion_error")
+	}
+	return converted, nil
+}
+
+// aggregateValue computes an aggregate function over a field on a clone of
+// the query and returns the raw result, or nil if no rows match.
+// If typ is nil, the type of the field is used for the result.
+func (q *Query) aggregateValue(function, field string, typ reflect.Type) (interface{}, apperror.Error) {
+	if q.backend == nil {
+		panic(fmt.Sprintf("Calling .%v() on query without backend", strings.Title(strings.ToLower(function))))
+	}
+
+	info := q.backend.ModelInfo(q.collection)
+	if info == nil {
+		return nil, &apperror.Err{
+			Public:  true,
+			Code:    "unknown_collection",
+			Message: fmt.Sprintf("Collection %v was not registered with the backend", q.collection),
+		}
+	}
+	attr := info.FindAttribute(field)
+	if attr == nil {
+		return nil, &apperror.Err{
+			Public:  true,
+			Code:    "unknown_field",
+			Message: fmt.Sprintf("The collection %v does not have a field %v", info.Collection(), field),
+		}
+	}
+	if typ == nil {
+		typ = attr.Type()
+	}
+
+	fn := NewFuncExpr(function, NewColFieldIdExpr(info.BackendName(), attr.BackendName()))
+
+	agg := q.Clone()
+	agg.SetFieldExpressions([]Expression{NewFieldSelectorExpr("value", fn, typ)})
+	agg.SetSorts(nil)
+	// Pluck() does not normalize the query.
+	if err := agg.Normalize(); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.backend.Pluck(agg)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 1 {
+		return nil, nil
+	}
+	v := reflect.ValueOf(rows[0]["value"])
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	val := v.Interface()
+	if raw, ok := val.([]byte); ok {
+		// Some drivers return numeric values as text.
+		val = string(raw)
+	}
+	return val, nil
+}
+
 func (q *Query) Delete() apperror.Error {
 	if q.backend == nil {
 		panic("Calling .Delete() on query without backend")
@@ -398,6 +1232,168 @@ func (q *Query) Delete() apperror.Error {
 	return q.backend.DeleteMany(q)
 }
 
+// Chunk runs the query in batches of the given size and calls fn with each
+// batch, until all results were processed or fn returns an error.
+//
+// If the query is not sorted, or only sorted ascending by the primary key,
+// the batches are fetched with a filter on the primary key (keyset
+// pagination), which is not affected by concurrent inserts or deletes.
+// Composite primary keys use a cursor over all primary key fields.
+// Otherwise, limit and offset are used.
+// A limit and offset set on the query are respected.
+func (q *Query) Chunk(size int, fn func(batch []interface{}) apperror.Error) apperror.Error {
+	if q.backend == nil {
+		panic("Calling .Chunk() on query without backend")
+	}
+	if size < 1 {
+		return apperror.New("invalid_chunk_size", "Chunk size must be greater than 0")
+	}
+
+	info := q.backend.ModelInfos().Find(q.collection)
+	if info == nil {
+		return &apperror.Err{
+			Public:  true,
+			Code:    "unknown_collection",
+			Message: fmt.Sprintf("Collection %v was not registered with the backend", q.collection),
+		}
+	}
+
+	s := q.GetStatement()
+	limit := s.Limit()
+	offset := s.Offset()
+
+	pks := info.PkAttributes()
+	keyset := len(pks) > 0 && offset == 0 && q.isSortedByPk(info)
+	directions := make([]bool, len(pks))
+	for i := range directions {
+		directions[i] = true
+	}
+
+	var lastId interface{}
+	processed := 0
+	for {
+		batchSize := size
+		if limit > 0 && limit-processed < batchSize {
+			batchSize = limit - processed
+		}
+		if batchSize < 1 {
+			return nil
+		}
+
+		// Each batch runs on a clone, so the query itself is not modified.
+		batchQ := q.Clone()
+		if keyset {
+			if len(s.Sorts()) == 0 {
+				for _, pk := range pks {
+					batchQ.Sort(pk.Name(), true)
+				}
+			}
+			if lastId != nil {
+				values := []interface{}{lastId}
+				if len(pks) > 1 {
+					ids, err := info.compositeId(lastId)
+					if err != nil {
+						return err
+					}
+					values = ids
+				}
+				batchQ.AfterCursor(attributeNames(pks), values, directions)
+			}
+			batchQ.Offset(0)
+		} else {
+			batchQ.Offset(offset + processed)
+		}
+		batchQ.Limit(batchSize)
+
+		batch, err := q.backend.Query(batchQ)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := fn(batch); err != nil {
+			return err
+		}
+
+		processed += len(batch)
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		if keyset {
+			lastId, err = info.DetermineModelId(batch[len(batch)-1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// EachRow runs the query and calls fn with the raw data map of each row,
+// until all rows were processed or fn returns an error.
+// Backends that support it stream the rows from a cursor, which is closed
+// when EachRow returns.
+func (q *Query) EachRow(fn func(row map[string]interface{}) apperror.Error) apperror.Error {
+	if q.backend == nil {
+		panic("Calling .EachRow() on query without backend")
+	}
+	return q.backend.EachRow(q, fn)
+}
+
+// Each runs the query and calls fn with each model, until all models were
+// processed or fn returns an error.
+// Like EachRow(), the models are streamed from a cursor if the backend
+// supports it.
+func (q *Query) Each(fn func(model interface{}) error) apperror.Error {
+	if q.backend == nil {
+		panic("Calling .Each() on query without backend")
+	}
+	return q.backend.Each(q, func(model interface{}) apperror.Error {
+		if err := fn(model); err != nil {
+			if appErr, ok := err.(apperror.Error); ok {
+				return appErr
+			}
+			return apperror.Wrap(err, "each_callback_error")
+		}
+		return nil
+	})
+}
+
+// isSortedByPk returns true if the query has no sorts, or is only sorted
+// ascending by all primary key fields, in the order of PkAttributes().
+func (q *Query) isSortedByPk(info *ModelInfo) bool {
+	sorts := q.GetStatement().Sorts()
+	if len(sorts) == 0 {
+		return true
+	}
+
+	pks := info.PkAttributes()
+	if len(sorts) != len(pks) {
+		return false
+	}
+	for i, sort := range sorts {
+		if !sort.Ascending() {
+			return false
+		}
+
+		var name string
+		switch e := sort.Expression().(type) {
+		case *IdentifierExpr:
+			name = e.Identifier()
+		case *ColFieldIdentifierExpr:
+			name = e.Field()
+		default:
+			return false
+		}
+		if info.FindAttribute(name) != pks[i] {
+			return false
+		}
+	}
+	return true
+}
+
 /**
  * RelationQuery.
  */
@@ -410,12 +1406,17 @@ type RelationQuery struct {
 
 	localField   string
 	foreignField string
+
+	// preload is true for joins added with Preload(), which are always
+	// loaded with a separate query.
+	preload bool
 }
 
 func RelQ(q *Query, relationName string, collection string, joinType string) *RelationQuery {
 	joinStmt := NewJoinStmt(collection, joinType, nil)
 	newQ := NewQuery(collection, q.backend)
 	newQ.SetStatement(joinStmt.SelectStatement())
+	newQ.isRelation = true
 
 	relQ := &RelationQuery{
 		Query:        *newQ,
@@ -448,6 +1449,7 @@ func RelQExpr(q *Query, collection, typ string, joinCondition Expression) *Relat
 	joinStmt := NewJoinStmt(collection, typ, joinCondition)
 	newQ := NewQuery(collection, q.backend)
 	newQ.SetStatement(joinStmt.SelectStatement())
+	newQ.isRelation = true
 
 	relQ := &RelationQuery{
 		Query:     *newQ,
@@ -460,6 +1462,22 @@ func RelQExpr(q *Query, collection, typ string, joinCondition Expression) *Relat
 
 // RelationQuery specific methods.
 
+// clone returns a deep copy of the relation query for the given base query.
+func (q *RelationQuery) clone(baseQuery *Query) *RelationQuery {
+	clone := *q
+	clone.Query = *q.Query.Clone()
+	clone.statement = q.statement.Clone()
+	clone.Query.statement = clone.statement.SelectStatement()
+	clone.baseQuery = baseQuery
+
+	// Nested joins must reference the copied query.
+	for _, join := range clone.joins {
+		join.baseQuery = &clone.Query
+	}
+
+	return &clone
+}
+
 func (q *RelationQuery) GetStatement() *JoinStmt {
 	return q.statement
 }
@@ -489,6 +1507,36 @@ func (q *RelationQuery) SetJoinType(typ string) *RelationQuery {
 	return q
 }
 
+// GetLocalField returns the field of the joined models that is matched with
+// GetForeignField() of the base models when assigning the join results.
+func (q *RelationQuery) GetLocalField() string {
+	return q.localField
+}
+
+func (q *RelationQuery) SetLocalField(field string) {
+	q.localField = field
+}
+
+// GetForeignField returns the field of the base models that is matched
+// with GetLocalField() of the joined models.
+func (q *RelationQuery) GetForeignField() string {
+	return q.foreignField
+}
+
+func (q *RelationQuery) SetForeignField(field string) {
+	q.foreignField = field
+}
+
+// GetPreload returns true if the relation is loaded with a separate query,
+// even if the backend could join it natively.
+func (q *RelationQuery) GetPreload() bool {
+	return q.preload
+}
+
+func (q *RelationQuery) SetPreload(preload bool) {
+	q.preload = preload
+}
+
 func (q *RelationQuery) Build() (*Query, apperror.Error) {
 	if q.backend == nil {
 		panic("Calling .Build() on a query without backend")
@@ -527,23 +1575,135 @@ func (q *RelationQuery) Last(targetModel ...interface{}) (interface{}, apperror.
 		panic("Calling .Last() on a query without backend")
 	}
 
-	newQ, err := q.backend.BuildRelationQuery(q)
-	if err != nil {
-		return nil, err
+	newQ, err := q.backend.BuildRelationQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return newQ.Last(targetModel...)
+}
+
+func (q *RelationQuery) Count() (int, apperror.Error) {
+	if q.backend == nil {
+		panic("Calling .Count() on a query without backend")
+	}
+
+	newQ, err := q.backend.BuildRelationQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	return newQ.Count()
+}
+
+// CountRelated returns the number of related models of all models matched
+// by the base query, without loading them.
+// For m2m relations, the entries of the m2m collection are counted, so the
+// related models do not have to be joined.
+func (q *RelationQuery) CountRelated() (int, apperror.Error) {
+	if q.backend == nil {
+		panic("Calling .CountRelated() on a query without backend")
+	}
+
+	relation := q.relation()
+	if relation == nil {
+		return 0, apperror.New("invalid_join_query_unknown_relation",
+			fmt.Sprintf("Unknown relation %v.%v", q.GetBaseQuery().GetCollection(), q.GetRelationName()))
+	}
+
+	if relation.RelationType() == RELATION_TYPE_M2M {
+		return q.countM2M(relation)
+	}
+
+	newQ, err := q.backend.BuildRelationQuery(q)
+	if err != nil {
+		if apperror.IsCode(err, "relation_query_on_empty_result") || apperror.IsCode(err, "relation_on_empty_result") {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return newQ.Count()
+}
+
+// countM2M counts the entries of the m2m collection for all base models with
+// a single query, grouped by the local key.
+// If the base query has no models, only the local keys are loaded.
+func (q *RelationQuery) countM2M(relation *Relation) (int, apperror.Error) {
+	if len(relation.LocalFields()) > 1 {
+		return 0, compositeM2MErr(relation)
+	}
+
+	keys := make([]interface{}, 0)
+	if models := q.GetBaseQuery().GetModels(); len(models) > 0 {
+		for _, model := range models {
+			key, err := relationLocalValue(relation, model)
+			if err != nil {
+				return 0, err
+			}
+			keys = append(keys, key)
+		}
+	} else {
+		attr := relation.Model().FindAttribute(relation.LocalField())
+		if attr == nil {
+			return 0, apperror.New("unknown_field",
+				fmt.Sprintf("The collection %v does not have a field %v", relation.Model().Collection(), relation.LocalField()))
+		}
+		slice := reflect.New(reflect.SliceOf(attr.Type()))
+		if err := q.GetBaseQuery().PluckColumn(attr.Name(), slice.Interface()); err != nil {
+			return 0, err
+		}
+		for i := 0; i < slice.Elem().Len(); i++ {
+			keys = append(keys, slice.Elem().Index(i).Interface())
+		}
+	}
+	if len(keys) < 1 {
+		return 0, nil
+	}
+
+	pivotField := relation.PivotLocalFields()[0]
+	countQ := q.backend.Q(relation.BackendName()).
+		FilterCond(pivotField, OPERATOR_IN, keys).
+		Group(pivotField).
+		Field(pivotField).
+		FieldExpr(NewFieldSelectorExpr("count", NewFuncExpr("COUNT", NewTextExpr("*")), reflect.TypeOf(0)))
+	// Pluck() does not normalize the query.
+	if err := countQ.Normalize(); err != nil {
+		return 0, err
+	}
+	rows, err := countQ.Pluck()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, row := range rows {
+		n, err := reflector.R(row["count"]).ConvertTo(0)
+		if err != nil {
+			return 0, apperror.Wrap(err, "count_conversion_error")
+		}
+		count += n.(int)
+	}
+	return count, nil
+}
+
+// relation returns the relation of the query, or nil if the base collection
+// or the relation is unknown.
+func (q *RelationQuery) relation() *Relation {
+	info := q.backend.ModelInfo(q.GetBaseQuery().GetCollection())
+	if info == nil {
+		return nil
 	}
-	return newQ.Last(targetModel...)
+	return info.Relation(q.GetRelationName())
 }
 
-func (q *RelationQuery) Count() (int, apperror.Error) {
+func (q *RelationQuery) Exists() (bool, apperror.Error) {
 	if q.backend == nil {
-		panic("Calling .Count() on a query without backend")
+		panic("Calling .Exists() on a query without backend")
 	}
 
 	newQ, err := q.backend.BuildRelationQuery(q)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	return newQ.Count()
+	return newQ.Exists()
 }
 
 func (q *RelationQuery) Delete() apperror.Error {
@@ -578,6 +1738,11 @@ func (q *RelationQuery) Offset(o int) *RelationQuery {
 	return q
 }
 
+func (q *RelationQuery) Paginate(page, perPage int) *RelationQuery {
+	q.Query.Paginate(page, perPage)
+	return q
+}
+
 /**
  * Fields methods.
  */
@@ -587,6 +1752,11 @@ func (q *RelationQuery) Field(fields ...string) *RelationQuery {
 	return q
 }
 
+func (q *RelationQuery) FieldAs(field, alias string) *RelationQuery {
+	q.Query.FieldAs(field, alias)
+	return q
+}
+
 func (q *RelationQuery) FieldExpr(exprs ...Expression) *RelationQuery {
 	q.Query.FieldExpr(exprs...)
 	return q
@@ -597,6 +1767,11 @@ func (q *RelationQuery) SetFields(fields []string) *RelationQuery {
 	return q
 }
 
+func (q *RelationQuery) WithHidden() *RelationQuery {
+	q.Query.WithHidden()
+	return q
+}
+
 func (q *RelationQuery) SetFieldExpressions(expressions []Expression) *RelationQuery {
 	q.Query.SetFieldExpressions(expressions)
 	return q
@@ -606,11 +1781,76 @@ func (q *RelationQuery) SetFieldExpressions(expressions []Expression) *RelationQ
  * Sort methods.
  */
 
+func (q *RelationQuery) Distinct(fields ...string) *RelationQuery {
+	q.Query.Distinct(fields...)
+	return q
+}
+
+func (q *RelationQuery) Group(fields ...string) *RelationQuery {
+	q.Query.Group(fields...)
+	return q
+}
+
+func (q *RelationQuery) GroupExpr(exprs ...Expression) *RelationQuery {
+	q.Query.GroupExpr(exprs...)
+	return q
+}
+
+func (q *RelationQuery) AfterCursor(fields []string, values []interface{}, directions []bool) *RelationQuery {
+	q.Query.AfterCursor(fields, values, directions)
+	return q
+}
+
+func (q *RelationQuery) Having(field, operator string, val interface{}) *RelationQuery {
+	q.Query.Having(field, operator, val)
+	return q
+}
+
+func (q *RelationQuery) HavingExpr(expr Expression) *RelationQuery {
+	q.Query.HavingExpr(expr)
+	return q
+}
+
 func (q *RelationQuery) Sort(name string, asc bool) *RelationQuery {
 	q.Query.Sort(name, asc)
 	return q
 }
 
+func (q *RelationQuery) SkipErrors() *RelationQuery {
+	q.Query.SkipErrors()
+	return q
+}
+
+func (q *RelationQuery) Consistency(level string) *RelationQuery {
+	q.Query.Consistency(level)
+	return q
+}
+
+func (q *RelationQuery) AllowAll() *RelationQuery {
+	q.Query.AllowAll()
+	return q
+}
+
+func (q *RelationQuery) SortNulls(name string, asc bool, nullsFirst bool) *RelationQuery {
+	q.Query.SortNulls(name, asc, nullsFirst)
+	return q
+}
+
+func (q *RelationQuery) SortRaw(fragment string) *RelationQuery {
+	q.Query.SortRaw(fragment)
+	return q
+}
+
+func (q *RelationQuery) OrderByIds(field string, ids []interface{}) *RelationQuery {
+	q.Query.OrderByIds(field, ids)
+	return q
+}
+
+func (q *RelationQuery) SortByRelationCount(relationName string, asc bool) *RelationQuery {
+	q.Query.SortByRelationCount(relationName, asc)
+	return q
+}
+
 func (q *RelationQuery) SortExpr(expr *SortExpr) *RelationQuery {
 	q.Query.SortExpr(expr)
 	return q
@@ -645,6 +1885,41 @@ func (q *RelationQuery) FilterCond(field string, condition string, val interface
 	return q
 }
 
+func (q *RelationQuery) IsNull(field string) *RelationQuery {
+	q.Query.IsNull(field)
+	return q
+}
+
+func (q *RelationQuery) IsNotNull(field string) *RelationQuery {
+	q.Query.IsNotNull(field)
+	return q
+}
+
+func (q *RelationQuery) WithDeleted() *RelationQuery {
+	q.Query.WithDeleted()
+	return q
+}
+
+func (q *RelationQuery) OnlyTrashed() *RelationQuery {
+	q.Query.OnlyTrashed()
+	return q
+}
+
+func (q *RelationQuery) WithoutRelation(relations ...string) *RelationQuery {
+	q.Query.WithoutRelation(relations...)
+	return q
+}
+
+func (q *RelationQuery) HavingCount(relationName string, operator string, n int) *RelationQuery {
+	q.Query.HavingCount(relationName, operator, n)
+	return q
+}
+
+func (q *RelationQuery) Search(fields []string, term string) *RelationQuery {
+	q.Query.Search(fields, term)
+	return q
+}
+
 func (q *RelationQuery) AndExpr(filters ...Expression) *RelationQuery {
 	q.Query.AndExpr(filters...)
 	return q
@@ -704,12 +1979,40 @@ func (q *RelationQuery) Join(fieldName string, joinType ...string) *RelationQuer
 	return q
 }
 
+func (q *RelationQuery) Preload(relations ...string) *RelationQuery {
+	q.Query.Preload(relations...)
+	return q
+}
+
 func (q *Query) Normalize() apperror.Error {
 	if q.backend == nil {
 		panic("Called .Normalize() on a query without a backend.")
 	}
+	return q.NormalizeWith(q.backend.ModelInfos())
+}
 
-	info := q.backend.ModelInfos().Find(q.collection)
+// NormalizedStatement normalizes the query and returns the resulting
+// statement, with field names resolved to backend names and relation
+// joins resolved.
+// Normalizing is idempotent, so this can be called on queries that were
+// already normalized.
+func (q *Query) NormalizedStatement() (*SelectStmt, apperror.Error) {
+	if err := q.Normalize(); err != nil {
+		return nil, err
+	}
+	return q.statement, nil
+}
+
+// NormalizeWith normalizes the query against the given model info registry
+// instead of the registry of the query's backend.
+// This allows to build and inspect the statement of a query without a
+// backend, for example in tests:
+//
+//	q := NewQuery("tasks", nil).Filter("Name", "x")
+//	err := q.NormalizeWith(infos)
+//	stmt := q.GetStatement()
+func (q *Query) NormalizeWith(infos ModelInfos) apperror.Error {
+	info := infos.Find(q.collection)
 	if info == nil {
 		return &apperror.Err{
 			Public:  true,
@@ -718,6 +2021,16 @@ func (q *Query) Normalize() apperror.Error {
 		}
 	}
 
+	switch q.consistency {
+	case CONSISTENCY_DEFAULT, CONSISTENCY_STRONG, CONSISTENCY_EVENTUAL:
+	default:
+		return &apperror.Err{
+			Public:  true,
+			Code:    "invalid_consistency_level",
+			Message: fmt.Sprintf("Unknown read consistency level %v", q.consistency),
+		}
+	}
+
 	// Normalize joins.
 
 	nestedJoins := make([]*RelationQuery, 0)
@@ -746,6 +2059,14 @@ func (q *Query) Normalize() apperror.Error {
 			}
 		}
 
+		if relation.IsPolymorphicOwner() {
+			return &apperror.Err{
+				Public:  true,
+				Code:    "unsupported_polymorphic_join",
+				Message: fmt.Sprintf("The polymorphic relation %v.%v can not be joined, use Related() instead", info.Collection(), relation.Name()),
+			}
+		}
+
 		if relation.Name() != relationName {
 			join.SetRelationName(relationName)
 			delete(q.joins, relationName)
@@ -753,6 +2074,13 @@ func (q *Query) Normalize() apperror.Error {
 		}
 	}
 
+	// Preload always-load relations.
+	if !q.isRelation {
+		if err := q.preloadAlwaysLoad(info); err != nil {
+			return err
+		}
+	}
+
 	// Now, move nested joins to their parent.
 	for _, join := range nestedJoins {
 		relationName := join.GetRelationName()
@@ -784,12 +2112,51 @@ func (q *Query) Normalize() apperror.Error {
 
 	s := q.GetStatement()
 
+	// Apply the default fields of the collection if no fields were specified.
+	if len(s.Fields()) == 0 && !q.withHidden {
+		for _, field := range info.DefaultFields() {
+			s.AddField(NewIdExpr(field))
+		}
+	}
+
 	// Normalize fields.
+	q.fieldAliases = make(map[string]bool)
 	fields := make([]Expression, 0)
 	for _, field := range s.Fields() {
+		// Resolve the field of aliased field selectors created with FieldAs().
+		if sel, ok := field.(*FieldSelectorExpr); ok {
+			if id, ok := sel.Expression().(*IdentifierExpr); ok {
+				attr := info.FindAttribute(id.Identifier())
+				if attr == nil {
+					return &apperror.Err{
+						Public:  true,
+						Code:    "unknown_field",
+						Message: fmt.Sprintf("The collection %v does not have a field %v", info.Collection(), id.Identifier()),
+					}
+				}
+				sel.SetExpression(NewColFieldIdExpr(info.BackendName(), attr.BackendName()))
+				sel.SetType(attr.Type())
+			} else if window, ok := sel.Expression().(*WindowExpr); ok {
+				if err := q.normalizeWindow(info, window); err != nil {
+					return err
+				}
+			} else if isComputedField(sel.Expression()) {
+				if _, err := q.normalizeIdentifiers(info, []Expression{sel.Expression()}); err != nil {
+					return err
+				}
+			}
+		}
+
 		id, ok := field.(*IdentifierExpr)
 		if !ok {
 			// Custom field, so just accept it.
+			// If it is named, remember the alias so sorts and filters
+			// can reference it.
+			if named, ok := field.(NamedExpression); ok && named.Name() != "" {
+				if info.FindAttribute(named.Name()) == nil {
+					q.fieldAliases[named.Name()] = true
+				}
+			}
 			fields = append(fields, field)
 			continue
 		}
@@ -850,8 +2217,24 @@ func (q *Query) Normalize() apperror.Error {
 	}
 	s.SetFields(fields)
 
+	// Filter out soft deleted models, or everything else with OnlyTrashed().
+	// A new AndExpr is built, since clones of the query share the filter.
+	if attr := info.SoftDeleteAttribute(); attr != nil && (q.onlyTrashed || !q.withDeleted) && !q.softDeleteFiltered {
+		operator := OPERATOR_IS_NULL
+		if q.onlyTrashed {
+			operator = OPERATOR_IS_NOT_NULL
+		}
+		filter := NewFieldValFilter(q.collection, attr.Name(), operator, nil)
+		if s.Filter() == nil {
+			s.SetFilter(filter)
+		} else {
+			s.SetFilter(NewAndExpr(s.Filter(), filter))
+		}
+		q.softDeleteFiltered = true
+	}
+
 	// Normalize Filters.
-	if err := q.normalizeFilter(info, s.Filter()); err != nil {
+	if err := q.normalizeFilter(infos, info, s.Filter()); err != nil {
 		return err
 	}
 
@@ -859,13 +2242,33 @@ func (q *Query) Normalize() apperror.Error {
 	sorts := make([]*SortExpr, 0)
 	for _, sort := range s.Sorts() {
 		expr := sort.Expression()
+		if order, ok := expr.(*CaseExpr); ok {
+			// Normalize the conditions of CASE sorts, like the ones
+			// created by OrderByIds().
+			for _, when := range order.Whens() {
+				if err := q.normalizeFilter(infos, info, when); err != nil {
+					return err
+				}
+			}
+		} else if count := q.relationCountStmt(info, expr); count != nil {
+			// Relation count added by SortByRelationCount().
+			sort.SetExpression(count)
+		}
+
 		id, ok := expr.(*IdentifierExpr)
 		if !ok {
 			// Custom sort, just add it.
 			sorts = append(sorts, sort)
+			continue
 		}
 
 		fieldName := id.Identifier()
+		if q.fieldAliases[fieldName] {
+			// Sort references an aliased field expression.
+			sorts = append(sorts, sort)
+			continue
+		}
+
 		left, right := utils.StrSplitLeft(fieldName, ".")
 		if right == "" {
 			// Not a nested field.
@@ -897,7 +2300,9 @@ func (q *Query) Normalize() apperror.Error {
 			}
 
 			// Add field to join.
-			join.Sort(right, sort.Ascending())
+			nested := NewSortExpr(NewIdExpr(right), sort.Ascending())
+			nested.SetNulls(sort.Nulls())
+			join.SortExpr(nested)
 			continue
 		}
 
@@ -919,36 +2324,205 @@ func (q *Query) Normalize() apperror.Error {
 			Message: fmt.Sprintf("Collection %v does not have a field %v", info.Collection(), fieldName),
 		}
 	}
+	s.SetSorts(sorts)
+
+	// Normalize group by.
+	groups, err := q.normalizeIdentifiers(info, s.GroupBy())
+	if err != nil {
+		return err
+	}
+	s.SetGroupBy(groups)
+
+	// Normalize having.
+	if having := s.Having(); having != nil {
+		q.normalizeHaving(info, having)
+		if err := q.normalizeFilter(infos, info, having); err != nil {
+			return err
+		}
+	}
+
+	// Normalize distinct on.
+	distinctOn, err := q.normalizeIdentifiers(info, s.DistinctOn())
+	if err != nil {
+		return err
+	}
+	s.SetDistinctOn(distinctOn)
+
+	return nil
+}
+
+// IsFieldAlias returns true if the given name references a named custom
+// field expression in the statement.
+// Only available after the query was normalized.
+func (q *Query) IsFieldAlias(name string) bool {
+	return q.fieldAliases[name]
+}
+
+// normalizeIdentifiers resolves a list of field identifiers, like group by
+// fields, to their backend names.
+// Custom expressions and aliases are kept as is.
+func (q *Query) normalizeIdentifiers(info *ModelInfo, exprs []Expression) ([]Expression, apperror.Error) {
+	normalized := make([]Expression, 0)
+	for _, expr := range exprs {
+		// Resolve the field of casts and date truncations, like
+		// CAST(created_at AS date).
+		if isComputedField(expr) {
+			nested := expr.(interface {
+				Expression() Expression
+				SetExpression(Expression)
+			})
+			inner, err := q.normalizeIdentifiers(info, []Expression{nested.Expression()})
+			if err != nil {
+				return nil, err
+			}
+			nested.SetExpression(inner[0])
+			normalized = append(normalized, expr)
+			continue
+		}
+
+		id, ok := expr.(*IdentifierExpr)
+		if !ok {
+			// Custom expression, just add it.
+			normalized = append(normalized, expr)
+			continue
+		}
+
+		fieldName := id.Identifier()
+		if q.fieldAliases[fieldName] {
+			normalized = append(normalized, expr)
+			continue
+		}
+
+		left, right := utils.StrSplitLeft(fieldName, ".")
+		attr := info.FindAttribute(left)
+		if attr == nil || (right != "" && !attr.BackendEmbed()) {
+			return nil, &apperror.Err{
+				Public:  true,
+				Code:    "unknown_field",
+				Message: fmt.Sprintf("The collection %v does not have a field %v", info.Collection(), fieldName),
+			}
+		}
+
+		backendName := attr.BackendName()
+		if right != "" {
+			backendName += "." + right
+		}
+		normalized = append(normalized, NewColFieldIdExpr(info.BackendName(), backendName))
+	}
+
+	return normalized, nil
+}
+
+// isComputedField returns true for expressions that compute a value from a
+// single field, like casts and date truncations.
+func isComputedField(expr Expression) bool {
+	switch expr.(type) {
+	case *CastExpr, *DateTruncExpr:
+		return true
+	}
+	return false
+}
+
+// normalizeHaving replaces having filter fields that reference the alias
+// of a selected field expression with the expression, since databases like
+// Postgres do not allow aliases in HAVING. A "count" field that is not an
+// attribute is replaced with COUNT(*).
+func (q *Query) normalizeHaving(info *ModelInfo, having Expression) {
+	switch f := having.(type) {
+	case *Filter:
+		name := ""
+		if id, ok := f.Field().(*ColFieldIdentifierExpr); ok {
+			name = id.Field()
+		} else if id, ok := f.Field().(*IdentifierExpr); ok {
+			name = id.Identifier()
+		}
+		if name == "" {
+			return
+		}
+
+		for _, field := range q.statement.Fields() {
+			named, ok := field.(NamedExpression)
+			if !ok || named.Name() != name {
+				continue
+			}
+			if nested, ok := field.(NestedExpression); ok {
+				f.SetField(nested.Expression())
+				return
+			}
+		}
+
+		if strings.ToLower(name) == "count" && info.FindAttribute(name) == nil {
+			f.SetField(NewFuncExpr("COUNT", NewTextExpr("*")))
+		}
+
+	case MultiExpression:
+		for _, e := range f.Expressions() {
+			q.normalizeHaving(info, e)
+		}
+
+	case NestedExpression:
+		q.normalizeHaving(info, f.Expression())
+	}
+}
+
+// normalizeWindow resolves the partition and sort fields of a window function.
+func (q *Query) normalizeWindow(info *ModelInfo, window *WindowExpr) apperror.Error {
+	partitions, err := q.normalizeIdentifiers(info, window.PartitionBy())
+	if err != nil {
+		return err
+	}
+	window.SetPartitionBy(partitions)
+
+	for _, sort := range window.Sorts() {
+		exprs, err := q.normalizeIdentifiers(info, []Expression{sort.Expression()})
+		if err != nil {
+			return err
+		}
+		sort.SetExpression(exprs[0])
+	}
 
 	return nil
 }
 
-func (q *Query) normalizeFilter(info *ModelInfo, filter Expression) apperror.Error {
+func (q *Query) normalizeFilter(infos ModelInfos, info *ModelInfo, filter Expression) apperror.Error {
 
 	switch f := filter.(type) {
 	case MultiExpression:
 		for _, e := range f.Expressions() {
-			if err := q.normalizeFilter(info, e); err != nil {
+			if err := q.normalizeFilter(infos, info, e); err != nil {
 				return err
 			}
 		}
 
 	case NestedExpression:
-		if err := q.normalizeFilter(info, f.Expression()); err != nil {
+		if err := q.normalizeFilter(infos, info, f.Expression()); err != nil {
 			return err
 		}
 
 	case FilterExpression:
-		if err := q.normalizeFilter(info, f.Field()); err != nil {
+		if filter, ok := f.(*Filter); ok {
+			q.normalizeRelationCount(info, filter)
+		}
+		if err := q.normalizeFilter(infos, info, f.Field()); err != nil {
+			return err
+		}
+		if err := q.normalizeFilter(infos, info, f.Clause()); err != nil {
 			return err
 		}
-		if err := q.normalizeFilter(info, f.Clause()); err != nil {
+		if err := q.normalizeFilterValue(infos, info, f); err != nil {
 			return err
 		}
 
 	case *ColFieldIdentifierExpr:
+		if q.fieldAliases[f.Field()] && (f.Collection() == "" || f.Collection() == q.collection || f.Collection() == info.Collection()) {
+			// Field references an alias of a field expression.
+			// Aliases are not qualified by a collection.
+			f.SetCollection("")
+			return nil
+		}
+
 		if f.Collection() != "" {
-			i := q.backend.ModelInfos().Find(f.Collection())
+			i := infos.Find(f.Collection())
 			if i == nil {
 				return apperror.New("unknown_collection",
 					fmt.Sprintf("The collection %v was not registered with the backend.", f.Collection()),
@@ -976,3 +2550,157 @@ func (q *Query) normalizeFilter(info *ModelInfo, filter Expression) apperror.Err
 
 	return nil
 }
+
+// preloadAlwaysLoad preloads the always-load relations of the collection
+// that are not joined already or excluded with WithoutRelation().
+func (q *Query) preloadAlwaysLoad(info *ModelInfo) apperror.Error {
+	excluded := make(map[string]bool)
+	for _, name := range q.withoutRelations {
+		relation := info.FindRelation(name)
+		if relation == nil {
+			return &apperror.Err{
+				Public:  true,
+				Code:    "unknown_relation",
+				Message: fmt.Sprintf("Collection '%v' does not have a relation '%v'", info.Collection(), name),
+			}
+		}
+		excluded[relation.Name()] = true
+	}
+
+	for name, relation := range info.Relations() {
+		if relation.AlwaysLoad() && !excluded[name] && q.joins[name] == nil {
+			q.Preload(name)
+		}
+	}
+	return nil
+}
+
+// normalizeFilterValue converts the value of a filter on an attribute with a
+// basic type to the type of the attribute, so all backends compare the same
+// values. Returns an invalid_filter_value error if the value can not be
+// converted, for example when filtering a numeric field with a string.
+func (q *Query) normalizeFilterValue(infos ModelInfos, info *ModelInfo, filter FilterExpression) apperror.Error {
+	field, ok := filter.Field().(*ColFieldIdentifierExpr)
+	if !ok || q.fieldAliases[field.Field()] {
+		return nil
+	}
+	val, ok := filter.Clause().(*ValueExpr)
+	if !ok || val.Value() == nil {
+		return nil
+	}
+
+	if field.Collection() != "" {
+		if i := infos.Find(field.Collection()); i != nil {
+			info = i
+		}
+	}
+	attr := info.FindAttribute(field.Field())
+	if attr == nil || attr.BackendMarshal() {
+		return nil
+	}
+
+	typ := attr.Type()
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if attr.BackendArray() && IsArrayOperator(filter.Operator()) {
+		// Array filters compare the values with the items.
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+	default:
+		// Only basic types are checked.
+		return nil
+	}
+
+	example := reflect.Zero(typ).Interface()
+	convert := func(value interface{}) (interface{}, apperror.Error) {
+		converted, err := reflector.R(value).ConvertTo(example)
+		if err != nil {
+			return nil, &apperror.Err{
+				Public:  true,
+				Code:    "invalid_filter_value",
+				Message: fmt.Sprintf("Invalid filter value %v for field %v.%v of type %v", value, info.Collection(), attr.Name(), typ),
+			}
+		}
+		return converted, nil
+	}
+
+	switch filter.Operator() {
+	case OPERATOR_EQ, OPERATOR_NEQ, OPERATOR_GT, OPERATOR_GTE, OPERATOR_LT, OPERATOR_LTE:
+		converted, err := convert(val.Value())
+		if err != nil {
+			return err
+		}
+		val.SetValue(converted)
+
+	case OPERATOR_IN, OPERATOR_CONTAINS, OPERATOR_OVERLAPS:
+		items := reflect.ValueOf(val.Value())
+		if items.Kind() != reflect.Slice {
+			converted, err := convert(val.Value())
+			if err != nil {
+				return err
+			}
+			val.SetValue(converted)
+			return nil
+		}
+
+		values := reflect.MakeSlice(reflect.SliceOf(typ), 0, items.Len())
+		for i := 0; i < items.Len(); i++ {
+			converted, err := convert(items.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+			values = reflect.Append(values, reflect.ValueOf(converted).Convert(typ))
+		}
+		val.SetValue(values.Interface())
+	}
+
+	return nil
+}
+
+// normalizeRelationCount replaces the COUNT(Relation) field of a filter
+// added with HavingCount() with a subquery that counts the related models.
+func (q *Query) normalizeRelationCount(info *ModelInfo, filter *Filter) {
+	if count := q.relationCountStmt(info, filter.Field()); count != nil {
+		filter.SetField(count)
+	}
+}
+
+// relationCountStmt builds a subquery that counts the related models of a
+// COUNT(Relation) function expression.
+// Returns nil if expr is not a relation count.
+func (q *Query) relationCountStmt(info *ModelInfo, expr Expression) *SelectStmt {
+	fn, ok := expr.(*FunctionExpr)
+	if !ok || strings.ToUpper(fn.Function()) != "COUNT" {
+		return nil
+	}
+	id, ok := fn.Expression().(*IdentifierExpr)
+	if !ok {
+		return nil
+	}
+	relation := info.FindRelation(id.Identifier())
+	if relation == nil || relation.IsPolymorphicOwner() {
+		return nil
+	}
+
+	var collection, field string
+	if relation.RelationType() == RELATION_TYPE_M2M {
+		collection = relation.BackendName()
+		field = relation.PivotLocalField()
+	} else {
+		related := relation.RelatedModel()
+		collection = related.BackendName()
+		field = related.Attribute(relation.ForeignField()).BackendName()
+	}
+	localField := info.Attribute(relation.LocalField()).BackendName()
+
+	count := NewSelectStmt(collection)
+	count.AddField(NewFuncExpr("COUNT", NewTextExpr("*")))
+	count.SetFilter(NewFilter(NewColFieldIdExpr(collection, field), OPERATOR_EQ, NewColFieldIdExpr(info.BackendName(), localField)))
+	return count
+}
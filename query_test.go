@@ -1,14 +1,235 @@
 package dukedb_test
 
 import (
-	//db "github.com/theduke/go-dukedb"
-
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	. "github.com/theduke/go-dukedb"
+	"github.com/theduke/go-dukedb/expressions"
 )
 
 var _ = Describe("db.Query", func() {
-	It("Should", func() {
-		Expect(1).To(Equal(1))
+	It("Should normalize without a backend", func() {
+		type Item struct {
+			Id        uint64
+			ItemName  string
+			CreatedAt int64
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+
+		q := NewQuery("items", nil).Filter("ItemName", "x").Sort("CreatedAt", false)
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+
+		sorts := q.GetStatement().Sorts()
+		Expect(sorts).To(HaveLen(1))
+		Expect(sorts[0].Expression()).To(Equal(expressions.NewColFieldIdExpr("items", "created_at")))
+
+		filter := q.GetStatement().Filter().(*expressions.Filter)
+		Expect(filter.Field()).To(Equal(expressions.NewColFieldIdExpr("items", "item_name")))
+	})
+
+	It("Should clone queries without affecting the original", func() {
+		type Item struct {
+			Id        uint64
+			ItemName  string
+			CreatedAt int64
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+
+		q := NewQuery("items", nil).Filter("ItemName", "x").Sort("CreatedAt", false).Limit(5)
+
+		clone := q.Clone().Limit(10).Offset(20).Filter("Id", 1)
+		Expect(clone.NormalizeWith(infos)).ToNot(HaveOccurred())
+
+		Expect(q.GetLimit()).To(Equal(5))
+		Expect(q.GetOffset()).To(Equal(0))
+		Expect(q.GetStatement().Filter()).To(Equal(expressions.NewFieldValFilter("items", "ItemName", "=", "x")))
+		Expect(q.GetStatement().Sorts()[0].Expression()).To(Equal(expressions.NewIdExpr("CreatedAt")))
+
+		q.Join("Parent")
+		clone = q.Clone()
+		clone.GetJoin("Parent").Filter("Id", 2)
+		Expect(clone.GetJoin("Parent").GetBaseQuery()).To(BeIdenticalTo(clone))
+		Expect(q.GetJoin("Parent").GetStatement().Filter()).To(BeNil())
+		Expect(q.GetJoin("Parent").GetBaseQuery()).To(BeIdenticalTo(q))
+	})
+
+	It("Should apply default fields unless fields are specified or hidden ones requested", func() {
+		type Item struct {
+			Id       uint64
+			ItemName string
+			Body     string
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+		infos.Get("items").SetDefaultFields("Id", "ItemName")
+
+		q := NewQuery("items", nil)
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		fields := q.GetStatement().Fields()
+		Expect(fields).To(HaveLen(2))
+		Expect(fields[1].(*expressions.FieldSelectorExpr).Name()).To(Equal("ItemName"))
+
+		q = NewQuery("items", nil).Field("Body")
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		Expect(q.GetStatement().Fields()).To(HaveLen(1))
+
+		q = NewQuery("items", nil).WithHidden()
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		Expect(q.GetStatement().Fields()).To(HaveLen(0))
+	})
+
+	It("Should compute the same shape for queries that only differ in values", func() {
+		type Item struct {
+			Id       uint64
+			ItemName string
+			Count    int
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+
+		shape := NewQuery("items", nil).Filter("ItemName", "a").FilterCond("Id", "in", []int{1, 2}).Limit(5).ShapeWith(infos)
+		Expect(shape).ToNot(BeEmpty())
+
+		same := NewQuery("items", nil).Filter("ItemName", "b").FilterCond("Id", "in", []int{3}).Limit(10).ShapeWith(infos)
+		Expect(same).To(Equal(shape))
+
+		Expect(NewQuery("items", nil).Filter("Count", 3).Limit(5).ShapeWith(infos)).ToNot(Equal(shape))
+		Expect(NewQuery("items", nil).Filter("ItemName", "a").ShapeWith(infos)).ToNot(Equal(
+			NewQuery("items", nil).Filter("ItemName", "a").Sort("Count", true).ShapeWith(infos)))
+		Expect(NewQuery("unknown", nil).ShapeWith(infos)).To(BeEmpty())
+	})
+
+	It("Should preload always-load relations unless excluded", func() {
+		type Profile struct{ Id uint64 }
+		type User struct {
+			Id        uint64
+			Profile   *Profile `db:"always-load"`
+			ProfileId uint64
+		}
+
+		infos, err := buildInfo(&User{}, &Profile{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(infos.Get("users").Relation("Profile").AlwaysLoad()).To(BeTrue())
+
+		q := NewQuery("users", nil)
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		Expect(q.GetJoin("Profile")).ToNot(BeNil())
+		Expect(q.GetJoin("Profile").GetPreload()).To(BeTrue())
+
+		q = NewQuery("users", nil).WithoutRelation("Profile")
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		Expect(q.GetJoin("Profile")).To(BeNil())
+
+		err = NewQuery("users", nil).WithoutRelation("Unknown").NormalizeWith(infos)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unknown_relation"))
+	})
+
+	It("Should error on unknown collections when normalizing without a backend", func() {
+		infos, err := buildInfo()
+		Expect(err).ToNot(HaveOccurred())
+
+		err = NewQuery("items", nil).NormalizeWith(infos)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("unknown_collection"))
+	})
+
+	It("Should validate the read consistency level", func() {
+		type Item struct {
+			Id uint64
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+
+		q := NewQuery("items", nil).Consistency(CONSISTENCY_STRONG)
+		Expect(q.GetConsistency()).To(Equal(CONSISTENCY_STRONG))
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+
+		err = NewQuery("items", nil).Consistency("sometimes").NormalizeWith(infos)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("invalid_consistency_level"))
+	})
+
+	It("Should convert filter values to the attribute type", func() {
+		type Item struct {
+			Id     uint64
+			IntVal int64
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+
+		q := NewQuery("items", nil).Filter("IntVal", "22")
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		filter := q.GetStatement().Filter().(*expressions.Filter)
+		Expect(filter.Clause().(*expressions.ValueExpr).Value()).To(Equal(int64(22)))
+
+		q = NewQuery("items", nil).FilterCond("Id", "in", []interface{}{"1", 2})
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		filter = q.GetStatement().Filter().(*expressions.Filter)
+		Expect(filter.Clause().(*expressions.ValueExpr).Value()).To(Equal([]uint64{1, 2}))
+
+		err = NewQuery("items", nil).Filter("IntVal", "not-a-number").NormalizeWith(infos)
+		Expect(err).To(HaveOccurred())
+		Expect(err.GetCode()).To(Equal("invalid_filter_value"))
+	})
+
+	It("Should resolve sorts and having filters on select field aliases", func() {
+		type Item struct {
+			Id       uint64
+			ItemName string
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+
+		count := expressions.NewFuncExpr("COUNT", expressions.NewTextExpr("*"))
+		q := NewQuery("items", nil).
+			Field("ItemName").
+			FieldExpr(expressions.NewFieldSelectorExpr("item_count", count, nil)).
+			Group("ItemName").
+			Having("item_count", ">", 1).
+			Sort("item_count", false)
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+		Expect(q.IsFieldAlias("item_count")).To(BeTrue())
+		Expect(q.IsFieldAlias("item_name")).To(BeFalse())
+
+		sorts := q.GetStatement().Sorts()
+		Expect(sorts).To(HaveLen(1))
+		Expect(sorts[0].Expression()).To(Equal(expressions.NewIdExpr("item_count")))
+		Expect(sorts[0].Ascending()).To(BeFalse())
+
+		having := q.GetStatement().Having().(*expressions.Filter)
+		Expect(having.Field()).To(Equal(count))
+
+		err = NewQuery("items", nil).Sort("item_count", false).NormalizeWith(infos)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should keep index hints when normalizing", func() {
+		type Item struct {
+			Id       uint64
+			ItemName string
+		}
+
+		infos, err := buildInfo(&Item{})
+		Expect(err).ToNot(HaveOccurred())
+
+		q := NewQuery("items", nil).IndexHint("items_item_name", expressions.INDEX_HINT_USE).Filter("ItemName", "x")
+		Expect(q.NormalizeWith(infos)).ToNot(HaveOccurred())
+
+		s := q.GetStatement()
+		Expect(s.IndexHint()).To(Equal("items_item_name"))
+		Expect(s.IndexHintMode()).To(Equal(expressions.INDEX_HINT_USE))
+		filter := s.Filter().(*expressions.Filter)
+		Expect(filter.Field()).To(Equal(expressions.NewColFieldIdExpr("items", "item_name")))
 	})
 })
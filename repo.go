@@ -0,0 +1,160 @@
+//go:build go1.18
+// +build go1.18
+
+package dukedb
+
+import (
+	"fmt"
+
+	"github.com/theduke/go-apperror"
+)
+
+// Repo is a typed wrapper around a backend for the collection of the
+// model type T.
+// It delegates to the backend methods and does the type assertions of the
+// returned models, so callers work with *T instead of interface{}.
+type Repo[T any] struct {
+	backend    Backend
+	collection string
+}
+
+// NewRepo returns a Repo for the collection that the model type T was
+// registered with.
+func NewRepo[T any](backend Backend) (*Repo[T], apperror.Error) {
+	info, err := backend.InfoForModel(new(T))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Repo[T]{
+		backend:    backend,
+		collection: info.Collection(),
+	}, nil
+}
+
+// MustNewRepo is like NewRepo, but panics on error.
+func MustNewRepo[T any](backend Backend) *Repo[T] {
+	r, err := NewRepo[T](backend)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r *Repo[T]) Backend() Backend {
+	return r.backend
+}
+
+func (r *Repo[T]) Collection() string {
+	return r.collection
+}
+
+// Q returns a new query for the collection.
+func (r *Repo[T]) Q() *Query {
+	return r.backend.Q(r.collection)
+}
+
+/**
+ * Queries.
+ */
+
+// Find returns all models of the collection.
+func (r *Repo[T]) Find() ([]*T, apperror.Error) {
+	return r.Query(r.Q())
+}
+
+// Query executes the query and returns the resulting models.
+func (r *Repo[T]) Query(q *Query) ([]*T, apperror.Error) {
+	items, err := r.backend.Query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]*T, 0, len(items))
+	for _, item := range items {
+		m, err := r.model(item)
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// First returns the first model matching the query, or nil if none was found.
+func (r *Repo[T]) First(q *Query) (*T, apperror.Error) {
+	item, err := r.backend.QueryOne(q)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return r.model(item)
+}
+
+// FindOne returns the model with the given id, or nil if none was found.
+func (r *Repo[T]) FindOne(id interface{}) (*T, apperror.Error) {
+	item, err := r.backend.FindOne(r.collection, id)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return r.model(item)
+}
+
+// FindBy returns all models with the given value for field.
+func (r *Repo[T]) FindBy(field string, value interface{}) ([]*T, apperror.Error) {
+	return r.Query(r.Q().Filter(field, value))
+}
+
+// FindOneBy returns the first model with the given value for field, or nil
+// if none was found.
+func (r *Repo[T]) FindOneBy(field string, value interface{}) (*T, apperror.Error) {
+	return r.First(r.Q().Filter(field, value))
+}
+
+// Count returns the number of models in the collection.
+func (r *Repo[T]) Count() (int, apperror.Error) {
+	return r.backend.Count(r.Q())
+}
+
+/**
+ * C(r)UD.
+ */
+
+func (r *Repo[T]) Create(models ...*T) apperror.Error {
+	return r.backend.Create(r.interfaces(models)...)
+}
+
+func (r *Repo[T]) CreateMany(models ...*T) apperror.Error {
+	return r.backend.CreateMany(r.interfaces(models)...)
+}
+
+func (r *Repo[T]) Update(model *T) apperror.Error {
+	return r.backend.Update(model)
+}
+
+func (r *Repo[T]) Save(model *T) apperror.Error {
+	return r.backend.Save(model)
+}
+
+func (r *Repo[T]) Delete(model *T) apperror.Error {
+	return r.backend.Delete(model)
+}
+
+// model asserts that a model returned by the backend is a *T.
+func (r *Repo[T]) model(item interface{}) (*T, apperror.Error) {
+	m, ok := item.(*T)
+	if !ok {
+		return nil, &apperror.Err{
+			Code:    "invalid_model_type",
+			Message: fmt.Sprintf("Expected a %T from collection %v, got %T", new(T), r.collection, item),
+		}
+	}
+	return m, nil
+}
+
+func (r *Repo[T]) interfaces(models []*T) []interface{} {
+	items := make([]interface{}, len(models))
+	for i, m := range models {
+		items[i] = m
+	}
+	return items
+}
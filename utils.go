@@ -1,12 +1,14 @@
 package dukedb
 
 import (
+	"crypto/rand"
 	//"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
 
 	"github.com/theduke/go-apperror"
+	"github.com/theduke/go-reflector"
 	"github.com/theduke/go-utils"
 )
 
@@ -16,7 +18,7 @@ import (
 
 func Pluralize(str string) string {
 	if str[len(str)-1] == 'y' {
-		str = str[1:len(str)-1] + "ie"
+		str = str[:len(str)-1] + "ie"
 	}
 
 	if str[len(str)-1] != 's' {
@@ -374,6 +376,126 @@ func BuildModelSliceFromMap(info ModelInfo, items []map[string]interface{}) (int
 }
 */
 
+/**
+ * Array columns.
+ */
+
+// FormatArrayLiteral formats the items of a slice as an SQL array literal
+// like {"a","b"}, which databases like postgres accept for array columns.
+// Pointer items are dereferenced, and nil items are written as NULL.
+// A nil slice is a NULL value rather than an empty array, so callers must
+// send it as nil instead of formatting it.
+func FormatArrayLiteral(slice interface{}) string {
+	v := reflect.ValueOf(slice)
+	items := make([]string, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		val := v.Index(i)
+		isRef := val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface
+		for isRef && !val.IsNil() {
+			val = val.Elem()
+			isRef = val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface
+		}
+		if isRef {
+			items[i] = "NULL"
+			continue
+		}
+
+		item := fmt.Sprint(val.Interface())
+		item = strings.Replace(item, `\`, `\\`, -1)
+		item = strings.Replace(item, `"`, `\"`, -1)
+		items[i] = `"` + item + `"`
+	}
+	return "{" + strings.Join(items, ",") + "}"
+}
+
+// ParseArrayLiteral parses an SQL array literal like {a,"b c",NULL}.
+// NULL items are returned as nil.
+func ParseArrayLiteral(literal string) ([]*string, apperror.Error) {
+	literal = strings.TrimSpace(literal)
+	if len(literal) < 2 || literal[0] != '{' || literal[len(literal)-1] != '}' {
+		return nil, apperror.New("invalid_array_literal", fmt.Sprintf("Invalid array literal %v", literal))
+	}
+	literal = literal[1 : len(literal)-1]
+
+	items := make([]*string, 0)
+	if literal == "" {
+		return items, nil
+	}
+
+	var item []rune
+	quoted, escaped, wasQuoted := false, false, false
+	addItem := func() {
+		str := string(item)
+		if !wasQuoted && strings.TrimSpace(str) == "NULL" {
+			items = append(items, nil)
+		} else {
+			if !wasQuoted {
+				str = strings.TrimSpace(str)
+			}
+			items = append(items, &str)
+		}
+		item = nil
+		wasQuoted = false
+	}
+
+	for _, c := range literal {
+		switch {
+		case escaped:
+			item = append(item, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			wasQuoted = true
+		case c == ',' && !quoted:
+			addItem()
+		default:
+			item = append(item, c)
+		}
+	}
+	if quoted || escaped {
+		return nil, apperror.New("invalid_array_literal", "Unterminated array literal")
+	}
+	addItem()
+
+	return items, nil
+}
+
+// arrayFromLiteral converts the text representation of an array column to
+// a slice of type typ.
+// Returns nil if val is not a string or []byte.
+func arrayFromLiteral(val interface{}, typ reflect.Type) (interface{}, apperror.Error) {
+	var literal string
+	if bytes, ok := val.([]byte); ok {
+		literal = string(bytes)
+	} else if str, ok := val.(string); ok {
+		literal = str
+	} else {
+		return nil, nil
+	}
+
+	items, err := ParseArrayLiteral(literal)
+	if err != nil {
+		return nil, err
+	}
+
+	slice := reflect.MakeSlice(typ, 0, len(items))
+	for _, item := range items {
+		itemVal := reflect.New(typ.Elem()).Elem()
+		if item != nil {
+			converted, err := reflector.Reflect(*item).ConvertToType(typ.Elem())
+			if err != nil {
+				return nil, apperror.Wrap(err, "unconvertable_array_item",
+					fmt.Sprintf("Array item %v could not be converted to %v", *item, typ.Elem()))
+			}
+			itemVal.Set(reflect.ValueOf(converted))
+		}
+		slice = reflect.Append(slice, itemVal)
+	}
+	return slice.Interface(), nil
+}
+
 /**
  * Model hooks.
  */
@@ -395,6 +517,23 @@ func CallModelHook(b Backend, m interface{}, hook string) apperror.Error {
 			}
 		}
 		return nil
+	case "BeforeSave":
+		if h, ok := m.(ModelBeforeSaveHook); ok {
+			err := h.BeforeSave(b)
+			if err == nil {
+				return nil
+			} else if apperr, ok := err.(apperror.Error); ok {
+				return apperr
+			} else {
+				return apperror.Wrap(err, "before_save_error")
+			}
+		}
+		return nil
+	case "AfterSave":
+		if h, ok := m.(ModelAfterSaveHook); ok {
+			h.AfterSave(b)
+		}
+		return nil
 	case "BeforeCreate":
 		if h, ok := m.(ModelBeforeCreateHook); ok {
 			err := h.BeforeCreate(b)
@@ -458,3 +597,27 @@ func CallModelHook(b Backend, m interface{}, hook string) apperror.Error {
 		}
 	}
 }
+
+/**
+ * Id generation.
+ */
+
+// UUIDGenerator is the default IDGenerator, which generates random
+// version 4 UUIDs.
+type UUIDGenerator struct{}
+
+// Ensure UUIDGenerator implements IDGenerator.
+var _ IDGenerator = UUIDGenerator{}
+
+func (UUIDGenerator) GenerateID() (string, apperror.Error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", apperror.Wrap(err, "uuid_generation_error")
+	}
+
+	// Set the version (4) and the variant (RFC 4122).
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
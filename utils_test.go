@@ -3,7 +3,7 @@ package dukedb_test
 import (
 	//"reflect"
 
-	//db "github.com/theduke/go-dukedb"
+	db "github.com/theduke/go-dukedb"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -16,6 +16,13 @@ var _ = Describe("Utils", func() {
 		Expect(1).To(Equal(1))
 	})
 
+	It("Should pluralize words with db.Pluralize()", func() {
+		Expect(db.Pluralize("task")).To(Equal("tasks"))
+		Expect(db.Pluralize("news")).To(Equal("news"))
+		Expect(db.Pluralize("category")).To(Equal("categories"))
+		Expect(db.Pluralize("y")).To(Equal("ies"))
+	})
+
 	/*
 		Describe("db.GetModelSliceFieldValues", func() {
 			var modelSlice []interface{}